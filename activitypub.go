@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal ActivityPub actor for the show. Fediverse users can follow it and
+// get a post for every new episode. Only what is needed for that is
+// implemented: WebFinger discovery, the actor document, an inbox accepting
+// (and undoing) follows, an outbox and HTTP signatures.
+//
+// See https://www.w3.org/TR/activitypub/ and
+// https://docs.joinmastodon.org/spec/activitypub/
+
+const (
+	WebfingerPath   = "/.well-known/webfinger"
+	ApActorPath     = "/ap/actor"
+	ApInboxPath     = "/ap/inbox"
+	ApOutboxPath    = "/ap/outbox"
+	ApFollowersPath = "/ap/followers"
+
+	apContentType  = "application/activity+json"
+	apPublic       = "https://www.w3.org/ns/activitystreams#Public"
+	apMaxBodyBytes = 1 << 20
+	// Number of episodes listed in the outbox.
+	apOutboxSize = 20
+)
+
+var apContext = []any{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+}
+
+type apFollower struct {
+	Inbox string    `json:"inbox"`
+	Since time.Time `json:"since"`
+}
+
+// apState is persisted in the state directory.
+type apState struct {
+	// Actor ID -> follower.
+	Followers map[string]apFollower `json:"followers"`
+	// Items announced so far, by their apItemKey.
+	Announced map[string]time.Time `json:"announced"`
+}
+
+type ActivityPub struct {
+	baseUrl string // The external URL, ending in a slash.
+	user    string
+	host    string
+	key     *rsa.PrivateKey
+	dir     string
+	client  *http.Client
+
+	mu    sync.Mutex // Guards state
+	state apState
+}
+
+// NewActivityPub sets up the actor @user@host, keeping its key and state in
+// dir. The episodes in items are considered already announced when the actor
+// is first created, so existing followers are not flooded.
+func NewActivityPub(dir, user, externalUrl string, items []Item) (*ActivityPub, error) {
+	u, err := url.Parse(externalUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	ap := &ActivityPub{
+		baseUrl: externalUrl,
+		user:    user,
+		host:    u.Host,
+		dir:     dir,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		state: apState{
+			Followers: make(map[string]apFollower),
+			Announced: make(map[string]time.Time),
+		},
+	}
+	if ap.key, err = loadOrCreateKey(filepath.Join(dir, "key.pem")); err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(ap.statePath())
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		now := time.Now().UTC()
+		for _, it := range items {
+			ap.state.Announced[apItemKey(it)] = now
+		}
+		if err := ap.save(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(buf, &ap.state); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", ap.statePath(), err)
+		}
+	}
+	return ap, nil
+}
+
+func (ap *ActivityPub) statePath() string {
+	return filepath.Join(ap.dir, "state.json")
+}
+
+// save persists the state. Must be called with mu held.
+func (ap *ActivityPub) save() error {
+	buf, err := json.MarshalIndent(ap.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ap.statePath(), buf, 0o600)
+}
+
+func loadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		der := x509.MarshalPKCS1PrivateKey(key)
+		out := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})
+		return key, writeFileAtomic(path, out, 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func apItemKey(it Item) string {
+	if it.legacyGuid != "" {
+		return it.legacyGuid
+	}
+	if it.Guid != "" {
+		return it.Guid
+	}
+	return it.Path
+}
+
+func (ap *ActivityPub) url(p string) string {
+	return ap.baseUrl + p[1:]
+}
+
+func (ap *ActivityPub) actorId() string {
+	return ap.url(ApActorPath)
+}
+
+func (ap *ActivityPub) keyId() string {
+	return ap.actorId() + "#main-key"
+}
+
+func (ap *ActivityPub) objectId(it Item) string {
+	sum := sha256.Sum256([]byte(apItemKey(it)))
+	return ap.baseUrl + "ap/episodes/" + hex.EncodeToString(sum[:8])
+}
+
+func writeActivityJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", apContentType+"; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("could not encode activity", "error", err, "tag", TagActivityPub)
+	}
+}
+
+// ServeWebfinger resolves acct:user@host to the actor.
+func (ap *ActivityPub) ServeWebfinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource != "acct:"+ap.user+"@"+ap.host && resource != ap.actorId() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"subject": "acct:" + ap.user + "@" + ap.host,
+		"aliases": []string{ap.actorId()},
+		"links": []map[string]string{
+			{"rel": "self", "type": apContentType, "href": ap.actorId()},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": ap.url(FeedHtmlPath)},
+		},
+	})
+}
+
+// ServeActor serves the actor document of the show.
+func (ap *ActivityPub) ServeActor(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		m := s.Channel
+		s.mu.RUnlock()
+		der, err := x509.MarshalPKIXPublicKey(&ap.key.PublicKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		writeActivityJSON(w, map[string]any{
+			"@context":          apContext,
+			"id":                ap.actorId(),
+			"type":              "Service",
+			"preferredUsername": ap.user,
+			"name":              m.Title,
+			"summary":           html.EscapeString(m.Desc),
+			"url":               ap.url(FeedHtmlPath),
+			"inbox":             ap.url(ApInboxPath),
+			"outbox":            ap.url(ApOutboxPath),
+			"followers":         ap.url(ApFollowersPath),
+			"icon":              map[string]string{"type": "Image", "url": m.CoverUrl},
+			"publicKey": map[string]string{
+				"id":           ap.keyId(),
+				"owner":        ap.actorId(),
+				"publicKeyPem": string(pub),
+			},
+		})
+	}
+}
+
+// ServeFollowers serves the follower collection, without listing followers.
+func (ap *ActivityPub) ServeFollowers(w http.ResponseWriter, r *http.Request) {
+	ap.mu.Lock()
+	n := len(ap.state.Followers)
+	ap.mu.Unlock()
+	writeActivityJSON(w, map[string]any{
+		"@context":   apContext,
+		"id":         ap.url(ApFollowersPath),
+		"type":       "OrderedCollection",
+		"totalItems": n,
+	})
+}
+
+// ServeOutbox lists announcements of the latest episodes.
+func (s *Server) ServeOutbox(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	items := s.Items
+	s.mu.RUnlock()
+	items = items[:min(len(items), apOutboxSize)]
+	activities := make([]any, 0, len(items))
+	for _, it := range items {
+		activities = append(activities, s.ActivityPub.create(it))
+	}
+	writeActivityJSON(w, map[string]any{
+		"@context":     apContext,
+		"id":           s.ActivityPub.url(ApOutboxPath),
+		"type":         "OrderedCollection",
+		"totalItems":   len(activities),
+		"orderedItems": activities,
+	})
+}
+
+// create builds the activity announcing an episode.
+func (ap *ActivityPub) create(it Item) map[string]any {
+	id := ap.objectId(it)
+	content := fmt.Sprintf(
+		`<p>New episode: <a href="%s">%s</a></p>`,
+		html.EscapeString(it.Link), html.EscapeString(it.Title),
+	)
+	if it.Desc != "" {
+		content += "<p>" + html.EscapeString(it.Desc) + "</p>"
+	}
+	published := it.ModTime.UTC().Format(time.RFC3339)
+	return map[string]any{
+		"@context":  apContext,
+		"id":        id + "/create",
+		"type":      "Create",
+		"actor":     ap.actorId(),
+		"published": published,
+		"to":        []string{apPublic},
+		"cc":        []string{ap.url(ApFollowersPath)},
+		"object": map[string]any{
+			"id":           id,
+			"type":         "Note",
+			"attributedTo": ap.actorId(),
+			"published":    published,
+			"to":           []string{apPublic},
+			"cc":           []string{ap.url(ApFollowersPath)},
+			"url":          it.Link,
+			"content":      content,
+			"attachment": []map[string]any{{
+				"type":      "Audio",
+				"mediaType": it.Enclosure.Type,
+				"url":       it.Enclosure.Url,
+				"name":      it.Title,
+			}},
+		},
+	}
+}
+
+// Announce posts episodes of items that have not been announced before to
+// all followers.
+func (ap *ActivityPub) Announce(items []Item) {
+	ap.mu.Lock()
+	var fresh []Item
+	now := time.Now().UTC()
+	for _, it := range items {
+		k := apItemKey(it)
+		if _, ok := ap.state.Announced[k]; ok || it.Draft {
+			continue
+		}
+		ap.state.Announced[k] = now
+		fresh = append(fresh, it)
+	}
+	inboxes := ap.inboxes()
+	if len(fresh) > 0 {
+		if err := ap.save(); err != nil {
+			slog.Error("could not save activitypub state", "error", err, "tag", TagActivityPub)
+		}
+	}
+	ap.mu.Unlock()
+
+	for _, it := range fresh {
+		slog.Info("announcing episode", "title", it.Title, "followers", len(inboxes), "tag", TagActivityPub)
+		activity := ap.create(it)
+		for _, inbox := range inboxes {
+			if err := ap.deliver(context.Background(), inbox, activity); err != nil {
+				slog.Warn("could not deliver activity", "error", err, "inbox", inbox, "tag", TagActivityPub)
+			}
+		}
+	}
+}
+
+// inboxes returns the distinct inboxes of all followers. Must be called with
+// mu held.
+func (ap *ActivityPub) inboxes() []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, f := range ap.state.Followers {
+		if !seen[f.Inbox] {
+			seen[f.Inbox] = true
+			out = append(out, f.Inbox)
+		}
+	}
+	return out
+}
+
+// ServeInbox handles Follow and Undo Follow activities. Requests must be
+// signed by the actor they claim to come from.
+func (ap *ActivityPub) ServeInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, apMaxBodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var activity struct {
+		Id     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &activity); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	actor, err := ap.verify(r, body, activity.Actor)
+	if err != nil {
+		slog.Warn("rejected unsigned or forged activity", "error", err, "actor", activity.Actor, "tag", TagActivityPub)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		inbox := actor.Inbox
+		if actor.Endpoints.SharedInbox != "" {
+			inbox = actor.Endpoints.SharedInbox
+		}
+		ap.mu.Lock()
+		ap.state.Followers[actor.Id] = apFollower{Inbox: inbox, Since: time.Now().UTC()}
+		err := ap.save()
+		ap.mu.Unlock()
+		if err != nil {
+			slog.Error("could not save activitypub state", "error", err, "tag", TagActivityPub)
+		}
+		slog.Info("new follower", "actor", actor.Id, "tag", TagActivityPub)
+		accept := map[string]any{
+			"@context": apContext,
+			"id":       ap.actorId() + "#accepts/" + url.PathEscape(activity.Id),
+			"type":     "Accept",
+			"actor":    ap.actorId(),
+			"object":   json.RawMessage(body),
+		}
+		go func() {
+			if err := ap.deliver(context.Background(), actor.Inbox, accept); err != nil {
+				slog.Warn("could not deliver accept", "error", err, "inbox", actor.Inbox, "tag", TagActivityPub)
+			}
+		}()
+	case "Undo":
+		var object struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(activity.Object, &object)
+		if object.Type != "Follow" {
+			break
+		}
+		ap.mu.Lock()
+		delete(ap.state.Followers, actor.Id)
+		err := ap.save()
+		ap.mu.Unlock()
+		if err != nil {
+			slog.Error("could not save activitypub state", "error", err, "tag", TagActivityPub)
+		}
+		slog.Info("lost follower", "actor", actor.Id, "tag", TagActivityPub)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type apActor struct {
+	Id        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		Id           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// verify checks that an incoming request is signed by the key of actorId,
+// the actor its activity claims to come from, and returns the actor.
+//
+// The actor is fetched from its own id rather than from the keyId, which is
+// on the same host, so that a signer cannot claim to be someone else with an
+// actor document of its own.
+func (ap *ActivityPub) verify(r *http.Request, body []byte, actorId string) (*apActor, error) {
+	params := parseSignature(r.Header.Get("Signature"))
+	keyId, sig64 := params["keyId"], params["signature"]
+	if keyId == "" || sig64 == "" {
+		return nil, errors.New("missing signature")
+	}
+	if !sameOrigin(keyId, actorId) {
+		return nil, errors.New("key is not on the host of the actor")
+	}
+	headers := strings.Fields(params["headers"])
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	if !containsAll(headers, "(request-target)", "host", "date", "digest") {
+		return nil, errors.New("signature does not cover required headers")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > time.Hour {
+		return nil, errors.New("missing or stale date")
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("digest mismatch")
+	}
+
+	actor, err := ap.fetchActor(r.Context(), actorId)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Id != actorId || actor.PublicKey.Id != keyId ||
+		actor.PublicKey.Owner != "" && actor.PublicKey.Owner != actorId {
+		return nil, errors.New("key does not belong to actor")
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, errors.New("actor has no public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	sig, err := base64.StdEncoding.DecodeString(sig64)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+// sameOrigin reports whether the URLs a and b have the same scheme and host.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+func containsAll(ss []string, want ...string) bool {
+	for _, w := range want {
+		found := false
+		for _, s := range ss {
+			if strings.EqualFold(s, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchActor dereferences an actor, or the actor owning a key, by its ID.
+func (ap *ActivityPub) fetchActor(ctx context.Context, id string) (*apActor, error) {
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid actor id %q", id)
+	}
+	u.Fragment = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", apContentType)
+	// Servers in secure mode only answer signed requests.
+	if err := ap.sign(req, nil); err != nil {
+		return nil, err
+	}
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch actor %s: %s", u, resp.Status)
+	}
+	var actor apActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, apMaxBodyBytes)).Decode(&actor); err != nil {
+		return nil, err
+	}
+	if actor.Inbox == "" {
+		return nil, fmt.Errorf("actor %s has no inbox", u)
+	}
+	return &actor, nil
+}
+
+// deliver posts an activity to an inbox.
+func (ap *ActivityPub) deliver(ctx context.Context, inbox string, activity any) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", apContentType)
+	if err := ap.sign(req, body); err != nil {
+		return err
+	}
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, apMaxBodyBytes))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("deliver to %s: %s", inbox, resp.Status)
+	}
+	return nil
+}
+
+// sign adds an HTTP signature (draft-cavage-http-signatures) to req.
+func (ap *ActivityPub) sign(req *http.Request, body []byte) error {
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		headers = append(headers, "digest")
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ap.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		ap.keyId(), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig),
+	))
+	return nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		h = strings.ToLower(h)
+		var v string
+		switch h {
+		case "(request-target)":
+			v = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			v = r.Host
+			if v == "" {
+				v = r.Header.Get("Host")
+			}
+		default:
+			v = r.Header.Get(h)
+		}
+		lines = append(lines, h+": "+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseSignature parses the parameters of a Signature header.
+func parseSignature(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		params[k] = strings.Trim(v, `"`)
+	}
+	return params
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"podserve/httplog"
+)
+
+const (
+	AdminPath        = "/admin"
+	AdminLoginPath   = "/admin/login"
+	AdminLogoutPath  = "/admin/logout"
+	AdminRefreshPath = "/admin/refresh"
+)
+
+// AdminUI is a minimal browser interface to the admin functionality. Admins
+// log in with an API key and get a session cookie; every form carries the
+// session's CSRF token.
+type AdminUI struct {
+	srv  *Server
+	auth *Authenticator
+	tmpl *template.Template
+}
+
+func NewAdminUI(srv *Server, auth *Authenticator) *AdminUI {
+	return &AdminUI{
+		srv:  srv,
+		auth: auth,
+		tmpl: template.Must(template.ParseFS(templateFS, "*/login.html", "*/admin.html")),
+	}
+}
+
+func (a *AdminUI) url(p string) string {
+	return a.srv.Metadata.externalUrl + p[1:]
+}
+
+type loginData struct {
+	Title         string
+	StylesheetUrl string
+	LoginPath     string
+	Error         string
+}
+
+type adminData struct {
+	Title         string
+	StylesheetUrl string
+	Principal     Principal
+	NumFiles      int
+	Top           []EpisodeDownloads // Most downloaded in the last 30 days.
+	StatsPath     string
+	RefreshPath   string
+	LogoutPath    string
+	CSRFField     string
+	CSRFToken     string
+}
+
+func (a *AdminUI) render(w http.ResponseWriter, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := a.tmpl.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("template error", "error", err, "template", name, "tag", TagHttp)
+	}
+}
+
+func (a *AdminUI) renderLogin(w http.ResponseWriter, status int, msg string) {
+	a.render(w, status, "login.html", loginData{
+		Title:         a.srv.Metadata.Title,
+		StylesheetUrl: a.srv.Metadata.StylesheetUrl,
+		LoginPath:     a.url(AdminLoginPath),
+		Error:         msg,
+	})
+}
+
+// ServeDashboard shows the admin page, or redirects to the login form if
+// there is no session. Admins authenticated by a forward-auth proxy get a
+// session right away.
+func (a *AdminUI) ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sess, ok := a.auth.Sessions.Get(r)
+	if !ok {
+		p, err := a.auth.Authenticate(r)
+		if err != nil || !p.Role.Allows(RoleAdmin) {
+			http.Redirect(w, r, a.url(AdminLoginPath), http.StatusSeeOther)
+			return
+		}
+		if sess, err = a.auth.Sessions.Create(w, p); err != nil {
+			slog.Error("could not create session", "error", err, "tag", TagAuth)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	httplog.SetPrincipal(w, sess.Principal.Name)
+	a.srv.mu.RLock()
+	numFiles := len(a.srv.Files)
+	a.srv.mu.RUnlock()
+	top := a.srv.topEpisodes(time.Now().AddDate(0, 0, -30), 10)
+	a.render(w, http.StatusOK, "admin.html", adminData{
+		Title:         a.srv.Metadata.Title,
+		StylesheetUrl: a.srv.Metadata.StylesheetUrl,
+		Principal:     sess.Principal,
+		NumFiles:      numFiles,
+		Top:           top,
+		StatsPath:     a.url(StatsPath),
+		RefreshPath:   a.url(AdminRefreshPath),
+		LogoutPath:    a.url(AdminLogoutPath),
+		CSRFField:     CSRFFormField,
+		CSRFToken:     sess.CSRFToken,
+	})
+}
+
+// ServeLogin shows the login form and starts a session for a valid admin key.
+func (a *AdminUI) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		a.renderLogin(w, http.StatusOK, "")
+	case http.MethodPost:
+		// Another site could otherwise log the browser in with a key of its
+		// own.
+		if crossOrigin(r, a.srv.Metadata.externalUrl) {
+			slog.Warn("rejected request", "error", ErrCSRF, "path", r.URL.Path, "tag", TagAuth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if a.auth.Keys == nil {
+			a.renderLogin(w, http.StatusUnauthorized, "Logging in with a key requires -keyFile.")
+			return
+		}
+		key, ok := a.auth.Keys.Authenticate(r.PostFormValue("key"))
+		if !ok || !key.Role.Allows(RoleAdmin) {
+			slog.Warn("failed admin login", "remote_addr", r.RemoteAddr, "tag", TagAuth)
+			a.srv.Audit.Append(AuditEntry{
+				Time:       time.Now().UTC(),
+				RemoteAddr: r.RemoteAddr,
+				Action:     "login_failed",
+			})
+			a.renderLogin(w, http.StatusUnauthorized, "Invalid key.")
+			return
+		}
+		p := Principal{Name: key.Name, Role: key.Role}
+		if _, err := a.auth.Sessions.Create(w, p); err != nil {
+			slog.Error("could not create session", "error", err, "tag", TagAuth)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		httplog.SetPrincipal(w, p.Name)
+		slog.Info("admin login", "principal", p.Name, "tag", TagAuth)
+		a.srv.Audit.Append(AuditEntry{
+			Time:       time.Now().UTC(),
+			Principal:  p.Name,
+			Role:       p.Role,
+			RemoteAddr: r.RemoteAddr,
+			Action:     "login",
+		})
+		http.Redirect(w, r, a.url(AdminPath), http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeLogout ends the session. It must be wrapped by requireRole so that the
+// CSRF token is checked.
+func (a *AdminUI) ServeLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.auth.Sessions.Destroy(w, r)
+	a.srv.Audit.Record(r, "logout", "", nil)
+	http.Redirect(w, r, a.url(AdminLoginPath), http.StatusSeeOther)
+}
+
+// ServeRefresh is the form counterpart of the refresh API endpoint. It must be
+// wrapped by requireRole so that the CSRF token is checked.
+func (a *AdminUI) ServeRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log := adminLogger(r, "refresh")
+	changed, err := a.srv.Refresh()
+	if err != nil {
+		log.Error("manual refresh failed", "error", err)
+		a.srv.Audit.Record(r, "refresh", "", map[string]any{"error": err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Info("manual refresh", "changed", changed)
+	a.srv.Audit.Record(r, "refresh", "", map[string]any{"changed": changed})
+	http.Redirect(w, r, a.url(AdminPath), http.StatusSeeOther)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Alert is a problem, or its resolution, that an operator should know
+// about even when nobody reads the logs.
+type Alert struct {
+	Title    string         `json:"title"`
+	Message  string         `json:"message"`
+	Resolved bool           `json:"resolved"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+// An Alerter logs alerts and sends them to a webhook, as JSON, and to an ntfy
+// topic, both optional. A nil Alerter only logs.
+type Alerter struct {
+	Webhook string // URL receiving alerts as JSON POSTs.
+	Ntfy    string // URL of an ntfy topic, e.g. https://ntfy.sh/my-podcast.
+
+	client *http.Client
+}
+
+func NewAlerter(webhook, ntfy string) *Alerter {
+	return &Alerter{
+		Webhook: webhook,
+		Ntfy:    ntfy,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send logs the alert and delivers it, logging delivery failures.
+func (a *Alerter) Send(ctx context.Context, alert Alert) {
+	args := []any{"tag", TagAlert, "title", alert.Title}
+	for k, v := range alert.Details {
+		args = append(args, k, v)
+	}
+	if alert.Resolved {
+		slog.Info(alert.Message, args...)
+	} else {
+		slog.Warn(alert.Message, args...)
+	}
+	if a == nil {
+		return
+	}
+	if a.Webhook != "" {
+		body, err := json.Marshal(alert)
+		if err == nil {
+			err = a.post(ctx, a.Webhook, "application/json", body, nil)
+		}
+		if err != nil {
+			slog.Error("could not send alert to webhook", "error", err, "tag", TagAlert)
+		}
+	}
+	if a.Ntfy != "" {
+		header := http.Header{"Title": {alert.Title}, "Tags": {"warning"}, "Priority": {"high"}}
+		if alert.Resolved {
+			header = http.Header{"Title": {alert.Title}, "Tags": {"white_check_mark"}}
+		}
+		if err := a.post(ctx, a.Ntfy, "text/plain", []byte(alert.Message), header); err != nil {
+			slog.Error("could not send alert to ntfy", "error", err, "tag", TagAlert)
+		}
+	}
+}
+
+func (a *Alerter) post(ctx context.Context, url, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", strings.SplitN(url, "?", 2)[0], resp.Status)
+	}
+	return nil
+}
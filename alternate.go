@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An Alternate is another rendition of an episode, e.g. a low bitrate version
+// for listeners on metered connections, emitted as
+// <podcast:alternateEnclosure>.
+//
+// Renditions are found by file name: ep.low.opus is a rendition of ep.mp3 in
+// the same directory, titled "low". Only the names of renditionNames and
+// bitrates such as 64k or 96kbps are titles, so that e.g. "Lecture 1.5.mp3"
+// stays an episode next to "Lecture 1.mp3". A file following that pattern
+// without a matching episode is an episode of its own.
+//
+// See https://podcastindex.org/namespace/1.0#alternate-enclosure
+type Alternate struct {
+	Title     string
+	Path      string
+	Enclosure Enclosure
+
+	file string // Location on disk if not at Path in the media directory.
+}
+
+// source returns the path of the rendition in the media library, empty if it
+// is not there.
+func (alt Alternate) source() string {
+	if alt.file != "" {
+		return ""
+	}
+	return alt.Path
+}
+
+func (alt Alternate) filePath(root string) string {
+	if alt.file != "" {
+		return alt.file
+	}
+	return filepath.Join(root, filepath.FromSlash(alt.Path))
+}
+
+// renditionNames are the titles of renditions, besides bitrates. More are
+// added with -renditionNames, see AddRenditionNames.
+var renditionNames = map[string]bool{
+	"low": true, "medium": true, "high": true, "lq": true, "hq": true,
+	"mono": true, "stereo": true, "small": true, "large": true,
+	"opus": true, "aac": true, "mp3": true, "ogg": true, "vorbis": true,
+	"flac": true, "m4a": true, "video": true, "audio": true,
+}
+
+// bitrateName matches the titles of renditions that are bitrates.
+var bitrateName = regexp.MustCompile(`^[0-9]+(k|kbps)$`)
+
+// AddRenditionNames adds the titles of renditions.
+func AddRenditionNames(names []string) {
+	for _, name := range names {
+		renditionNames[strings.ToLower(name)] = true
+	}
+}
+
+// alternateOf splits the relative path of a possible rendition into the base
+// path (without extension) of the episode it belongs to and its title.
+func alternateOf(p string) (base, title string, ok bool) {
+	stem := strings.TrimSuffix(p, path.Ext(p))
+	ext := path.Ext(stem)
+	if len(ext) < 2 {
+		return "", "", false
+	}
+	title = ext[1:]
+	if name := strings.ToLower(title); !renditionNames[name] && !bitrateName.MatchString(name) {
+		return "", "", false
+	}
+	return strings.TrimSuffix(stem, ext), title, true
+}
+
+// groupAlternates moves renditions into the Alternates of their episodes.
+func groupAlternates(items []Item) []Item {
+	episodes := make(map[string]int, len(items))
+	for i, it := range items {
+		episodes[strings.TrimSuffix(it.Path, path.Ext(it.Path))] = i
+	}
+	isAlternate := make([]bool, len(items))
+	for i, it := range items {
+		base, title, ok := alternateOf(it.Path)
+		if !ok {
+			continue
+		}
+		j, ok := episodes[base]
+		if !ok || isAlternate[j] {
+			continue
+		}
+		isAlternate[i] = true
+		items[j].Alternates = append(items[j].Alternates, Alternate{
+			Title:     title,
+			Path:      it.Path,
+			Enclosure: it.Enclosure,
+		})
+	}
+	out := items[:0]
+	for i, it := range items {
+		if !isAlternate[i] {
+			out = append(out, it)
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"podserve/httplog"
+)
+
+const (
+	ApiPath        = "/api/"
+	ApiRefreshPath = "/api/refresh"
+	// ApiRefreshPendingPath reports what a refresh would change, without
+	// applying it.
+	ApiRefreshPendingPath = "/api/refresh/pending"
+	// ApiRefreshHistoryPath lists the latest refreshes.
+	ApiRefreshHistoryPath = "/api/refresh/history"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("could not encode json response", "error", err, "tag", TagHttp)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// adminLogger returns a logger for an administrative action, annotated with
+// the API key or user that performed it.
+func adminLogger(r *http.Request, action string) *slog.Logger {
+	p, _ := PrincipalFrom(r.Context())
+	return slog.With("tag", TagAdmin, "action", action, "principal", p.Name, "request_id", httplog.RequestId(r.Context()))
+}
+
+// ServeRefresh rescans the media directory right away instead of waiting for
+// the next periodic refresh.
+func (s *Server) ServeRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	log := adminLogger(r, "refresh")
+	changed, err := s.Refresh()
+	if err != nil {
+		log.Error("manual refresh failed", "error", err)
+		s.Audit.Record(r, "refresh", "", map[string]any{"error": err.Error()})
+		writeJSONError(w, http.StatusInternalServerError, "refresh failed")
+		return
+	}
+	s.mu.RLock()
+	numFiles := len(s.Files)
+	s.mu.RUnlock()
+	log.Info("manual refresh", "changed", changed, "num_files", numFiles)
+	s.Audit.Record(r, "refresh", "", map[string]any{"changed": changed})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"changed":   changed,
+		"num_files": numFiles,
+	})
+}
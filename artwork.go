@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Episodes have artwork if an image file of the same name is next to their
+// media file, e.g. episode.jpg next to episode.mp3, or else if their media
+// file has cover art embedded in its tags. The latter is served from
+// ArtworkPath followed by the path of the media file.
+const ArtworkPath = "/artwork/"
+
+// artworkTypes are the image files used as episode artwork, by extension.
+var artworkTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// ServeArtwork serves the cover art embedded in a media file. It is read from
+// the file once and then kept in the MemCache, as long as the file does not
+// change.
+func (s *Server) ServeArtwork(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	name, ok := lookupPath(s.Files, strings.TrimPrefix(r.URL.Path, ArtworkPath))
+	f := s.Files[name]
+	s.mu.RUnlock()
+	parse, hasParser := mediaParsers[strings.ToLower(filepath.Ext(name))]
+	if !ok || !hasParser || f.Path == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := fmt.Sprintf("%sartwork:%d:%d:%s", s.Metadata.externalUrl, f.ModTime.UnixNano(), f.Size, name)
+	var mi MediaInfo
+	e, err := s.MemCache.Get(key, func() (*memEntry, error) {
+		var err error
+		if mi, err = parse(f.Path); err != nil {
+			return nil, err
+		}
+		if mi.artwork == nil {
+			return nil, fs.ErrNotExist
+		}
+		return newMemEntry(mi.Artwork, mi.artwork, f.ModTime, "")
+	})
+	switch {
+	case errors.Is(err, errTooLarge):
+		// Served as read, too large to cache.
+		w.Header().Set("Content-Type", mi.Artwork)
+		http.ServeContent(w, r, "", f.ModTime, bytes.NewReader(mi.artwork))
+	case err != nil:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		e.serve(w, r)
+	}
+}
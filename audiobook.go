@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// In audiobook mode every directory in the media directory is a book and the
+// media files in it its chapters. The feed is serial, books are listed one
+// after the other and chapters in file name order, numbered from 1 in every
+// book.
+
+// bookOf returns the book of the file at the relative path p, its directory
+// without any drafts directory, and "" for files at the root of the media
+// directory.
+func bookOf(p string) string {
+	var dirs []string
+	for _, d := range strings.Split(path.Dir(p), "/") {
+		if d != "." && d != DraftsDir {
+			dirs = append(dirs, d)
+		}
+	}
+	return strings.Join(dirs, "/")
+}
+
+// sortAudiobooks orders items by book and then by file name, comparing runs
+// of digits by value so that "2.mp3" comes before "10.mp3".
+func sortAudiobooks(items []Item) {
+	slices.SortStableFunc(items, func(a, b Item) int {
+		if c := naturalCompare(a.Book, b.Book); c != 0 {
+			return c
+		}
+		return naturalCompare(path.Base(a.Path), path.Base(b.Path))
+	})
+}
+
+// numberChapters numbers the published chapters of every book of sorted
+// items, replacing any other episode numbers.
+func numberChapters(items []Item) {
+	n := 0
+	for i := range items {
+		if i == 0 || items[i].Book != items[i-1].Book {
+			n = 0
+		}
+		if items[i].Draft {
+			items[i].Episode = 0
+			continue
+		}
+		n++
+		items[i].Episode = n
+	}
+}
+
+// naturalCompare compares strings case insensitively, with runs of digits
+// compared by their value.
+func naturalCompare(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			da, db := digitRun(a), digitRun(b)
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitRun(s string) int {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
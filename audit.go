@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ApiAuditPath = "/api/audit"
+
+// An AuditEntry records an administrative action: who did what, and when.
+type AuditEntry struct {
+	Time       time.Time      `json:"time"`
+	Principal  string         `json:"principal"`
+	Role       Role           `json:"role,omitempty"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	Action     string         `json:"action"`
+	Target     string         `json:"target,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// AuditLog is an append-only log of administrative actions, stored as one
+// JSON object per line. A nil *AuditLog discards all entries.
+type AuditLog struct {
+	path string
+	mu   sync.Mutex // Serializes writes
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	// Fail early if the log cannot be written.
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fp.Close()
+	return &AuditLog{path: path}, nil
+}
+
+// Record appends an entry for an action performed by the principal of r.
+func (a *AuditLog) Record(r *http.Request, action, target string, details map[string]any) {
+	if a == nil {
+		return
+	}
+	p, _ := PrincipalFrom(r.Context())
+	a.Append(AuditEntry{
+		Time:       time.Now().UTC(),
+		Principal:  p.Name,
+		Role:       p.Role,
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Target:     target,
+		Details:    details,
+	})
+}
+
+func (a *AuditLog) Append(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("could not encode audit entry", "error", err, "tag", TagAdmin)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fp, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		slog.Error("could not open audit log", "error", err, "path", a.path, "tag", TagAdmin)
+		return
+	}
+	defer fp.Close()
+	if _, err := fp.Write(append(buf, '\n')); err != nil {
+		slog.Error("could not write audit log", "error", err, "path", a.path, "tag", TagAdmin)
+		return
+	}
+	if err := fp.Sync(); err != nil {
+		slog.Error("could not sync audit log", "error", err, "path", a.path, "tag", TagAdmin)
+	}
+}
+
+// Query returns up to limit of the most recent entries matching the non-empty
+// filters, newest first.
+func (a *AuditLog) Query(action, principal string, since time.Time, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	fp, err := os.Open(a.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	sc := bufio.NewScanner(fp)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// Most likely a line torn by a crash, skip it.
+			continue
+		}
+		if (action != "" && e.Action != action) ||
+			(principal != "" && e.Principal != principal) ||
+			e.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// ServeAudit lists audit log entries. Supported query parameters are action,
+// principal, since (RFC 3339) and limit (default 100).
+func (s *Server) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Audit == nil {
+		writeJSONError(w, http.StatusNotFound, "audit log is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since, expected RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	entries, err := s.Audit.Query(q.Get("action"), q.Get("principal"), since, limit)
+	if err != nil {
+		slog.Error("could not read audit log", "error", err, "tag", TagAdmin)
+		writeJSONError(w, http.StatusInternalServerError, "could not read audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
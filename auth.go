@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"podserve/httplog"
+)
+
+// A Role determines which parts of the server a principal may access.
+type Role string
+
+const (
+	// Listeners may fetch the feed and media.
+	RoleListener Role = "listener"
+	// Admins may additionally use the admin API.
+	RoleAdmin Role = "admin"
+	// Replicas may only sync the media library, see Replica.
+	RoleReplica Role = "replica"
+)
+
+func ParseRole(s string) (Role, bool) {
+	switch r := Role(s); r {
+	case RoleListener, RoleAdmin, RoleReplica:
+		return r, true
+	}
+	return "", false
+}
+
+// Allows reports whether a principal with role r may access something
+// requiring the role required.
+func (r Role) Allows(required Role) bool {
+	return r == RoleAdmin || r == required
+}
+
+type ctxKey int
+
+const ctxKeyPrincipal ctxKey = iota
+
+// A Principal is the authenticated identity behind a request.
+type Principal struct {
+	Name string // Name of the API key or user.
+	Role Role
+	// The listener key, if given as a token rather than a header, see
+	// Authenticate.
+	Token string
+}
+
+const (
+	// TokenParam is the query parameter of listener keys given as tokens, so
+	// that private feeds can be shared as plain URLs.
+	TokenParam = "token"
+	// TokenCookie keeps the token of a browser, for the media of the HTML
+	// pages to be fetched with it.
+	TokenCookie = "podserve_token"
+)
+
+// PrincipalFrom returns the principal of an authenticated request.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(ctxKeyPrincipal).(Principal)
+	return p, ok
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator identifies the principal behind requests.
+type Authenticator struct {
+	Keys     *KeyStore
+	Forward  *ForwardAuth
+	Sessions *SessionStore
+	// Whether the TokenCookie is only sent over https, as it is anyway for
+	// requests made over TLS.
+	Secure bool
+}
+
+// Authenticate identifies the principal of r. Admin UI sessions take
+// precedence, followed by users asserted by a trusted forward-auth proxy.
+// Otherwise API keys are accepted as bearer tokens, or as the password of HTTP
+// basic auth with the key name as user name, since that is what podcast apps
+// support. Listener keys, and only those as URLs end up in logs and
+// histories, are also accepted as the TokenParam query parameter or the
+// TokenCookie.
+//
+// Requests authenticated by a session cookie are sent automatically by the
+// browser, so state-changing ones must also carry the CSRF token of the
+// session. ErrCSRF is returned otherwise.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if a == nil {
+		return Principal{}, ErrUnauthenticated
+	}
+	if a.Sessions != nil {
+		if sess, ok := a.Sessions.Get(r); ok {
+			if err := sess.CheckCSRF(r); err != nil {
+				return Principal{}, err
+			}
+			return sess.Principal, nil
+		}
+	}
+	if a.Forward != nil {
+		if p, ok := a.Forward.Authenticate(r); ok {
+			// The proxy authenticates browsers with a cookie as well, reject
+			// state-changing requests initiated by other sites.
+			if !isSafeMethod(r.Method) && r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+				return Principal{}, ErrCSRF
+			}
+			return p, nil
+		}
+	}
+	if a.Keys == nil {
+		return Principal{}, ErrUnauthenticated
+	}
+	if token := bearerToken(r); token != "" {
+		if key, ok := a.Keys.Authenticate(token); ok {
+			return Principal{Name: key.Name, Role: key.Role}, nil
+		}
+		return Principal{}, ErrUnauthenticated
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		if key, ok := a.Keys.Authenticate(pass); ok && key.Name == user {
+			return Principal{Name: key.Name, Role: key.Role}, nil
+		}
+	}
+	token := r.URL.Query().Get(TokenParam)
+	if c, err := r.Cookie(TokenCookie); err == nil && token == "" {
+		token = c.Value
+	}
+	if token != "" {
+		if key, ok := a.Keys.Authenticate(token); ok && key.Role == RoleListener {
+			return Principal{Name: key.Name, Role: key.Role, Token: token}, nil
+		}
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// withToken adds the token query parameter to the URLs of the server in the
+// feed, escaped as XML.
+func withToken(feed []byte, externalUrl, token string) []byte {
+	return addToken(feed, html.EscapeString(externalUrl), "&amp;", token)
+}
+
+// withTokenJSON adds the token query parameter to the URLs of the server in
+// the JSON feed, which leaves & unescaped.
+func withTokenJSON(feed []byte, externalUrl, token string) []byte {
+	return addToken(feed, externalUrl, "&", token)
+}
+
+// tokenUrls caches the regexps of addToken by prefix, of which there is one
+// per show.
+var tokenUrls sync.Map
+
+func addToken(feed []byte, prefix, amp, token string) []byte {
+	v, ok := tokenUrls.Load(prefix)
+	if !ok {
+		v, _ = tokenUrls.LoadOrStore(prefix, regexp.MustCompile(regexp.QuoteMeta(prefix)+`[^"<\s]*`))
+	}
+	urls := v.(*regexp.Regexp)
+	param := TokenParam + "=" + url.QueryEscape(token)
+	return urls.ReplaceAllFunc(feed, func(u []byte) []byte {
+		sep := "?"
+		if bytes.ContainsRune(u, '?') {
+			sep = amp
+		}
+		return append(u[:len(u):len(u)], sep+param...)
+	})
+}
+
+// requireRole only lets requests from principals with the given role through
+// to h. With a nil Authenticator, admin routes are disabled entirely and
+// listener routes are public.
+func requireRole(a *Authenticator, role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a == nil {
+			if role == RoleAdmin {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrCSRF) {
+			slog.Warn("rejected request", "error", err, "path", r.URL.Path, "tag", TagAuth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			if role == RoleAdmin {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="podserve"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Basic realm="podserve", charset="UTF-8"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		httplog.SetPrincipal(w, p.Name)
+		if !p.Role.Allows(role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if p.Token != "" && r.URL.Query().Has(TokenParam) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     TokenCookie,
+				Value:    p.Token,
+				Path:     "/",
+				Secure:   a.Secure || r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyPrincipal, p)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
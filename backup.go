@@ -0,0 +1,422 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tarball of everything podserve keeps next to the
+// media, but not the media itself: the sidecar files in the media directory
+// (anything that is not a media file) under media/, and the state files
+// given by the server flags under state/<flag>/, or under shows/<show>/<flag>
+// for those of each show with -multi. A manifest records where the state
+// files were, so that restoring puts them back in place unless told
+// otherwise, see restoreFallback.
+
+const backupManifest = "manifest.json"
+
+// stateFlags are the server flags naming state files or directories worth
+// keeping across migrations.
+var stateFlags = []struct {
+	name string
+	dir  bool
+	show bool // One file per show with -multi, see showStateFile.
+}{
+	{"config", false, false},
+	{"guidFile", false, true},
+	{"editsFile", false, true},
+	{"statsFile", false, true},
+	{"keyFile", false, false},
+	{"valueFile", false, false},
+	{"auditLog", false, false},
+	{"metaCache", false, true},
+	{"activityPubDir", true, false},
+}
+
+type backupManifestData struct {
+	Created time.Time `json:"created"`
+	// Paths of the state files when backed up, by flag name, relative to
+	// the working directory of the backup if within it.
+	State map[string]string `json:"state"`
+	// Paths of the state files of each show with -multi, by show and flag
+	// name.
+	Shows map[string]map[string]string `json:"shows,omitempty"`
+}
+
+func stateFlagSet(fset *flag.FlagSet, verb string) map[string]*string {
+	paths := make(map[string]*string, len(stateFlags))
+	for _, sf := range stateFlags {
+		paths[sf.name] = fset.String(sf.name, "", fmt.Sprintf("%s the -%s of the server", verb, sf.name))
+	}
+	return paths
+}
+
+// runBackup implements the backup subcommand.
+func runBackup(args []string) error {
+	fset := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fset.String("dir", "", "media directory to back up the sidecar files of")
+	out := fset.String("out", "", "path of the backup to create, e.g. podserve.tar.gz")
+	multi := fset.Bool("multi", false, "back up the state files of every show of -dir, as the server names them with -multi")
+	paths := stateFlagSet(fset, "back up")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve backup -out FILE [flags]\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *out == "" {
+		fset.Usage()
+		return errors.New("backup: -out is required")
+	}
+	var shows []string
+	if *multi {
+		if *dir == "" {
+			fset.Usage()
+			return errors.New("backup: -multi requires -dir")
+		}
+		var err error
+		if shows, err = listShows(*dir); err != nil {
+			return err
+		}
+	}
+
+	fp, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	gz := gzip.NewWriter(fp)
+	tw := tar.NewWriter(gz)
+
+	manifest := backupManifestData{Created: time.Now().UTC(), State: make(map[string]string)}
+	n := 0
+	if *dir != "" {
+		err := filepath.WalkDir(*dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(*dir, p)
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if rel == TrashDir || rel == ReplicaPartDir {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if _, isMedia := mimeType[filepath.Ext(p)]; isMedia || !d.Type().IsRegular() {
+				return nil
+			}
+			n++
+			return addToBackup(tw, p, path.Join("media", filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, sf := range stateFlags {
+		src := *paths[sf.name]
+		if src == "" {
+			continue
+		}
+		if *multi && sf.show {
+			for _, name := range shows {
+				p := showStateFile(src, name)
+				if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+					continue // The server has not written it yet.
+				}
+				recorded, err := manifestPath(p)
+				if err != nil {
+					return err
+				}
+				if manifest.Shows == nil {
+					manifest.Shows = make(map[string]map[string]string)
+				}
+				if manifest.Shows[name] == nil {
+					manifest.Shows[name] = make(map[string]string)
+				}
+				manifest.Shows[name][sf.name] = recorded
+				n++
+				if err := addToBackup(tw, p, path.Join("shows", name, sf.name)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		recorded, err := manifestPath(src)
+		if err != nil {
+			return err
+		}
+		manifest.State[sf.name] = recorded
+		prefix := path.Join("state", sf.name)
+		if !sf.dir {
+			n++
+			if err := addToBackup(tw, src, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			n++
+			return addToBackup(tw, p, path.Join(prefix, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: backupManifest, Mode: 0o644, Size: int64(len(buf)), ModTime: manifest.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %d files to %s.\n", n, *out)
+	return nil
+}
+
+// manifestPath returns the path p of a state file as recorded in the
+// manifest: relative to the working directory if within it, so that it can
+// be restored from the same place on another host, or else absolute.
+func manifestPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(wd, abs); err == nil && filepath.IsLocal(rel) {
+		return rel, nil
+	}
+	return abs, nil
+}
+
+func addToBackup(tw *tar.Writer, src, name string) error {
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fp)
+	return err
+}
+
+// runRestore implements the restore subcommand.
+func runRestore(args []string) error {
+	fset := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fset.String("in", "", "path of the backup to restore")
+	dir := fset.String("dir", "", "media directory to restore the sidecar files to")
+	force := fset.Bool("force", false, "overwrite existing files")
+	paths := stateFlagSet(fset, "where to restore, instead of where it was backed up from,")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve restore -in FILE [flags]\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *in == "" {
+		fset.Usage()
+		return errors.New("restore: -in is required")
+	}
+
+	// The manifest is written last, read it first.
+	var manifest backupManifestData
+	err := readBackup(*in, func(name string, _ *tar.Header, r io.Reader) error {
+		if name != backupManifest {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(&manifest)
+	})
+	if err != nil {
+		return err
+	}
+	if manifest.Created.IsZero() {
+		return fmt.Errorf("restore: %s is not a podserve backup", *in)
+	}
+
+	dests := make(map[string]string) // Name in the backup -> destination.
+	err = readBackup(*in, func(name string, _ *tar.Header, _ io.Reader) error {
+		dst, err := restoreDest(name, *dir, paths, manifest)
+		if err != nil || dst == "" {
+			return err
+		}
+		if _, err := os.Stat(dst); err == nil && !*force {
+			return fmt.Errorf("restore: %s exists, use -force to overwrite it", dst)
+		}
+		dests[name] = dst
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = readBackup(*in, func(name string, hdr *tar.Header, r io.Reader) error {
+		dst, ok := dests[name]
+		if !ok {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(dst, buf, fs.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d files from the backup of %s.\n", len(dests), manifest.Created.Format(time.DateTime))
+	return nil
+}
+
+// restoreDest returns where to restore the file name of a backup, or "" to
+// skip it.
+func restoreDest(name, dir string, paths map[string]*string, manifest backupManifestData) (string, error) {
+	if name == backupManifest {
+		return "", nil
+	}
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("restore: invalid path %q in backup", name)
+	}
+	if rel, ok := strings.CutPrefix(name, "media/"); ok {
+		if dir == "" {
+			return "", nil
+		}
+		return filepath.Join(dir, filepath.FromSlash(rel)), nil
+	}
+	if rest, ok := strings.CutPrefix(name, "shows/"); ok {
+		show, flagName, _ := strings.Cut(rest, "/")
+		p, ok := paths[flagName]
+		if !ok {
+			return "", nil
+		}
+		if *p != "" {
+			return showStateFile(*p, show), nil
+		}
+		return restoreFallback(manifest.Shows[show][flagName], flagName)
+	}
+	rest, ok := strings.CutPrefix(name, "state/")
+	if !ok {
+		return "", nil
+	}
+	flagName, rel, _ := strings.Cut(rest, "/")
+	p, ok := paths[flagName]
+	if !ok {
+		return "", nil
+	}
+	base := *p
+	if base == "" {
+		var err error
+		if base, err = restoreFallback(manifest.State[flagName], flagName); err != nil || base == "" {
+			return "", err
+		}
+	}
+	if rel == "" {
+		return base, nil
+	}
+	return filepath.Join(base, filepath.FromSlash(rel)), nil
+}
+
+// restoreFallback returns where to restore the state file of flagName that
+// the manifest records at p, when the flag is not given. The manifest is only
+// trusted with paths within the working directory, as a backup could
+// otherwise overwrite any file: others require the flag.
+func restoreFallback(p, flagName string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	dst := p
+	// Backups of older releases recorded absolute paths.
+	if filepath.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(wd, p); err == nil {
+			dst = rel
+		}
+	}
+	if !filepath.IsLocal(dst) {
+		return "", fmt.Errorf("restore: the -%s of the backup was outside the working directory, at %s, give -%s to restore it", flagName, p, flagName)
+	}
+	return dst, nil
+}
+
+// readBackup calls fn with every regular file of the backup at p.
+func readBackup(p string, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	fp, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A benchStats collects the results of the requests of one kind.
+type benchStats struct {
+	latencies []time.Duration // Of successful requests, until the body was read.
+	bytes     int64
+	errors    int
+	statuses  map[int]int
+}
+
+// A bench sends requests to a running podserve and records how it fared.
+type bench struct {
+	feedUrl   string
+	key       string
+	rangeSize int64
+	feedRatio float64
+	client    *http.Client
+	episodes  []rssItem
+	lengths   []int64
+
+	mu    sync.Mutex // Guards stats
+	stats map[string]*benchStats
+}
+
+func (b *bench) record(op string, status int, latency time.Duration, n int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.stats[op]
+	if !ok {
+		s = &benchStats{statuses: make(map[int]int)}
+		b.stats[op] = s
+	}
+	s.bytes += n
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.statuses[status]++
+	if status >= 400 {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (b *bench) get(ctx context.Context, u, rangeHeader string) (int, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", "podserve-bench")
+	if b.key != "" {
+		req.Header.Set("Authorization", "Bearer "+b.key)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, n, err
+}
+
+// fetchFeed reads the episodes of the feed, to pick media to fetch from.
+func (b *bench) fetchFeed() error {
+	req, err := http.NewRequest(http.MethodGet, b.feedUrl, nil)
+	if err != nil {
+		return err
+	}
+	if b.key != "" {
+		req.Header.Set("Authorization", "Bearer "+b.key)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", b.feedUrl, resp.Status)
+	}
+	var feed rssFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return fmt.Errorf("parse feed: %w", err)
+	}
+	for _, it := range feed.Channel.Items {
+		if it.Enclosure.Url != "" {
+			b.episodes = append(b.episodes, it)
+		}
+	}
+	return nil
+}
+
+// run sends requests until ctx is done: feed polls with probability
+// feedRatio, else a range of rangeSize bytes at a random offset of a random
+// episode, or the whole episode if rangeSize is 0.
+func (b *bench) run(ctx context.Context, rng *rand.Rand) {
+	for ctx.Err() == nil {
+		op, u, rangeHeader := "feed", b.feedUrl, ""
+		if len(b.episodes) > 0 && rng.Float64() >= b.feedRatio {
+			it := b.episodes[rng.Intn(len(b.episodes))]
+			op, u = "media", it.Enclosure.Url
+			if length := it.Enclosure.Length; b.rangeSize > 0 {
+				var off int64
+				if length > b.rangeSize {
+					off = rng.Int63n(length - b.rangeSize)
+				}
+				rangeHeader = fmt.Sprintf("bytes=%d-%d", off, off+b.rangeSize-1)
+			}
+		}
+		start := time.Now()
+		status, n, err := b.get(ctx, u, rangeHeader)
+		if ctx.Err() != nil {
+			// Cut short by the end of the run.
+			return
+		}
+		b.record(op, status, time.Since(start), n, err)
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+func (b *bench) report(w io.Writer, took time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "request\trequests\terrors\treq/s\tMiB/s\tp50\tp90\tp99\tmax\t")
+	ops := make([]string, 0, len(b.stats))
+	for op := range b.stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		s := b.stats[op]
+		slices.Sort(s.latencies)
+		n := len(s.latencies) + s.errors
+		fmt.Fprintf(
+			tw, "%s\t%d\t%d\t%.1f\t%.2f\t%s\t%s\t%s\t%s\t\n",
+			op, n, s.errors, float64(n)/took.Seconds(), float64(s.bytes)/(1<<20)/took.Seconds(),
+			percentile(s.latencies, 0.5).Round(time.Millisecond/10),
+			percentile(s.latencies, 0.9).Round(time.Millisecond/10),
+			percentile(s.latencies, 0.99).Round(time.Millisecond/10),
+			percentile(s.latencies, 1).Round(time.Millisecond/10),
+		)
+	}
+	tw.Flush()
+	for _, op := range ops {
+		s := b.stats[op]
+		codes := make([]int, 0, len(s.statuses))
+		for code := range s.statuses {
+			codes = append(codes, code)
+		}
+		slices.Sort(codes)
+		var parts []string
+		for _, code := range codes {
+			parts = append(parts, fmt.Sprintf("%d: %d", code, s.statuses[code]))
+		}
+		fmt.Fprintf(w, "%s statuses: %s\n", op, strings.Join(parts, ", "))
+	}
+}
+
+// runBench implements the bench subcommand.
+func runBench(args []string) error {
+	fset := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrency := fset.Int("concurrency", 10, "number of concurrent clients")
+	duration := fset.Duration("duration", 30*time.Second, "how long to send requests for")
+	feedRatio := fset.Float64("feedRatio", 0.2, "fraction of requests polling the feed, the others fetch media")
+	rangeSize := fset.String("rangeSize", "1M", "size of the ranges of media fetched, whole files if 0")
+	key := fset.String("key", "", "key sent as bearer token, for -private servers")
+	timeout := fset.Duration("timeout", 60*time.Second, "timeout of a request")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve bench [flags] <feed-url>\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.Arg(0) == "" {
+		fset.Usage()
+		return errors.New("bench: missing feed URL")
+	}
+	size, err := parseSize(*rangeSize)
+	if err != nil {
+		return fmt.Errorf("bench: -rangeSize: %w", err)
+	}
+	if *concurrency < 1 || *feedRatio < 0 || *feedRatio > 1 {
+		return errors.New("bench: -concurrency must be positive and -feedRatio between 0 and 1")
+	}
+	b := &bench{
+		feedUrl:   fset.Arg(0),
+		key:       *key,
+		rangeSize: size,
+		feedRatio: *feedRatio,
+		client: &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+		stats: make(map[string]*benchStats),
+	}
+	if err := b.fetchFeed(); err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	fmt.Printf("%d clients for %s against %s, %d episodes\n", *concurrency, *duration, b.feedUrl, len(b.episodes))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			b.run(ctx, rand.New(rand.NewSource(seed)))
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+	b.report(os.Stdout, time.Since(start))
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// A UABlocklist refuses requests from user agents matching any of its
+// patterns, such as scrapers or apps downloading the same episodes over and
+// over, to protect limited bandwidth.
+type UABlocklist struct {
+	patterns []*regexp.Regexp
+	sources  []string
+	hits     []atomic.Int64 // Requests refused, by pattern.
+}
+
+// LoadUABlocklist reads a file of patterns, one regular expression per line
+// matched case-insensitively anywhere in the User-Agent header. Lines
+// starting with # are ignored.
+func LoadUABlocklist(p string) (*UABlocklist, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	b := &UABlocklist{}
+	sc := bufio.NewScanner(fp)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p, n, err)
+		}
+		b.patterns = append(b.patterns, re)
+		b.sources = append(b.sources, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	b.hits = make([]atomic.Int64, len(b.patterns))
+	return b, nil
+}
+
+// match returns the index of the first pattern matching ua, or -1.
+func (b *UABlocklist) match(ua string) int {
+	for i, re := range b.patterns {
+		if re.MatchString(ua) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Wrap answers requests of h from blocked user agents with 403 Forbidden.
+func (b *UABlocklist) Wrap(h http.Handler) http.Handler {
+	if b == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := b.match(r.UserAgent()); i >= 0 {
+			b.hits[i].Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (b *UABlocklist) WriteMetrics(w *metricsWriter) {
+	w.Help("podserve_blocked_requests_total", "counter", "Media requests refused by the user agent blocklist, by pattern.")
+	for i, src := range b.sources {
+		w.Sample("podserve_blocked_requests_total", b.hits[i].Load(), "pattern", src)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MediaCache keeps local copies of the media files of a remote library, laid
+// out like the library, to serve them from. A file is downloaded on its first
+// request, and again once changed in the library. The least recently used
+// files are evicted beyond MaxSize.
+type MediaCache struct {
+	Dir     string
+	MaxSize int64 // Bytes, 0 is unlimited.
+
+	mu       sync.Mutex // Guards all below
+	fetching map[string]chan struct{}
+	used     map[string]time.Time // Path in Dir -> last use.
+}
+
+func NewMediaCache(dir string, maxSize int64) (*MediaCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &MediaCache{
+		Dir:      dir,
+		MaxSize:  maxSize,
+		fetching: make(map[string]chan struct{}),
+		used:     make(map[string]time.Time),
+	}, nil
+}
+
+// Cached returns the path of the cached copy of the file f of the library, if
+// it is cached and not being downloaded.
+func (c *MediaCache) Cached(f remoteFile) (string, bool) {
+	dst := filepath.Join(c.Dir, filepath.FromSlash(f.Path))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, busy := c.fetching[dst]; busy {
+		return "", false
+	}
+	return dst, c.hit(dst, f)
+}
+
+// hit reports whether dst is an up-to-date copy of f, marking it used if so.
+func (c *MediaCache) hit(dst string, f remoteFile) bool {
+	info, err := os.Stat(dst)
+	if err != nil || info.Size() != f.Size || !info.ModTime().Equal(f.ModTime) {
+		return false
+	}
+	c.used[dst] = time.Now()
+	return true
+}
+
+// Get returns the path of the cached copy of the file f of the library. Unless
+// cached, fill is called to download it into a temporary file. Concurrent
+// gets of a file download it once, and the download is not canceled with ctx,
+// others may be waiting for it.
+func (c *MediaCache) Get(ctx context.Context, f remoteFile, fill func(fp *os.File) error) (string, error) {
+	dst := filepath.Join(c.Dir, filepath.FromSlash(f.Path))
+	var done chan struct{}
+	for {
+		c.mu.Lock()
+		var busy bool
+		if done, busy = c.fetching[dst]; !busy {
+			if c.hit(dst, f) {
+				c.mu.Unlock()
+				return dst, nil
+			}
+			done = make(chan struct{})
+			c.fetching[dst] = done
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	err := c.download(f, dst, fill)
+	c.mu.Lock()
+	delete(c.fetching, dst)
+	close(done)
+	if err == nil {
+		c.used[dst] = time.Now()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	slog.Info("cached file", "path", f.Path, "size", f.Size, "tag", TagCache)
+	c.evict(dst)
+	return dst, nil
+}
+
+// download fills dst through a temporary file, dated like f.
+func (c *MediaCache) download(f remoteFile, dst string, fill func(fp *os.File) error) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if err := fill(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(fp.Name(), f.ModTime, f.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), dst)
+}
+
+// evict deletes the least recently used cached files until the cache fits in
+// MaxSize, keeping the file at keep.
+func (c *MediaCache) evict(keep string) {
+	if c.MaxSize <= 0 {
+		return
+	}
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []cached
+	var total int64
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	filepath.WalkDir(c.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".part") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		used, ok := c.used[p]
+		if !ok {
+			// Cached before a restart.
+			used = info.ModTime()
+		}
+		files = append(files, cached{p, info.Size(), used})
+		total += info.Size()
+		return nil
+	})
+	slices.SortFunc(files, func(a, b cached) int {
+		return a.used.Compare(b.used)
+	})
+	for _, f := range files {
+		if total <= c.MaxSize {
+			break
+		}
+		if _, busy := c.fetching[f.path]; busy || f.path == keep {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			slog.Error("could not evict cached file", "error", err, "path", f.path, "tag", TagCache)
+			continue
+		}
+		delete(c.used, f.path)
+		total -= f.size
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Episodes have chapters if their media file has chapter markers, or if a
+// chapters file in the JSON chapters format of the podcast namespace is next
+// to it, e.g. episode.chapters.json next to episode.mp3, which takes
+// precedence. They are served as JSON from ChaptersPath followed by the path
+// of the media file, linked as podcast:chapters.
+//
+// See https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+const (
+	ChaptersPath = "/chapters/"
+	chaptersExt  = ".chapters.json"
+	chaptersType = "application/json+chapters"
+)
+
+type jsonChapters struct {
+	Version  string        `json:"version"`
+	Chapters []jsonChapter `json:"chapters"`
+}
+
+type jsonChapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title,omitempty"`
+	Img       string  `json:"img,omitempty"`
+	Url       string  `json:"url,omitempty"`
+}
+
+// readChapters reads the chapters file at p of fsys.
+func readChapters(fsys fs.FS, p string) ([]Chapter, error) {
+	buf, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	var jc jsonChapters
+	if err := json.Unmarshal(buf, &jc); err != nil {
+		return nil, err
+	}
+	var chapters []Chapter
+	for _, c := range jc.Chapters {
+		if c.StartTime < 0 || c.EndTime != 0 && c.EndTime < c.StartTime {
+			return nil, fmt.Errorf("chapter %q ends before it starts", c.Title)
+		}
+		chapters = append(chapters, Chapter{
+			Start: c.StartTime,
+			End:   c.EndTime,
+			Title: c.Title,
+			Image: c.Img,
+			Url:   c.Url,
+		})
+	}
+	return chapters, nil
+}
+
+// applyChapterFiles replaces the chapters of items with those of the chapters
+// files next to them, keyed by path without extension.
+func applyChapterFiles(fsys fs.FS, items []Item, files map[string]string) {
+	for i := range items {
+		p, ok := files[strings.TrimSuffix(items[i].Path, path.Ext(items[i].Path))]
+		if !ok {
+			continue
+		}
+		chapters, err := readChapters(fsys, p)
+		if err != nil {
+			slog.Warn("ignoring invalid chapters file", "error", err, "file", p, "tag", TagRefresh)
+			continue
+		}
+		items[i].Chapters = chapters
+	}
+}
+
+// ServeChapters serves the chapters of a published episode.
+func (s *Server) ServeChapters(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	name, _ := lookupPath(s.Files, strings.TrimPrefix(r.URL.Path, ChaptersPath))
+	var chapters []Chapter
+	for _, it := range s.Items {
+		if it.Path == name {
+			chapters = it.Chapters
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if len(chapters) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	jc := jsonChapters{Version: "1.2.0"}
+	for _, c := range chapters {
+		jc.Chapters = append(jc.Chapters, jsonChapter{
+			StartTime: c.Start,
+			EndTime:   c.End,
+			Title:     c.Title,
+			Img:       c.Image,
+			Url:       c.Url,
+		})
+	}
+	w.Header().Set("Content-Type", chaptersType)
+	if err := json.NewEncoder(w).Encode(jc); err != nil {
+		slog.Error("could not encode chapters", "error", err, "tag", TagHttp)
+	}
+}
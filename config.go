@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Config is what a -config file sets besides flags.
+type Config struct {
+	// Settings of the shows of -multi by name, overridden by their ShowFile.
+	Feeds map[string]ShowSettings
+}
+
+// LoadConfig reads the configuration file p, in TOML if named *.toml and in
+// YAML otherwise. Its keys are the names of the flags of fset, which it sets
+// unless given on the command line, and feeds, the settings of the shows of
+// -multi. Lists are set as comma separated values.
+func LoadConfig(p string, fset *flag.FlagSet) (*Config, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if strings.EqualFold(filepath.Ext(p), ".toml") {
+		doc, err = parseTOML(string(buf))
+	} else {
+		err = yaml.Unmarshal(buf, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", p, err)
+	}
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	c := &Config{}
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if k == "feeds" {
+			if c.Feeds, err = configFeeds(doc[k]); err != nil {
+				return nil, fmt.Errorf("%s: feeds: %w", p, err)
+			}
+			continue
+		}
+		if k == "config" || fset.Lookup(k) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", p, k)
+		}
+		if given[k] {
+			continue
+		}
+		v, err := configValue(doc[k])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", p, k, err)
+		}
+		if err := fset.Set(k, v); err != nil {
+			return nil, fmt.Errorf("%s: %s: invalid value %q: %w", p, k, v, err)
+		}
+	}
+	return c, nil
+}
+
+// configValue formats a value of a configuration file as a flag value.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			if _, ok := e.([]any); ok {
+				return "", errors.New("nested lists are not supported")
+			}
+			var err error
+			if parts[i], err = configValue(e); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// configFeeds decodes the feeds of a configuration file, by way of YAML so
+// that they are decoded the same from TOML.
+func configFeeds(v any) (map[string]ShowSettings, error) {
+	buf, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var feeds map[string]ShowSettings
+	dec := yaml.NewDecoder(strings.NewReader(string(buf)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&feeds); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+// parseTOML parses the subset of TOML (https://toml.io) configuration files
+// need: tables, key/value pairs with bare, quoted or dotted keys, basic and
+// literal strings, integers, floats, booleans, arrays and inline tables.
+// Multi-line strings, dates and arrays of tables are not supported.
+func parseTOML(s string) (map[string]any, error) {
+	p := &tomlParser{s: s, line: 1}
+	doc, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return doc, nil
+}
+
+type tomlParser struct {
+	s    string
+	i    int
+	line int
+}
+
+func (p *tomlParser) parse() (map[string]any, error) {
+	doc := make(map[string]any)
+	table := doc
+	for {
+		p.skip(true)
+		if p.i >= len(p.s) {
+			return doc, nil
+		}
+		if p.s[p.i] == '[' {
+			if strings.HasPrefix(p.s[p.i:], "[[") {
+				return nil, errors.New("arrays of tables are not supported")
+			}
+			p.i++
+			keys, err := p.keys()
+			if err != nil {
+				return nil, err
+			}
+			if p.i >= len(p.s) || p.s[p.i] != ']' {
+				return nil, errors.New("expected ] after table name")
+			}
+			p.i++
+			if table, err = tomlTable(doc, keys); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := p.keyValue(table); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// skip skips spaces and comments, and newlines as well if newlines is set.
+func (p *tomlParser) skip(newlines bool) {
+	for p.i < len(p.s) {
+		switch c := p.s[p.i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.i++
+		case c == '\n' && newlines:
+			p.line++
+			p.i++
+		case c == '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skip(false)
+	if p.i < len(p.s) && p.s[p.i] != '\n' {
+		return fmt.Errorf("unexpected %q", p.s[p.i])
+	}
+	return nil
+}
+
+// keys parses a possibly dotted key.
+func (p *tomlParser) keys() ([]string, error) {
+	var keys []string
+	for {
+		p.skip(false)
+		var k string
+		switch {
+		case p.i >= len(p.s):
+			return nil, errors.New("expected a key")
+		case p.s[p.i] == '"' || p.s[p.i] == '\'':
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			k = v.(string)
+		default:
+			start := p.i
+			for p.i < len(p.s) && isTOMLBareKey(p.s[p.i]) {
+				p.i++
+			}
+			if p.i == start {
+				return nil, fmt.Errorf("unexpected %q in key", p.s[p.i])
+			}
+			k = p.s[start:p.i]
+		}
+		keys = append(keys, k)
+		p.skip(false)
+		if p.i >= len(p.s) || p.s[p.i] != '.' {
+			return keys, nil
+		}
+		p.i++
+	}
+}
+
+func isTOMLBareKey(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-'
+}
+
+// keyValue parses a key/value pair into table.
+func (p *tomlParser) keyValue(table map[string]any) error {
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if p.i >= len(p.s) || p.s[p.i] != '=' {
+		return errors.New("expected = after key")
+	}
+	p.i++
+	p.skip(false)
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	if table, err = tomlTable(table, keys[:len(keys)-1]); err != nil {
+		return err
+	}
+	k := keys[len(keys)-1]
+	if _, ok := table[k]; ok {
+		return fmt.Errorf("duplicate key %q", k)
+	}
+	table[k] = v
+	return nil
+}
+
+// tomlTable returns the table of the dotted key keys in table, creating it
+// if needed.
+func tomlTable(table map[string]any, keys []string) (map[string]any, error) {
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case nil:
+			sub := make(map[string]any)
+			table[k] = sub
+			table = sub
+		case map[string]any:
+			table = v
+		default:
+			return nil, fmt.Errorf("key %q is not a table", k)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) value() (any, error) {
+	if p.i >= len(p.s) {
+		return nil, errors.New("expected a value")
+	}
+	switch c := p.s[p.i]; c {
+	case '"':
+		if strings.HasPrefix(p.s[p.i:], `"""`) {
+			return nil, errors.New("multi-line strings are not supported")
+		}
+		end := p.i + 1
+		for ; end < len(p.s) && p.s[end] != '"' && p.s[end] != '\n'; end++ {
+			if p.s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(p.s) || p.s[end] != '"' {
+			return nil, errors.New("unterminated string")
+		}
+		v, err := tomlUnescape(p.s[p.i+1 : end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s: %w", p.s[p.i:end+1], err)
+		}
+		p.i = end + 1
+		return v, nil
+	case '\'':
+		if strings.HasPrefix(p.s[p.i:], "'''") {
+			return nil, errors.New("multi-line strings are not supported")
+		}
+		end := strings.IndexAny(p.s[p.i+1:], "'\n")
+		if end < 0 || p.s[p.i+1+end] != '\'' {
+			return nil, errors.New("unterminated string")
+		}
+		v := p.s[p.i+1 : p.i+1+end]
+		p.i += end + 2
+		return v, nil
+	case '[':
+		p.i++
+		arr := []any{}
+		for {
+			p.skip(true)
+			if p.i < len(p.s) && p.s[p.i] == ']' {
+				p.i++
+				return arr, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+			p.skip(true)
+			if p.i < len(p.s) && p.s[p.i] == ',' {
+				p.i++
+			} else if p.i >= len(p.s) || p.s[p.i] != ']' {
+				return nil, errors.New("expected , or ] in array")
+			}
+		}
+	case '{':
+		p.i++
+		table := make(map[string]any)
+		for {
+			p.skip(false)
+			if p.i < len(p.s) && p.s[p.i] == '}' && len(table) == 0 {
+				p.i++
+				return table, nil
+			}
+			if err := p.keyValue(table); err != nil {
+				return nil, err
+			}
+			p.skip(false)
+			switch {
+			case p.i < len(p.s) && p.s[p.i] == ',':
+				p.i++
+			case p.i < len(p.s) && p.s[p.i] == '}':
+				p.i++
+				return table, nil
+			default:
+				return nil, errors.New("expected , or } in inline table")
+			}
+		}
+	}
+	end := p.i
+	for end < len(p.s) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.s[end])) {
+		end++
+	}
+	tok := p.s[p.i:end]
+	p.i = end
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	for _, prefix := range []struct {
+		s    string
+		base int
+	}{{"0x", 16}, {"0o", 8}, {"0b", 2}} {
+		digits, ok := strings.CutPrefix(num, prefix.s)
+		if !ok {
+			continue
+		}
+		if digits == "" || digits[0] == '+' || digits[0] == '-' {
+			return nil, fmt.Errorf("invalid value %q", tok)
+		}
+		n, err := strconv.ParseUint(digits, prefix.base, 63)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", tok)
+		}
+		return int64(n), nil
+	}
+	// Decimal, unlike Go a leading zero does not make octal.
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return n, nil
+	}
+	if tomlFloat.MatchString(num) {
+		if f, err := strconv.ParseFloat(num, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q", tok)
+}
+
+// tomlFloat matches TOML floats, underscores removed, as ParseFloat accepts
+// more such as hexadecimal floats and "infinity".
+var tomlFloat = regexp.MustCompile(`^[+-]?(?:[0-9]+(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?|inf|nan)$`)
+
+// tomlUnescape returns the basic string s, without its quotes, with its escape
+// sequences replaced. Those of TOML differ from those of Go: \x, \a, \v and
+// octal escapes are not, and \e is, see https://toml.io/en/v1.0.0#string.
+func tomlUnescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", errors.New("unterminated escape")
+		}
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case 'e':
+			b.WriteByte(0x1b)
+		case '"', '\\':
+			b.WriteByte(c)
+		case 'u', 'U':
+			n := 4
+			if c == 'U' {
+				n = 8
+			}
+			if i+n >= len(s) {
+				return "", fmt.Errorf("short escape \\%c", c)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid escape \\%s", s[i:i+1+n])
+			}
+			b.WriteRune(rune(r))
+			i += n
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+	return b.String(), nil
+}
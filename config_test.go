@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOMLValues(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want any
+	}{
+		{"string", `v = "hello"`, "hello"},
+		{"escapes", `v = "a\tb\nc\"d\\e"`, "a\tb\nc\"d\\e"},
+		{"control escapes", `v = "\b\f\r\e"`, "\b\f\r\x1b"},
+		{"unicode escape", `v = "caf\u00e9"`, "café"},
+		{"long unicode escape", `v = "\U0001F399"`, "\U0001F399"},
+		{"literal string", `v = 'C:\path\x'`, `C:\path\x`},
+		{"decimal", `v = 42`, int64(42)},
+		{"negative", `v = -17`, int64(-17)},
+		{"plus sign", `v = +5`, int64(5)},
+		{"leading zero", `v = 010`, int64(10)},
+		{"underscores", `v = 1_000_000`, int64(1000000)},
+		{"hexadecimal", `v = 0xff`, int64(255)},
+		{"octal", `v = 0o755`, int64(0o755)},
+		{"binary", `v = 0b1010`, int64(10)},
+		{"float", `v = 1.5`, 1.5},
+		{"exponent", `v = 5e+2`, 500.0},
+		{"negative float", `v = -0.25`, -0.25},
+		{"true", `v = true`, true},
+		{"array", `v = [1, "a", false]`, []any{int64(1), "a", false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseTOML(tt.toml)
+			if err != nil {
+				t.Fatalf("parseTOML(%q): %v", tt.toml, err)
+			}
+			if got := doc["v"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML(%q) = %#v, want %#v", tt.toml, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+	}{
+		{"Go hex escape", `v = "\x41"`},
+		{"Go octal escape", `v = "\101"`},
+		{"Go bell escape", `v = "\a"`},
+		{"Go single quote escape", `v = "\'"`},
+		{"short unicode escape", `v = "\u00e"`},
+		{"surrogate escape", `v = "\ud800"`},
+		{"unterminated string", `v = "abc`},
+		{"signed hexadecimal", `v = 0x-1`},
+		{"empty hexadecimal", `v = 0x`},
+		{"octal digit", `v = 0o8`},
+		{"binary digit", `v = 0b2`},
+		{"hexadecimal float", `v = 0x1p-2`},
+		{"infinity", `v = infinity`},
+		{"bare word", `v = hello`},
+		{"duplicate key", "v = 1\nv = 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if doc, err := parseTOML(tt.toml); err == nil {
+				t.Errorf("parseTOML(%q) = %#v, want an error", tt.toml, doc)
+			}
+		})
+	}
+}
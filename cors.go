@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Headers a cross-origin web player needs to read in order to seek in media
+// files and display download progress.
+const corsExposeHeaders = "Accept-Ranges, Content-Length, Content-Range, Content-Type, ETag, Last-Modified"
+
+type CorsConfig struct {
+	// Origins allowed to make cross-origin requests. A single "*" allows any
+	// origin. CORS headers are not sent at all if empty.
+	Origins []string
+	Methods []string
+	Headers []string
+}
+
+func (c CorsConfig) enabled() bool {
+	return len(c.Origins) > 0
+}
+
+func (c CorsConfig) allowOrigin(origin string) (string, bool) {
+	if slices.Contains(c.Origins, "*") {
+		return "*", true
+	}
+	if slices.Contains(c.Origins, origin) {
+		return origin, true
+	}
+	return "", false
+}
+
+// cors adds CORS headers to responses of h and answers preflight requests,
+// allowing web-based players hosted on other origins to fetch the feed and
+// the media directly.
+func cors(c CorsConfig, h http.Handler) http.Handler {
+	if !c.enabled() {
+		return h
+	}
+	methods := strings.Join(c.Methods, ", ")
+	headers := strings.Join(c.Headers, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed, ok := c.allowOrigin(origin)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// Preflight request.
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// splitList splits a comma separated flag value into its trimmed, non-empty
+// elements.
+func splitList(s string) []string {
+	var out []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const ctxKeyInflight ctxKey = ctxKeyPrincipal + 1
+
+// A Drain keeps track of the requests in flight, so that shutting down lets
+// them, long media downloads in particular, finish within a drain period
+// rather than cutting them off.
+type Drain struct {
+	mu       sync.Mutex // Guards the fields below
+	requests map[*inflight]bool
+	end      time.Time // End of the drain period, zero until shutting down.
+}
+
+type inflight struct {
+	drain    *Drain
+	rc       *http.ResponseController
+	deadline time.Time // Write deadline of the request, zero if none.
+}
+
+func NewDrain() *Drain {
+	return &Drain{requests: make(map[*inflight]bool)}
+}
+
+// Wrap tracks the requests handled by h, to which the server applies the
+// write timeout timeout.
+func (d *Drain) Wrap(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &inflight{drain: d, rc: http.NewResponseController(w)}
+		if timeout > 0 {
+			req.deadline = time.Now().Add(timeout)
+		}
+		d.mu.Lock()
+		d.requests[req] = true
+		d.mu.Unlock()
+		defer func() {
+			d.mu.Lock()
+			delete(d.requests, req)
+			d.mu.Unlock()
+		}()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyInflight, req)))
+	})
+}
+
+// Start starts the drain period, of length period, and moves the write
+// deadline of the requests in flight to its end if they had a later one.
+func (d *Drain) Start(period time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.end = time.Now().Add(period)
+	if len(d.requests) > 0 {
+		slog.Info("waiting for requests in flight to finish", "requests", len(d.requests), "drain", period, "tag", TagService)
+	}
+	for req := range d.requests {
+		if req.deadline.IsZero() || req.deadline.After(d.end) {
+			if err := req.setDeadline(d.end); err != nil {
+				slog.Warn("could not set write deadline", "error", err, "tag", TagService)
+			}
+		}
+	}
+}
+
+// Len returns the number of requests in flight.
+func (d *Drain) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.requests)
+}
+
+// setWriteDeadline sets the write deadline of the request r to t, or to the
+// end of the drain period if shutting down and that is earlier.
+func setWriteDeadline(w http.ResponseWriter, r *http.Request, t time.Time) error {
+	req, ok := r.Context().Value(ctxKeyInflight).(*inflight)
+	if !ok {
+		return http.NewResponseController(w).SetWriteDeadline(t)
+	}
+	d := req.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.end.IsZero() && t.After(d.end) {
+		t = d.end
+	}
+	return req.setDeadline(t)
+}
+
+func (req *inflight) setDeadline(t time.Time) error {
+	req.deadline = t
+	return req.rc.SetWriteDeadline(t)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// ApiChannelPath reads and edits the metadata of the channel.
+const ApiChannelPath = "/api/channel"
+
+// ChannelEdit replaces metadata of the channel given on the command line.
+// Fields left out are not replaced.
+type ChannelEdit struct {
+	Title     *string `json:"title,omitempty"`
+	Desc      *string `json:"description,omitempty"`
+	Author    *string `json:"author,omitempty"`
+	Copyright *string `json:"copyright,omitempty"`
+	Explicit  *bool   `json:"explicit,omitempty"`
+}
+
+// EpisodeEdit replaces the title and description of an episode, or hides it
+// from the feed. Fields left out are not replaced.
+type EpisodeEdit struct {
+	Title  *string `json:"title,omitempty"`
+	Desc   *string `json:"description,omitempty"`
+	Hidden *bool   `json:"hidden,omitempty"`
+}
+
+// EditStore persists the edits made through the admin API in a JSON file,
+// applied every time the feed is generated. Edits of episodes are keyed by
+// path relative to the media directory.
+type EditStore struct {
+	path string
+
+	mu    sync.Mutex // Guards edits
+	edits editState
+}
+
+type editState struct {
+	Channel  ChannelEdit            `json:"channel"`
+	Episodes map[string]EpisodeEdit `json:"episodes,omitempty"`
+}
+
+func NewEditStore(path string) (*EditStore, error) {
+	es := &EditStore{path: path}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return es, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &es.edits); err != nil {
+		return nil, fmt.Errorf("parse edits file %s: %w", path, err)
+	}
+	return es, nil
+}
+
+func (es *EditStore) save() error {
+	buf, err := json.MarshalIndent(es.edits, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(es.path, append(buf, '\n'), 0o644)
+}
+
+// Channel returns the edits of the channel.
+func (es *EditStore) Channel() ChannelEdit {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.edits.Channel
+}
+
+// Episode returns the edits of the episode at path p, and false if it has
+// none.
+func (es *EditStore) Episode(p string) (EpisodeEdit, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	e, ok := es.edits.Episodes[p]
+	return e, ok
+}
+
+// EditChannel merges edit into the edits of the channel and saves them. An
+// empty string restores what was given on the command line.
+func (es *EditStore) EditChannel(edit ChannelEdit) (ChannelEdit, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	c := &es.edits.Channel
+	mergeEdit(&c.Title, edit.Title)
+	mergeEdit(&c.Desc, edit.Desc)
+	mergeEdit(&c.Author, edit.Author)
+	mergeEdit(&c.Copyright, edit.Copyright)
+	if edit.Explicit != nil {
+		c.Explicit = edit.Explicit
+	}
+	return *c, es.save()
+}
+
+// EditEpisode merges edit into the edits of the episode at path p and saves
+// them. An empty string, or false, restores the original.
+func (es *EditStore) EditEpisode(p string, edit EpisodeEdit) (EpisodeEdit, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	e := es.edits.Episodes[p]
+	mergeEdit(&e.Title, edit.Title)
+	mergeEdit(&e.Desc, edit.Desc)
+	mergeEdit(&e.Hidden, edit.Hidden)
+	if e == (EpisodeEdit{}) {
+		delete(es.edits.Episodes, p)
+	} else {
+		if es.edits.Episodes == nil {
+			es.edits.Episodes = make(map[string]EpisodeEdit)
+		}
+		es.edits.Episodes[p] = e
+	}
+	return e, es.save()
+}
+
+// mergeEdit sets *dst to v if given, or back to nil if v is the zero value.
+func mergeEdit[T comparable](dst **T, v *T) {
+	if v == nil {
+		return
+	}
+	var zero T
+	if *v == zero {
+		*dst = nil
+	} else {
+		*dst = v
+	}
+}
+
+// applyChannel returns m with the edits of the channel applied.
+func (es *EditStore) applyChannel(m Metadata) Metadata {
+	c := es.Channel()
+	if c.Title != nil {
+		m.Title = *c.Title
+	}
+	if c.Desc != nil {
+		m.Desc = *c.Desc
+	}
+	if c.Author != nil {
+		m.Author = *c.Author
+	}
+	if c.Copyright != nil {
+		m.Copyright = *c.Copyright
+	}
+	if c.Explicit != nil {
+		m.Explicit = *c.Explicit
+	}
+	return m
+}
+
+// applyEpisodes applies the edits of episodes to items, leaving out those
+// that are hidden.
+func (es *EditStore) applyEpisodes(items []Item) []Item {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var kept []Item
+	for _, it := range items {
+		e, ok := es.edits.Episodes[it.Path]
+		if !ok {
+			kept = append(kept, it)
+			continue
+		}
+		if e.Hidden != nil && *e.Hidden {
+			continue
+		}
+		if e.Title != nil {
+			it.Title = *e.Title
+		}
+		if e.Desc != nil {
+			it.Desc = *e.Desc
+		}
+		kept = append(kept, it)
+	}
+	return kept
+}
+
+// ServeChannel handles the channel API:
+//
+//	GET   /api/channel  the metadata of the channel and its edits
+//	PATCH /api/channel  edit the metadata of the channel
+func (s *Server) ServeChannel(w http.ResponseWriter, r *http.Request) {
+	es := s.Metadata.edits
+	if es == nil {
+		writeJSONError(w, http.StatusNotFound, "editing is disabled, see -editsFile")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.RLock()
+		m := s.Channel
+		s.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"title":       m.Title,
+			"description": m.Desc,
+			"author":      m.Author,
+			"copyright":   m.Copyright,
+			"explicit":    m.Explicit,
+			"edits":       es.Channel(),
+		})
+	case http.MethodPatch:
+		var edit ChannelEdit
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&edit); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid channel edit: "+err.Error())
+			return
+		}
+		c, err := es.EditChannel(edit)
+		if err != nil {
+			adminLogger(r, "edit").Error("could not save channel edit", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "could not save edit")
+			return
+		}
+		adminLogger(r, "edit").Info("edited channel")
+		s.Audit.Record(r, "edit", "", map[string]any{"channel": edit})
+		s.refreshAfterChange(r)
+		writeJSON(w, http.StatusOK, c)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// editEpisode handles PATCH /api/episodes/<path>, which edits the episode at
+// path p. Hidden episodes can be edited, to show them again.
+func (s *Server) editEpisode(w http.ResponseWriter, r *http.Request, p string) {
+	es := s.Metadata.edits
+	if es == nil {
+		writeJSONError(w, http.StatusNotFound, "editing is disabled, see -editsFile")
+		return
+	}
+	s.mu.RLock()
+	_, published := s.Files[p]
+	_, draft := s.DraftFiles[p]
+	s.mu.RUnlock()
+	if _, edited := es.Episode(p); !published && !draft && !edited {
+		writeJSONError(w, http.StatusNotFound, "no such episode")
+		return
+	}
+	var edit EpisodeEdit
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&edit); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid episode edit: "+err.Error())
+		return
+	}
+	e, err := es.EditEpisode(p, edit)
+	if err != nil {
+		adminLogger(r, "edit").Error("could not save episode edit", "error", err, "path", p)
+		writeJSONError(w, http.StatusInternalServerError, "could not save edit")
+		return
+	}
+	adminLogger(r, "edit").Info("edited episode", "path", p)
+	s.Audit.Record(r, "edit", p, map[string]any{"episode": edit})
+	s.refreshAfterChange(r)
+	writeJSON(w, http.StatusOK, e)
+}
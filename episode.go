@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// EpisodesPath serves a page per published episode, at EpisodesPath + slug.
+	EpisodesPath = "/episodes/"
+	// MediaPath serves media files under names made from their slug, if
+	// enabled, see mediaName.
+	MediaPath = "/media/"
+)
+
+type EpisodePageData struct {
+	Metadata Metadata
+	Theme    Theme
+	Locale   *Locale
+	Item     Item
+	IndexUrl string
+	FeedUrl  string
+}
+
+// slugify turns a title into a URL path segment, e.g. "Ep. 1: Hello!" becomes
+// "ep-1-hello".
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "episode"
+	}
+	return b.String()
+}
+
+// assignSlugs gives every published item a unique slug, made from the slug
+// set in its sidecar or else its title. Of items sharing a slug, the one whose
+// file is oldest keeps it and the others get a suffix following from their
+// path, so that slugs neither depend on the order of items nor change as
+// episodes are added. Drafts have no page and are left alone.
+func assignSlugs(items []Item) {
+	bySlug := make(map[string][]*Item)
+	for i := range items {
+		it := &items[i]
+		if it.Draft {
+			continue
+		}
+		base := it.Slug
+		if base == "" {
+			base = it.Title
+		}
+		it.Slug = slugify(base)
+		bySlug[it.Slug] = append(bySlug[it.Slug], it)
+	}
+	for slug, same := range bySlug {
+		if len(same) == 1 {
+			continue
+		}
+		slices.SortFunc(same, func(a, b *Item) int {
+			if c := a.fileTime.Compare(b.fileTime); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Path, b.Path)
+		})
+		for _, it := range same[1:] {
+			sum := sha256.Sum256([]byte(it.Path))
+			it.Slug = slug + "-" + hex.EncodeToString(sum[:4])
+		}
+	}
+}
+
+// mediaName is the name an item's media file is first published under with
+// -slugUrls, e.g. 2024-03-01-my-episode.mp3. The GuidStore keeps it from then
+// on, see GuidStore.MediaNames: unlike the path on disk, the title or the
+// date of the tags, it does not change.
+func mediaName(it Item) string {
+	return it.ModTime.Format(time.DateOnly) + "-" + it.Slug + strings.ToLower(path.Ext(it.Path))
+}
+
+// alternateMediaName is the name of a rendition of it, following from that
+// of it, e.g. 2024-03-01-my-episode.low.opus.
+func alternateMediaName(it Item, alt Alternate) string {
+	return strings.TrimSuffix(it.media, path.Ext(it.media)) + "." + alt.Title + strings.ToLower(path.Ext(alt.Path))
+}
+
+// paragraphs splits show notes into paragraphs on blank lines.
+func paragraphs(s string) []string {
+	var out []string
+	for _, p := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (s *Server) ServeEpisodePage(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	slug := strings.TrimPrefix(r.URL.Path, EpisodesPath)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, it := range s.Items {
+		if it.Slug != slug {
+			continue
+		}
+		feedUrl := s.Metadata.externalUrl + FeedPath[1:]
+		subUrl := subscribeUrl(r, feedUrl)
+		if subUrl != feedUrl {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		err := s.HtmlTemplate.ExecuteTemplate(w, "episode.html", EpisodePageData{
+			Metadata: s.Channel,
+			Theme:    s.Theme,
+			Locale:   s.locale(w, r),
+			Item:     it,
+			IndexUrl: s.Metadata.externalUrl + FeedHtmlPath[1:],
+			FeedUrl:  subUrl,
+		})
+		if err != nil {
+			slog.Error("template error", "error", err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
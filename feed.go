@@ -1,72 +1,245 @@
 package main
 
 import (
-	"bytes"
-	"html/template"
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/fs"
+	"log/slog"
+	"math"
+	"mime"
 	"net/url"
-	"os"
+	"path"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 )
 
-const (
-	XMLHeader = `<?xml version="1.0" encoding="UTF-8"?>`
-	// See the references in the package comment for a description of supported
-	// fields.
-	RSSTemplate = `
-<rss version="2.0"
- xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"
- xmlns:content="http://purl.org/rss/1.0/modules/content/"
->
-<channel>
- <title>{{.Metadata.Title}}</title>
- <link>{{.Metadata.Link}}</link>
- <description>{{.Metadata.Desc}}</description>
- <language>{{.Metadata.Language}}</language>
- <itunes:image href="{{.Metadata.CoverUrl}}" />
- {{range .Items}}
- <item>
-  <title>{{.Title}}</title>
-  <link>{{.Link}}</link>
-  <description>{{.Desc}}</description>
-  <pubDate>{{timeRFC2822 .ModTime}}</pubDate>
-  <enclosure url="{{.Enclosure.Url}}" length="{{.Enclosure.Length}}" Type="{{.Enclosure.Type}}" />
- </item>
- {{- end}}
-</channel>
-</rss>
-`
-)
-
 // The date format required in a podcast RSS. See [2] in package documentation.
-const TimeRFC2822 = "Mon, Jan 02 2006 15:04:05 MST"
+const TimeRFC2822 = "Mon, 02 Jan 2006 15:04:05 -0700"
 
 type TemplateData struct {
 	Metadata Metadata
+	Theme    Theme
+	Locale   *Locale // Of the HTML page.
 	Items    []Item
+
+	// URL to subscribe to the feed with, only set for the HTML page.
+	SubscribeUrl string
+
+	// Pagination of the HTML page. PrevUrl and NextUrl are empty on the first
+	// and last page. MoreUrl is the API URL of the next page if the page loads
+	// more items as the viewer scrolls.
+	Page, Pages      int
+	PrevUrl, NextUrl string
+	MoreUrl          string
 }
 
 type Metadata struct {
-	Title         string
-	Link          string
-	Desc          string
-	Language      string
-	CoverUrl      string
-	StylesheetUrl string
+	Title    string
+	Link     string
+	Desc     string
+	Language string
+	CoverUrl string
+	// Size of the cover in the RSS <image>, see rssImageSize. Left out if 0.
+	CoverWidth, CoverHeight int
+	StylesheetUrl           string
+	ShowType                ShowType
+	Explicit                bool
+	Value                   *ValueBlock // Value-for-value recipients, optional.
+	Copyright               string      // Optional.
+	Author                  string      // Optional.
+	Category                *Category   // Optional.
+	License                 *License    // Optional.
+	// Page on supporting the show, linked as <podcast:funding> and from the
+	// header of the HTML pages, optional.
+	SupportUrl  string
+	SupportText string // Defaults to a translation, see FundingText.
 
 	externalUrl string
 	localRoot   string
+	guids       *GuidStore // Persisted GUIDs of items, optional.
+	edits       *EditStore // Edits made through the admin API, optional.
+	slugUrls    bool       // Publish media under MediaPath rather than their path.
+	transcoder  *Transcoder
+	meta        *MetaCache // Metadata extracted from media files, optional.
+	extractor   *Extractor
+	audiobooks  bool // Directories are books and their files chapters.
+	hasher      *Hasher
+	scan        ScanPolicy
+	localCover  bool // Look for a cover image in localRoot, see findCover.
+	// Scan without side effects, to preview a refresh: nothing is persisted,
+	// queued or removed, see Server.Pending.
+	dryRun bool
+	// Items per page of the RSS feed, see FeedPages. 0 for one page.
+	maxItemsPerPage int
+	// Order of the feed outside audiobook mode. sortOrder is "asc" or
+	// "desc", and by default that of the show type.
+	sortBy    SortKey
+	sortOrder string
+	// Number of the newest episodes published, 0 for all.
+	maxItems int
+	// Patterns of -exclude, applied before those of the IgnoreFile.
+	exclude []string
+	// The media library. localRoot is the media directory of a LocalSource,
+	// or where a remote library is cached.
+	source MediaSource
+	// Episodes hosted elsewhere, optional.
+	manifest *Manifest
+	// Signs the feed and checksums, optional.
+	signingKey ed25519.PrivateKey
+	locale     *Locale // Of the show's language.
+}
+
+// A Category is the itunes:category of a show, one of those listed at
+// https://podcasters.apple.com/support/1691-apple-podcasts-categories, and
+// optionally one of its subcategories.
+type Category struct {
+	Name string
+	Sub  string
+}
+
+// ParseCategory parses a category and subcategory separated by a slash, e.g.
+// "Technology" or "Society & Culture/Documentary". It returns nil for an empty
+// string.
+func ParseCategory(s string) *Category {
+	name, sub, _ := strings.Cut(s, "/")
+	name, sub = strings.TrimSpace(name), strings.TrimSpace(sub)
+	if name == "" {
+		return nil
+	}
+	return &Category{Name: name, Sub: sub}
+}
+
+// ShowType is the itunes:type of a show.
+type ShowType string
+
+const (
+	// Episodes are meant to be consumed in any order, newest first.
+	ShowEpisodic ShowType = "episodic"
+	// Episodes are meant to be consumed in order, oldest first, e.g.
+	// audiobooks and story-driven shows.
+	ShowSerial ShowType = "serial"
+)
+
+func ParseShowType(s string) (ShowType, bool) {
+	switch t := ShowType(s); t {
+	case ShowEpisodic, ShowSerial:
+		return t, true
+	}
+	return "", false
+}
+
+// SortKey is what items are sorted by in the feed, after those pinned or
+// with an explicit order, see sortItems.
+type SortKey string
+
+const (
+	SortDate  SortKey = "date"  // The publication date.
+	SortName  SortKey = "name"  // The path in the media library.
+	SortTrack SortKey = "track" // The track number of the tags, then the date.
+)
+
+func ParseSortKey(s string) (SortKey, bool) {
+	switch k := SortKey(s); k {
+	case SortDate, SortName, SortTrack:
+		return k, true
+	}
+	return "", false
 }
 
 type Item struct {
+	Guid      string
+	Episode   int // Number of the episode, 0 if it has none, see GuidStore.
+	Season    int // Number of the season, 0 if it has none, see seasonEpisode.
 	Title     string
+	Slug      string // Identifies the episode page, see EpisodesPath.
 	Path      string
-	ModTime   time.Time
+	Book      string    // Title of the audiobook, in audiobook mode.
+	ModTime   time.Time // Publication date, the file's unless tagged.
 	Link      string
 	Desc      string
+	Author    string // Optional.
 	Enclosure Enclosure
+	// Other renditions of the episode, see Alternate.
+	Alternates []Alternate
+
+	// SHA-256 of the media file, once computed by the Hasher.
+	Hash string
+
+	Pinned bool
+	Order  *int // Explicit position, overriding date-based sorting.
+	track  int  // From the tags, 0 if none, see SortTrack.
+	Draft  bool // Only available in the preview feed.
+
+	// Overrides the channel's explicit setting if set.
+	Explicit *bool
+	// Value-for-value recipients of this episode, replacing those of the
+	// channel.
+	Value *ValueBlock
+
+	SocialInteract []SocialInteract
+	CommentsUrl    string // Page with comments on the episode, optional.
+
+	// Replaces the channel's license if set.
+	License *License
+
+	// URL of the episode's image, optional: an image file next to it, its
+	// embedded cover art or the poster of a video.
+	Image string
+	// The image file if served by podserve, keyed by imagePath in Files.
+	imagePath string
+	imageFile FileInfo
+
+	// Loudness of the episode, optional.
+	ReplayGain *ReplayGain
+
+	// Transcripts of the episode, optional, see Transcript.
+	Transcripts []Transcript
+
+	// URL of the waveform of the episode, optional, see Waveform.
+	Peaks     string
+	peaksPath string
+	peaksFile FileInfo
+
+	// URL of the HLS playlist of a video, optional, see applyHls.
+	Hls    string
+	hlsDir string
+
+	// Read from the media file, if the Extractor could, see MediaInfo.
+	Duration float64 // In seconds, 0 if unknown.
+	Chapters []Chapter
+	// URL of the chapters as JSON, see ChaptersPath, empty if none.
+	ChaptersUrl string
+
+	fileTime time.Time // Modification time of the media file.
+	origin   string    // URL of the media file of a Manifest episode.
+	// When the episode was first published, as recorded in the GuidStore,
+	// the zero time without one.
+	added time.Time
+	// The file the enclosure was converted to, see Transcoder.Convert. The
+	// media file is then an alternate.
+	converted string
+	media     string // Name under MediaPath with -slugUrls, see mediaName.
+	// The identity of the item before migrate-guids, which it keeps for
+	// ActivityPub whether Guid is that or the new GUID, see
+	// GuidStore.LegacyUntil.
+	legacyGuid string
+}
+
+// IsVideo reports whether the episode is a video.
+func (it Item) IsVideo() bool {
+	return strings.HasPrefix(it.Enclosure.Type, "video/")
+}
+
+// IsDocument reports whether the episode is neither audio nor video, such as
+// a PDF, which is linked to rather than played.
+func (it Item) IsDocument() bool {
+	return !it.IsVideo() && !strings.HasPrefix(it.Enclosure.Type, "audio/")
 }
 
 type Enclosure struct {
@@ -80,102 +253,574 @@ type FileInfo struct {
 	MimeType string
 	Size     int64
 	ModTime  time.Time
+	Hash     string // SHA-256 of the content, optional.
+	// Path in the media library of a file served by its MediaSource, empty
+	// for files generated by podserve, which are served from Path. Path is
+	// where a remote library's file is cached, if it is.
+	Source string
+	// URL of a file hosted elsewhere, see Manifest. Path is then empty.
+	Url string
 }
 
-// I only use mp3/mp4 audio and have therefore only mapped those.
-//
 // Citing Apple [3], the following are supported, at least on iOS:
 //
 // "The type values for the supported file formats are: audio/x-m4a,
 // audio/mpeg, video/quicktime, video/mp4, video/x-m4v, and application/pdf."
+//
+// The other formats are for apps beyond Apple's. Opus is mostly useful for
+// low bitrate renditions, see Alternate. Ogg files are assumed to be audio.
+//
+// Video is only published from the extensions that are unambiguously video,
+// since I use .mp4 for audio.
+//
+// More types are added with -mimeTypes, see AddMimeTypes.
 var mimeType = map[string]string{
-	".mp3": "audio/mpeg",
-	".mp4": "audio/x-m4a",
-	".m4a": "audio/x-m4a",
+	".mp3":  "audio/mpeg",
+	".mp4":  "audio/x-m4a",
+	".m4a":  "audio/x-m4a",
+	".opus": "audio/opus",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".flac": "audio/flac",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".pdf":  "application/pdf",
 }
 
-func GenerateFeed(m Metadata) ([]byte, map[string]FileInfo, []Item, error) {
-	items, err := m.Items()
-	if err != nil {
-		return nil, nil, nil, err
+// AddMimeTypes adds the types of media files to publish, or overrides those
+// of known extensions, given as .ext=type.
+func AddMimeTypes(list []string) error {
+	for _, e := range list {
+		ext, typ, ok := strings.Cut(e, "=")
+		ext, typ = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(typ)
+		if !ok || len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext[1:], "./") {
+			return fmt.Errorf("invalid media type %q, expected .ext=type", e)
+		}
+		if _, _, err := mime.ParseMediaType(typ); err != nil || !strings.Contains(typ, "/") {
+			return fmt.Errorf("invalid media type %q of %s", typ, ext)
+		}
+		mimeType[ext] = typ
 	}
-	feedXml, err := m.Feed(items)
+	return nil
+}
+
+// A Snapshot is the state of the media directory at one scan.
+type Snapshot struct {
+	// The metadata of the channel the feed was generated with, with the
+	// edits of the admin API applied.
+	Channel Metadata
+
+	FeedXML []byte
+	Files   map[string]FileInfo // Path -> File of published items.
+	Items   []Item              // Published items, in feed order.
+	// Further pages of the feed, FeedXML being the first, see FeedPages.
+	FeedPages [][]byte
+
+	// ETag of FeedXML and FeedPages, and when they last changed, to answer
+	// conditional requests of apps polling the feed.
+	FeedETag    string
+	FeedModTime time.Time
+	// The feed as Atom and JSON Feed, see FeedAtomPath and FeedJSONPath.
+	FeedAtom []byte
+	FeedJSON []byte
+
+	// Drafts are left out of the public feed. They are included in the preview
+	// feed, and their files are served under PreviewPath.
+	PreviewXML []byte
+	DraftFiles map[string]FileInfo
+	Drafts     int // Number of draft items.
+
+	// SHA-256 of published media files, see ChecksumsPath, and signatures
+	// of the feed and checksums if signed.
+	Checksums    []byte
+	FeedSig      []byte
+	ChecksumsSig []byte
+
+	// Paths left out of the scan as they could not be read, see ScanPolicy.
+	Unreadable []string
+
+	// File name of the cover image of the show in its media directory, served
+	// next to its feed, empty if it uses the built-in one, see findCover.
+	Cover string
+
+	// Media maps names under MediaPath to paths in Files, see mediaName.
+	Media map[string]string
+	// HlsDirs maps names under HlsPath to directories of HLS segments.
+	HlsDirs map[string]string
+}
+
+func GenerateFeed(m Metadata) (*Snapshot, error) {
+	var cover string
+	if m.localCover {
+		var w, h int
+		if cover, w, h = findCover(m.localRoot); cover != "" {
+			m.CoverUrl, m.CoverWidth, m.CoverHeight = m.externalUrl+cover, w, h
+		}
+	}
+	if m.edits != nil {
+		m = m.edits.applyChannel(m)
+	}
+	all, unreadable, err := m.Items()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
-	files := make(map[string]FileInfo)
-	for _, it := range items {
-		files[it.Path] = FileInfo{
+	// The cached metadata of unreadable files is still good.
+	if m.meta != nil && len(unreadable) == 0 && !m.dryRun {
+		paths := make(map[string]bool, len(all))
+		for _, it := range all {
+			paths[it.Path] = true
+		}
+		m.meta.Prune(paths)
+		if err := m.meta.Save(); err != nil {
+			slog.Warn("could not save metadata cache", "error", err, "tag", TagRefresh)
+		}
+	}
+	if m.audiobooks {
+		sortAudiobooks(all)
+	} else {
+		ascending := m.ShowType == ShowSerial
+		if m.sortOrder != "" {
+			ascending = m.sortOrder == "asc"
+		}
+		sortItems(all, m.sortBy, ascending)
+	}
+	if m.guids != nil && m.dryRun {
+		if err := m.guids.Preview(all, m.source); err != nil {
+			return nil, err
+		}
+	} else if m.guids != nil {
+		if err := m.guids.Assign(all, m.source); err != nil {
+			return nil, err
+		}
+	}
+	if m.slugUrls {
+		for i := range all {
+			it := &all[i]
+			if it.media == "" || it.converted != "" {
+				continue
+			}
+			it.Enclosure.Url = m.externalUrl + MediaPath[1:] + escapePath(it.media)
+			for j, alt := range it.Alternates {
+				it.Alternates[j].Enclosure.Url = m.externalUrl + MediaPath[1:] + escapePath(alternateMediaName(*it, alt))
+			}
+		}
+	}
+	if m.audiobooks {
+		numberChapters(all)
+	}
+	if m.maxItems > 0 {
+		all = newestItems(all, m.maxItems)
+	}
+	var items []Item
+	snap := Snapshot{
+		Channel:    m,
+		Cover:      cover,
+		Files:      make(map[string]FileInfo),
+		DraftFiles: make(map[string]FileInfo),
+		Media:      make(map[string]string),
+		HlsDirs:    make(map[string]string),
+	}
+	for _, it := range all {
+		fi := FileInfo{
 			Path:     filepath.Join(m.localRoot, it.Path),
 			MimeType: it.Enclosure.Type,
 			Size:     it.Enclosure.Length,
-			ModTime:  it.ModTime,
+			ModTime:  it.fileTime,
+			Hash:     it.Hash,
+			Source:   it.Path,
+		}
+		if it.origin != "" {
+			fi = FileInfo{MimeType: fi.MimeType, Size: fi.Size, ModTime: fi.ModTime, Url: it.origin}
+		}
+		if it.Draft {
+			snap.Drafts++
+			snap.DraftFiles[it.Path] = fi
+			for _, alt := range it.Alternates {
+				snap.DraftFiles[alt.Path] = FileInfo{
+					Path:     alt.filePath(m.localRoot),
+					MimeType: alt.Enclosure.Type,
+					Size:     alt.Enclosure.Length,
+					ModTime:  it.fileTime,
+					Source:   alt.source(),
+				}
+			}
+			continue
+		}
+		snap.Files[it.Path] = fi
+		if it.imagePath != "" {
+			snap.Files[it.imagePath] = it.imageFile
+		}
+		if it.peaksPath != "" {
+			snap.Files[it.peaksPath] = it.peaksFile
 		}
+		for _, t := range it.Transcripts {
+			snap.Files[t.path] = t.file
+		}
+		if it.converted != "" {
+			snap.Files[RenditionsPath[1:]+filepath.Base(it.converted)] = FileInfo{
+				Path:     it.converted,
+				MimeType: it.Enclosure.Type,
+				Size:     it.Enclosure.Length,
+				ModTime:  it.fileTime,
+			}
+		}
+		if it.hlsDir != "" {
+			snap.HlsDirs[filepath.Base(it.hlsDir)] = it.hlsDir
+		}
+		if m.slugUrls && it.media != "" {
+			snap.Media[it.media] = it.Path
+		}
+		for _, alt := range it.Alternates {
+			snap.Files[alt.Path] = FileInfo{
+				Path:     alt.filePath(m.localRoot),
+				MimeType: alt.Enclosure.Type,
+				Size:     alt.Enclosure.Length,
+				ModTime:  it.fileTime,
+				Source:   alt.source(),
+			}
+			if m.slugUrls && it.media != "" {
+				snap.Media[alternateMediaName(it, alt)] = alt.Path
+			}
+		}
+		items = append(items, it)
+	}
+	pages, err := m.FeedPages(items)
+	if err != nil {
+		return nil, err
+	}
+	snap.FeedXML, snap.FeedPages = pages[0], pages[1:]
+	h := sha256.New()
+	for _, page := range pages {
+		h.Write(page)
+	}
+	snap.FeedETag = `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	snap.FeedModTime = time.Now()
+	if snap.FeedAtom, err = m.AtomFeed(items); err != nil {
+		return nil, err
+	}
+	if snap.FeedJSON, err = m.JSONFeed(items); err != nil {
+		return nil, err
 	}
-	slices.SortFunc(items, func(a, b Item) int {
-		if b.ModTime.Before(a.ModTime) {
-			return -1
+	if snap.PreviewXML, err = m.Feed(all); err != nil {
+		return nil, err
+	}
+	snap.Checksums = checksums(items)
+	if m.signingKey != nil {
+		snap.FeedSig = ed25519.Sign(m.signingKey, snap.FeedXML)
+		snap.ChecksumsSig = ed25519.Sign(m.signingKey, snap.Checksums)
+	}
+	snap.Items = items
+	snap.Unreadable = unreadable
+	return &snap, nil
+}
+
+// sortItems orders items for the feed and HTML page: pinned items first, then
+// items with an explicit order (lowest first), then the rest by key, in
+// ascending order if ascending, i.e. oldest first for SortDate.
+func sortItems(items []Item, key SortKey, ascending bool) {
+	slices.SortStableFunc(items, func(a, b Item) int {
+		if a.Pinned != b.Pinned {
+			if a.Pinned {
+				return -1
+			}
+			return 1
+		}
+		if (a.Order == nil) != (b.Order == nil) {
+			if a.Order != nil {
+				return -1
+			}
+			return 1
+		}
+		if a.Order != nil && *a.Order != *b.Order {
+			return cmp.Compare(*a.Order, *b.Order)
+		}
+		var c int
+		switch key {
+		case SortName:
+			c = strings.Compare(a.Path, b.Path)
+		case SortTrack:
+			// Items without a track number go last.
+			if (a.track == 0) != (b.track == 0) {
+				if a.track != 0 {
+					return -1
+				}
+				return 1
+			}
+			c = cmp.Compare(a.track, b.track)
 		}
-		return 1
+		if c == 0 {
+			c = a.ModTime.Compare(b.ModTime)
+		}
+		if !ascending {
+			c = -c
+		}
+		return c
 	})
-	return feedXml, files, items, nil
 }
 
-// Reads the local file system and returns a slice of available Items
-// with all the metadata required to serve them.
-func (m Metadata) Items() ([]Item, error) {
+// newestItems returns the n newest of the published items, those pinned and
+// drafts, in the order of items.
+func newestItems(items []Item, n int) []Item {
+	var dates []time.Time
+	for _, it := range items {
+		if !it.Pinned && !it.Draft {
+			dates = append(dates, it.ModTime)
+		}
+	}
+	if len(dates) <= n {
+		return items
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int { return b.Compare(a) })
+	// Of the items published at the same time as the oldest one kept, the
+	// first ones are.
+	oldest, ties := dates[n-1], 0
+	for _, d := range dates[:n] {
+		if d.Equal(oldest) {
+			ties++
+		}
+	}
+	var kept []Item
+	for _, it := range items {
+		switch {
+		case it.Pinned || it.Draft || it.ModTime.After(oldest):
+			kept = append(kept, it)
+		case it.ModTime.Equal(oldest) && ties > 0:
+			kept = append(kept, it)
+			ties--
+		}
+	}
+	return kept
+}
+
+// Reads the media library and returns a slice of available Items
+// with all the metadata required to serve them, and the paths of the files
+// and directories that could not be read, which are left out.
+func (m Metadata) Items() ([]Item, []string, error) {
 	if m.externalUrl[len(m.externalUrl)-1] != '/' {
 		panic("Meta.Items: expected externalUrl to end in '/'")
 	}
 	var pp []Item
-	fsys := os.DirFS(m.localRoot)
-	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+	var unreadable []string
+	// Image files by their path without extension, see ArtworkPath.
+	images := make(map[string]FileInfo)
+	// Chapters files by the path without extension of their media file.
+	chapterFiles := make(map[string]string)
+	// Transcript files by their path without extension.
+	transcripts := make(map[string][]Transcript)
+	fsys := m.source
+	ignore, err := readIgnore(fsys, m.exclude)
+	if err != nil {
+		slog.Warn("could not read ignore file", "error", err, "file", IgnoreFile, "tag", TagRefresh)
+	}
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			if path == "." {
+				return err
+			}
+			slog.Warn("skipping unreadable path", "error", err, "file", path, "tag", TagRefresh)
+			unreadable = append(unreadable, path)
+			return nil
+		}
+		if path != "." && ignore.Ignored(path, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
 		}
 		if d.IsDir() {
+			if path == TrashDir || path == ReplicaPartDir {
+				return fs.SkipDir
+			}
+			if path == ManifestDir && m.manifest != nil {
+				slog.Warn("skipping directory reserved for the manifest", "file", path, "tag", TagRefresh)
+				return fs.SkipDir
+			}
 			return nil
 		}
 		name := d.Name()
 		ext := filepath.Ext(name)
 
 		if mime, ok := mimeType[ext]; ok {
-			info, err := os.Stat(filepath.Join(m.localRoot, path))
+			info, err := fsys.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted since listed.
+				return nil
+			}
 			if err != nil {
-				return err
+				slog.Warn("skipping unreadable file", "error", err, "file", path, "tag", TagRefresh)
+				unreadable = append(unreadable, path)
+				return nil
 			}
-			title := name[:len(name)-len(ext)]
-			url, err := url.Parse(m.externalUrl + url.PathEscape(path))
+			season, episode, title := seasonEpisode(path, name[:len(name)-len(ext)])
+			sc, err := readSidecar(fsys, path)
+			if err != nil {
+				slog.Warn("ignoring invalid sidecar", "error", err, "file", path, "tag", TagRefresh)
+			}
+			draft := sc.Draft || isDraftPath(path)
+			prefix := m.externalUrl
+			if draft {
+				prefix += PreviewPath[1:]
+			}
+			url, err := url.Parse(prefix + escapePath(path))
 			if err != nil {
 				return err
 			}
 			pp = append(pp, Item{
 				Title:   title,
+				Season:  season,
+				Episode: episode,
 				Path:    path,
 				ModTime: info.ModTime(),
 				Link:    url.String(),
-				Desc:    "",
+
+				fileTime: info.ModTime(),
+				Slug:     sc.Slug,
+				Desc:     sc.Notes,
 				Enclosure: Enclosure{
 					Url:    url.String(),
 					Length: info.Size(),
 					Type:   mime,
 				},
+				Pinned: sc.Pinned,
+				Order:  sc.Order,
+				Draft:  draft,
+
+				Explicit: sc.Explicit,
+				Value:    sc.Value,
+
+				SocialInteract: sc.SocialInteract,
+				CommentsUrl:    sc.CommentsUrl,
+				License:        sc.license,
 			})
+		} else if strings.HasSuffix(name, chaptersExt) {
+			chapterFiles[strings.TrimSuffix(path, chaptersExt)] = path
+		} else if typ, ok := transcriptTypes[strings.ToLower(ext)]; ok {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			key := strings.TrimSuffix(path, ext)
+			transcripts[key] = append(transcripts[key], Transcript{
+				Url:  m.externalUrl + escapePath(path),
+				Type: typ,
+				path: path,
+				file: FileInfo{
+					Path:     filepath.Join(m.localRoot, path),
+					MimeType: typ,
+					Size:     info.Size(),
+					ModTime:  info.ModTime(),
+					Source:   path,
+				},
+			})
+		} else if typ, ok := artworkTypes[strings.ToLower(ext)]; ok {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			images[strings.TrimSuffix(path, ext)] = FileInfo{
+				Path:     filepath.Join(m.localRoot, path),
+				MimeType: typ,
+				Size:     info.Size(),
+				ModTime:  info.ModTime(),
+				Source:   path,
+			}
 		}
 		return nil
 	})
-	return pp, err
+	if err != nil {
+		return nil, nil, err
+	}
+	pp = groupAlternates(pp)
+	for i := range pp {
+		if pp[i].Draft {
+			continue
+		}
+		key := strings.TrimSuffix(pp[i].Path, path.Ext(pp[i].Path))
+		pp[i].Transcripts = transcripts[key]
+		img, ok := images[key]
+		if !ok {
+			continue
+		}
+		pp[i].Image = m.externalUrl + escapePath(img.Source)
+		pp[i].imagePath = img.Source
+		pp[i].imageFile = img
+	}
+	if m.audiobooks {
+		for i := range pp {
+			pp[i].Book = bookOf(pp[i].Path)
+		}
+	}
+	if order, err := readPlaylist(fsys); err != nil {
+		slog.Warn("ignoring invalid playlist", "error", err, "tag", TagRefresh)
+	} else if order != nil {
+		applyPlaylist(pp, order)
+	}
+	if m.extractor != nil {
+		for i := range pp {
+			if mi, ok := m.extractor.Extract(m.localRoot, pp[i].Path); ok {
+				applyMediaInfo(&pp[i], mi)
+				if mi.Artwork != "" && pp[i].Image == "" && !pp[i].Draft {
+					pp[i].Image = m.externalUrl + ArtworkPath[1:] + escapePath(pp[i].Path)
+				}
+			}
+		}
+	}
+	applyChapterFiles(fsys, pp, chapterFiles)
+	if m.transcoder != nil {
+		keep := make(map[string]bool)
+		pp = m.transcoder.Convert(m, pp, keep)
+		m.transcoder.Apply(m, pp, keep)
+	}
+	if m.hasher != nil {
+		m.hasher.Apply(m, pp)
+	}
+	if m.manifest != nil {
+		hosted, unreachable, err := m.manifest.Items(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		pp = append(pp, hosted...)
+		unreadable = append(unreadable, unreachable...)
+	}
+	if m.edits != nil {
+		pp = m.edits.applyEpisodes(pp)
+	}
+	// Published episodes link to their page, drafts have none and link to
+	// their media file.
+	assignSlugs(pp)
+	for i := range pp {
+		if pp[i].Draft {
+			continue
+		}
+		pp[i].Link = m.externalUrl + EpisodesPath[1:] + pp[i].Slug
+		if len(pp[i].Chapters) > 0 {
+			pp[i].ChaptersUrl = m.externalUrl + ChaptersPath[1:] + escapePath(pp[i].Path)
+		}
+	}
+	return pp, unreadable, nil
+}
+
+// isDraftPath reports whether p is within a drafts directory.
+func isDraftPath(p string) bool {
+	return slices.Contains(strings.Split(path.Dir(p), "/"), DraftsDir)
+}
+
+// The RSS <image> is at most this large.
+const rssImageMaxWidth, rssImageMaxHeight = 144, 400
+
+// rssImageSize fits an image of w×h pixels within the maximum size of the RSS
+// <image>, keeping its aspect ratio.
+func rssImageSize(w, h int) (int, int) {
+	scale := min(1, float64(rssImageMaxWidth)/float64(w), float64(rssImageMaxHeight)/float64(h))
+	return max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
 }
 
-func (m Metadata) Feed(items []Item) ([]byte, error) {
-	ff := template.FuncMap{
-		"timeRFC2822": func(t *time.Time) string {
-			return t.Format(TimeRFC2822)
-		},
+// FundingText is the text of links to the support page.
+func (m Metadata) FundingText() string {
+	if m.SupportText != "" {
+		return m.SupportText
 	}
-	tmpl := template.Must(template.New("rss").Funcs(ff).Parse(RSSTemplate))
-	var buf bytes.Buffer
-	buf.Write([]byte(XMLHeader))
-	err := tmpl.Execute(&buf, TemplateData{m, items})
-	return buf.Bytes(), err
+	return m.locale.T("support")
 }
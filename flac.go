@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FLAC files start with metadata blocks, of which STREAMINFO gives the exact
+// number of samples and the MD5 of the decoded audio, VORBIS_COMMENT the tags,
+// without framing or magic unlike in Ogg, and PICTURE the cover art.
+//
+// See https://xiph.org/flac/format.html
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+	// Pictures larger than this are skipped.
+	flacMaxPicture = 16 << 20
+)
+
+// parseFlac reads the duration, audio MD5, tags and cover art of a FLAC file.
+func parseFlac(path string) (MediaInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer fp.Close()
+	r := bufio.NewReader(fp)
+
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || string(magic[:]) != "fLaC" {
+		return MediaInfo{}, errUnsupportedFormat
+	}
+	var (
+		mi         MediaInfo
+		streamInfo bool
+		front      bool
+	)
+	for last := false; !last; {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return MediaInfo{}, fmt.Errorf("flac: %w", err)
+		}
+		last = h[0]&0x80 != 0
+		kind := h[0] & 0x7f
+		n := int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		switch {
+		case kind == flacPicture && n <= flacMaxPicture && !front:
+			b, err := readBlock(r, int64(n))
+			if err != nil {
+				return MediaInfo{}, fmt.Errorf("flac: %w", err)
+			}
+			if typ, data, ok := parseFlacPicture(b); ok && (mi.artwork == nil || typ == pictureFrontCover) {
+				mi.setArtwork(data)
+				front = typ == pictureFrontCover
+			}
+		case kind == flacStreamInfo || kind == flacVorbisComment:
+			b, err := readBlock(r, int64(n))
+			if err != nil {
+				return MediaInfo{}, fmt.Errorf("flac: %w", err)
+			}
+			if kind == flacVorbisComment {
+				var picture []byte
+				if mi.Tags, picture, err = parseVorbisComments(b); err != nil {
+					return MediaInfo{}, err
+				}
+				if picture != nil && mi.artwork == nil {
+					mi.setArtwork(picture)
+				}
+				continue
+			}
+			if len(b) < 34 {
+				return MediaInfo{}, errors.New("flac: short STREAMINFO")
+			}
+			// 20 bits of sample rate, 3 of channels, 5 of bits per sample and
+			// 36 of total samples.
+			v := binary.BigEndian.Uint64(b[10:])
+			rate := v >> 44
+			samples := v & (1<<36 - 1)
+			if rate > 0 {
+				mi.Duration = float64(samples) / float64(rate)
+			}
+			mi.audioBits = int(v>>36&0x1f) + 1
+			if sum := [16]byte(b[18:34]); sum != [16]byte{} {
+				mi.AudioMD5 = hex.EncodeToString(sum[:])
+			}
+			streamInfo = true
+		default:
+			if _, err := r.Discard(n); err != nil {
+				return MediaInfo{}, fmt.Errorf("flac: %w", err)
+			}
+		}
+	}
+	if !streamInfo {
+		return MediaInfo{}, errors.New("flac: missing STREAMINFO")
+	}
+	return mi, nil
+}
+
+// parseFlacPicture returns the picture type and image data of a PICTURE
+// block, which Vorbis comments carry too, base64 encoded.
+func parseFlacPicture(b []byte) (uint32, []byte, bool) {
+	field := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if len(b) < 4 {
+		return 0, nil, false
+	}
+	typ := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if _, ok := field(); !ok { // MIME type.
+		return 0, nil, false
+	}
+	if _, ok := field(); !ok { // Description.
+		return 0, nil, false
+	}
+	if len(b) < 16 { // Width, height, color depth and number of colors.
+		return 0, nil, false
+	}
+	b = b[16:]
+	data, ok := field()
+	if !ok || len(data) == 0 {
+		return 0, nil, false
+	}
+	return typ, data, true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"testing"
+)
+
+// flacBlock returns a metadata block of the given type.
+func flacBlock(kind byte, last bool, body []byte) []byte {
+	if last {
+		kind |= 0x80
+	}
+	n := len(body)
+	return concat([]byte{kind, byte(n >> 16), byte(n >> 8), byte(n)}, body)
+}
+
+// flacStreamInfoBlock returns a STREAMINFO block body of stereo audio.
+func flacStreamInfoBlock(rate, bits int, samples int64, md5 string) []byte {
+	b := make([]byte, 10, 34) // Block and frame sizes.
+	v := uint64(rate)<<44 | 1<<41 | uint64(bits-1)<<36 | uint64(samples)
+	b = binary.BigEndian.AppendUint64(b, v)
+	sum := make([]byte, 16)
+	copy(sum, md5)
+	return append(b, sum...)
+}
+
+// flacPictureBlock returns a PICTURE block body.
+func flacPictureBlock(typ uint32, mime string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(mime)))
+	b = append(b, mime...)
+	b = binary.BigEndian.AppendUint32(b, 0) // Description.
+	b = append(b, make([]byte, 16)...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func TestParseFlac(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	md5 := "\x01\x23\x45\x67\x89\xab\xcd\xef\xfe\xdc\xba\x98\x76\x54\x32\x10"
+	streamInfo := flacBlock(flacStreamInfo, false, flacStreamInfoBlock(44100, 16, 90*44100, md5))
+	comments := flacBlock(flacVorbisComment, false, vorbisComments("podserve", "TITLE=Episode 1", "Artist=Someone"))
+	tests := []struct {
+		name     string
+		data     []byte
+		duration float64
+		tags     map[string]string
+		md5      string
+		bits     int
+		artwork  string
+		err      error // Nil for any error if wantErr.
+		wantErr  bool
+	}{
+		{
+			name: "tags and front cover",
+			data: concat(
+				[]byte("fLaC"), streamInfo, comments,
+				flacBlock(1, false, make([]byte, 100)), // Padding.
+				flacBlock(flacPicture, false, flacPictureBlock(0, "image/gif", gif)),
+				flacBlock(flacPicture, true, flacPictureBlock(pictureFrontCover, "image/png", png)),
+			),
+			duration: 90,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+			md5:      "0123456789abcdeffedcba9876543210",
+			bits:     16,
+			artwork:  "image/png",
+		},
+		{
+			name: "picture in comments",
+			data: concat(
+				[]byte("fLaC"),
+				flacBlock(flacStreamInfo, false, flacStreamInfoBlock(48000, 24, 24000, "")),
+				flacBlock(flacVorbisComment, true, vorbisComments(
+					"podserve",
+					"METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(flacPictureBlock(pictureFrontCover, "image/gif", gif)),
+				)),
+			),
+			duration: 0.5,
+			tags:     map[string]string{},
+			bits:     24,
+			artwork:  "image/gif",
+		},
+		{
+			name:     "unknown rate",
+			data:     concat([]byte("fLaC"), flacBlock(flacStreamInfo, true, flacStreamInfoBlock(0, 16, 0, md5))),
+			md5:      "0123456789abcdeffedcba9876543210",
+			bits:     16,
+			duration: 0,
+		},
+		{name: "not flac", data: []byte("OggS\x00\x02"), err: errUnsupportedFormat, wantErr: true},
+		{name: "empty", data: nil, err: errUnsupportedFormat, wantErr: true},
+		{
+			name:    "short STREAMINFO",
+			data:    concat([]byte("fLaC"), flacBlock(flacStreamInfo, true, make([]byte, 20))),
+			wantErr: true,
+		},
+		{
+			name:    "missing STREAMINFO",
+			data:    concat([]byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComments("podserve"))),
+			wantErr: true,
+		},
+		{name: "no last block", data: concat([]byte("fLaC"), streamInfo, comments), wantErr: true},
+		{name: "truncated block", data: concat([]byte("fLaC"), streamInfo[:20]), wantErr: true},
+		{
+			name:    "oversized comments",
+			data:    concat([]byte("fLaC"), streamInfo, []byte{flacVorbisComment | 0x80, 0xff, 0xff, 0xff}, comments[4:]),
+			wantErr: true,
+		},
+		{
+			name:    "oversized picture",
+			data:    concat([]byte("fLaC"), streamInfo, []byte{flacPicture | 0x80, 0xff, 0xff, 0xf0}, png),
+			wantErr: true,
+		},
+		{
+			name: "oversized comment count",
+			data: concat(
+				[]byte("fLaC"), streamInfo,
+				flacBlock(flacVorbisComment, true, []byte("\x08\x00\x00\x00podserve\xff\xff\xff\xff")),
+			),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeMedia(t, "episode.flac", tt.data)
+			var mi MediaInfo
+			var err error
+			if n := allocated(func() { mi, err = parseFlac(p) }); n > 1<<20 {
+				t.Errorf("parseFlac allocated %d bytes", n)
+			}
+			if tt.wantErr {
+				if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseFlac = %+v, %v, want error %v", mi, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFlac: %v", err)
+			}
+			if mi.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", mi.Duration, tt.duration)
+			}
+			if !maps.Equal(mi.Tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", mi.Tags, tt.tags)
+			}
+			if mi.AudioMD5 != tt.md5 || mi.audioBits != tt.bits {
+				t.Errorf("audio MD5 = %q of %d bits, want %q of %d bits", mi.AudioMD5, mi.audioBits, tt.md5, tt.bits)
+			}
+			if mi.Artwork != tt.artwork {
+				t.Errorf("artwork = %q, want %q", mi.Artwork, tt.artwork)
+			}
+		})
+	}
+}
+
+func TestParseFlacTruncated(t *testing.T) {
+	data := concat(
+		[]byte("fLaC"),
+		flacBlock(flacStreamInfo, false, flacStreamInfoBlock(44100, 16, 44100, "")),
+		flacBlock(flacVorbisComment, false, vorbisComments("podserve", "TITLE=Episode 1")),
+		flacBlock(flacPicture, true, flacPictureBlock(pictureFrontCover, "image/png", []byte("\x89PNG\r\n\x1a\n"))),
+	)
+	parseTruncated(t, "episode.flac", data, parseFlac)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"time"
+)
+
+const (
+	// FeedAtomPath and FeedJSONPath serve the feed as Atom and JSON Feed, for
+	// feed readers rather than podcast apps.
+	FeedAtomPath = "/feed.atom"
+	FeedJSONPath = "/feed.json"
+)
+
+// The Atom feed, see RFC 4287.
+type atomFeed struct {
+	XMLName  xml.Name      `xml:"http://www.w3.org/2005/Atom feed"`
+	Lang     string        `xml:"xml:lang,attr,omitempty"`
+	Id       string        `xml:"id"`
+	Title    string        `xml:"title"`
+	Subtitle string        `xml:"subtitle,omitempty"`
+	Updated  string        `xml:"updated"`
+	Links    []atomLink    `xml:"link"`
+	Author   atomPerson    `xml:"author"`
+	Category *atomCategory `xml:"category"`
+	Logo     string        `xml:"logo,omitempty"`
+	Rights   string        `xml:"rights,omitempty"`
+	Entries  []atomEntry   `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Title  string `xml:"title,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Links     []atomLink  `xml:"link"`
+	Author    *atomPerson `xml:"author"`
+	Summary   string      `xml:"summary,omitempty"`
+}
+
+// AtomFeed returns the Atom feed of items.
+func (m Metadata) AtomFeed(items []Item) ([]byte, error) {
+	f := atomFeed{
+		Lang:     m.Language,
+		Id:       m.externalUrl + FeedAtomPath[1:],
+		Title:    m.Title,
+		Subtitle: m.Desc,
+		Updated:  feedUpdated(items).Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: m.externalUrl + FeedAtomPath[1:]},
+			{Rel: "alternate", Type: "text/html", Href: m.externalUrl + FeedHtmlPath[1:]},
+			{Rel: "alternate", Type: "application/rss+xml", Href: m.externalUrl + FeedPath[1:]},
+		},
+		// Required unless every entry has an author.
+		Author: atomPerson{Name: m.Author},
+		Logo:   m.CoverUrl,
+		Rights: m.Copyright,
+	}
+	if f.Author.Name == "" {
+		f.Author.Name = m.Title
+	}
+	if m.Category != nil {
+		f.Category = &atomCategory{Term: m.Category.Name}
+	}
+	for _, it := range items {
+		e := atomEntry{
+			Id:        itemId(it),
+			Title:     it.Title,
+			Updated:   it.ModTime.Format(time.RFC3339),
+			Published: it.ModTime.Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: it.Link},
+				{Rel: "enclosure", Type: it.Enclosure.Type, Href: it.Enclosure.Url, Length: it.Enclosure.Length},
+			},
+			Summary: it.Desc,
+		}
+		for _, alt := range it.Alternates {
+			e.Links = append(e.Links, atomLink{
+				Rel:    "enclosure",
+				Type:   alt.Enclosure.Type,
+				Href:   alt.Enclosure.Url,
+				Title:  alt.Title,
+				Length: alt.Enclosure.Length,
+			})
+		}
+		if it.Author != "" {
+			e.Author = &atomPerson{Name: it.Author}
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", " ")
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// The JSON Feed, see https://www.jsonfeed.org/version/1.1/.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url,omitempty"`
+	FeedUrl     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Icon        string         `json:"icon,omitempty"`
+	Authors     []jsonAuthor   `json:"authors,omitempty"`
+	Language    string         `json:"language,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	Id            string           `json:"id"`
+	Url           string           `json:"url,omitempty"`
+	Title         string           `json:"title"`
+	ContentText   string           `json:"content_text"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published"`
+	Authors       []jsonAuthor     `json:"authors,omitempty"`
+	Attachments   []jsonAttachment `json:"attachments"`
+}
+
+type jsonAttachment struct {
+	Url               string  `json:"url"`
+	MimeType          string  `json:"mime_type"`
+	Title             string  `json:"title,omitempty"`
+	SizeInBytes       int64   `json:"size_in_bytes,omitempty"`
+	DurationInSeconds float64 `json:"duration_in_seconds,omitempty"`
+}
+
+// JSONFeed returns the JSON Feed of items.
+func (m Metadata) JSONFeed(items []Item) ([]byte, error) {
+	f := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       m.Title,
+		HomePageUrl: m.externalUrl + FeedHtmlPath[1:],
+		FeedUrl:     m.externalUrl + FeedJSONPath[1:],
+		Description: m.Desc,
+		Icon:        m.CoverUrl,
+		Language:    m.Language,
+		Items:       []jsonFeedItem{},
+	}
+	if m.Author != "" {
+		f.Authors = []jsonAuthor{{Name: m.Author}}
+	}
+	for _, it := range items {
+		ji := jsonFeedItem{
+			Id:            itemId(it),
+			Url:           it.Link,
+			Title:         it.Title,
+			ContentText:   it.Desc,
+			Image:         it.Image,
+			DatePublished: it.ModTime.Format(time.RFC3339),
+			Attachments: []jsonAttachment{{
+				Url:               it.Enclosure.Url,
+				MimeType:          it.Enclosure.Type,
+				SizeInBytes:       it.Enclosure.Length,
+				DurationInSeconds: it.Duration,
+			}},
+		}
+		for _, alt := range it.Alternates {
+			ji.Attachments = append(ji.Attachments, jsonAttachment{
+				Url:               alt.Enclosure.Url,
+				MimeType:          alt.Enclosure.Type,
+				Title:             alt.Title,
+				SizeInBytes:       alt.Enclosure.Length,
+				DurationInSeconds: it.Duration,
+			})
+		}
+		if it.Author != "" {
+			ji.Authors = []jsonAuthor{{Name: it.Author}}
+		}
+		f.Items = append(f.Items, ji)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// URLs are easier to read, and to add the token of private feeds to,
+	// with & left as is.
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// itemId identifies an item in the feed: its GUID, or else its enclosure URL
+// as podcast apps do.
+func itemId(it Item) string {
+	if it.Guid != "" {
+		return it.Guid
+	}
+	return it.Enclosure.Url
+}
+
+// feedUpdated returns when the newest of items was published, or the zero
+// time if there are none.
+func feedUpdated(items []Item) time.Time {
+	var t time.Time
+	for _, it := range items {
+		if it.ModTime.After(t) {
+			t = it.ModTime
+		}
+	}
+	return t
+}
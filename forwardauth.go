@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ForwardAuth trusts the user name set in a request header by an
+// authenticating reverse proxy (Authelia, authentik, Traefik forward-auth,
+// ...), as long as the request comes directly from one of the trusted proxies.
+type ForwardAuth struct {
+	TrustedProxies []netip.Prefix
+	// Headers carrying the user name, the first one present is used.
+	UserHeaders []string
+	// Header with a comma separated list of groups of the user.
+	GroupsHeader string
+	// Users and groups mapped to the admin role, everyone else is a listener.
+	AdminUsers  []string
+	AdminGroups []string
+}
+
+// ParsePrefixes parses a list of CIDR prefixes or single IP addresses.
+func ParsePrefixes(ss []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", s, err)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %w", s, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// remoteAddr returns the address of the immediate peer of r.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func (f *ForwardAuth) trusted(r *http.Request) bool {
+	addr, ok := remoteAddr(r)
+	if !ok {
+		return false
+	}
+	for _, p := range f.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate returns the principal named by the forward-auth headers of r.
+func (f *ForwardAuth) Authenticate(r *http.Request) (Principal, bool) {
+	if !f.trusted(r) {
+		return Principal{}, false
+	}
+	var user string
+	for _, h := range f.UserHeaders {
+		if user = strings.TrimSpace(r.Header.Get(h)); user != "" {
+			break
+		}
+	}
+	if user == "" {
+		return Principal{}, false
+	}
+	p := Principal{Name: user, Role: RoleListener}
+	if slices.Contains(f.AdminUsers, user) {
+		p.Role = RoleAdmin
+	} else if f.GroupsHeader != "" {
+		for _, g := range splitList(r.Header.Get(f.GroupsHeader)) {
+			if slices.Contains(f.AdminGroups, g) {
+				p.Role = RoleAdmin
+				break
+			}
+		}
+	}
+	return p, true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A GuidRecord is the persisted identity of an episode.
+type GuidRecord struct {
+	Guid    string    `json:"guid"`
+	Created time.Time `json:"created"`
+	// Legacy is set for GUIDs carried over from the enclosure URL by
+	// migrate-guids of older releases, which kept it as the GUID for good.
+	Legacy bool `json:"legacy,omitempty"`
+	// LegacyGuid is the identity apps knew the episode by before GUIDs were
+	// enabled, its enclosure URL, as recorded by migrate-guids. It is
+	// published instead of Guid until GuidStore.LegacyUntil.
+	LegacyGuid string `json:"legacy_guid,omitempty"`
+	// Episode is the number of the episode, given when it is first
+	// published if numbering is enabled, 0 if it has none.
+	Episode int `json:"episode,omitempty"`
+	// Size and Fingerprint identify the content of the file, so that the
+	// GUID follows it when the file is renamed or moved, see fingerprint.
+	Size        int64  `json:"size,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Media is the name the episode is published under with -slugUrls,
+	// given when it is first published, see GuidStore.MediaNames.
+	Media string `json:"media,omitempty"`
+}
+
+// fingerprintSize is how much of the start of a file is hashed to identify
+// its content.
+const fingerprintSize = 64 << 10
+
+// GuidStore persists the GUIDs of episodes in a JSON file, keyed by path
+// relative to the media directory. Episodes are given a GUID the first time
+// they are seen and keep it from then on, even if their file is renamed or
+// moved.
+type GuidStore struct {
+	path string
+	// Numbered gives published episodes increasing numbers, in order of
+	// publication. Numbers are never reused, even if episodes are removed.
+	Numbered bool
+	// MediaNames gives published episodes a name under MediaPath, see
+	// mediaName. Like GUIDs, names are kept from then on, even if episodes
+	// are retitled, retagged or moved.
+	MediaNames bool
+	// LegacyUntil is when episodes with a LegacyGuid switch to their new
+	// GUID, the zero time for never.
+	LegacyUntil time.Time
+
+	mu      sync.Mutex // Guards records
+	records map[string]GuidRecord
+}
+
+func NewGuidStore(path string) (*GuidStore, error) {
+	gs := &GuidStore{path: path, records: make(map[string]GuidRecord)}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return gs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &gs.records); err != nil {
+		return nil, fmt.Errorf("parse guid file %s: %w", path, err)
+	}
+	return gs, nil
+}
+
+func (gs *GuidStore) save() error {
+	buf, err := json.MarshalIndent(gs.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(gs.path, append(buf, '\n'), 0o644)
+}
+
+func newGuid() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // Version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant 10
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// Records returns a copy of the GUIDs of all episodes, by path.
+func (gs *GuidStore) Records() map[string]GuidRecord {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return maps.Clone(gs.records)
+}
+
+// Replace replaces the GUIDs of all episodes with records, as synced from a
+// primary, and reports whether any changed.
+func (gs *GuidStore) Replace(records map[string]GuidRecord) (bool, error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	same := maps.EqualFunc(gs.records, records, func(a, b GuidRecord) bool {
+		return a.Guid == b.Guid && a.Created.Equal(b.Created) && a.Legacy == b.Legacy && a.LegacyGuid == b.LegacyGuid && a.Episode == b.Episode &&
+			a.Size == b.Size && a.Fingerprint == b.Fingerprint && a.Media == b.Media
+	})
+	if same {
+		return false, nil
+	}
+	gs.records = maps.Clone(records)
+	return true, gs.save()
+}
+
+// Assign sets the GUID of every item, creating and persisting GUIDs for new
+// items. The files of the items are read from fsys to fingerprint them: a new
+// item whose file has the content of one that is gone takes over its GUID.
+func (gs *GuidStore) Assign(items []Item, fsys fs.FS) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	changed, err := gs.assign(items, fsys)
+	if err != nil || !changed {
+		return err
+	}
+	return gs.save()
+}
+
+// Preview sets the GUID of every item as Assign would, without keeping or
+// persisting the GUIDs and numbers given to new items.
+func (gs *GuidStore) Preview(items []Item, fsys fs.FS) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	records := gs.records
+	gs.records = maps.Clone(records)
+	defer func() { gs.records = records }()
+	_, err := gs.assign(items, fsys)
+	return err
+}
+
+// assign implements Assign, and reports whether the records changed. The
+// caller holds gs.mu.
+func (gs *GuidStore) assign(items []Item, fsys fs.FS) (bool, error) {
+	changed := false
+	now := time.Now().UTC()
+	present := make(map[string]bool, len(items))
+	for _, it := range items {
+		present[it.Path] = true
+	}
+	for i := range items {
+		it := &items[i]
+		rec, ok := gs.records[it.Path]
+		if !ok || rec.Fingerprint == "" || rec.Size != it.Enclosure.Length {
+			fp, err := fingerprint(fsys, it.Path)
+			if err != nil {
+				slog.Warn("could not fingerprint file, its GUID will not follow renames", "error", err, "file", it.Path, "tag", TagRefresh)
+			}
+			if !ok && fp != "" {
+				if old := gs.moved(present, it.Enclosure.Length, fp); old != "" {
+					slog.Info("file renamed, keeping its GUID", "from", old, "to", it.Path, "tag", TagRefresh)
+					rec, ok = gs.records[old], true
+					delete(gs.records, old)
+					gs.records[it.Path] = rec
+					changed = true
+				}
+			}
+			if !ok {
+				guid, err := newGuid()
+				if err != nil {
+					return false, err
+				}
+				rec = GuidRecord{Guid: guid, Created: now}
+			}
+			updated := rec
+			updated.Size, updated.Fingerprint = it.Enclosure.Length, fp
+			if !ok || updated != rec {
+				gs.records[it.Path] = updated
+				changed = true
+			}
+		}
+		it.Guid, it.legacyGuid = gs.published(rec, now), rec.LegacyGuid
+		it.added = rec.Created
+		// Numbers given by the layout of the media directory come first.
+		if it.Episode == 0 {
+			it.Episode = rec.Episode
+		}
+	}
+	if gs.Numbered && gs.number(items) {
+		changed = true
+	}
+	if gs.MediaNames && gs.name(items) {
+		changed = true
+	}
+	return changed, nil
+}
+
+// published returns the GUID rec is published with: its LegacyGuid until
+// LegacyUntil, so that apps keep identifying episodes as before while they
+// pick up the new GUIDs, and its Guid from then on.
+func (gs *GuidStore) published(rec GuidRecord, now time.Time) string {
+	if rec.LegacyGuid != "" && (gs.LegacyUntil.IsZero() || now.Before(gs.LegacyUntil)) {
+		return rec.LegacyGuid
+	}
+	return rec.Guid
+}
+
+// moved returns the path of a file gone from present whose content had the
+// given size and fingerprint, or an empty path if there is none.
+func (gs *GuidStore) moved(present map[string]bool, size int64, fp string) string {
+	var found string
+	for p, rec := range gs.records {
+		if present[p] || rec.Size != size || rec.Fingerprint != fp {
+			continue
+		}
+		// The same content could have been published more than once, pick
+		// one deterministically.
+		if found == "" || p < found {
+			found = p
+		}
+	}
+	return found
+}
+
+// fingerprint identifies the content of the file p of fsys, with the SHA-256
+// of its first fingerprintSize bytes. Together with the size, that tells
+// episodes apart without reading whole files, which matters for remote
+// libraries.
+func fingerprint(fsys fs.FS, p string) (string, error) {
+	fp, err := fsys.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, fp, fingerprintSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// number gives numbers to published items without one, following the
+// highest number given so far or by the layout of the media directory, and
+// reports whether any was given.
+func (gs *GuidStore) number(items []Item) bool {
+	last := 0
+	for _, rec := range gs.records {
+		last = max(last, rec.Episode)
+	}
+	for _, it := range items {
+		last = max(last, it.Episode)
+	}
+	var fresh []*Item
+	for i := range items {
+		if !items[i].Draft && items[i].Episode == 0 {
+			fresh = append(fresh, &items[i])
+		}
+	}
+	slices.SortStableFunc(fresh, func(a, b *Item) int {
+		if c := a.ModTime.Compare(b.ModTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	for _, it := range fresh {
+		last++
+		rec := gs.records[it.Path]
+		rec.Episode = last
+		gs.records[it.Path] = rec
+		it.Episode = last
+	}
+	return len(fresh) > 0
+}
+
+// name gives names under MediaPath to published items without one, unique
+// among all names given so far, and reports whether any was given.
+func (gs *GuidStore) name(items []Item) bool {
+	used := make(map[string]bool, len(gs.records))
+	for _, rec := range gs.records {
+		used[rec.Media] = true
+	}
+	named := false
+	for i := range items {
+		it := &items[i]
+		if it.Draft {
+			continue
+		}
+		rec := gs.records[it.Path]
+		if rec.Media == "" {
+			name := mediaName(*it)
+			ext := path.Ext(name)
+			for n := 2; used[name]; n++ {
+				name = strings.TrimSuffix(mediaName(*it), ext) + "-" + strconv.Itoa(n) + ext
+			}
+			used[name] = true
+			rec.Media = name
+			gs.records[it.Path] = rec
+			named = true
+		}
+		it.media = rec.Media
+	}
+	return named
+}
+
+// runMigrateGuids implements the migrate-guids subcommand. Without a guid
+// element podcast apps identify episodes by their enclosure URL. The
+// migration gives every episode that does not have a GUID yet a new one, and
+// records that URL next to it as its legacy GUID. The feed keeps presenting
+// the same identities once GUIDs are enabled, until -legacyGuidsUntil, so no
+// app re-downloads the catalog. Episodes added afterwards only get new, random
+// GUIDs.
+func runMigrateGuids(args []string) error {
+	fset := flag.NewFlagSet("migrate-guids", flag.ExitOnError)
+	dir := fset.String("dir", ".", "directory with media files")
+	externalUrl := fset.String(
+		"externalUrl", "",
+		"external URL the feed has been published with until now, "+
+			"the same value as given to the server",
+	)
+	guidFile := fset.String("guidFile", "", "path of the GUID file to create or update")
+	dryRun := fset.Bool("dryRun", false, "only print what would be migrated")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve migrate-guids [flags]\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *guidFile == "" || *externalUrl == "" {
+		fset.Usage()
+		return errors.New("migrate-guids: -guidFile and -externalUrl are required")
+	}
+	if (*externalUrl)[len(*externalUrl)-1] != '/' {
+		*externalUrl += "/"
+	}
+
+	gs, err := NewGuidStore(*guidFile)
+	if err != nil {
+		return err
+	}
+	m := Metadata{externalUrl: *externalUrl, localRoot: *dir, source: NewLocalSource(*dir, ScanPolicy{})}
+	items, unreadable, err := m.Items()
+	if err != nil {
+		return err
+	}
+	if len(unreadable) > 0 {
+		return fmt.Errorf("could not read %d files, e.g. %s", len(unreadable), unreadable[0])
+	}
+	migrated, already := 0, 0
+	now := time.Now().UTC()
+	for _, it := range items {
+		if it.Draft {
+			// Drafts were never published, they get new GUIDs.
+			continue
+		}
+		if _, ok := gs.records[it.Path]; ok {
+			already++
+			continue
+		}
+		guid, err := newGuid()
+		if err != nil {
+			return err
+		}
+		// Apps know the episode by the URL it had before escapePath.
+		legacyUrl := legacyMediaUrl(*externalUrl, it.Path)
+		fmt.Printf("%s -> %s, published as %s until -legacyGuidsUntil\n", it.Path, guid, legacyUrl)
+		gs.records[it.Path] = GuidRecord{Guid: guid, Created: now, LegacyGuid: legacyUrl}
+		migrated++
+	}
+	if *dryRun {
+		fmt.Printf("Would migrate %d episodes.\n", migrated)
+		return nil
+	}
+	if err := gs.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d episodes, %d already had a GUID.\n", migrated, already)
+	return nil
+}
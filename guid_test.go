@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGuidStorePublished(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	migrated := GuidRecord{Guid: "urn:uuid:new", LegacyGuid: "https://podcast.example.com/a.mp3"}
+	tests := []struct {
+		name  string
+		rec   GuidRecord
+		until time.Time
+		want  string
+	}{
+		{"not migrated", GuidRecord{Guid: "urn:uuid:new"}, time.Time{}, "urn:uuid:new"},
+		{"no cutoff", migrated, time.Time{}, migrated.LegacyGuid},
+		{"before cutoff", migrated, now.AddDate(0, 0, 1), migrated.LegacyGuid},
+		{"at cutoff", migrated, now, migrated.Guid},
+		{"after cutoff", migrated, now.AddDate(0, 0, -1), migrated.Guid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := &GuidStore{LegacyUntil: tt.until}
+			if got := gs.published(tt.rec, now); got != tt.want {
+				t.Errorf("published = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ApiHashingPath reports the progress of the Hasher.
+	ApiHashingPath = "/api/hashing"
+
+	// Key of the SHA-256 of a file in the MetaCache.
+	metaSha256 = "sha256"
+	// How often the Hasher logs its progress and publishes its results.
+	hashProgressInterval = 10 * time.Second
+)
+
+type hashJob struct {
+	path string // Relative to the media directory.
+	src  string
+}
+
+// A Hasher computes the SHA-256 of media files with a pool of workers in the
+// background, so that serving is never blocked on it. Hashes are kept in the
+// MetaCache and used as ETags of the files once known.
+type Hasher struct {
+	Meta   *MetaCache
+	OnDone func() // Called when new hashes are available.
+
+	workers int
+	limiter *rateLimiter // Shared by all workers, nil if unlimited.
+	jobs    chan hashJob
+
+	mu     sync.Mutex // Guards queued
+	queued map[string]bool
+
+	total   atomic.Int64 // Files queued since start.
+	done    atomic.Int64
+	failed  atomic.Int64
+	bytes   atomic.Int64
+	started time.Time
+}
+
+// NewHasher returns a Hasher with the given number of workers, reading at
+// most rate bytes per second in total, or without limit if rate is 0.
+func NewHasher(meta *MetaCache, workers int, rate int64) *Hasher {
+	h := &Hasher{
+		Meta:    meta,
+		workers: workers,
+		jobs:    make(chan hashJob, 4096),
+		queued:  make(map[string]bool),
+		started: time.Now(),
+	}
+	if rate > 0 {
+		h.limiter = &rateLimiter{rate: rate}
+	}
+	return h
+}
+
+// Apply sets the hash of every item whose hash is known and queues the rest.
+// Nothing is queued by dry runs.
+func (h *Hasher) Apply(m Metadata, items []Item) {
+	for i := range items {
+		it := &items[i]
+		if it.converted != "" {
+			// The hash is that of the enclosure.
+			continue
+		}
+		src := filepath.Join(m.localRoot, it.Path)
+		info, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+		if h.Meta.Get(it.Path, info, metaSha256, &it.Hash) {
+			continue
+		}
+		if m.dryRun {
+			continue
+		}
+		h.mu.Lock()
+		if !h.queued[src] {
+			select {
+			case h.jobs <- hashJob{path: it.Path, src: src}:
+				h.queued[src] = true
+				h.total.Add(1)
+			default:
+				// Queued on a later refresh.
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Run starts the workers and reports progress until ctx is done.
+func (h *Hasher) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var workers sync.WaitGroup
+	var fresh atomic.Bool // New hashes since they were last published.
+	for i := 0; i < h.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case job := <-h.jobs:
+					if err := h.hash(ctx, job); err != nil {
+						if ctx.Err() != nil {
+							return
+						}
+						h.failed.Add(1)
+						slog.Warn("could not hash file", "error", err, "file", job.path, "tag", TagHash)
+					} else {
+						h.done.Add(1)
+						fresh.Store(true)
+					}
+					h.mu.Lock()
+					delete(h.queued, job.src)
+					h.mu.Unlock()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(hashProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			workers.Wait()
+			return
+		}
+		if !fresh.Swap(false) {
+			continue
+		}
+		p := h.Progress()
+		slog.Info(
+			"hashing progress", "tag", TagHash,
+			"done", p.Done, "total", p.Total, "failed", p.Failed, "bytes", p.Bytes,
+		)
+		if err := h.Meta.Save(); err != nil {
+			slog.Warn("could not save metadata cache", "error", err, "tag", TagHash)
+		}
+		if h.OnDone != nil {
+			h.OnDone()
+		}
+	}
+}
+
+func (h *Hasher) hash(ctx context.Context, job hashJob) error {
+	hash, info, err := hashFile(ctx, job.src, h.limiter, &h.bytes)
+	if err != nil {
+		return err
+	}
+	return h.Meta.Put(job.path, info, metaSha256, hash)
+}
+
+// hashFile returns the hex-encoded SHA-256 of the file at p, and its state
+// when opened. Reads are spaced out by limiter, if not nil, and counted in
+// read.
+func hashFile(ctx context.Context, p string, limiter *rateLimiter, read *atomic.Int64) (string, fs.FileInfo, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.New()
+	buf := make([]byte, 1<<20)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		n, err := fp.Read(buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			read.Add(int64(n))
+			if err := limiter.wait(ctx, n); err != nil {
+				return "", nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(sum.Sum(nil)), info, nil
+}
+
+type HashProgress struct {
+	Total   int64   `json:"total"`
+	Done    int64   `json:"done"`
+	Failed  int64   `json:"failed"`
+	Pending int     `json:"pending"`
+	Bytes   int64   `json:"bytes"`
+	Rate    float64 `json:"bytes_per_second"` // Average since start.
+}
+
+func (h *Hasher) Progress() HashProgress {
+	h.mu.Lock()
+	pending := len(h.queued)
+	h.mu.Unlock()
+	bytes := h.bytes.Load()
+	return HashProgress{
+		Total:   h.total.Load(),
+		Done:    h.done.Load(),
+		Failed:  h.failed.Load(),
+		Pending: pending,
+		Bytes:   bytes,
+		Rate:    float64(bytes) / time.Since(h.started).Seconds(),
+	}
+}
+
+func (h *Hasher) ServeProgress(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Progress())
+}
+
+// rateLimiter spaces out reads so that at most rate bytes are read per second.
+type rateLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time // When the next read may start.
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// HealthzPath answers whether the server is alive, ReadyzPath whether it
+	// is ready to serve.
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// Health answers the liveness and readiness probes of orchestrators such as
+// Kubernetes or Docker Compose. The server is alive as long as it answers,
+// and ready once the media directory has been scanned, until it starts
+// shutting down.
+type Health struct {
+	ready atomic.Bool
+}
+
+func (h *Health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// Wrap answers the probes, and passes other requests on to next. Probes are
+// neither logged nor counted as requests in flight, to keep the log from
+// filling with them.
+func (h *Health) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != HealthzPath && r.URL.Path != ReadyzPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.URL.Path == ReadyzPath && !h.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// HlsPath serves HLS playlists and segments of video episodes, at
+	// HlsPath + <name>/ + hlsPlaylist.
+	HlsPath     = "/hls/"
+	hlsPlaylist = "index.m3u8"
+	// Segment length in seconds.
+	hlsSegment = 6
+)
+
+func (t *Transcoder) hlsName(src string, info fs.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00hls:%d", src, info.Size(), info.ModTime().UnixNano(), hlsSegment)
+	return hex.EncodeToString(h.Sum(nil)[:12]) + ".hls"
+}
+
+// applyHls sets the HLS playlist of the video episode it, if packaged
+// already, or else queues packaging it. Browsers and TVs can then stream long
+// videos rather than download the whole file. It returns the name of the
+// directory of segments in the cache.
+func (t *Transcoder) applyHls(m Metadata, it *Item, src string, info fs.FileInfo) string {
+	name := t.hlsName(src, info)
+	dst := filepath.Join(t.dir, name)
+	if _, err := os.Stat(filepath.Join(dst, hlsPlaylist)); err != nil {
+		t.enqueue(m, transcodeJob{kind: jobHls, src: src, dst: dst})
+		return name
+	}
+	it.Hls = m.externalUrl + HlsPath[1:] + name + "/" + hlsPlaylist
+	it.hlsDir = dst
+	return name
+}
+
+// makeHls splits a video into segments without re-encoding it, which
+// requires codecs supported by HLS, such as H.264 and AAC.
+func (t *Transcoder) makeHls(ctx context.Context, job transcodeJob) error {
+	tmp := job.dst + ".part"
+	os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(
+		ctx, t.ffmpeg, "-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", job.src, "-c", "copy", "-f", "hls",
+		"-hls_time", fmt.Sprint(hlsSegment),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(tmp, "seg%05d.ts"),
+		filepath.Join(tmp, hlsPlaylist),
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(tmp)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return os.Rename(tmp, job.dst)
+}
+
+// ServeHls serves the playlists and segments of published videos.
+func (s *Server) ServeHls(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, HlsPath), "/")
+	if !ok || file == "" || strings.ContainsAny(file, `/\`) || strings.HasPrefix(file, ".") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mu.RLock()
+	dir, ok := s.HlsDirs[name]
+	s.mu.RUnlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fp, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch filepath.Ext(file) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), fp)
+}
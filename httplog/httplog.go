@@ -0,0 +1,236 @@
+// Package httplog logs the responses of an HTTP server with log/slog, one
+// line per request with its status, latency and the bytes actually sent.
+package httplog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tag of the log messages, as in the tag attribute of the rest of podserve.
+const Tag = "http"
+
+// RequestIdHeader identifies a request in the log, sent in the response for
+// debugging clients. The one of a reverse proxy in front is kept if valid.
+const RequestIdHeader = "X-Request-Id"
+
+type ctxKey int
+
+const ctxKeyRequestId ctxKey = 0
+
+// Verbosity is which responses are logged.
+type Verbosity string
+
+const (
+	LogAll    Verbosity = "all"
+	LogErrors Verbosity = "errors" // Responses with a status of 400 or more.
+	LogOff    Verbosity = "off"
+)
+
+// ParseVerbosity returns the verbosity named s.
+func ParseVerbosity(s string) (Verbosity, bool) {
+	switch v := Verbosity(s); v {
+	case LogAll, LogErrors, LogOff:
+		return v, true
+	}
+	return "", false
+}
+
+// A Logger logs the responses of the handlers it wraps.
+type Logger struct {
+	Verbosity Verbosity
+	// Query parameters whose values are left out of the log, such as
+	// credentials.
+	Redact []string
+}
+
+// Wrap logs the responses of h, and gives every request an ID, see
+// RequestIdHeader.
+func (l Logger) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewResponseWriter(w)
+		rw.requestId = r.Header.Get(RequestIdHeader)
+		if !validRequestId(rw.requestId) {
+			rw.requestId = newRequestId()
+		}
+		rw.Header().Set(RequestIdHeader, rw.requestId)
+		start := time.Now()
+		defer func() { l.log(rw, r, time.Since(start)) }()
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), ctxKeyRequestId, rw.requestId)))
+	})
+}
+
+func newRequestId() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestId reports whether id is fit for the log: short and made of
+// letters, digits and -_.:, as proxies generate them.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestId returns the ID of the request, see RequestIdHeader.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestId).(string)
+	return id
+}
+
+// A ResponseWriter records the status and size of a response.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64 // Number of body bytes actually sent to the client.
+
+	principal string // Name of the authenticated principal, if any.
+	requestId string
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, status: 200}
+}
+
+// Status returns the status of the response, 200 until written.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// Written returns the number of body bytes sent so far.
+func (w *ResponseWriter) Written() int64 {
+	return w.written
+}
+
+// SetPrincipal logs the response as made to the principal named name, if w
+// is a ResponseWriter.
+func SetPrincipal(w http.ResponseWriter, name string) {
+	if rw, ok := w.(*ResponseWriter); ok {
+		rw.principal = name
+	}
+}
+
+func (w *ResponseWriter) Header() http.Header {
+	return w.ResponseWriter.Header()
+}
+
+func (w *ResponseWriter) Write(buf []byte) (int, error) {
+	if w.status >= 400 {
+		// If status is an error, skip writing the body. This is because this
+		// ResponseWriter is sent to http.ServeContent that writes an error message
+		// to the wire in case something fails. We'd rather just log it and send
+		// only the status to the client.
+		err := errors.New(string(buf))
+		slog.Error("http response error", "error", err, "status", w.status, "request_id", w.requestId, "tag", Tag)
+		return len(buf), nil
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// log logs the response to r, which took latency to handle.
+func (l Logger) log(w *ResponseWriter, r *http.Request, latency time.Duration) {
+	switch {
+	case l.Verbosity == LogOff:
+		return
+	case l.Verbosity == LogErrors && w.status < 400:
+		return
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	uri = redactQuery(uri, l.Redact)
+	args := []any{
+		"tag", Tag,
+		"remote_addr", r.RemoteAddr,
+		"method", r.Method,
+		"path", uri,
+		"proto", r.Proto,
+		"status", w.status,
+		"request_id", w.requestId,
+		"latency", latency,
+		"bytes_written", w.written,
+	}
+	if contentLength := w.Header().Get("Content-Length"); contentLength != "" {
+		if length, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
+			args = append(args, "content_length", length)
+		}
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		args = append(args, "range", rangeHeader)
+		switch w.status {
+		case http.StatusPartialContent:
+			args = append(args, "range_result", "satisfied")
+		case http.StatusRequestedRangeNotSatisfiable:
+			args = append(args, "range_result", "rejected")
+		case http.StatusOK:
+			// The range was ignored (e.g. If-Range mismatch or invalid syntax)
+			// and the whole file was sent.
+			args = append(args, "range_result", "ignored")
+		}
+		if contentRange := w.Header().Get("Content-Range"); contentRange != "" {
+			args = append(args, "content_range", contentRange)
+		}
+	}
+	if w.principal != "" {
+		args = append(args, "principal", w.principal)
+	}
+	if xForwardedFor := r.Header.Get("X-Forwarded-For"); xForwardedFor != "" {
+		args = append(args, "x_forwarded_for", xForwardedFor)
+	}
+	if userAgent := r.UserAgent(); userAgent != "" {
+		args = append(args, "user_agent", userAgent)
+	}
+	slog.Info("Sent response", args...)
+}
+
+// redactQuery replaces the values of the query parameters params of uri.
+func redactQuery(uri string, params []string) string {
+	p, query, ok := strings.Cut(uri, "?")
+	if !ok || len(params) == 0 {
+		return uri
+	}
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if slices.Contains(params, key) {
+			pairs[i] = url.QueryEscape(key) + "=REDACTED"
+		}
+	}
+	return p + "?" + strings.Join(pairs, "&")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cmp"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed locales/*.yaml
+var localeFS embed.FS
+
+// languageTag matches the language codes -lang accepts, e.g. en or pt-BR.
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// The language whose messages are used where a translation lacks one.
+const fallbackLanguage = "en"
+
+// A Locale holds the messages of the HTML pages in a language.
+type Locale struct {
+	Lang string `yaml:"-"`
+	// Go layout of dates, and abbreviated month names replacing those of the
+	// layout, optional.
+	DateLayout string            `yaml:"date"`
+	Months     []string          `yaml:"months"`
+	Messages   map[string]string `yaml:",inline"`
+
+	fallback *Locale
+}
+
+// T returns the message of the given key, formatted with args if any.
+func (l *Locale) T(key string, args ...any) string {
+	for ; l != nil; l = l.fallback {
+		if msg, ok := l.Messages[key]; ok {
+			if len(args) > 0 {
+				return fmt.Sprintf(msg, args...)
+			}
+			return msg
+		}
+	}
+	return key
+}
+
+// Date formats t for the language.
+func (l *Locale) Date(t time.Time) string {
+	for l.DateLayout == "" && l.fallback != nil {
+		l = l.fallback
+	}
+	s := t.Format(l.DateLayout)
+	if len(l.Months) == 12 && strings.Contains(l.DateLayout, "Jan") {
+		s = strings.Replace(s, t.Format("Jan"), l.Months[t.Month()-1], 1)
+	}
+	return s
+}
+
+// LangCookie remembers the language chosen with the lang query parameter.
+const LangCookie = "podserve_lang"
+
+// locale returns the locale of the HTML page of a request, see negotiate.
+func (s *Server) locale(w http.ResponseWriter, r *http.Request) *Locale {
+	return s.Locales.negotiate(w, r, s.Metadata.locale)
+}
+
+// negotiate returns the locale of the HTML page of a request: that of the
+// lang query parameter, remembered in a cookie for the following pages, else
+// the first translated language of its Accept-Language header, else def.
+func (ls *Locales) negotiate(w http.ResponseWriter, r *http.Request, def *Locale) *Locale {
+	w.Header().Add("Vary", "Accept-Language, Cookie")
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if l, ok := ls.Get(lang); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     LangCookie,
+				Value:    l.Lang,
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				SameSite: http.SameSiteLaxMode,
+			})
+			return l
+		}
+	}
+	if c, err := r.Cookie(LangCookie); err == nil {
+		if l, ok := ls.Get(c.Value); ok {
+			return l
+		}
+	}
+	for _, lang := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if l, ok := ls.Get(lang); ok {
+			return l
+		}
+	}
+	return def
+}
+
+// acceptedLanguages returns the languages of an Accept-Language header, most
+// preferred first, leaving out the wildcard and those refused with q=0.
+func acceptedLanguages(header string) []string {
+	type accepted struct {
+		lang string
+		q    float64
+	}
+	var langs []accepted
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang = strings.TrimSpace(lang)
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if lang == "" || lang == "*" || q <= 0 {
+			continue
+		}
+		langs = append(langs, accepted{lang, q})
+	}
+	slices.SortStableFunc(langs, func(a, b accepted) int {
+		return cmp.Compare(b.q, a.q)
+	})
+	out := make([]string, len(langs))
+	for i, a := range langs {
+		out[i] = a.lang
+	}
+	return out
+}
+
+// Locales are the translations of the HTML pages, by language tag.
+type Locales struct {
+	byLang map[string]*Locale
+	// Default is the locale of the show's language.
+	Default *Locale
+}
+
+// LoadLocales reads the built-in translations and those of dir, named after
+// their language tag, e.g. de.yaml, which add to or replace built-in ones.
+// The default locale is that of lang, or English without a translation.
+func LoadLocales(dir, lang string) (*Locales, error) {
+	ls := &Locales{byLang: make(map[string]*Locale)}
+	if err := ls.load(localeFS, "locales"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := ls.load(os.DirFS(dir), "."); err != nil {
+			return nil, err
+		}
+	}
+	en := ls.byLang[fallbackLanguage]
+	for _, l := range ls.byLang {
+		if l != en {
+			l.fallback = en
+		}
+	}
+	if l, ok := ls.Get(lang); ok {
+		ls.Default = l
+	} else {
+		ls.Default = en
+	}
+	return ls, nil
+}
+
+func (ls *Locales) load(fsys fs.FS, dir string) error {
+	paths, err := fs.Glob(fsys, path.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		buf, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		lang := strings.ToLower(strings.TrimSuffix(path.Base(p), ".yaml"))
+		l := ls.byLang[lang]
+		if l == nil {
+			l = &Locale{Lang: lang, Messages: make(map[string]string)}
+			ls.byLang[lang] = l
+		}
+		// Keys of the file replace those already loaded.
+		if err := yaml.Unmarshal(buf, l); err != nil {
+			return fmt.Errorf("parse translation %s: %w", p, err)
+		}
+		if l.Months != nil && len(l.Months) != 12 {
+			return errors.New("translation " + p + ": months must list 12 names")
+		}
+	}
+	return nil
+}
+
+// Get returns the locale of a language tag, or of its primary language, e.g.
+// de for de-AT.
+func (ls *Locales) Get(lang string) (*Locale, bool) {
+	lang = strings.ToLower(lang)
+	if l, ok := ls.byLang[lang]; ok {
+		return l, true
+	}
+	base, _, _ := strings.Cut(lang, "-")
+	l, ok := ls.byLang[base]
+	return l, ok
+}
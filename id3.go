@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// MP3 files carry their tags in an ID3v2 tag at the start, versions 2.2, 2.3
+// and 2.4 of which differ in the size of frame headers and in how sizes and
+// dates are written. Older files may only have an ID3v1 tag, a fixed record
+// of 128 bytes at the end.
+//
+// See https://id3.org/id3v2.4.0-structure, https://id3.org/id3v2.3.0,
+// https://id3.org/id3v2-00 and https://id3.org/id3v2-chapters-1.0.
+
+const (
+	// Tags larger than this are mostly cover art and are not read.
+	id3MaxTag  = 16 << 20
+	id3v1Size  = 128
+	id3TagHead = 10
+	// Picture type of the front cover, in APIC frames as in FLAC PICTURE
+	// blocks.
+	pictureFrontCover = 3
+)
+
+// id3TextFrames maps the text frames read to tag keys, as named by ffprobe
+// and Vorbis comments. 2.2 frames have 3 character IDs.
+var id3TextFrames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TALB": "album", "TAL": "album",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "track", "TRK": "track",
+	// Release and recording dates of 2.4, see id3Date for older versions.
+	"TDRL": "date",
+	"TDRC": "date",
+	// Podcast description, as written by iTunes.
+	"TDES": "description", "TDS": "description",
+}
+
+// parseMP3 reads the tags and chapters of an MP3 file, from its ID3v2 tag or
+// else its ID3v1 tag, and the duration of the audio between them.
+func parseMP3(path string) (MediaInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return MediaInfo{}, err
+	}
+
+	var mi MediaInfo
+	var h [id3TagHead]byte
+	if _, err := io.ReadFull(fp, h[:]); err != nil {
+		return MediaInfo{}, errUnsupportedFormat
+	}
+	var start int64
+	if string(h[:3]) == "ID3" {
+		size := syncsafe(h[6:10])
+		if size > id3MaxTag {
+			return MediaInfo{}, fmt.Errorf("id3: tag of %d bytes", size)
+		}
+		b, err := readBlock(fp, int64(size))
+		if err != nil {
+			return MediaInfo{}, fmt.Errorf("id3: %w", err)
+		}
+		var picture []byte
+		if mi.Tags, mi.Chapters, picture, err = parseID3v2(h[3], h[5], b); err != nil {
+			return MediaInfo{}, err
+		}
+		if picture != nil {
+			mi.setArtwork(picture)
+		}
+		start = id3TagHead + int64(size)
+		if h[5]&0x10 != 0 { // Footer of 2.4.
+			start += id3TagHead
+		}
+	}
+	end := info.Size()
+	v1, ok, err := readID3v1(fp, end)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	if ok {
+		end -= id3v1Size
+		if len(mi.Tags) == 0 {
+			mi.Tags = v1
+		}
+	}
+	if start < end {
+		if mi.Duration, err = mp3Duration(fp, start, end); err != nil {
+			return MediaInfo{}, err
+		}
+	}
+	return mi, nil
+}
+
+// syncsafe decodes a 28 bit integer stored in the low 7 bits of 4 bytes.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise undoes the unsynchronisation scheme, which inserts a zero
+// after every 0xff.
+func unsynchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+// parseID3v2 parses the frames of an ID3v2 tag of the given major version and
+// header flags, returning its tags, chapters and cover art: the front cover
+// or else the first picture.
+func parseID3v2(version, flags byte, b []byte) (map[string]string, []Chapter, []byte, error) {
+	if version < 2 || version > 4 {
+		return nil, nil, nil, fmt.Errorf("id3: unsupported version 2.%d", version)
+	}
+	// 2.4 unsynchronises frame by frame.
+	if flags&0x80 != 0 && version < 4 {
+		b = unsynchronise(b)
+	}
+	if flags&0x40 != 0 && version >= 3 {
+		if len(b) < 4 {
+			return nil, nil, nil, errors.New("id3: short extended header")
+		}
+		n := int(binary.BigEndian.Uint32(b)) + 4 // Size excludes itself in 2.3.
+		if version == 4 {
+			n = syncsafe(b)
+		}
+		if n > len(b) {
+			return nil, nil, nil, errors.New("id3: invalid extended header")
+		}
+		b = b[n:]
+	}
+	tags := make(map[string]string)
+	var (
+		chapters       []Chapter
+		year, day, hm  string // Dates of 2.2 and 2.3.
+		comment, txxxD string
+		picture        []byte
+		front          bool
+	)
+	for {
+		id, data, rest, ok := id3Frame(version, b)
+		if !ok {
+			break
+		}
+		b = rest
+		switch {
+		case id3TextFrames[id] != "":
+			k := id3TextFrames[id]
+			// The release date takes precedence over the recording date.
+			if _, ok := tags[k]; !ok || id == "TDRL" {
+				if v := id3Text(data); v != "" {
+					tags[k] = v
+				}
+			}
+		case id == "TYER" || id == "TYE":
+			year = id3Text(data)
+		case id == "TDAT" || id == "TDA":
+			day = id3Text(data)
+		case id == "TIME" || id == "TIM":
+			hm = id3Text(data)
+		case id == "COMM" || id == "COM":
+			// The first comment without a description is the comment proper,
+			// others are e.g. iTunes normalization values.
+			if desc, text, ok := id3Comment(data); ok && comment == "" && (desc == "" || strings.EqualFold(desc, "description")) {
+				comment = text
+			}
+		case id == "TXXX" || id == "TXX":
+			if desc, text, ok := id3UserText(data); ok && strings.EqualFold(desc, "description") && txxxD == "" {
+				txxxD = text
+			}
+		case id == "CHAP":
+			if c, ok := id3Chapter(version, data); ok {
+				chapters = append(chapters, c)
+			}
+		case id == "APIC" || id == "PIC":
+			if kind, p, ok := id3Picture(version, data); ok && !front && (picture == nil || kind == pictureFrontCover) {
+				picture, front = p, kind == pictureFrontCover
+			}
+		}
+	}
+	if _, ok := tags["date"]; !ok && year != "" {
+		tags["date"] = id3Date(year, day, hm)
+	}
+	if comment != "" {
+		tags["comment"] = comment
+	}
+	if _, ok := tags["description"]; !ok && txxxD != "" {
+		tags["description"] = txxxD
+	}
+	slices.SortStableFunc(chapters, func(a, b Chapter) int {
+		switch {
+		case a.Start < b.Start:
+			return -1
+		case a.Start > b.Start:
+			return 1
+		}
+		return 0
+	})
+	return tags, chapters, picture, nil
+}
+
+// id3Frame splits off the first frame of b, returning its ID and its data
+// with unsynchronisation and the data length indicator of 2.4 undone. It
+// reports false at the padding or the end of the tag. Compressed and
+// encrypted frames are returned without data.
+func id3Frame(version byte, b []byte) (string, []byte, []byte, bool) {
+	headSize := 10
+	if version == 2 {
+		headSize = 6
+	}
+	if len(b) < headSize || b[0] == 0 {
+		return "", nil, nil, false
+	}
+	var id string
+	var size int
+	var flags uint16
+	switch version {
+	case 2:
+		id = string(b[:3])
+		size = int(b[3])<<16 | int(b[4])<<8 | int(b[5])
+	case 3:
+		id = string(b[:4])
+		size = int(binary.BigEndian.Uint32(b[4:]))
+		flags = binary.BigEndian.Uint16(b[8:])
+	default:
+		id = string(b[:4])
+		size = syncsafe(b[4:8])
+		flags = binary.BigEndian.Uint16(b[8:])
+	}
+	if size < 0 || size > len(b)-headSize {
+		return "", nil, nil, false
+	}
+	data, rest := b[headSize:headSize+size], b[headSize+size:]
+	switch version {
+	case 3:
+		if flags&0x00c0 != 0 {
+			data = nil
+		}
+	case 4:
+		if flags&0x000c != 0 {
+			data = nil
+			break
+		}
+		if flags&0x0002 != 0 {
+			data = unsynchronise(data)
+		}
+		if flags&0x0001 != 0 && len(data) >= 4 {
+			data = data[4:]
+		}
+	}
+	return id, data, rest, true
+}
+
+// id3Decode decodes a string in the given text encoding: ISO-8859-1, UTF-16
+// with a byte order mark, UTF-16BE or UTF-8.
+func id3Decode(enc byte, b []byte) string {
+	switch enc {
+	case 0:
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r)
+	case 1, 2:
+		bigEndian := enc == 2
+		if len(b) >= 2 && (b[0] == 0xfe && b[1] == 0xff || b[0] == 0xff && b[1] == 0xfe) {
+			bigEndian = b[0] == 0xfe
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if bigEndian {
+				u[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				u[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		return string(utf16.Decode(u))
+	default:
+		return strings.ToValidUTF8(string(b), "\uFFFD")
+	}
+}
+
+// id3Cut splits b at the first terminator of a string in the given encoding,
+// a zero byte, or two aligned ones in UTF-16.
+func id3Cut(enc byte, b []byte) ([]byte, []byte, bool) {
+	if enc != 1 && enc != 2 {
+		return bytes.Cut(b, []byte{0})
+	}
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			return b[:i], b[i+2:], true
+		}
+	}
+	return b, nil, false
+}
+
+// id3Text returns the first value of a text frame.
+func id3Text(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	v, _, _ := id3Cut(data[0], data[1:])
+	return strings.TrimSpace(id3Decode(data[0], v))
+}
+
+// id3Comment returns the description and text of a COMM frame.
+func id3Comment(data []byte) (string, string, bool) {
+	if len(data) < 4 {
+		return "", "", false
+	}
+	enc := data[0]
+	desc, text, ok := id3Cut(enc, data[4:]) // After the language.
+	if !ok {
+		return "", "", false
+	}
+	text, _, _ = id3Cut(enc, text)
+	return id3Decode(enc, desc), strings.TrimSpace(id3Decode(enc, text)), true
+}
+
+// id3UserText returns the description and value of a TXXX frame.
+func id3UserText(data []byte) (string, string, bool) {
+	if len(data) < 1 {
+		return "", "", false
+	}
+	enc := data[0]
+	desc, v, ok := id3Cut(enc, data[1:])
+	if !ok {
+		return "", "", false
+	}
+	v, _, _ = id3Cut(enc, v)
+	return id3Decode(enc, desc), strings.TrimSpace(id3Decode(enc, v)), true
+}
+
+// id3Picture returns the picture type and image data of an APIC frame, or of
+// a PIC frame in 2.2, which has a three letter image format instead of a MIME
+// type.
+func id3Picture(version byte, data []byte) (byte, []byte, bool) {
+	if len(data) < 1 {
+		return 0, nil, false
+	}
+	enc, rest := data[0], data[1:]
+	if version == 2 {
+		if len(rest) < 3 {
+			return 0, nil, false
+		}
+		rest = rest[3:]
+	} else {
+		var ok bool
+		if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+			return 0, nil, false
+		}
+	}
+	if len(rest) < 1 {
+		return 0, nil, false
+	}
+	kind := rest[0]
+	_, img, ok := id3Cut(enc, rest[1:]) // After the description.
+	if !ok || len(img) == 0 {
+		return 0, nil, false
+	}
+	return kind, img, true
+}
+
+// id3Chapter parses a CHAP frame, whose title is in an embedded TIT2 frame.
+func id3Chapter(version byte, data []byte) (Chapter, bool) {
+	_, rest, ok := bytes.Cut(data, []byte{0}) // Element ID.
+	if !ok || len(rest) < 16 {
+		return Chapter{}, false
+	}
+	c := Chapter{
+		Start: float64(binary.BigEndian.Uint32(rest)) / 1000,
+		End:   float64(binary.BigEndian.Uint32(rest[4:])) / 1000,
+	}
+	sub := rest[16:] // After the byte offsets.
+	for {
+		id, data, next, ok := id3Frame(version, sub)
+		if !ok {
+			break
+		}
+		sub = next
+		if id == "TIT2" {
+			c.Title = id3Text(data)
+		}
+	}
+	return c, true
+}
+
+// id3Date joins the year, day (DDMM) and time (HHMM) frames of 2.2 and 2.3
+// into a date for parseTagDate, which ignores years alone.
+func id3Date(year, day, hm string) string {
+	if len(year) != 4 || len(day) != 4 {
+		return year
+	}
+	d := fmt.Sprintf("%s-%s-%s", year, day[2:], day[:2])
+	if len(hm) == 4 {
+		d += fmt.Sprintf("T%s:%s", hm[:2], hm[2:])
+	}
+	return d
+}
+
+// readID3v1 reads the ID3v1 tag at the end of fp, of the given size, and
+// reports whether there is one.
+func readID3v1(fp *os.File, size int64) (map[string]string, bool, error) {
+	if size < id3v1Size {
+		return nil, false, nil
+	}
+	var b [id3v1Size]byte
+	if _, err := fp.ReadAt(b[:], size-id3v1Size); err != nil {
+		return nil, false, fmt.Errorf("id3: %w", err)
+	}
+	if string(b[:3]) != "TAG" {
+		return nil, false, nil
+	}
+	field := func(f []byte) string {
+		f, _, _ = bytes.Cut(f, []byte{0})
+		return strings.TrimSpace(id3Decode(0, f))
+	}
+	tags := make(map[string]string)
+	for k, v := range map[string]string{
+		"title":   field(b[3:33]),
+		"artist":  field(b[33:63]),
+		"album":   field(b[63:93]),
+		"date":    field(b[93:97]),
+		"comment": field(b[97:127]),
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags, true, nil
+}
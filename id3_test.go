@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+)
+
+// id3Syncsafe encodes n as a 28 bit syncsafe integer.
+func id3Syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// id3FrameOf returns a frame of the given version.
+func id3FrameOf(version byte, id string, data []byte) []byte {
+	n := len(data)
+	switch version {
+	case 2:
+		return concat([]byte(id), []byte{byte(n >> 16), byte(n >> 8), byte(n)}, data)
+	case 3:
+		return concat([]byte(id), binary.BigEndian.AppendUint32(nil, uint32(n)), []byte{0, 0}, data)
+	}
+	return concat([]byte(id), id3Syncsafe(n), []byte{0, 0}, data)
+}
+
+// id3TagOf returns an ID3v2 tag of the given version holding frames.
+func id3TagOf(version byte, frames ...[]byte) []byte {
+	body := concat(frames...)
+	return concat([]byte{'I', 'D', '3', version, 0, 0}, id3Syncsafe(len(body)), body)
+}
+
+// id3Chap returns the data of a CHAP frame of version 2.4.
+func id3Chap(id string, start, end uint32, title string) []byte {
+	b := append([]byte(id), 0)
+	b = binary.BigEndian.AppendUint32(b, start)
+	b = binary.BigEndian.AppendUint32(b, end)
+	b = append(b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // Offsets.
+	return concat(b, id3FrameOf(4, "TIT2", []byte("\x03"+title)))
+}
+
+func TestParseID3v2(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	gif := []byte("GIF89a")
+	tests := []struct {
+		name     string
+		version  byte
+		flags    byte
+		frames   [][]byte
+		tags     map[string]string
+		chapters []Chapter
+		picture  []byte
+		wantErr  bool
+	}{
+		{
+			name:    "2.4",
+			version: 4,
+			frames: [][]byte{
+				id3FrameOf(4, "TIT2", []byte("\x03Épisode 1\x00")),
+				id3FrameOf(4, "TPE1", []byte("\x03Someone")),
+				id3FrameOf(4, "TDRC", []byte("\x032025-02-28")),
+				id3FrameOf(4, "TDRL", []byte("\x032025-03-01")),
+				id3FrameOf(4, "COMM", []byte("\x03engiTunNORM\x00 0000")),
+				id3FrameOf(4, "COMM", []byte("\x03eng\x00The comment")),
+				id3FrameOf(4, "TXXX", []byte("\x03DESCRIPTION\x00The description")),
+			},
+			tags: map[string]string{
+				"title": "Épisode 1", "artist": "Someone", "date": "2025-03-01",
+				"comment": "The comment", "description": "The description",
+			},
+		},
+		{
+			name:    "2.3 UTF-16",
+			version: 3,
+			frames: [][]byte{
+				id3FrameOf(3, "TIT2", []byte("\x01\xff\xfeE\x00p\x00 \x001\x00\x00\x00")),
+				id3FrameOf(3, "TALB", []byte("\x01\xfe\xff\x00S\x00h\x00o\x00w")),
+				id3FrameOf(3, "TYER", []byte("\x002025")),
+				id3FrameOf(3, "TDAT", []byte("\x000103")),
+				id3FrameOf(3, "TIME", []byte("\x000930")),
+			},
+			tags: map[string]string{"title": "Ep 1", "album": "Show", "date": "2025-03-01T09:30"},
+		},
+		{
+			name:    "2.2",
+			version: 2,
+			frames: [][]byte{
+				id3FrameOf(2, "TT2", []byte("\x00Caf\xe9")),
+				id3FrameOf(2, "TYE", []byte("\x002025")),
+				id3FrameOf(2, "PIC", concat([]byte("\x00PNG\x03\x00"), png)),
+			},
+			tags:    map[string]string{"title": "Café", "date": "2025"},
+			picture: png,
+		},
+		{
+			name:    "front cover",
+			version: 4,
+			frames: [][]byte{
+				id3FrameOf(4, "APIC", concat([]byte("\x00image/gif\x00\x00\x00"), gif)),
+				id3FrameOf(4, "APIC", concat([]byte("\x00image/png\x00\x03\x00"), png)),
+				id3FrameOf(4, "APIC", concat([]byte("\x00image/gif\x00\x03\x00"), gif)),
+			},
+			tags:    map[string]string{},
+			picture: png,
+		},
+		{
+			name:    "chapters",
+			version: 4,
+			frames: [][]byte{
+				id3FrameOf(4, "CHAP", id3Chap("ch1", 60000, 120500, "Second")),
+				id3FrameOf(4, "CHAP", id3Chap("ch0", 0, 60000, "First")),
+				id3FrameOf(4, "CHAP", []byte("ch2\x00short")),
+			},
+			tags: map[string]string{},
+			chapters: []Chapter{
+				{Start: 0, End: 60, Title: "First"},
+				{Start: 60, End: 120.5, Title: "Second"},
+			},
+		},
+		{
+			name:    "unsynchronised 2.3",
+			version: 3,
+			flags:   0x80,
+			frames:  [][]byte{bytes.ReplaceAll(id3FrameOf(3, "TIT2", []byte("\x00\xff\xe9t\xff\xe9")), []byte{0xff}, []byte{0xff, 0})},
+			tags:    map[string]string{"title": "ÿétÿé"},
+		},
+		{
+			name:    "padding",
+			version: 4,
+			frames:  [][]byte{id3FrameOf(4, "TIT2", []byte("\x03Title")), make([]byte, 64), id3FrameOf(4, "TPE1", []byte("\x03Ignored"))},
+			tags:    map[string]string{"title": "Title"},
+		},
+		{
+			name:    "oversized frame",
+			version: 4,
+			frames:  [][]byte{id3FrameOf(4, "TIT2", []byte("\x03Title")), []byte("TPE1\x7f\x7f\x7f\x7f\x00\x00\x03Someone")},
+			tags:    map[string]string{"title": "Title"},
+		},
+		{
+			name:    "oversized 2.3 frame",
+			version: 3,
+			frames:  [][]byte{[]byte("TIT2\xff\xff\xff\xff\x00\x00\x00Title")},
+			tags:    map[string]string{},
+		},
+		{
+			name:    "empty frames",
+			version: 4,
+			frames: [][]byte{
+				id3FrameOf(4, "TIT2", nil),
+				id3FrameOf(4, "COMM", []byte("\x03en")),
+				id3FrameOf(4, "TXXX", []byte("\x03DESCRIPTION")),
+				id3FrameOf(4, "APIC", []byte("\x00image/png")),
+				id3FrameOf(4, "CHAP", nil),
+			},
+			tags: map[string]string{},
+		},
+		{name: "unsupported version", version: 5, wantErr: true},
+		{name: "short extended header", version: 3, flags: 0x40, frames: [][]byte{{0, 0}}, wantErr: true},
+		{name: "oversized extended header", version: 4, flags: 0x40, frames: [][]byte{{0x7f, 0x7f, 0x7f, 0x7f, 0, 0}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, chapters, picture, err := parseID3v2(tt.version, tt.flags, concat(tt.frames...))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseID3v2 = %q, want an error", tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseID3v2: %v", err)
+			}
+			if !maps.Equal(tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", tags, tt.tags)
+			}
+			if !reflect.DeepEqual(chapters, tt.chapters) {
+				t.Errorf("chapters = %+v, want %+v", chapters, tt.chapters)
+			}
+			if string(picture) != string(tt.picture) {
+				t.Errorf("picture = %q, want %q", picture, tt.picture)
+			}
+		})
+	}
+}
+
+// id3v1 returns an ID3v1 tag.
+func id3v1(title, artist, year, comment string) []byte {
+	b := make([]byte, id3v1Size)
+	copy(b, "TAG")
+	copy(b[3:33], title)
+	copy(b[33:63], artist)
+	copy(b[93:97], year)
+	copy(b[97:127], comment)
+	return b
+}
+
+func TestParseMP3Tags(t *testing.T) {
+	tagged := id3TagOf(4, id3FrameOf(4, "TIT2", []byte("\x03Episode 1")))
+	tests := []struct {
+		name    string
+		data    []byte
+		tags    map[string]string
+		err     error // Nil for any error if wantErr.
+		wantErr bool
+	}{
+		{name: "ID3v2", data: tagged, tags: map[string]string{"title": "Episode 1"}},
+		{
+			name: "ID3v1",
+			data: concat(make([]byte, 64), id3v1("Episode 2", "Someone", "2025", "")),
+			tags: map[string]string{"title": "Episode 2", "artist": "Someone", "date": "2025"},
+		},
+		{
+			name: "ID3v2 over ID3v1",
+			data: concat(tagged, id3v1("Episode 2", "", "", "")),
+			tags: map[string]string{"title": "Episode 1"},
+		},
+		{name: "no tags", data: make([]byte, 64)},
+		{name: "too short", data: []byte("ID3"), err: errUnsupportedFormat, wantErr: true},
+		{name: "oversized tag", data: concat([]byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7f"), tagged[10:]), wantErr: true},
+		{name: "truncated tag", data: concat([]byte("ID3\x04\x00\x00\x04\x00\x00\x00"), tagged[10:]), wantErr: true},
+		{name: "unsupported version", data: concat([]byte("ID3\x05"), tagged[4:]), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeMedia(t, "episode.mp3", tt.data)
+			var mi MediaInfo
+			var err error
+			if n := allocated(func() { mi, err = parseMP3(p) }); n > 1<<20 {
+				t.Errorf("parseMP3 allocated %d bytes", n)
+			}
+			if tt.wantErr {
+				if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseMP3 = %+v, %v, want error %v", mi, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMP3: %v", err)
+			}
+			if !maps.Equal(mi.Tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", mi.Tags, tt.tags)
+			}
+		})
+	}
+	parseTruncated(t, "episode.mp3", concat(tagged, id3v1("Episode 2", "", "", "")), parseMP3)
+}
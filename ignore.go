@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile in the media directory lists the files and directories left out
+// of the feed, with the patterns of .gitignore files: one per line, blank
+// lines and lines starting with # aside. Patterns without a slash match the
+// name at any depth, others the path relative to the media directory; * and ?
+// match within a name, ** across directories, a trailing / only matches
+// directories and a leading ! includes again what an earlier pattern left
+// out. Files within a directory that is left out cannot be included again.
+//
+// See https://git-scm.com/docs/gitignore#_pattern_format
+const IgnoreFile = ".podignore"
+
+// An Ignore matches paths against ignore patterns, the last matching one
+// deciding.
+type Ignore struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ParseIgnore returns the Ignore of the patterns in lines.
+func ParseIgnore(lines []string) (*Ignore, error) {
+	ig := &Ignore{}
+	for _, line := range lines {
+		if err := ig.add(line); err != nil {
+			return nil, err
+		}
+	}
+	return ig, nil
+}
+
+// readIgnore returns the Ignore of the patterns of -exclude, given as
+// exclude, followed by those of the IgnoreFile of fsys if any. Invalid
+// patterns of the IgnoreFile are left out.
+func readIgnore(fsys fs.FS, exclude []string) (*Ignore, error) {
+	ig, err := ParseIgnore(exclude)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := fs.ReadFile(fsys, IgnoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ig, nil
+	}
+	if err != nil {
+		return ig, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; sc.Scan(); n++ {
+		if err := ig.add(sc.Text()); err != nil {
+			slog.Warn("ignoring invalid pattern", "error", err, "file", IgnoreFile, "line", n, "tag", TagRefresh)
+		}
+	}
+	return ig, sc.Err()
+}
+
+func (ig *Ignore) add(line string) error {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	var p ignorePattern
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		p.negate = true
+		line = rest
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if rest, ok := strings.CutSuffix(line, "/"); ok {
+		p.dirOnly = true
+		line = rest
+	}
+	if line == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	var expr strings.Builder
+	expr.WriteByte('^')
+	if rest, ok := strings.CutPrefix(line, "/"); ok {
+		line = rest
+	} else if !strings.Contains(line, "/") {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return fmt.Errorf("unterminated [ in %q", line)
+			}
+			class := line[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	expr.WriteByte('$')
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	p.re = re
+	ig.patterns = append(ig.patterns, p)
+	return nil
+}
+
+// Ignored reports whether the file, or directory if dir, at path p relative
+// to the media directory is left out. A nil Ignore leaves out nothing.
+func (ig *Ignore) Ignored(p string, dir bool) bool {
+	if ig == nil {
+		return false
+	}
+	ignored := false
+	for _, pat := range ig.patterns {
+		if pat.dirOnly && !dir {
+			continue
+		}
+		if pat.re.MatchString(p) {
+			ignored = !pat.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rssFeed is the part of a podcast RSS feed that import reads.
+type rssFeed struct {
+	Channel struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Language    string `xml:"language"`
+		Image       struct {
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	// content:encoded, usually the full show notes.
+	Content   string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Guid      string `xml:"guid"`
+	PubDate   string `xml:"pubDate"`
+	Comments  string `xml:"comments"`
+	Enclosure struct {
+		Url    string `xml:"url,attr"`
+		Type   string `xml:"type,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Episode  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	Explicit string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd explicit"`
+}
+
+// importSidecar is what import writes to the sidecar of an episode.
+type importSidecar struct {
+	Notes       string `yaml:"notes,omitempty"`
+	Explicit    *bool  `yaml:"explicit,omitempty"`
+	CommentsUrl string `yaml:"commentsUrl,omitempty"`
+}
+
+// Layouts of pubDate found in the wild, RFC 2822 being more of a suggestion.
+var pubDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	time.RFC3339,
+}
+
+func parsePubDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range pubDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var (
+	htmlBreak = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlock = regexp.MustCompile(`(?i)</(p|div|li|h[1-6])>`)
+	htmlTag   = regexp.MustCompile(`<[^>]*>`)
+	blankRuns = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+// htmlToText turns show notes in HTML into the plain paragraphs of sidecar
+// notes.
+func htmlToText(s string) string {
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlBlock.ReplaceAllString(s, "\n\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = blankRuns.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+// importFileName returns the file name of an imported episode, its title made
+// safe for file systems, since titles are taken from file names.
+func importFileName(title, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '-'
+		}
+		if r < ' ' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(title))
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 200 {
+		// Cut on a rune boundary.
+		n := 200
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	if name == "" {
+		name = "episode"
+	}
+	return name + ext
+}
+
+// importUniqueName returns the file name name of an episode, or if an earlier
+// episode of the feed took it, as episodes can share a title, name with the
+// publication date of the episode appended, or else a counter. Names depend
+// only on the feed, so an import run again finds the files it wrote.
+func importUniqueName(name, ext, pubDate string, taken map[string]bool) string {
+	base := strings.TrimSuffix(name, ext)
+	if date, ok := parsePubDate(pubDate); ok && taken[name] {
+		name = base + " " + date.Format("2006-01-02") + ext
+	}
+	for n := 2; taken[name]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// importExts maps enclosure types to the extensions podserve serves them
+// from, for enclosure URLs without a known extension.
+var importExts = map[string]string{
+	"audio/mpeg":      ".mp3",
+	"audio/mp3":       ".mp3",
+	"audio/x-m4a":     ".m4a",
+	"audio/mp4":       ".m4a",
+	"audio/m4a":       ".m4a",
+	"audio/ogg":       ".ogg",
+	"audio/opus":      ".opus",
+	"audio/flac":      ".flac",
+	"audio/aac":       ".aac",
+	"audio/wav":       ".wav",
+	"audio/x-wav":     ".wav",
+	"audio/wave":      ".wav",
+	"video/x-m4v":     ".m4v",
+	"video/mp4":       ".m4v",
+	"video/quicktime": ".mov",
+	"application/pdf": ".pdf",
+}
+
+// importExt returns the extension of the media file of an enclosure, and false
+// if podserve does not serve its type.
+func importExt(u, typ string) (string, bool) {
+	if pu, err := url.Parse(u); err == nil {
+		ext := strings.ToLower(path.Ext(pu.Path))
+		if _, ok := mimeType[ext]; ok {
+			return ext, true
+		}
+	}
+	mt, _, _ := mime.ParseMediaType(typ)
+	ext, ok := importExts[mt]
+	return ext, ok
+}
+
+// runImport implements the import subcommand.
+func runImport(args []string) error {
+	fset := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := fset.String("dir", ".", "directory to write the media files and sidecars to")
+	guidFile := fset.String(
+		"guidFile", "",
+		"GUID file of the server, to keep the GUIDs and episode numbers of the "+
+			"feed (recommended, podcast apps would otherwise see every episode as new)",
+	)
+	dryRun := fset.Bool("dryRun", false, "only print what would be imported")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve import [flags] <rss-url>\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	feedUrl := fset.Arg(0)
+	if feedUrl == "" {
+		fset.Usage()
+		return errors.New("import: missing feed URL")
+	}
+
+	resp, err := http.Get(feedUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import: %s: %s", feedUrl, resp.Status)
+	}
+	var feed rssFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return fmt.Errorf("import: parse feed: %w", err)
+	}
+
+	var gs *GuidStore
+	if *guidFile != "" {
+		if gs, err = NewGuidStore(*guidFile); err != nil {
+			return err
+		}
+	}
+	imported, skipped := 0, 0
+	now := time.Now().UTC()
+	taken := make(map[string]bool)
+	for _, it := range feed.Channel.Items {
+		ext, ok := importExt(it.Enclosure.Url, it.Enclosure.Type)
+		if !ok {
+			fmt.Printf("Skipping %q: unsupported enclosure %q (%s)\n", it.Title, it.Enclosure.Url, it.Enclosure.Type)
+			skipped++
+			continue
+		}
+		name := importUniqueName(importFileName(it.Title, ext), ext, it.PubDate, taken)
+		dst := filepath.Join(*dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			fmt.Printf("Skipping %q: %s exists\n", it.Title, name)
+			skipped++
+			continue
+		}
+		fmt.Printf("%s -> %s\n", it.Enclosure.Url, name)
+		if *dryRun {
+			imported++
+			continue
+		}
+
+		if err := downloadFile(it.Enclosure.Url, dst); err != nil {
+			return fmt.Errorf("import %q: %w", it.Title, err)
+		}
+		sc := importSidecar{Notes: htmlToText(it.Content), CommentsUrl: it.Comments}
+		if sc.Notes == "" {
+			sc.Notes = htmlToText(it.Description)
+		}
+		switch strings.ToLower(strings.TrimSpace(it.Explicit)) {
+		case "true", "yes", "explicit":
+			explicit := true
+			sc.Explicit = &explicit
+		}
+		if sc != (importSidecar{}) {
+			buf, err := yaml.Marshal(sc)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(strings.TrimSuffix(dst, ext)+".yaml", buf, 0o644); err != nil {
+				return err
+			}
+		}
+		// The modification time is the publication date.
+		if date, ok := parsePubDate(it.PubDate); ok {
+			if err := os.Chtimes(dst, date, date); err != nil {
+				return err
+			}
+		}
+		if gs != nil && it.Guid != "" {
+			episode, _ := strconv.Atoi(strings.TrimSpace(it.Episode))
+			gs.records[name] = GuidRecord{Guid: strings.TrimSpace(it.Guid), Created: now, Episode: episode}
+			// Saved after every episode, so an interrupted import keeps them.
+			if err := gs.save(); err != nil {
+				return err
+			}
+		}
+		imported++
+	}
+	if *dryRun {
+		fmt.Printf("Would import %d episodes, skipping %d.\n", imported, skipped)
+		return nil
+	}
+	fmt.Printf("Imported %d episodes, skipped %d.\n", imported, skipped)
+	c := feed.Channel
+	lang := strings.TrimSpace(c.Language)
+	if lang == "" {
+		lang = "en"
+	}
+	fmt.Printf(
+		"Serve them with: podserve -dir %q -title %q -desc %q -lang %q",
+		*dir, strings.TrimSpace(c.Title), htmlToText(c.Description), lang,
+	)
+	if *guidFile != "" {
+		fmt.Printf(" -guidFile %q", *guidFile)
+	}
+	fmt.Println()
+	if c.Image.Href != "" {
+		fmt.Printf("The show's cover is at %s.\n", c.Image.Href)
+	}
+	return nil
+}
+
+// downloadFile downloads u to dst, through a temporary file so that an
+// interrupted download leaves nothing behind.
+func downloadFile(u, dst string) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	fp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := io.Copy(fp, resp.Body); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), dst)
+}
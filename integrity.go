@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ChecksumsPath lists the SHA-256 of the media files of published
+	// episodes, in the format of sha256sum.
+	ChecksumsPath = "/checksums.txt"
+	// Detached Ed25519 signatures of the feed and the checksums, with the
+	// public key to verify them, if the feed is signed.
+	FeedSigPath      = "/feed.sig"
+	ChecksumsSigPath = "/checksums.txt.sig"
+	FeedPubKeyPath   = "/feed.pub"
+)
+
+// LoadSigningKey reads an Ed25519 private key in PEM-encoded PKCS #8, as
+// generated by openssl genpkey -algorithm ed25519.
+func LoadSigningKey(p string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM-encoded private key", p)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an Ed25519 key, got %T", p, key)
+	}
+	return k, nil
+}
+
+// checksums lists the hashes of the media files of items, in the format of
+// sha256sum, by path. Files not hashed yet are left out, as are paths
+// sha256sum could not check.
+func checksums(items []Item) []byte {
+	var hashed []Item
+	for _, it := range items {
+		if it.Hash != "" && !strings.ContainsAny(it.Path, "\n\\") {
+			hashed = append(hashed, it)
+		}
+	}
+	slices.SortFunc(hashed, func(a, b Item) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	var b bytes.Buffer
+	for _, it := range hashed {
+		fmt.Fprintf(&b, "%s  %s\n", it.Hash, it.Path)
+	}
+	return b.Bytes()
+}
+
+// sri returns the subresource integrity string of a hex-encoded SHA-256, as
+// in <podcast:integrity>.
+func sri(hash string) string {
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return ""
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(b)
+}
+
+func serveBytes(w http.ResponseWriter, r *http.Request, contentType string, b []byte) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(b)
+	}
+}
+
+func (s *Server) ServeChecksums(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	serveBytes(w, r, "text/plain; charset=UTF-8", s.Checksums)
+}
+
+// ServeSignature serves the signature of the feed or of the checksums, whose
+// bytes it signs are served at the same time. A feed linked to the host it
+// is requested from, or with the token of a listener, is signed as served to
+// the request.
+func (s *Server) ServeSignature(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r.URL.Path == ChecksumsSigPath {
+		serveBytes(w, r, "application/octet-stream", s.ChecksumsSig)
+		return
+	}
+	sig := s.FeedSig
+	if s.Proxy != nil {
+		w.Header().Add("Vary", "Host, X-Forwarded-Host, X-Forwarded-Proto")
+	}
+	if feed, _, token := s.requestFeed(r, s.FeedXML, "", withToken); !bytes.Equal(feed, s.FeedXML) {
+		sig = ed25519.Sign(s.Metadata.signingKey, feed)
+		if token {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+	}
+	serveBytes(w, r, "application/octet-stream", sig)
+}
+
+func (s *Server) ServePublicKey(w http.ResponseWriter, r *http.Request) {
+	der, err := x509.MarshalPKIXPublicKey(s.Metadata.signingKey.Public())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	serveBytes(w, r, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Prefix of generated API keys, making them easy to recognize in config files
+// and secret scanners.
+const apiKeyPrefix = "psk_"
+
+// An APIKey as persisted in the key file. Only the SHA-256 hash of the secret
+// is stored; the secret itself is shown once, when the key is created.
+type APIKey struct {
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Role      Role       `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key can be used at time t. A key revoked with a
+// grace period stays active until its revocation time.
+func (k APIKey) Active(t time.Time) bool {
+	return k.RevokedAt == nil || t.Before(*k.RevokedAt)
+}
+
+// KeyStore holds the API keys of a key file. The file is reread whenever it
+// changes on disk, so keys managed with the keys subcommand take effect
+// without restarting the server.
+type KeyStore struct {
+	path string
+
+	mu      sync.Mutex // Guards keys and modTime
+	keys    []APIKey
+	modTime time.Time
+}
+
+func NewKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// reload reads the key file if it was modified since it was last read. A
+// missing file is treated as an empty key set. Must be called with mu held or
+// before the store is shared.
+func (ks *KeyStore) reload() error {
+	info, err := os.Stat(ks.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		ks.keys, ks.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(ks.modTime) {
+		return nil
+	}
+	keys, err := readKeyFile(ks.path)
+	if err != nil {
+		return err
+	}
+	ks.keys, ks.modTime = keys, info.ModTime()
+	return nil
+}
+
+// Authenticate returns the active key matching secret.
+func (ks *KeyStore) Authenticate(secret string) (APIKey, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err := ks.reload(); err != nil {
+		slog.Error("could not reload key file", "error", err, "path", ks.path, "tag", TagAuth)
+	}
+	hash := hashKey(secret)
+	now := time.Now()
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 && k.Active(now) {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func readKeyFile(path string) ([]APIKey, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return nil, fmt.Errorf("parse key file %s: %w", path, err)
+	}
+	for i := range keys {
+		// Keys created before roles were introduced were all admin keys.
+		if keys[i].Role == "" {
+			keys[i].Role = RoleAdmin
+		}
+	}
+	return keys, nil
+}
+
+// writeKeyFile atomically replaces the key file, readable only by its owner.
+func writeKeyFile(path string, keys []APIKey) error {
+	buf, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(buf, '\n'), 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	fp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), path)
+}
+
+// activeKeyIndex returns the index of the unrevoked key called name, or -1.
+func activeKeyIndex(keys []APIKey, name string) int {
+	for i, k := range keys {
+		if k.Name == name && k.RevokedAt == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// runKeys implements the keys subcommand:
+//
+//	podserve keys -keyFile keys.json add|list|revoke|rotate [name]
+func runKeys(args []string) error {
+	fset := flag.NewFlagSet("keys", flag.ExitOnError)
+	keyFile := fset.String("keyFile", "", "path of the API key file")
+	roleName := fset.String(
+		"role", string(RoleAdmin),
+		"role of added keys: \"listener\" (feed and media), \"replica\" (syncing the library) "+
+			"or \"admin\" (everything)",
+	)
+	grace := fset.Duration(
+		"grace", 0,
+		"when rotating, keep the old key valid for this long",
+	)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve keys [flags] add|list|revoke|rotate [name]\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *keyFile == "" {
+		fset.Usage()
+		return errors.New("keys: -keyFile is required")
+	}
+	role, ok := ParseRole(*roleName)
+	if !ok {
+		return fmt.Errorf("keys: unknown role %q", *roleName)
+	}
+	cmd, name := fset.Arg(0), fset.Arg(1)
+	if cmd != "list" && name == "" {
+		fset.Usage()
+		return fmt.Errorf("keys %s: missing key name", cmd)
+	}
+
+	keys, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	switch cmd {
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\tCREATED\tSTATUS")
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				if k.Active(now) {
+					status = "expires " + k.RevokedAt.Format(time.RFC3339)
+				} else {
+					status = "revoked " + k.RevokedAt.Format(time.RFC3339)
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.Name, k.Role, k.CreatedAt.Format(time.RFC3339), status)
+		}
+		return tw.Flush()
+	case "add":
+		if activeKeyIndex(keys, name) >= 0 {
+			return fmt.Errorf("keys add: key %q already exists, use rotate to replace it", name)
+		}
+	case "revoke", "rotate":
+		i := activeKeyIndex(keys, name)
+		if i < 0 {
+			return fmt.Errorf("keys %s: no active key named %q", cmd, name)
+		}
+		revokedAt := now
+		if cmd == "rotate" {
+			revokedAt = now.Add(*grace)
+		}
+		keys[i].RevokedAt = &revokedAt
+		// A rotated key keeps its role.
+		role = keys[i].Role
+		if cmd == "revoke" {
+			return writeKeyFile(*keyFile, keys)
+		}
+	default:
+		fset.Usage()
+		return fmt.Errorf("keys: unknown command %q", cmd)
+	}
+
+	// Add a new key, either a fresh one or the replacement of a rotated key.
+	secret, err := generateKey()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, APIKey{Name: name, Hash: hashKey(secret), Role: role, CreatedAt: now})
+	if err := writeKeyFile(*keyFile, keys); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s key %q. Store it now, it will not be shown again:\n%s\n", role, name, secret)
+	return nil
+}
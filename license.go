@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// A License of the show or of an episode, emitted as <podcast:license>.
+//
+// See https://podcastindex.org/namespace/1.0#license
+type License struct {
+	// Name is an SPDX identifier, such as cc-by-4.0, or the name of a license
+	// not on the SPDX list, which then requires Url.
+	Name string
+	// Url of the license's text, optional for SPDX licenses.
+	Url string
+}
+
+// NewLicense returns the license of the given name and URL, nil if both are
+// empty.
+func NewLicense(name, u string) (*License, error) {
+	if name == "" && u == "" {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, errors.New("license URL without a license")
+	}
+	if u != "" {
+		if pu, err := url.Parse(u); err != nil || !pu.IsAbs() {
+			return nil, errors.New("license URL is not an absolute URL")
+		}
+	}
+	return &License{Name: name, Url: u}, nil
+}
+
+// Creative Commons licenses by the kind in their SPDX identifier.
+var ccKinds = map[string]bool{
+	"by": true, "by-sa": true, "by-nd": true, "by-nc": true, "by-nc-sa": true, "by-nc-nd": true,
+}
+
+// Link returns the URL of the license's text: Url, or the deed of a Creative
+// Commons license, empty if unknown.
+func (l License) Link() string {
+	if l.Url != "" {
+		return l.Url
+	}
+	id := strings.ToLower(l.Name)
+	if version, ok := strings.CutPrefix(id, "cc0-"); ok {
+		return "https://creativecommons.org/publicdomain/zero/" + version + "/"
+	}
+	kind, ok := strings.CutPrefix(id, "cc-")
+	i := strings.LastIndex(kind, "-")
+	if !ok || i < 0 || !ccKinds[kind[:i]] {
+		return ""
+	}
+	return "https://creativecommons.org/licenses/" + kind[:i] + "/" + kind[i+1:] + "/"
+}
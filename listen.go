@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd, see sd_listen_fds(3).
+const sdListenFdsStart = 3
+
+// listen opens a listener on addr, a TCP host:port or unix:path for a Unix
+// domain socket. A socket file left behind by a previous run is replaced.
+func listen(addr string) (net.Listener, error) {
+	p, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(p); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", p)
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// none if the server was not started that way. systemd keeps the sockets
+// open across restarts, so that connections wait for the server rather than
+// being refused.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// Not meant for child processes, such as ffmpeg.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var ls []net.Listener
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd socket "+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// The listener has its own copy of the file descriptor, not
+		// inherited by child processes.
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) == 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	return ls, nil
+}
+
+// listenerAddrs returns the addresses of ls, for logging.
+func listenerAddrs(ls []net.Listener) string {
+	addrs := make([]string, len(ls))
+	for i, l := range ls {
+		addrs[i] = l.Addr().Network() + ":" + l.Addr().String()
+	}
+	return strings.Join(addrs, ", ")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Episodes of the manifest are published under this directory of the
+	// media library. A directory of the media library with this name is
+	// skipped when scanning while there is a manifest.
+	ManifestDir = "_manifest"
+	// Timeout of HEAD requests for the sizes and dates of manifest episodes.
+	manifestHeadTimeout = 30 * time.Second
+)
+
+// A ManifestEntry is an episode hosted elsewhere. Its settings are those of a
+// Sidecar.
+type ManifestEntry struct {
+	// Url of the media file.
+	Url string `yaml:"url"`
+	// Name identifies the episode, in its URLs on podserve and for its GUID,
+	// and defaults to the file name of Url. Set it before changing Url to
+	// keep the episode's identity.
+	Name  string `yaml:"name"`
+	Title string `yaml:"title"`
+	// Date is the publication date, Size the length of the media file in
+	// bytes and Type its MIME type. Size and Date default to the
+	// Content-Length and Last-Modified of a HEAD request, Type to the type of
+	// the extension of Url.
+	Date     time.Time `yaml:"date"`
+	Size     int64     `yaml:"size"`
+	Type     string    `yaml:"type"`
+	Duration float64   `yaml:"duration"` // In seconds, optional.
+	Author   string    `yaml:"author"`
+
+	Sidecar `yaml:",inline"`
+}
+
+// A Manifest is a YAML file listing episodes hosted elsewhere, to aggregate
+// them with the media library into one feed. It is read again on every
+// refresh. Requests for their media files are redirected to their URLs, or
+// proxied, ranges included, if Proxy is set.
+type Manifest struct {
+	Path  string
+	Proxy bool
+
+	client *http.Client
+	mu     sync.Mutex // Guards heads
+	heads  map[string]manifestHead
+}
+
+// A manifestHead is what a HEAD request told of a media file.
+type manifestHead struct {
+	size    int64
+	modTime time.Time
+}
+
+func NewManifest(p string, proxy bool) *Manifest {
+	return &Manifest{Path: p, Proxy: proxy, client: &http.Client{}, heads: make(map[string]manifestHead)}
+}
+
+func (mf *Manifest) read() ([]ManifestEntry, error) {
+	buf, err := os.ReadFile(mf.Path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Episodes []ManifestEntry `yaml:"episodes"`
+	}
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", mf.Path, err)
+	}
+	names := make(map[string]bool, len(doc.Episodes))
+	for i := range doc.Episodes {
+		e := &doc.Episodes[i]
+		u, err := url.Parse(e.Url)
+		if err != nil || !(u.Scheme == "http" || u.Scheme == "https") {
+			return nil, fmt.Errorf("manifest %s: episode %d: invalid url %q", mf.Path, i+1, e.Url)
+		}
+		if e.Name == "" {
+			e.Name = path.Base(u.Path)
+		}
+		if e.Name == "." || e.Name == "/" || strings.Contains(e.Name, "/") {
+			return nil, fmt.Errorf("manifest %s: episode %d: invalid name %q", mf.Path, i+1, e.Name)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("manifest %s: episode %d: duplicate name %q, set another one", mf.Path, i+1, e.Name)
+		}
+		names[e.Name] = true
+		if e.Type == "" {
+			var ok bool
+			if e.Type, ok = mimeType[strings.ToLower(path.Ext(u.Path))]; !ok {
+				return nil, fmt.Errorf("manifest %s: episode %d: unknown media type of %q, set its type", mf.Path, i+1, e.Url)
+			}
+		}
+		if err := e.Sidecar.normalize(); err != nil {
+			return nil, fmt.Errorf("manifest %s: episode %d: %w", mf.Path, i+1, err)
+		}
+	}
+	return doc.Episodes, nil
+}
+
+// head returns the size and modification time of the media file at u, asking
+// its host once.
+func (mf *Manifest) head(u string) (manifestHead, error) {
+	mf.mu.Lock()
+	h, ok := mf.heads[u]
+	mf.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), manifestHeadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return h, err
+	}
+	resp, err := mf.client.Do(req)
+	if err != nil {
+		return h, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return h, fmt.Errorf("HEAD %s: %s", u, resp.Status)
+	}
+	h.size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	h.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	mf.mu.Lock()
+	mf.heads[u] = h
+	mf.mu.Unlock()
+	return h, nil
+}
+
+// Items returns the episodes of the manifest, and the URLs of those left out
+// as their media file could not be reached.
+func (mf *Manifest) Items(m Metadata) ([]Item, []string, error) {
+	entries, err := mf.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	var items []Item
+	var unreachable []string
+	for _, e := range entries {
+		if e.Size <= 0 || e.Date.IsZero() {
+			h, err := mf.head(e.Url)
+			if err != nil {
+				slog.Warn("skipping unreachable manifest episode", "error", err, "url", e.Url, "tag", TagRefresh)
+				unreachable = append(unreachable, e.Url)
+				continue
+			}
+			if e.Size <= 0 {
+				e.Size = h.size
+			}
+			if e.Date.IsZero() {
+				e.Date = h.modTime
+			}
+		}
+		if e.Date.IsZero() {
+			slog.Warn("skipping manifest episode without a date", "url", e.Url, "tag", TagRefresh)
+			continue
+		}
+		if e.Title == "" {
+			e.Title = strings.TrimSuffix(e.Name, path.Ext(e.Name))
+		}
+		p := ManifestDir + "/" + e.Name
+		prefix := m.externalUrl
+		if e.Draft {
+			prefix += PreviewPath[1:]
+		}
+		link := prefix + escapePath(p)
+		items = append(items, Item{
+			Title:   e.Title,
+			Path:    p,
+			ModTime: e.Date,
+			Link:    link,
+			Desc:    e.Notes,
+			Author:  e.Author,
+			Enclosure: Enclosure{
+				Url:    link,
+				Length: e.Size,
+				Type:   e.Type,
+			},
+			Duration: e.Duration,
+			Slug:     e.Slug,
+			Pinned:   e.Pinned,
+			Order:    e.Order,
+			Draft:    e.Draft,
+
+			Explicit: e.Explicit,
+			Value:    e.Value,
+
+			SocialInteract: e.SocialInteract,
+			CommentsUrl:    e.CommentsUrl,
+			License:        e.license,
+
+			fileTime: e.Date,
+			origin:   e.Url,
+		})
+	}
+	return items, unreachable, nil
+}
+
+// ServeFile serves the manifest episode file f, of f.Url.
+func (mf *Manifest) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	if !mf.Proxy {
+		http.Redirect(w, r, f.Url, http.StatusFound)
+		return
+	}
+	proxyFile(w, r, f.Url, TagHttp, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, r.Method, f.Url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header
+		return mf.client.Do(req)
+	})
+}
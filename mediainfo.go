@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key of the MediaInfo in the MetaCache, changed when parsers read more, for
+// files read before to be read again.
+const metaMediaInfo = "mediainfo6"
+
+// MediaInfo is what is read from the contents of a media file.
+type MediaInfo struct {
+	Duration float64 `json:"duration"` // In seconds, 0 if unknown.
+	// Tags with lower case keys, e.g. "title" or "artist".
+	Tags     map[string]string `json:"tags,omitempty"`
+	Chapters []Chapter         `json:"chapters,omitempty"`
+	// MD5 of the decoded audio as recorded in the file, to verify its
+	// integrity, only known for FLAC, see Verifier.Ffmpeg.
+	AudioMD5  string `json:"audio_md5,omitempty"`
+	audioBits int    // Bits per sample the MD5 is of.
+	// Type of the cover art embedded in the file, if any. The image itself is
+	// not in the MetaCache but read when first served, see ServeArtwork.
+	Artwork string `json:"artwork,omitempty"`
+	artwork []byte
+}
+
+// setArtwork keeps the embedded picture data if it is an image.
+func (mi *MediaInfo) setArtwork(data []byte) {
+	if typ := http.DetectContentType(data); strings.HasPrefix(typ, "image/") {
+		mi.Artwork, mi.artwork = typ, data
+	}
+}
+
+type Chapter struct {
+	Start float64 `json:"start"` // In seconds.
+	End   float64 `json:"end"`
+	Title string  `json:"title"`
+	// URLs of an image and a page for the chapter, only given by chapters
+	// files, see ChaptersPath.
+	Image string `json:"img,omitempty"`
+	Url   string `json:"url,omitempty"`
+}
+
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// readBlock reads the n bytes of a block of r. The buffer grows as they are
+// read rather than being allocated up front, so that the size given by a
+// corrupt or truncated file is not allocated whole.
+func readBlock(r io.Reader, n int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, n))
+	if err == nil && int64(len(b)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// mediaParsers read MediaInfo natively, by file extension. A parser returns
+// errUnsupportedFormat for files it cannot make sense of.
+var mediaParsers = map[string]func(path string) (MediaInfo, error){
+	".ogg":  parseOgg,
+	".oga":  parseOgg,
+	".opus": parseOgg,
+	".flac": parseFlac,
+	".mp3":  parseMP3,
+	".mp4":  parseMP4,
+	".m4a":  parseMP4,
+	".m4v":  parseMP4,
+	".mov":  parseMP4,
+	".wav":  parseWav,
+}
+
+// An Extractor reads the MediaInfo of media files, with the native parser of
+// the format if there is one and else, or if it fails or does not find the
+// duration, with ffprobe if enabled. Results are cached in the MetaCache.
+type Extractor struct {
+	Meta    *MetaCache
+	FFprobe string // ffprobe executable, optional.
+}
+
+// Extract returns the MediaInfo of the file at the relative path p, and false
+// if none could be read.
+func (e *Extractor) Extract(root, p string) (MediaInfo, bool) {
+	src := filepath.Join(root, filepath.FromSlash(p))
+	info, err := os.Stat(src)
+	if err != nil {
+		return MediaInfo{}, false
+	}
+	var mi MediaInfo
+	if e.Meta.Get(p, info, metaMediaInfo, &mi) {
+		return mi, true
+	}
+	err = errUnsupportedFormat
+	if parse, ok := mediaParsers[strings.ToLower(filepath.Ext(p))]; ok {
+		mi, err = parse(src)
+	}
+	if (err != nil || mi.Duration == 0) && e.FFprobe != "" {
+		if err != nil && !errors.Is(err, errUnsupportedFormat) {
+			slog.Debug("falling back to ffprobe", "error", err, "file", p, "tag", TagRefresh)
+		}
+		// Keeps what the native parser read if ffprobe fails too.
+		if probed, perr := ffprobe(e.FFprobe, src); perr == nil || err != nil {
+			mi, err = probed, perr
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, errUnsupportedFormat) {
+			slog.Warn("could not read media info", "error", err, "file", p, "tag", TagRefresh)
+		}
+		return MediaInfo{}, false
+	}
+	if err := e.Meta.Put(p, info, metaMediaInfo, mi); err != nil {
+		slog.Warn("could not cache media info", "error", err, "file", p, "tag", TagRefresh)
+	}
+	return mi, true
+}
+
+// applyMediaInfo sets the fields of an item that come from its media file.
+// Titles from tags replace file names, while descriptions from tags are only
+// used if the sidecar has no notes.
+func applyMediaInfo(it *Item, mi MediaInfo) {
+	it.Duration = mi.Duration
+	it.Chapters = mi.Chapters
+	if t := strings.TrimSpace(mi.Tags["title"]); t != "" {
+		it.Title = t
+	}
+	if it.Desc == "" {
+		it.Desc = mi.Tags["description"]
+	}
+	if it.Desc == "" {
+		it.Desc = mi.Tags["comment"]
+	}
+	it.Author = strings.TrimSpace(mi.Tags["artist"])
+	it.track = trackNumber(mi.Tags)
+	if d, ok := parseTagDate(mi.Tags["date"]); ok {
+		it.ModTime = d
+	}
+}
+
+// trackNumber returns the track number of tags, 0 if there is none. Vorbis
+// comments name it tracknumber, and it may be followed by the number of
+// tracks, as in 3/12.
+func trackNumber(tags map[string]string) int {
+	s, ok := tags["track"]
+	if !ok {
+		s = tags["tracknumber"]
+	}
+	s, _, _ = strings.Cut(s, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// parseTagDate parses the date of a tag, which must at least include the
+// day. Years alone, as often found in tags, are ignored.
+func parseTagDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ffprobe reads the MediaInfo of the file at src with ffprobe.
+func ffprobe(ffprobe, src string) (MediaInfo, error) {
+	out, err := exec.Command(
+		ffprobe, "-v", "error", "-print_format", "json",
+		"-show_format", "-show_chapters", src,
+	).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return MediaInfo{}, fmt.Errorf("ffprobe: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return MediaInfo{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return MediaInfo{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var mi MediaInfo
+	mi.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if len(probe.Format.Tags) > 0 {
+		mi.Tags = make(map[string]string, len(probe.Format.Tags))
+		for k, v := range probe.Format.Tags {
+			mi.Tags[strings.ToLower(k)] = v
+		}
+	}
+	for _, c := range probe.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		mi.Chapters = append(mi.Chapters, Chapter{Start: start, End: end, Title: c.Tags["title"]})
+	}
+	return mi, nil
+}
+
+// formatDuration formats seconds as H:MM:SS, as used by itunes:duration.
+func formatDuration(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+}
+
+// NewExtractor returns an Extractor falling back to the ffprobe executable,
+// looked up in PATH, or never falling back if ffprobe is empty.
+func NewExtractor(meta *MetaCache, ffprobe string) (*Extractor, error) {
+	if ffprobe == "" {
+		return &Extractor{Meta: meta}, nil
+	}
+	p, err := exec.LookPath(ffprobe)
+	if err != nil {
+		return nil, err
+	}
+	return &Extractor{Meta: meta, FFprobe: p}, nil
+}
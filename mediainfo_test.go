@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// writeMedia writes a media file fixture named name, returning its path.
+func writeMedia(t *testing.T, name string, b []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// allocated returns the number of bytes f allocates.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// parseTruncated parses every prefix of b as a file named name, which must
+// not panic, whatever error it returns.
+func parseTruncated(t *testing.T, name string, b []byte, parse func(string) (MediaInfo, error)) {
+	t.Helper()
+	dir := t.TempDir()
+	for n := range b {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		parse(p)
+	}
+}
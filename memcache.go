@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memCacheMaxEntry is the size of the largest response kept by a MemCache.
+const memCacheMaxEntry = 4 << 20
+
+// A MemCache keeps small responses in memory, with a gzipped variant of those
+// worth compressing: the feeds, the HTML feed pages, cover images and static
+// assets. They are then neither rendered nor read again, nor compressed on
+// every request. The responses of a show are dropped when it is refreshed,
+// see Invalidate, and the least recently used ones beyond MaxSize.
+//
+// A nil MemCache caches nothing, and responses not cached are not gzipped
+// either, which would cost a compression every time.
+type MemCache struct {
+	MaxSize int64
+
+	mu      sync.Mutex // Guards all below
+	entries map[string]*memEntry
+	size    int64
+	tick    uint64 // Incremented on every use, to order entries by last use.
+}
+
+// A memEntry is a cached response.
+type memEntry struct {
+	body        []byte
+	gz          []byte // Gzipped body, nil if not worth it.
+	contentType string
+	etag        string
+	modTime     time.Time
+	used        uint64
+}
+
+var errTooLarge = errors.New("response too large to cache")
+
+func NewMemCache(maxSize int64) *MemCache {
+	return &MemCache{MaxSize: maxSize, entries: make(map[string]*memEntry)}
+}
+
+// newMemEntry returns the cached response body of type contentType, with the
+// ETag etag if given, or else one following from body.
+func newMemEntry(contentType string, body []byte, modTime time.Time, etag string) (*memEntry, error) {
+	if len(body) > memCacheMaxEntry {
+		return nil, errTooLarge
+	}
+	e := &memEntry{body: body, contentType: contentType, etag: etag, modTime: modTime}
+	if e.etag == "" {
+		sum := sha256.Sum256(body)
+		e.etag = `"` + hex.EncodeToString(sum[:12]) + `"`
+	}
+	return e, nil
+}
+
+// compress sets the gzipped body of e, if worth it.
+func (e *memEntry) compress() {
+	if !compressible(e.contentType) || len(e.body) <= 1<<10 {
+		return
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(e.body)
+	zw.Close()
+	if buf.Len() < len(e.body) {
+		e.gz = buf.Bytes()
+	}
+}
+
+// compressible reports whether responses of type contentType are worth
+// compressing, unlike images and media that are compressed already.
+func compressible(contentType string) bool {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.TrimSpace(typ)
+	return strings.HasPrefix(typ, "text/") ||
+		strings.HasSuffix(typ, "xml") ||
+		strings.HasSuffix(typ, "json") ||
+		typ == "application/javascript"
+}
+
+// Get returns the response cached under key, or else that of fill, cached if
+// not too large.
+func (c *MemCache) Get(key string, fill func() (*memEntry, error)) (*memEntry, error) {
+	if c == nil {
+		return fill()
+	}
+	c.mu.Lock()
+	c.tick++
+	if e, ok := c.entries[key]; ok {
+		e.used = c.tick
+		c.mu.Unlock()
+		return e, nil
+	}
+	c.mu.Unlock()
+
+	e, err := fill()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(e.body)) > c.MaxSize {
+		return e, nil
+	}
+	e.compress()
+	size := e.size()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.size -= old.size()
+	}
+	e.used = c.tick
+	c.entries[key] = e
+	c.size += size
+	for c.size > c.MaxSize {
+		c.evict()
+	}
+	return e, nil
+}
+
+func (e *memEntry) size() int64 {
+	return int64(len(e.body) + len(e.gz))
+}
+
+// evict drops the least recently used entry. The caller holds c.mu.
+func (c *MemCache) evict() {
+	var oldest string
+	var used uint64
+	for key, e := range c.entries {
+		if oldest == "" || e.used < used {
+			oldest, used = key, e.used
+		}
+	}
+	c.size -= c.entries[oldest].size()
+	delete(c.entries, oldest)
+}
+
+// Invalidate drops the responses cached under keys starting with prefix.
+func (c *MemCache) Invalidate(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.size -= e.size()
+			delete(c.entries, key)
+		}
+	}
+}
+
+// FileServer serves the files of fsys, which never change, like
+// http.FileServer but from memory.
+func (c *MemCache) FileServer(fsys fs.FS) http.Handler {
+	files := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		e, err := c.Get("fs:"+name, func() (*memEntry, error) {
+			body, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, err
+			}
+			typ := mime.TypeByExtension(path.Ext(name))
+			if typ == "" {
+				typ = http.DetectContentType(body)
+			}
+			return newMemEntry(typ, body, time.Time{}, "")
+		})
+		if err != nil || !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			// Directories, missing files and the like.
+			files.ServeHTTP(w, r)
+			return
+		}
+		e.serve(w, r)
+	})
+}
+
+// serve serves the response, gzipped if the client accepts it.
+func (e *memEntry) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", e.contentType)
+	body, etag := e.body, e.etag
+	if e.gz != nil {
+		h.Add("Vary", "Accept-Encoding")
+		// Ranges are of the file as is.
+		if r.Header.Get("Range") == "" && acceptsGzip(r) {
+			body, etag = e.gz, strings.TrimSuffix(etag, `"`)+`-gzip"`
+			h.Set("Content-Encoding", "gzip")
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, "", e.modTime, bytes.NewReader(body))
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r accepts gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// A metaEntry holds what was extracted from one media file, valid as long as
+// the file keeps its size and modification time.
+type metaEntry struct {
+	Size    int64                      `json:"size"`
+	ModTime time.Time                  `json:"mod_time"`
+	Values  map[string]json.RawMessage `json:"values"`
+}
+
+// MetaCache caches metadata extracted from media files, such as their
+// loudness, keyed by path relative to the media directory, so that unchanged
+// files are not parsed or measured again. It is kept in memory and, if given
+// a path, persisted across restarts. A nil MetaCache caches nothing.
+type MetaCache struct {
+	path string // Optional.
+
+	mu      sync.Mutex // Guards entries and dirty
+	entries map[string]*metaEntry
+	dirty   bool
+}
+
+func NewMetaCache(path string) (*MetaCache, error) {
+	c := &MetaCache{path: path, entries: make(map[string]*metaEntry)}
+	if path == "" {
+		return c, nil
+	}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &c.entries); err != nil {
+		return nil, fmt.Errorf("parse metadata cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *MetaCache) valid(e *metaEntry, info fs.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// Get decodes the value cached under key for the file at p into v. It reports
+// false if there is none, or if the file has changed since.
+func (c *MetaCache) Get(p string, info fs.FileInfo, key string, v any) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[p]
+	if !ok || !c.valid(e, info) {
+		return false
+	}
+	raw, ok := e.Values[key]
+	return ok && json.Unmarshal(raw, v) == nil
+}
+
+// Stored decodes the value cached under key for the file at p into v even if
+// the file has changed since, and returns the size and modification time the
+// file had then. It reports false if there is none.
+func (c *MetaCache) Stored(p string, key string, v any) (int64, time.Time, bool) {
+	if c == nil {
+		return 0, time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[p]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	raw, ok := e.Values[key]
+	if !ok || json.Unmarshal(raw, v) != nil {
+		return 0, time.Time{}, false
+	}
+	return e.Size, e.ModTime, true
+}
+
+// Paths returns the paths of the files with cached values.
+func (c *MetaCache) Paths() []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := make([]string, 0, len(c.entries))
+	for p := range c.entries {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// Put caches v under key for the file at p, dropping values cached for an
+// earlier version of the file.
+func (c *MetaCache) Put(p string, info fs.FileInfo, key string, v any) error {
+	if c == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[p]
+	if !ok || !c.valid(e, info) {
+		e = &metaEntry{Size: info.Size(), ModTime: info.ModTime(), Values: make(map[string]json.RawMessage)}
+		c.entries[p] = e
+	}
+	e.Values[key] = raw
+	c.dirty = true
+	return nil
+}
+
+// Prune drops the entries of files not in keep.
+func (c *MetaCache) Prune(keep map[string]bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.entries {
+		if !keep[p] {
+			delete(c.entries, p)
+			c.dirty = true
+		}
+	}
+}
+
+// Save persists the cache if it has changed.
+func (c *MetaCache) Save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	buf, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path, buf, 0o644); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"podserve/httplog"
+)
+
+// MetricsPath serves metrics in the Prometheus text format.
+const MetricsPath = "/metrics"
+
+// A metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) Help(name, typ, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a sample of a metric, labels given as name and value pairs.
+func (w *metricsWriter) Sample(name string, value any, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		fmt.Fprintf(&w.buf, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(&w.buf, " %v\n", value)
+}
+
+func (w *metricsWriter) Counter(name, help string, value any) {
+	w.Help(name, "counter", help)
+	w.Sample(name, value)
+}
+
+func (w *metricsWriter) Gauge(name, help string, value any) {
+	w.Help(name, "gauge", help)
+	w.Sample(name, value)
+}
+
+// ServeMetrics serves the metrics of the server for Prometheus to scrape.
+func (s *Server) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var mw metricsWriter
+	s.History.WriteMetrics(&mw)
+	s.mu.RLock()
+	mw.Gauge("podserve_feed_items", "Episodes in the feed.", len(s.Items))
+	mw.Gauge("podserve_feed_drafts", "Drafts, only in the preview feed.", s.Drafts)
+	s.mu.RUnlock()
+	if s.Http != nil {
+		s.Http.WriteMetrics(&mw)
+	}
+	if s.Limiter != nil {
+		s.Limiter.WriteMetrics(&mw)
+	}
+	if s.Blocklist != nil {
+		s.Blocklist.WriteMetrics(&mw)
+	}
+	if s.Integrity != nil {
+		s.Integrity.WriteMetrics(&mw)
+	}
+	if s.Replica != nil {
+		s.Replica.WriteMetrics(&mw)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(mw.buf.Bytes())
+}
+
+// HttpMetrics counts the requests of a show and the bytes sent, by route.
+type HttpMetrics struct {
+	mu       sync.Mutex // Guards the fields below
+	requests map[httpRequestKey]int64
+	bytes    map[string]int64 // By route.
+}
+
+type httpRequestKey struct {
+	route  string
+	status int
+}
+
+func NewHttpMetrics() *HttpMetrics {
+	return &HttpMetrics{requests: make(map[httpRequestKey]int64), bytes: make(map[string]int64)}
+}
+
+// Wrap counts the requests handled by mux, by the pattern they match rather
+// than their path so as not to count every media file apart.
+func (m *HttpMetrics) Wrap(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw, ok := w.(*httplog.ResponseWriter)
+		if !ok {
+			rw = httplog.NewResponseWriter(w)
+		}
+		written := rw.Written()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+		defer func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.requests[httpRequestKey{route, rw.Status()}]++
+			m.bytes[route] += rw.Written() - written
+		}()
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+func (m *HttpMetrics) WriteMetrics(w *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]httpRequestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b httpRequestKey) int {
+		if c := strings.Compare(a.route, b.route); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+	w.Help("podserve_http_requests_total", "counter", "HTTP requests, by route and status.")
+	for _, k := range keys {
+		w.Sample("podserve_http_requests_total", m.requests[k], "route", k.route, "status", strconv.Itoa(k.status))
+	}
+	w.Help("podserve_http_response_bytes_total", "counter", "Bytes of response bodies sent, by route.")
+	routes := make([]string, 0, len(m.bytes))
+	for route := range m.bytes {
+		routes = append(routes, route)
+	}
+	slices.Sort(routes)
+	for _, route := range routes {
+		w.Sample("podserve_http_response_bytes_total", m.bytes[route], "route", route)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// The audio of MP3 files is a sequence of MPEG frames, each starting with a
+// 4 byte header giving its bit rate and sample rate. There is no overall
+// length: VBR encoders write the number of frames in a Xing (or Info) or VBRI
+// header in the first frame, while for CBR files it follows from the bit rate
+// and the size of the audio.
+//
+// See http://www.mp3-tech.org/programmer/frame_header.html and
+// https://www.codeproject.com/Articles/8295/MPEG-Audio-Frame-Header
+
+const (
+	// How far past the ID3v2 tag to look for the first frame.
+	mp3SyncWindow = 64 << 10
+)
+
+// mp3Bitrates are the bit rates in kbit/s by bitrate index, of MPEG-1 layers
+// I, II and III and of MPEG-2 and 2.5 layer I and layers II and III.
+var mp3Bitrates = [5][16]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mp3SampleRates are the sample rates of MPEG-1 by index, halved for MPEG-2
+// and quartered for MPEG-2.5.
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+// An mp3Frame is what the header of a frame tells.
+type mp3Frame struct {
+	mpeg1      bool
+	layer      int
+	bitrate    int // In bit/s.
+	sampleRate int
+	samples    int // Per frame.
+	size       int // In bytes, header included.
+	mono       bool
+}
+
+// parseMP3Frame parses the frame header at the start of b.
+func parseMP3Frame(b []byte) (mp3Frame, bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, false
+	}
+	version := b[1] >> 3 & 3 // 0: 2.5, 2: 2, 3: 1
+	layer := 4 - int(b[1]>>1&3)
+	bitrateIndex := b[2] >> 4
+	rateIndex := b[2] >> 2 & 3
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	f := mp3Frame{mpeg1: version == 3, layer: layer, mono: b[3]>>6 == 3}
+	table := layer - 1
+	if !f.mpeg1 {
+		table = 3
+		if layer > 1 {
+			table = 4
+		}
+	}
+	f.bitrate = mp3Bitrates[table][bitrateIndex] * 1000
+	f.sampleRate = mp3SampleRates[rateIndex]
+	switch version {
+	case 2:
+		f.sampleRate /= 2
+	case 0:
+		f.sampleRate /= 4
+	}
+	padding := int(b[2] >> 1 & 1)
+	switch {
+	case layer == 1:
+		f.samples = 384
+		f.size = (12*f.bitrate/f.sampleRate + padding) * 4
+	case layer == 3 && !f.mpeg1:
+		f.samples = 576
+		f.size = 72*f.bitrate/f.sampleRate + padding
+	default:
+		f.samples = 1152
+		f.size = 144*f.bitrate/f.sampleRate + padding
+	}
+	return f, true
+}
+
+// mp3Duration returns the duration in seconds of the audio of fp, which
+// starts at off and ends at end, or 0 if no frame is found there.
+func mp3Duration(fp *os.File, off, end int64) (float64, error) {
+	buf := make([]byte, min(mp3SyncWindow, end-off))
+	n, err := fp.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	buf = buf[:n]
+	// The first frame is the first header followed by another one, so that
+	// stray sync bits in padding or junk are skipped.
+	for i := 0; i+4 <= len(buf); i++ {
+		f, ok := parseMP3Frame(buf[i:])
+		if !ok {
+			continue
+		}
+		next, ok := parseMP3Frame(buf[min(i+f.size, len(buf)):])
+		if i+f.size+4 <= len(buf) && (!ok || next.sampleRate != f.sampleRate) {
+			continue
+		}
+		if frames, ok := mp3VBRFrames(buf[i:], f); ok {
+			return float64(frames) * float64(f.samples) / float64(f.sampleRate), nil
+		}
+		audio := end - off - int64(i)
+		return float64(audio) * 8 / float64(f.bitrate), nil
+	}
+	return 0, nil
+}
+
+// mp3VBRFrames returns the number of frames in the Xing or VBRI header of the
+// first frame b, if it has one.
+func mp3VBRFrames(b []byte, f mp3Frame) (int64, bool) {
+	// The Xing header follows the side information, whose size depends on
+	// the version and the channels.
+	side := 32
+	switch {
+	case f.mpeg1 && f.mono, !f.mpeg1 && !f.mono:
+		side = 17
+	case !f.mpeg1 && f.mono:
+		side = 9
+	}
+	if x := b[min(4+side, len(b)):]; len(x) >= 12 && (bytes.HasPrefix(x, []byte("Xing")) || bytes.HasPrefix(x, []byte("Info"))) {
+		if binary.BigEndian.Uint32(x[4:])&1 == 0 {
+			return 0, false
+		}
+		return int64(binary.BigEndian.Uint32(x[8:])), true
+	}
+	if v := b[min(36, len(b)):]; len(v) >= 18 && bytes.HasPrefix(v, []byte("VBRI")) {
+		return int64(binary.BigEndian.Uint32(v[14:])), true
+	}
+	return 0, false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// mp3Frames returns n frames with the given header, whose first frame body
+// starts with first.
+func mp3Frames(header []byte, n int, first []byte) []byte {
+	f, ok := parseMP3Frame(header)
+	if !ok {
+		panic("invalid frame header")
+	}
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		frame := make([]byte, f.size)
+		copy(frame, header)
+		if i == 0 {
+			copy(frame[4:], first)
+		}
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+func TestMP3Duration(t *testing.T) {
+	// MPEG-1 layer III at 128 kbit/s and 44.1 kHz, stereo and mono, and
+	// MPEG-2 layer III at 64 kbit/s and 22.05 kHz.
+	stereo := []byte{0xff, 0xfb, 0x90, 0x00}
+	mono := []byte{0xff, 0xfb, 0x90, 0xc0}
+	mpeg2 := []byte{0xff, 0xf3, 0x80, 0x00}
+	xing := func(frames uint32) []byte {
+		b := append([]byte("Xing"), 0, 0, 0, 1)
+		return binary.BigEndian.AppendUint32(b, frames)
+	}
+	vbri := binary.BigEndian.AppendUint32(append([]byte("VBRI"), make([]byte, 10)...), 1000)
+	tag := id3TagOf(4, id3FrameOf(4, "TIT2", []byte("\x03Episode 1")))
+	tests := []struct {
+		name     string
+		data     []byte
+		duration float64
+	}{
+		{"CBR", mp3Frames(stereo, 10, nil), float64(10*417*8) / 128000},
+		{"CBR after ID3v2", concat(tag, mp3Frames(stereo, 10, nil)), float64(10*417*8) / 128000},
+		{
+			"CBR between ID3v2 and ID3v1",
+			concat(tag, mp3Frames(stereo, 10, nil), id3v1("Episode 1", "", "", "")),
+			float64(10*417*8) / 128000,
+		},
+		{"MPEG-2", mp3Frames(mpeg2, 10, nil), float64(10*208*8) / 64000},
+		{"Xing", mp3Frames(stereo, 3, concat(make([]byte, 32), xing(500))), 500 * 1152 / 44100.0},
+		{"Xing mono", mp3Frames(mono, 3, concat(make([]byte, 17), xing(500))), 500 * 1152 / 44100.0},
+		{"Xing without frames", mp3Frames(stereo, 3, concat(make([]byte, 32), []byte("Xing\x00\x00\x00\x00"))), float64(3*417*8) / 128000},
+		{"VBRI", mp3Frames(stereo, 3, concat(make([]byte, 32), vbri)), 1000 * 1152 / 44100.0},
+		// Sync bits not followed by a frame are skipped.
+		{"junk", concat([]byte{0xff, 0xfb, 0x90, 0x00, 1, 2, 3}, mp3Frames(stereo, 10, nil)), float64(10*417*8) / 128000},
+		{"no frames", concat(tag, make([]byte, 1000)), 0},
+		{"invalid header", concat(tag, []byte{0xff, 0xff, 0xff, 0xff}, make([]byte, 100)), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mi, err := parseMP3(writeMedia(t, "episode.mp3", tt.data))
+			if err != nil {
+				t.Fatalf("parseMP3: %v", err)
+			}
+			if mi.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", mi.Duration, tt.duration)
+			}
+		})
+	}
+	parseTruncated(t, "episode.mp3", mp3Frames(stereo, 3, concat(make([]byte, 32), xing(500))), parseMP3)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// MP4 files (and QuickTime, which they derive from) are trees of boxes, each
+// a 32 bit size and a 4 character type followed by its body. iTunes-style
+// tags are items of moov/udta/meta/ilst, each holding its value in a data
+// box, cover art included. The moov box may come after the media data, which
+// is skipped over. Chapters are read from the Nero chpl box of moov/udta, as
+// written by ffmpeg and most podcast tools.
+//
+// See ISO/IEC 14496-12 and
+// https://developer.apple.com/documentation/quicktime-file-format/metadata_item_list_atom
+
+// mp4TagItems maps the ilst items read to tag keys, as named by ffprobe.
+var mp4TagItems = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"\xa9alb": "album",
+	"\xa9day": "date",
+	"\xa9cmt": "comment",
+	"\xa9gen": "genre",
+	"desc":    "description",
+	// Long description, preferred over the short one.
+	"ldes": "description",
+}
+
+// Cover art larger than this is skipped.
+const mp4MaxCover = 16 << 20
+
+// mp4Box is the header of a box: its type, and where its body starts and
+// ends in the file.
+type mp4Box struct {
+	typ        string
+	start, end int64
+}
+
+// mp4Boxes returns the boxes between off and end of r.
+func mp4Boxes(r io.ReaderAt, off, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for off+8 <= end {
+		var h [16]byte
+		if _, err := r.ReadAt(h[:8], off); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(h[:4]))
+		head := int64(8)
+		switch size {
+		case 0: // Extends to the end.
+			size = end - off
+		case 1: // 64 bit size.
+			if _, err := r.ReadAt(h[8:16], off+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(h[8:16]))
+			head = 16
+		}
+		if size < head || size > end-off {
+			return nil, fmt.Errorf("mp4: invalid size of box %q", h[4:8])
+		}
+		boxes = append(boxes, mp4Box{typ: string(h[4:8]), start: off + head, end: off + size})
+		off += size
+	}
+	return boxes, nil
+}
+
+// mp4Find returns the first box of the given type among boxes.
+func mp4Find(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// parseMP4 reads the duration and tags of an MP4 or QuickTime file.
+func parseMP4(path string) (MediaInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	top, err := mp4Boxes(fp, 0, info.Size())
+	if err != nil || len(top) == 0 {
+		return MediaInfo{}, errUnsupportedFormat
+	}
+	switch top[0].typ {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip":
+	default:
+		return MediaInfo{}, errUnsupportedFormat
+	}
+	moov, ok := mp4Find(top, "moov")
+	if !ok {
+		return MediaInfo{}, errors.New("mp4: no moov box")
+	}
+	var mi MediaInfo
+	if mi.Duration, err = mp4Duration(fp, moov); err != nil {
+		return MediaInfo{}, err
+	}
+	var cover []byte
+	if mi.Tags, cover, err = mp4Tags(fp, moov); err != nil {
+		return MediaInfo{}, err
+	}
+	if cover != nil {
+		mi.setArtwork(cover)
+	}
+	if mi.Chapters, err = mp4Chapters(fp, moov, mi.Duration); err != nil {
+		return MediaInfo{}, err
+	}
+	return mi, nil
+}
+
+// mp4Chapters reads the chapters of the chpl box of the moov box, each
+// ending where the next starts and the last at the end of the file.
+func mp4Chapters(r io.ReaderAt, moov mp4Box, duration float64) ([]Chapter, error) {
+	children, err := mp4Boxes(r, moov.start, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	udta, ok := mp4Find(children, "udta")
+	if !ok {
+		return nil, nil
+	}
+	if children, err = mp4Boxes(r, udta.start, udta.end); err != nil {
+		return nil, err
+	}
+	chpl, ok := mp4Find(children, "chpl")
+	if !ok || chpl.end-chpl.start > 1<<20 {
+		return nil, nil
+	}
+	b := make([]byte, chpl.end-chpl.start)
+	if _, err := r.ReadAt(b, chpl.start); err != nil {
+		return nil, err
+	}
+	// The version and flags, 4 reserved bytes in version 1, and the number
+	// of chapters. Every chapter is a start time in units of 100 ns and a
+	// title prefixed by its length.
+	if len(b) < 5 {
+		return nil, nil
+	}
+	off := 4
+	if b[0] == 1 {
+		off += 4
+	}
+	if off >= len(b) {
+		return nil, nil
+	}
+	n := int(b[off])
+	off++
+	var chapters []Chapter
+	for i := 0; i < n && off+9 <= len(b); i++ {
+		start := float64(binary.BigEndian.Uint64(b[off:])) / 1e7
+		l := int(b[off+8])
+		off += 9
+		if off+l > len(b) {
+			break
+		}
+		title := strings.ToValidUTF8(string(b[off:off+l]), "\uFFFD")
+		off += l
+		if len(chapters) > 0 {
+			chapters[len(chapters)-1].End = start
+		}
+		c := Chapter{Start: start, Title: title}
+		if duration > start {
+			c.End = duration
+		}
+		chapters = append(chapters, c)
+	}
+	return chapters, nil
+}
+
+// mp4Duration reads the duration of the movie from the mvhd box of the moov
+// box, 0 if unknown as in fragmented files.
+func mp4Duration(r io.ReaderAt, moov mp4Box) (float64, error) {
+	children, err := mp4Boxes(r, moov.start, moov.end)
+	if err != nil {
+		return 0, err
+	}
+	mvhd, ok := mp4Find(children, "mvhd")
+	if !ok || mvhd.end-mvhd.start < 32 {
+		return 0, nil
+	}
+	var b [32]byte
+	if _, err := r.ReadAt(b[:], mvhd.start); err != nil {
+		return 0, err
+	}
+	// After the version and flags, creation and modification times precede
+	// the time scale and duration, all 64 bits wide in version 1.
+	var scale, duration uint64
+	if b[0] == 1 {
+		scale = uint64(binary.BigEndian.Uint32(b[20:]))
+		duration = binary.BigEndian.Uint64(b[24:])
+	} else {
+		scale = uint64(binary.BigEndian.Uint32(b[12:]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+		if duration == 0xffffffff {
+			duration = 0
+		}
+	}
+	if scale == 0 {
+		return 0, nil
+	}
+	return float64(duration) / float64(scale), nil
+}
+
+// mp4Tags reads the ilst items of the moov box, returning the tags and the
+// image data of the first cover.
+func mp4Tags(r io.ReaderAt, moov mp4Box) (map[string]string, []byte, error) {
+	box := moov
+	for _, typ := range []string{"udta", "meta", "ilst"} {
+		children, err := mp4Boxes(r, box.start, box.end)
+		if err != nil {
+			return nil, nil, err
+		}
+		var ok bool
+		if box, ok = mp4Find(children, typ); !ok {
+			return nil, nil, nil
+		}
+		if typ == "meta" {
+			// A full box with a version and flags in MP4, but not in
+			// QuickTime.
+			var vf [4]byte
+			if _, err := r.ReadAt(vf[:], box.start); err != nil {
+				return nil, nil, err
+			}
+			if vf == [4]byte{} {
+				box.start += 4
+			}
+		}
+	}
+	items, err := mp4Boxes(r, box.start, box.end)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags := make(map[string]string)
+	var cover []byte
+	for _, it := range items {
+		if it.typ == "covr" && cover == nil {
+			if cover, err = mp4Cover(r, it); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if it.typ == "trkn" {
+			n, err := mp4TrackNumber(r, it)
+			if err != nil {
+				return nil, nil, err
+			}
+			if n > 0 {
+				tags["track"] = strconv.Itoa(n)
+			}
+			continue
+		}
+		k, ok := mp4TagItems[it.typ]
+		if !ok {
+			continue
+		}
+		if _, ok := tags[k]; ok && it.typ != "ldes" {
+			continue
+		}
+		v, err := mp4Text(r, it)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags, cover, nil
+}
+
+// mp4Text returns the text value of the data box of an ilst item, empty if
+// it is not text.
+func mp4Text(r io.ReaderAt, item mp4Box) (string, error) {
+	children, err := mp4Boxes(r, item.start, item.end)
+	if err != nil {
+		return "", err
+	}
+	data, ok := mp4Find(children, "data")
+	// A type indicator and a locale precede the value. Text items are short,
+	// larger ones are e.g. cover art.
+	if !ok || data.end-data.start < 8 || data.end-data.start > 1<<20 {
+		return "", nil
+	}
+	b := make([]byte, data.end-data.start)
+	if _, err := r.ReadAt(b, data.start); err != nil {
+		return "", err
+	}
+	switch binary.BigEndian.Uint32(b) {
+	case 1: // UTF-8
+		return strings.TrimSpace(strings.ToValidUTF8(string(b[8:]), "\uFFFD")), nil
+	case 2: // UTF-16BE
+		u := make([]uint16, (len(b)-8)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[8+2*i:])
+		}
+		return strings.TrimSpace(string(utf16.Decode(u))), nil
+	}
+	return "", nil
+}
+
+// mp4TrackNumber returns the track number of a trkn item, binary data of 2
+// bytes of padding, the track number and the number of tracks.
+func mp4TrackNumber(r io.ReaderAt, item mp4Box) (int, error) {
+	children, err := mp4Boxes(r, item.start, item.end)
+	if err != nil {
+		return 0, err
+	}
+	data, ok := mp4Find(children, "data")
+	// After the type indicator and the locale.
+	if !ok || data.end-data.start < 12 {
+		return 0, nil
+	}
+	var b [4]byte
+	if _, err := r.ReadAt(b[:], data.start+8); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b[2:])), nil
+}
+
+// mp4Cover returns the image of the first data box of a covr item, nil if it
+// is too large.
+func mp4Cover(r io.ReaderAt, item mp4Box) ([]byte, error) {
+	children, err := mp4Boxes(r, item.start, item.end)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := mp4Find(children, "data")
+	// After the type indicator, 13 for JPEG and 14 for PNG, and the locale.
+	if !ok || data.end-data.start <= 8 || data.end-data.start > mp4MaxCover {
+		return nil, nil
+	}
+	b := make([]byte, data.end-data.start-8)
+	if _, err := r.ReadAt(b, data.start+8); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
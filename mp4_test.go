@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+)
+
+// mp4BoxOf returns a box of the given type holding body.
+func mp4BoxOf(typ string, body ...[]byte) []byte {
+	b := concat(body...)
+	return concat(binary.BigEndian.AppendUint32(nil, uint32(8+len(b))), []byte(typ), b)
+}
+
+// mp4Item returns an ilst item whose data box has the given type indicator.
+func mp4Item(typ string, kind uint32, value []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, kind)
+	return mp4BoxOf(typ, mp4BoxOf("data", data, []byte{0, 0, 0, 0}, value))
+}
+
+// mp4Mvhd returns an mvhd box of version 0.
+func mp4Mvhd(scale, duration uint32) []byte {
+	b := make([]byte, 12, 100) // Version, flags and times.
+	b = binary.BigEndian.AppendUint32(b, scale)
+	b = binary.BigEndian.AppendUint32(b, duration)
+	return mp4BoxOf("mvhd", b, make([]byte, 80))
+}
+
+// mp4Chpl returns a chpl box of version 1.
+func mp4Chpl(count byte, chapters ...Chapter) []byte {
+	b := []byte{1, 0, 0, 0, 0, 0, 0, 0, count}
+	for _, c := range chapters {
+		b = binary.BigEndian.AppendUint64(b, uint64(c.Start*1e7))
+		b = append(b, byte(len(c.Title)))
+		b = append(b, c.Title...)
+	}
+	return mp4BoxOf("chpl", b)
+}
+
+func TestParseMP4(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	ftyp := mp4BoxOf("ftyp", []byte("M4A \x00\x00\x00\x00isomM4A "))
+	ilst := mp4BoxOf("ilst",
+		mp4Item("\xa9nam", 1, []byte("Episode 1 ")),
+		mp4Item("\xa9ART", 2, []byte("\x00S\x00o\x00m\x00e\x00o\x00n\x00e")),
+		mp4Item("desc", 1, []byte("Short")),
+		mp4Item("ldes", 1, []byte("Long description")),
+		mp4Item("trkn", 0, []byte{0, 0, 0, 7, 0, 9, 0, 0}),
+		mp4Item("covr", 14, png),
+		mp4Item("\xa9too", 1, []byte("Lavf")),
+	)
+	udta := mp4BoxOf("udta",
+		mp4Chpl(2, Chapter{Start: 0, Title: "Intro"}, Chapter{Start: 30, Title: "Topic"}),
+		mp4BoxOf("meta", make([]byte, 4), mp4BoxOf("hdlr", make([]byte, 24)), ilst),
+	)
+	moov := mp4BoxOf("moov", mp4Mvhd(1000, 90500), udta)
+	mdat := mp4BoxOf("mdat", make([]byte, 100))
+	tags := map[string]string{"title": "Episode 1", "artist": "Someone", "description": "Long description", "track": "7"}
+	chapters := []Chapter{{Start: 0, End: 30, Title: "Intro"}, {Start: 30, End: 90.5, Title: "Topic"}}
+
+	mvhd1 := make([]byte, 20, 120) // Version 1, flags and times.
+	mvhd1[0] = 1
+	mvhd1 = binary.BigEndian.AppendUint32(mvhd1, 48000)
+	mvhd1 = binary.BigEndian.AppendUint64(mvhd1, 48000*3600)
+	mvhd1 = append(mvhd1, make([]byte, 80)...)
+	// A 64 bit size, and a size extending to the end of the file.
+	largeMdat := concat([]byte{0, 0, 0, 1}, []byte("mdat"), binary.BigEndian.AppendUint64(nil, 16+100), make([]byte, 100))
+	tests := []struct {
+		name     string
+		data     []byte
+		duration float64
+		tags     map[string]string
+		chapters []Chapter
+		artwork  string
+		err      error // Nil for any error if wantErr.
+		wantErr  bool
+	}{
+		{
+			name:     "tags and chapters",
+			data:     concat(ftyp, moov, mdat),
+			duration: 90.5,
+			tags:     tags,
+			chapters: chapters,
+			artwork:  "image/png",
+		},
+		{
+			name:     "moov after mdat",
+			data:     concat(ftyp, largeMdat, moov, []byte{0, 0, 0, 0}, []byte("free"), make([]byte, 10)),
+			duration: 90.5,
+			tags:     tags,
+			chapters: chapters,
+			artwork:  "image/png",
+		},
+		{
+			name:     "mvhd version 1",
+			data:     concat(ftyp, mp4BoxOf("moov", mp4BoxOf("mvhd", mvhd1))),
+			duration: 3600,
+		},
+		{
+			name:     "fragmented",
+			data:     concat(ftyp, mp4BoxOf("moov", mp4Mvhd(1000, 0xffffffff))),
+			duration: 0,
+		},
+		{
+			name: "QuickTime meta",
+			data: concat(
+				mp4BoxOf("ftyp", []byte("qt  ")),
+				mp4BoxOf("moov", mp4Mvhd(600, 600), mp4BoxOf("udta", mp4BoxOf("meta", mp4BoxOf("hdlr", make([]byte, 24)), ilst))),
+			),
+			duration: 1,
+			tags:     tags,
+			artwork:  "image/png",
+		},
+		{
+			name: "chapter count",
+			data: concat(
+				ftyp,
+				mp4BoxOf("moov", mp4Mvhd(1, 60), mp4BoxOf("udta", mp4Chpl(200, Chapter{Start: 10, Title: "Only"}))),
+			),
+			duration: 60,
+			chapters: []Chapter{{Start: 10, End: 60, Title: "Only"}},
+		},
+		{name: "not mp4", data: []byte("\x00\x00\x00\x10RIFF\x00\x00\x00\x00WAVE"), err: errUnsupportedFormat, wantErr: true},
+		{name: "empty", data: nil, err: errUnsupportedFormat, wantErr: true},
+		{name: "no moov", data: concat(ftyp, mdat), wantErr: true},
+		{name: "oversized box", data: concat(ftyp, []byte("\x7f\xff\xff\xffmoov"), udta), err: errUnsupportedFormat, wantErr: true},
+		{name: "undersized box", data: concat(ftyp, []byte("\x00\x00\x00\x04moov"), udta), err: errUnsupportedFormat, wantErr: true},
+		{
+			name:    "oversized 64 bit box",
+			data:    concat(ftyp, []byte{0, 0, 0, 1}, []byte("mdat"), []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}),
+			err:     errUnsupportedFormat,
+			wantErr: true,
+		},
+		{
+			name:    "oversized child box",
+			data:    concat(ftyp, mp4BoxOf("moov", mp4Mvhd(1000, 1000), []byte("\x00\x10\x00\x00udta"))),
+			wantErr: true,
+		},
+		{
+			name:    "oversized data box",
+			data:    concat(ftyp, mp4BoxOf("moov", mp4BoxOf("udta", mp4BoxOf("meta", make([]byte, 4), mp4BoxOf("ilst", mp4BoxOf("\xa9nam", []byte("\x00\x10\x00\x00data"))))))),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeMedia(t, "episode.m4a", tt.data)
+			var mi MediaInfo
+			var err error
+			if n := allocated(func() { mi, err = parseMP4(p) }); n > 1<<20 {
+				t.Errorf("parseMP4 allocated %d bytes", n)
+			}
+			if tt.wantErr {
+				if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseMP4 = %+v, %v, want error %v", mi, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMP4: %v", err)
+			}
+			if mi.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", mi.Duration, tt.duration)
+			}
+			if len(mi.Tags) > 0 || len(tt.tags) > 0 {
+				if !maps.Equal(mi.Tags, tt.tags) {
+					t.Errorf("tags = %q, want %q", mi.Tags, tt.tags)
+				}
+			}
+			if !reflect.DeepEqual(mi.Chapters, tt.chapters) {
+				t.Errorf("chapters = %+v, want %+v", mi.Chapters, tt.chapters)
+			}
+			if mi.Artwork != tt.artwork {
+				t.Errorf("artwork = %q, want %q", mi.Artwork, tt.artwork)
+			}
+		})
+	}
+	parseTruncated(t, "episode.m4a", concat(ftyp, moov, mdat), parseMP4)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/jpeg"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ShowsPath is where the shows of a multi-show server are served, each
+	// under ShowsPath<name>/ with the routes of a single show.
+	ShowsPath = "/feeds/"
+	// ShowFile holds the settings of a show, in its directory.
+	ShowFile = "show.yaml"
+)
+
+// showName matches the names of the directories served as shows, which are
+// used as is in their URLs.
+var showName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// coverFiles are the names of the cover image of a show in its directory, in
+// order of preference.
+var coverFiles = []string{"cover.jpg", "cover.jpeg", "cover.png"}
+
+// ShowSettings are the settings of a show of a multi-show server, read from
+// its ShowFile and the feeds of the -config file. Those left out are the ones
+// given on the command line, except for the title, which defaults to the name
+// of the show's directory.
+type ShowSettings struct {
+	Title    string `yaml:"title"`
+	Desc     string `yaml:"description"`
+	Language string `yaml:"language"`
+	Author   string `yaml:"author"`
+	// See ParseCategory.
+	Category string `yaml:"category"`
+	// "episodic" or "serial".
+	Type       string `yaml:"type"`
+	Explicit   *bool  `yaml:"explicit"`
+	Copyright  string `yaml:"copyright"`
+	License    string `yaml:"license"`
+	LicenseUrl string `yaml:"licenseUrl"`
+}
+
+// ReadShowSettings reads the ShowFile of the show in dir, if it has one.
+func ReadShowSettings(dir string) (ShowSettings, error) {
+	var s ShowSettings
+	p := filepath.Join(dir, ShowFile)
+	buf, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := yaml.Unmarshal(buf, &s); err != nil {
+		return s, fmt.Errorf("parse %s: %w", p, err)
+	}
+	return s, nil
+}
+
+// apply overrides the settings of m with those set in s.
+func (s ShowSettings) apply(m *Metadata) error {
+	if s.Title != "" {
+		m.Title = s.Title
+	}
+	if s.Desc != "" {
+		m.Desc = s.Desc
+	}
+	if s.Language != "" {
+		if !languageTag.MatchString(s.Language) {
+			return fmt.Errorf("invalid language code %q", s.Language)
+		}
+		m.Language = s.Language
+	}
+	if s.Author != "" {
+		m.Author = s.Author
+	}
+	if s.Category != "" {
+		m.Category = ParseCategory(s.Category)
+	}
+	if s.Type != "" {
+		t, ok := ParseShowType(s.Type)
+		if !ok {
+			return fmt.Errorf("unknown show type %q: allowed values are \"episodic\" or \"serial\"", s.Type)
+		}
+		m.ShowType = t
+	}
+	if s.Explicit != nil {
+		m.Explicit = *s.Explicit
+	}
+	if s.Copyright != "" {
+		m.Copyright = s.Copyright
+	}
+	if s.License != "" || s.LicenseUrl != "" {
+		l, err := NewLicense(s.License, s.LicenseUrl)
+		if err != nil {
+			return fmt.Errorf("license: %w", err)
+		}
+		m.License = l
+	}
+	return nil
+}
+
+// listShows returns the names of the shows of a multi-show server: the
+// subdirectories of dir, hidden ones aside.
+func listShows(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !showName.MatchString(name) {
+			slog.Warn("skipping show directory whose name is not usable in URLs", "dir", name, "tag", TagStart)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// showStateFile returns the state file of the show name derived from p, one
+// given on the command line: guids.json is guids.<name>.json. It is p for a
+// single show, and empty if p is.
+func showStateFile(p, name string) string {
+	if p == "" || name == "" {
+		return p
+	}
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "." + name + ext
+}
+
+// findCover returns the file name of the cover image of the show in dir, and
+// its size in the RSS <image>, or an empty name if it has none. It is looked
+// for on every scan, so a cover can be added, replaced or removed.
+func findCover(dir string) (string, int, int) {
+	for _, name := range coverFiles {
+		fp, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		c, _, err := image.DecodeConfig(fp)
+		fp.Close()
+		if err != nil {
+			slog.Warn("could not read cover image", "error", err, "file", filepath.Join(dir, name), "tag", TagRefresh)
+			continue
+		}
+		w, h := rssImageSize(c.Width, c.Height)
+		return name, w, h
+	}
+	return "", 0, 0
+}
+
+// ServeCover serves the cover image of the show.
+func (s *Server) ServeCover(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	cover := s.Cover
+	s.mu.RUnlock()
+	if cover == "" || cover != path.Base(r.URL.Path) {
+		// Another of coverFiles.
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := filepath.Join(s.Metadata.localRoot, cover)
+	info, err := os.Stat(p)
+	if err != nil {
+		http.ServeFile(w, r, p)
+		return
+	}
+	// The cover is not part of the feed, so a new one does not invalidate
+	// the cache but is cached apart.
+	key := fmt.Sprintf("%scover:%d:%d", s.Metadata.externalUrl, info.ModTime().UnixNano(), info.Size())
+	e, err := s.MemCache.Get(key, func() (*memEntry, error) {
+		if info.Size() > memCacheMaxEntry {
+			return nil, errTooLarge
+		}
+		body, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return newMemEntry(mime.TypeByExtension(filepath.Ext(p)), body, info.ModTime(), "")
+	})
+	if err != nil {
+		http.ServeFile(w, r, p)
+		return
+	}
+	e.serve(w, r)
+}
+
+// A ShowIndex is the root page of a multi-show server, listing its shows.
+type ShowIndex struct {
+	Metadata Metadata // Title and stylesheet of the page.
+	Shows    []*Server
+
+	Theme   Theme
+	Locales *Locales
+
+	tmpl *template.Template
+}
+
+type ShowIndexData struct {
+	Metadata Metadata
+	Theme    Theme
+	Locale   *Locale
+	Shows    []ShowIndexEntry
+}
+
+type ShowIndexEntry struct {
+	Title    string
+	CoverUrl string
+	Episodes int
+	HtmlUrl  string
+	FeedUrl  string
+}
+
+func NewShowIndex(m Metadata, shows []*Server) *ShowIndex {
+	tmpl := template.Must(template.ParseFS(templateFS, "*/shows.html", "*/theme.html"))
+	return &ShowIndex{Metadata: m, Shows: shows, tmpl: tmpl}
+}
+
+func (idx *ShowIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data := ShowIndexData{
+		Metadata: idx.Metadata,
+		Theme:    idx.Theme,
+		Locale:   idx.Locales.negotiate(w, r, idx.Locales.Default),
+	}
+	for _, s := range idx.Shows {
+		s.mu.RLock()
+		episodes := len(s.Items)
+		coverUrl := s.Channel.CoverUrl
+		s.mu.RUnlock()
+		data.Shows = append(data.Shows, ShowIndexEntry{
+			Title:    s.Metadata.Title,
+			CoverUrl: coverUrl,
+			Episodes: episodes,
+			HtmlUrl:  s.Metadata.externalUrl + FeedHtmlPath[1:],
+			FeedUrl:  s.Metadata.externalUrl + FeedPath[1:],
+		})
+	}
+	if err := idx.tmpl.ExecuteTemplate(w, "shows.html", data); err != nil {
+		slog.Error("template error", "error", err)
+	}
+}
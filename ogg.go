@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Ogg files carry their metadata as Vorbis comments in the second packet of
+// the stream, after the identification header. Both Opus and Vorbis streams
+// are read, other codecs are unsupported.
+//
+// See https://www.xiph.org/ogg/doc/framing.html,
+// https://www.xiph.org/vorbis/doc/v-comment.html and RFC 7845.
+
+const (
+	// Comment packets larger than this are skipped, they are mostly cover art.
+	oggMaxPacket = 1 << 20
+	// How far from the end to look for the last page, which holds the total
+	// number of samples. Pages are at most 64 KiB.
+	oggTailSize = 1 << 17
+)
+
+var oggCapture = []byte("OggS")
+
+// oggPageHeader is the fixed part of a page header, followed by a segment
+// table of Segments bytes.
+type oggPageHeader struct {
+	Capture  [4]byte
+	Version  uint8
+	Flags    uint8
+	Granule  int64
+	Serial   uint32
+	Sequence uint32
+	Checksum uint32
+	Segments uint8
+}
+
+// oggReader reads the packets of the first logical stream of an Ogg file.
+type oggReader struct {
+	r      *bufio.Reader
+	serial uint32
+	first  bool
+	lacing []byte // Segment table of the current page, what is left of it.
+}
+
+func (o *oggReader) page() error {
+	var h oggPageHeader
+	for {
+		if err := binary.Read(o.r, binary.LittleEndian, &h); err != nil {
+			return err
+		}
+		if !bytes.Equal(h.Capture[:], oggCapture) {
+			return errUnsupportedFormat
+		}
+		o.lacing = make([]byte, h.Segments)
+		if _, err := io.ReadFull(o.r, o.lacing); err != nil {
+			return err
+		}
+		if !o.first {
+			o.first = true
+			o.serial = h.Serial
+		}
+		if h.Serial == o.serial {
+			return nil
+		}
+		// Another multiplexed stream.
+		n := 0
+		for _, l := range o.lacing {
+			n += int(l)
+		}
+		if _, err := o.r.Discard(n); err != nil {
+			return err
+		}
+	}
+}
+
+// packet returns the next packet, or nil if it is larger than limit and was
+// skipped.
+func (o *oggReader) packet(limit int) ([]byte, error) {
+	var p []byte
+	n := 0
+	for {
+		if len(o.lacing) == 0 {
+			if err := o.page(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		l := int(o.lacing[0])
+		o.lacing = o.lacing[1:]
+		n += l
+		if n <= limit {
+			seg := make([]byte, l)
+			if _, err := io.ReadFull(o.r, seg); err != nil {
+				return nil, err
+			}
+			p = append(p, seg...)
+		} else if _, err := o.r.Discard(l); err != nil {
+			return nil, err
+		}
+		if l < 255 {
+			break
+		}
+	}
+	if n > limit {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parseOgg reads the Vorbis comments and duration of an Opus or Vorbis file.
+func parseOgg(path string) (MediaInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer fp.Close()
+	o := &oggReader{r: bufio.NewReader(fp)}
+
+	head, err := o.packet(4096)
+	if err != nil {
+		return MediaInfo{}, fmt.Errorf("ogg: %w", err)
+	}
+	var (
+		rate      int64  // Granule positions per second.
+		skip      int64  // Granules before the first sample.
+		tagsMagic string // Of the comment packet.
+	)
+	switch {
+	case bytes.HasPrefix(head, []byte("OpusHead")) && len(head) >= 19:
+		rate = 48000
+		skip = int64(binary.LittleEndian.Uint16(head[10:]))
+		tagsMagic = "OpusTags"
+	case bytes.HasPrefix(head, []byte("\x01vorbis")) && len(head) >= 30:
+		rate = int64(binary.LittleEndian.Uint32(head[12:]))
+		tagsMagic = "\x03vorbis"
+	default:
+		return MediaInfo{}, errUnsupportedFormat
+	}
+
+	var mi MediaInfo
+	comments, err := o.packet(oggMaxPacket)
+	if err != nil {
+		return MediaInfo{}, fmt.Errorf("ogg: %w", err)
+	}
+	if comments != nil {
+		if !bytes.HasPrefix(comments, []byte(tagsMagic)) {
+			return MediaInfo{}, errors.New("ogg: missing comment header")
+		}
+		var picture []byte
+		if mi.Tags, picture, err = parseVorbisComments(comments[len(tagsMagic):]); err != nil {
+			return MediaInfo{}, err
+		}
+		if picture != nil {
+			mi.setArtwork(picture)
+		}
+	}
+
+	granule, err := oggLastGranule(fp, o.serial)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	if rate > 0 && granule > skip {
+		mi.Duration = float64(granule-skip) / float64(rate)
+	}
+	return mi, nil
+}
+
+// parseVorbisComments parses a comment header after its magic, returning its
+// tags and the image data of its cover art, the front cover or else the first
+// picture. Keys are lower cased, and only the first value of a repeated key is
+// kept.
+func parseVorbisComments(b []byte) (map[string]string, []byte, error) {
+	errInvalid := errors.New("ogg: invalid comment header")
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, false
+		}
+		s := b[4 : 4+n]
+		b = b[4+n:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // Vendor.
+		return nil, nil, errInvalid
+	}
+	if len(b) < 4 {
+		return nil, nil, errInvalid
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	tags := make(map[string]string)
+	var (
+		picture []byte
+		front   bool
+	)
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			return nil, nil, errInvalid
+		}
+		k, v, ok := strings.Cut(string(c), "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(k)
+		if k == "metadata_block_picture" {
+			if front {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				continue
+			}
+			if typ, data, ok := parseFlacPicture(b); ok && (picture == nil || typ == pictureFrontCover) {
+				picture, front = data, typ == pictureFrontCover
+			}
+			continue
+		}
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+	return tags, picture, nil
+}
+
+// oggLastGranule returns the granule position of the last page of the
+// stream, the number of samples up to its end.
+func oggLastGranule(fp *os.File, serial uint32) (int64, error) {
+	info, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	off := max(0, info.Size()-oggTailSize)
+	tail := make([]byte, info.Size()-off)
+	if _, err := fp.ReadAt(tail, off); err != nil {
+		return 0, err
+	}
+	const headerSize = 27
+	for i := bytes.LastIndex(tail, oggCapture); i >= 0; i = bytes.LastIndex(tail[:i], oggCapture) {
+		if len(tail)-i < headerSize {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+		if binary.LittleEndian.Uint32(tail[i+14:]) == serial && granule != -1 {
+			return granule, nil
+		}
+	}
+	return 0, nil
+}
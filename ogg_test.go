@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"testing"
+)
+
+// oggPage returns a page of the stream serial holding packets whole.
+func oggPage(serial uint32, granule int64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	h := oggPageHeader{Granule: granule, Serial: serial, Segments: uint8(len(lacing))}
+	copy(h.Capture[:], oggCapture)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, h)
+	b.Write(lacing)
+	b.Write(body)
+	return b.Bytes()
+}
+
+// vorbisComments returns a comment header without its magic.
+func vorbisComments(vendor string, comments ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(vendor)))
+	b = append(b, vendor...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, c := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseOgg(t *testing.T) {
+	// Version, channels, pre-skip of 312, input sample rate, gain and
+	// channel mapping.
+	opusHead := []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	opusTags := concat([]byte("OpusTags"), vorbisComments("podserve", "TITLE=Episode 1", "artist=Someone", "TITLE=Other", "junk"))
+	opus := concat(
+		oggPage(1, 0, opusHead),
+		oggPage(1, 0, opusTags),
+		oggPage(1, 2*48000+312, []byte("audio")),
+	)
+	// Version, channels, sample rate of 44100 and bit rates, block sizes and
+	// framing.
+	vorbisHead := concat([]byte("\x01vorbis\x00\x00\x00\x00\x02\x44\xac\x00\x00"), make([]byte, 15))
+	vorbis := concat(
+		oggPage(7, 0, vorbisHead),
+		oggPage(7, 0, concat([]byte("\x03vorbis"), vorbisComments("podserve", "DATE=2025-03-01"))),
+		oggPage(7, 44100, []byte("audio")),
+		oggPage(7, 3*44100, []byte("audio")),
+	)
+	tests := []struct {
+		name     string
+		data     []byte
+		duration float64
+		tags     map[string]string
+		err      error // Nil for any error if wantErr.
+		wantErr  bool
+	}{
+		{
+			name:     "opus",
+			data:     opus,
+			duration: 2,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+		},
+		{
+			name:     "vorbis",
+			data:     vorbis,
+			duration: 3,
+			tags:     map[string]string{"date": "2025-03-01"},
+		},
+		{
+			name: "multiplexed",
+			data: concat(
+				oggPage(1, 0, opusHead),
+				oggPage(2, 0, []byte("other stream")),
+				oggPage(1, 0, opusTags),
+				oggPage(1, 2*48000+312, []byte("audio")),
+				oggPage(2, 10*48000, []byte("other stream")),
+			),
+			duration: 2,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+		},
+		{
+			name:     "no audio",
+			data:     concat(oggPage(1, 0, opusHead), oggPage(1, 0, opusTags)),
+			duration: 0,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+		},
+		{name: "not ogg", data: concat([]byte("RIFF\x00\x00\x00\x00WAVE"), make([]byte, 64)), err: errUnsupportedFormat, wantErr: true},
+		{name: "unknown codec", data: oggPage(1, 0, []byte("\x80theora")), err: errUnsupportedFormat, wantErr: true},
+		{name: "short head", data: oggPage(1, 0, opusHead[:12]), err: errUnsupportedFormat, wantErr: true},
+		{name: "truncated page header", data: opus[:20], wantErr: true},
+		{name: "truncated comments", data: opus[:len(oggPage(1, 0, opusHead))+40], wantErr: true},
+		{
+			name:    "missing comments",
+			data:    concat(oggPage(1, 0, opusHead), oggPage(1, 0, []byte("audio"))),
+			wantErr: true,
+		},
+		{
+			name: "oversized vendor",
+			data: concat(
+				oggPage(1, 0, opusHead),
+				oggPage(1, 0, concat([]byte("OpusTags\xf0\xff\xff\x7f"), []byte("podserve"))),
+			),
+			wantErr: true,
+		},
+		{
+			name: "oversized comment",
+			data: concat(
+				oggPage(1, 0, opusHead),
+				oggPage(1, 0, []byte("OpusTags\x08\x00\x00\x00podserve\x01\x00\x00\x00\xff\xff\xff\xffTITLE=")),
+			),
+			wantErr: true,
+		},
+		{
+			name: "comment count",
+			data: concat(
+				oggPage(1, 0, opusHead),
+				oggPage(1, 0, []byte("OpusTags\x08\x00\x00\x00podserve\x00\xca\x9a\x3b")),
+			),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeMedia(t, "episode.opus", tt.data)
+			var mi MediaInfo
+			var err error
+			if n := allocated(func() { mi, err = parseOgg(p) }); n > 1<<20 {
+				t.Errorf("parseOgg allocated %d bytes", n)
+			}
+			if tt.wantErr {
+				if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseOgg = %+v, %v, want error %v", mi, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseOgg: %v", err)
+			}
+			if mi.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", mi.Duration, tt.duration)
+			}
+			if !maps.Equal(mi.Tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", mi.Tags, tt.tags)
+			}
+		})
+	}
+	parseTruncated(t, "episode.opus", opus, parseOgg)
+	parseTruncated(t, "episode.ogg", vorbis, parseOgg)
+}
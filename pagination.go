@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ApiItemsPath lists published episodes a page at a time, for scripts and the
+// infinite scroll of the HTML page.
+const ApiItemsPath = "/api/items"
+
+// paginate returns the items on the 1-based page and the number of pages. A
+// size of 0 puts all items on one page. Pages out of range are empty.
+func paginate(items []Item, page, size int) ([]Item, int) {
+	if size <= 0 {
+		return items, 1
+	}
+	pages := max(1, (len(items)+size-1)/size)
+	if page < 1 || page > pages {
+		return nil, pages
+	}
+	start := (page - 1) * size
+	return items[start:min(start+size, len(items))], pages
+}
+
+// pageParam parses the page query parameter, defaulting to the first page.
+func pageParam(r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("page")
+	if s == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(s)
+	return page, err == nil && page >= 1
+}
+
+// pageUrl returns the URL of a page of base, or "" if there is no such page.
+func pageUrl(base string, page, pages int) string {
+	if page < 1 || page > pages {
+		return ""
+	}
+	if page == 1 {
+		return base
+	}
+	return base + "?page=" + strconv.Itoa(page)
+}
+
+type apiItem struct {
+	Title       string `json:"title"`
+	Book        string `json:"book,omitempty"`
+	Link        string `json:"link"`
+	Url         string `json:"url"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	SizeText    string `json:"size_text"`
+	Modified    string `json:"modified"`
+	CommentsUrl string `json:"comments_url,omitempty"`
+	Image       string `json:"image,omitempty"`
+
+	Transcripts []apiTranscript `json:"transcripts,omitempty"`
+	ReplayGain  *ReplayGain     `json:"replay_gain,omitempty"`
+}
+
+type apiTranscript struct {
+	Url    string `json:"url"`
+	Format string `json:"format"`
+}
+
+func (s *Server) ServeItems(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	page, ok := pageParam(r)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	s.mu.RLock()
+	items, pages := paginate(s.Items, page, s.PageSize)
+	s.mu.RUnlock()
+
+	loc := s.locale(w, r)
+	out := make([]apiItem, 0, len(items))
+	for _, it := range items {
+		var transcripts []apiTranscript
+		for _, t := range it.Transcripts {
+			transcripts = append(transcripts, apiTranscript{Url: t.Url, Format: t.Format()})
+		}
+		out = append(out, apiItem{
+			Title:       it.Title,
+			Book:        it.Book,
+			Link:        it.Link,
+			Url:         it.Enclosure.Url,
+			Type:        it.Enclosure.Type,
+			Size:        it.Enclosure.Length,
+			SizeText:    readableBytes(it.Enclosure.Length),
+			Modified:    loc.Date(it.ModTime),
+			CommentsUrl: it.CommentsUrl,
+			Image:       it.Image,
+
+			Transcripts: transcripts,
+			ReplayGain:  it.ReplayGain,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"items": out,
+		"page":  page,
+		"pages": pages,
+		"next":  pageUrl(s.Metadata.externalUrl+ApiItemsPath[1:], page+1, pages),
+	})
+}
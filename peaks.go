@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Number of peaks in the waveform of an episode.
+	peaksCount = 800
+	// Sample rate the audio is decoded at for the waveform, plenty to find the
+	// peaks.
+	peaksSampleRate = 8000
+)
+
+// Waveform is the JSON served for the waveform view of the web player. Peaks
+// are the highest amplitudes of equally long parts of the episode, from 0 to
+// 100.
+type Waveform struct {
+	Duration float64 `json:"duration"`
+	Peaks    []int   `json:"peaks"`
+}
+
+func (t *Transcoder) peaksName(src string, info fs.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00peaks:%d:%d", src, info.Size(), info.ModTime().UnixNano(), peaksCount, peaksSampleRate)
+	return hex.EncodeToString(h.Sum(nil)[:12]) + ".json"
+}
+
+// applyPeaks sets the waveform of it, if computed already, or else queues
+// computing it. It returns the name of the waveform in the cache.
+func (t *Transcoder) applyPeaks(m Metadata, it *Item, src string, info fs.FileInfo) string {
+	name := t.peaksName(src, info)
+	dst := filepath.Join(t.dir, name)
+	pi, err := os.Stat(dst)
+	if err != nil {
+		t.enqueue(m, transcodeJob{kind: jobPeaks, src: src, dst: dst})
+		return name
+	}
+	it.Peaks = m.externalUrl + RenditionsPath[1:] + name
+	it.peaksPath = RenditionsPath[1:] + name
+	it.peaksFile = FileInfo{
+		Path:     dst,
+		MimeType: "application/json",
+		Size:     pi.Size(),
+		ModTime:  pi.ModTime(),
+	}
+	return name
+}
+
+// makePeaks decodes the episode with ffmpeg and computes its waveform.
+func (t *Transcoder) makePeaks(ctx context.Context, job transcodeJob) error {
+	cmd := exec.CommandContext(
+		ctx, t.ffmpeg, "-nostdin", "-hide_banner", "-loglevel", "error",
+		"-i", job.src, "-vn", "-ac", "1", "-ar", fmt.Sprint(peaksSampleRate),
+		"-f", "s16le", "-",
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Peaks of windows of a tenth of a second, merged into peaksCount peaks
+	// once the length is known.
+	const window = peaksSampleRate / 10
+	var windows []int16
+	var samples int
+	var peak int16
+	r := bufio.NewReader(stdout)
+	var buf [2]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				cmd.Wait()
+				return err
+			}
+			break
+		}
+		v := int16(binary.LittleEndian.Uint16(buf[:]))
+		if v < 0 {
+			v = -(v + 1)
+		}
+		peak = max(peak, v)
+		if samples++; samples%window == 0 {
+			windows = append(windows, peak)
+			peak = 0
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	if samples%window != 0 {
+		windows = append(windows, peak)
+	}
+	if len(windows) == 0 {
+		return errors.New("no audio")
+	}
+
+	wf := Waveform{
+		Duration: float64(samples) / peaksSampleRate,
+		Peaks:    make([]int, min(peaksCount, len(windows))),
+	}
+	for i := range wf.Peaks {
+		start := i * len(windows) / len(wf.Peaks)
+		end := (i + 1) * len(windows) / len(wf.Peaks)
+		var p int16
+		for _, v := range windows[start:end] {
+			p = max(p, v)
+		}
+		wf.Peaks[i] = int(p) * 100 / 32767
+	}
+	out, err := json.Marshal(wf)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(job.dst, out, 0o644)
+}
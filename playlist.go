@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Playlist files in the media directory, in order of precedence. They list
+// media files by path relative to the media directory, in feed order.
+// playlist.txt has one path per line and ignores blank lines and lines
+// starting with #. index.yaml is a YAML list of paths.
+var playlistFiles = []string{"playlist.txt", "index.yaml"}
+
+// readPlaylist returns the position of every file in the playlist of the
+// media library, and nil if there is none.
+func readPlaylist(fsys fs.FS) (map[string]int, error) {
+	for _, name := range playlistFiles {
+		buf, err := fs.ReadFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		if path.Ext(name) == ".yaml" {
+			if err := yaml.Unmarshal(buf, &paths); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", name, err)
+			}
+		} else {
+			sc := bufio.NewScanner(bytes.NewReader(buf))
+			for sc.Scan() {
+				line := strings.TrimSpace(sc.Text())
+				if line != "" && !strings.HasPrefix(line, "#") {
+					paths = append(paths, line)
+				}
+			}
+		}
+		order := make(map[string]int, len(paths))
+		for i, p := range paths {
+			p = path.Clean(strings.TrimPrefix(p, "./"))
+			if _, ok := order[p]; ok {
+				slog.Warn("ignoring duplicate playlist entry", "file", p, "playlist", name, "tag", TagRefresh)
+				continue
+			}
+			order[p] = i + 1
+		}
+		return order, nil
+	}
+	return nil, nil
+}
+
+// applyPlaylist orders the items listed in the playlist explicitly, replacing
+// any order from their sidecars.
+func applyPlaylist(items []Item, order map[string]int) {
+	listed := make(map[string]bool, len(order))
+	for i := range items {
+		if pos, ok := order[items[i].Path]; ok {
+			items[i].Order = &pos
+			listed[items[i].Path] = true
+		}
+	}
+	for p := range order {
+		if !listed[p] {
+			slog.Warn("playlist entry matches no episode", "file", p, "tag", TagRefresh)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Width the posters of video episodes are scaled down to, if wider.
+const posterWidth = 1400
+
+func (t *Transcoder) posterName(src string, info fs.FileInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00poster:%d", src, info.Size(), info.ModTime().UnixNano(), posterWidth)
+	return hex.EncodeToString(h.Sum(nil)[:12]) + ".jpg"
+}
+
+// applyPoster sets the image of the video episode it to its poster, if made
+// already, or else queues making it. It returns the name of the poster in the
+// cache.
+func (t *Transcoder) applyPoster(m Metadata, it *Item, src string, info fs.FileInfo) string {
+	name := t.posterName(src, info)
+	dst := filepath.Join(t.dir, name)
+	pi, err := os.Stat(dst)
+	if err != nil {
+		t.enqueue(m, transcodeJob{kind: jobPoster, src: src, dst: dst})
+		return name
+	}
+	it.Image = m.externalUrl + RenditionsPath[1:] + name
+	it.imagePath = RenditionsPath[1:] + name
+	it.imageFile = FileInfo{
+		Path:     dst,
+		MimeType: "image/jpeg",
+		Size:     pi.Size(),
+		ModTime:  pi.ModTime(),
+	}
+	return name
+}
+
+// makePoster extracts a representative frame of a video as its poster.
+func (t *Transcoder) makePoster(ctx context.Context, job transcodeJob) error {
+	tmp := job.dst + ".part"
+	cmd := exec.CommandContext(
+		ctx, t.ffmpeg, "-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", job.src, "-an", "-frames:v", "1",
+		"-vf", fmt.Sprintf("thumbnail,scale='min(%d,iw)':-2", posterWidth),
+		"-f", "image2", "-c:v", "mjpeg", tmp,
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return os.Rename(tmp, job.dst)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Media files in a directory with this name are drafts.
+	DraftsDir = "_drafts"
+
+	PreviewPath     = "/preview/"
+	PreviewFeedPath = "/preview/feed"
+)
+
+// ServePreview serves the preview feed, which includes drafts, and the media
+// files of drafts. It is meant to be wrapped by requireRole.
+func (s *Server) ServePreview(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if r.URL.Path == PreviewFeedPath {
+		feed := s.PreviewXML
+		if base, _ := s.requestBase(r); base != s.Metadata.externalUrl {
+			feed = rebase(feed, s.Metadata.externalUrl, base)
+		}
+		w.Header().Add("Content-Type", "application/rss+xml; charset=UTF-8")
+		w.Header().Add("Content-Length", strconv.Itoa(len(feed)))
+		w.Header().Add("Cache-Control", "private")
+		w.WriteHeader(http.StatusOK)
+		w.Write(feed)
+		return
+	}
+	requestedFile := strings.TrimPrefix(r.URL.Path, PreviewPath)
+	if p, ok := lookupPath(s.DraftFiles, requestedFile); ok {
+		s.serveFile(w, r, s.DraftFiles, p)
+		return
+	}
+	// Published items are part of the preview feed as well.
+	p, _ := lookupPath(s.Files, requestedFile)
+	s.serveFile(w, r, s.Files, p)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// ProxyHeaders derives the external URL of the server from the headers a
+// reverse proxy sets, so that one server behind a proxy with several host
+// names publishes feeds linking to the one they were requested from.
+type ProxyHeaders struct {
+	// Proxies trusted to set the headers, any if empty.
+	Trusted []netip.Prefix
+}
+
+// externalUrl returns externalUrl with its scheme and host replaced by those
+// of r: the X-Forwarded-Proto and X-Forwarded-Host headers, or else the Host
+// header. The path is kept, for servers published under a prefix. Invalid
+// headers, or headers of an untrusted peer, are ignored.
+func (p *ProxyHeaders) externalUrl(r *http.Request, externalUrl string) string {
+	if len(p.Trusted) > 0 && !(&ForwardAuth{TrustedProxies: p.Trusted}).trusted(r) {
+		return externalUrl
+	}
+	u, err := url.Parse(externalUrl)
+	if err != nil {
+		return externalUrl
+	}
+	// Proxies in a chain append their values.
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		u.Scheme = proto
+	}
+	host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	if host = strings.TrimSpace(host); host == "" {
+		host = r.Host
+	}
+	if h, err := url.Parse("http://" + host); err != nil || h.Host != host || h.User != nil || h.Path != "" {
+		return externalUrl
+	}
+	u.Host = host
+	return u.String()
+}
+
+// rebase replaces the external URL from with to in feed, in XML as well as
+// in JSON.
+func rebase(feed []byte, from, to string) []byte {
+	feed = bytes.ReplaceAll(feed, []byte(from), []byte(to))
+	if escaped := html.EscapeString(from); escaped != from {
+		feed = bytes.ReplaceAll(feed, []byte(escaped), []byte(html.EscapeString(to)))
+	}
+	return feed
+}
+
+// requestBase returns the external URL of the server for r, and a suffix for
+// the ETag of what is served with it, empty for -externalUrl.
+func (s *Server) requestBase(r *http.Request) (string, string) {
+	base := s.Metadata.externalUrl
+	if s.Proxy == nil {
+		return base, ""
+	}
+	if b := s.Proxy.externalUrl(r, base); b != base {
+		sum := sha256.Sum256([]byte(b))
+		return b, "-" + hex.EncodeToString(sum[:4])
+	}
+	return base, ""
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Size of the blocks ranges of remote files are read in.
+	rangeBlockSize = 256 << 10
+	// Blocks read ahead of the one requested, for the player's next request.
+	rangeReadAhead = 2
+	// Blocks kept in memory, across files.
+	rangeCacheBlocks = 128
+	// Timeout of reading a block.
+	rangeReadTimeout = time.Minute
+)
+
+// A BlockCache keeps blocks of remote media files in memory, read with ranged
+// requests, evicting the least recently used beyond MaxBlocks. The blocks of a
+// file are dropped once it changes, as they are keyed by its modification
+// time.
+type BlockCache struct {
+	MaxBlocks int
+
+	mu     sync.Mutex // Guards all below
+	blocks map[blockKey]*block
+	clock  int64 // Incremented on every use of a block.
+}
+
+type blockKey struct {
+	path    string
+	modTime time.Time
+	index   int64
+}
+
+type block struct {
+	done chan struct{} // Closed once read.
+	data []byte
+	err  error
+	used int64
+}
+
+func NewBlockCache(maxBlocks int) *BlockCache {
+	return &BlockCache{MaxBlocks: maxBlocks, blocks: make(map[blockKey]*block)}
+}
+
+// get returns the block of the given key, reading it with read unless cached.
+// Concurrent gets of a block read it once. Failed reads are not cached.
+func (c *BlockCache) get(key blockKey, read func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	c.clock++
+	b, ok := c.blocks[key]
+	if ok {
+		b.used = c.clock
+		c.mu.Unlock()
+		<-b.done
+		return b.data, b.err
+	}
+	b = &block{done: make(chan struct{}), used: c.clock}
+	c.blocks[key] = b
+	c.evict()
+	c.mu.Unlock()
+
+	b.data, b.err = read()
+	if b.err != nil {
+		c.mu.Lock()
+		if c.blocks[key] == b {
+			delete(c.blocks, key)
+		}
+		c.mu.Unlock()
+	}
+	close(b.done)
+	return b.data, b.err
+}
+
+// cached reports whether the block of the given key is cached or being read.
+func (c *BlockCache) cached(key blockKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.blocks[key]
+	return ok
+}
+
+// evict drops the least recently used blocks beyond MaxBlocks. Waiters of a
+// block being read still get it.
+func (c *BlockCache) evict() {
+	for len(c.blocks) > c.MaxBlocks {
+		var oldest blockKey
+		var oldestUse int64 = -1
+		for k, b := range c.blocks {
+			if oldestUse < 0 || b.used < oldestUse {
+				oldest, oldestUse = k, b.used
+			}
+		}
+		delete(c.blocks, oldest)
+	}
+}
+
+// A rangeFile is a remote file read in blocks through a BlockCache, for
+// http.ServeContent to serve ranges of it without downloading it whole.
+type rangeFile struct {
+	blocks *BlockCache
+	file   remoteFile
+	// readRange reads n bytes at offset off of the file at path p.
+	readRange func(ctx context.Context, p string, off, n int64) ([]byte, error)
+}
+
+func (rf *rangeFile) block(i int64) ([]byte, error) {
+	key := blockKey{rf.file.Path, rf.file.ModTime, i}
+	return rf.blocks.get(key, func() ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), rangeReadTimeout)
+		defer cancel()
+		off := i * rangeBlockSize
+		n := min(rangeBlockSize, rf.file.Size-off)
+		data, err := rf.readRange(ctx, rf.file.Path, off, n)
+		if err == nil && int64(len(data)) != n {
+			err = io.ErrUnexpectedEOF
+		}
+		return data, err
+	})
+}
+
+func (rf *rangeFile) ReadAt(b []byte, off int64) (int, error) {
+	read := 0
+	for read < len(b) {
+		pos := off + int64(read)
+		if pos >= rf.file.Size {
+			return read, io.EOF
+		}
+		i := pos / rangeBlockSize
+		data, err := rf.block(i)
+		if err != nil {
+			return read, err
+		}
+		read += copy(b[read:], data[pos-i*rangeBlockSize:])
+		rf.readAhead(i)
+	}
+	return read, nil
+}
+
+// readAhead reads the blocks following block i in the background.
+func (rf *rangeFile) readAhead(i int64) {
+	for j := i + 1; j <= i+rangeReadAhead && j*rangeBlockSize < rf.file.Size; j++ {
+		if !rf.blocks.cached(blockKey{rf.file.Path, rf.file.ModTime, j}) {
+			go rf.block(j)
+		}
+	}
+}
+
+// A cachedRemote serves the media files of a remote library from a
+// MediaCache. A range of a file not cached yet, as when seeking in an episode,
+// is served right away with ranged reads, while the file is downloaded in the
+// background for later requests.
+type cachedRemote struct {
+	cache  *MediaCache
+	blocks *BlockCache
+	tag    string
+	// stat returns the current state of the file at path p.
+	stat func(op, p string) (remoteFile, error)
+	// fill downloads the file at path p to fp.
+	fill func(p string, fp *os.File) error
+	// readRange reads n bytes at offset off of the file at path p.
+	readRange func(ctx context.Context, p string, off, n int64) ([]byte, error)
+}
+
+func (c cachedRemote) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	rf, err := c.stat("fetch", f.Source)
+	if errors.Is(err, fs.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not stat file", "error", err, "file", f.Source, "tag", c.tag)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	f.Size, f.ModTime = rf.Size, rf.ModTime
+	fill := func(fp *os.File) error { return c.fill(rf.Path, fp) }
+	if p, ok := c.cache.Cached(rf); ok {
+		serveLocalFile(w, r, f, p)
+		return
+	}
+	if r.Header.Get("Range") != "" {
+		go func() {
+			if _, err := c.cache.Get(context.Background(), rf, fill); err != nil {
+				slog.Error("could not fetch file", "error", err, "file", rf.Path, "tag", c.tag)
+			}
+		}()
+		content := &rangeFile{blocks: c.blocks, file: rf, readRange: c.readRange}
+		serveContent(w, r, f, io.NewSectionReader(content, 0, rf.Size))
+		return
+	}
+	p, err := c.cache.Get(r.Context(), rf, fill)
+	if err != nil {
+		slog.Error("could not fetch file", "error", err, "file", f.Source, "tag", c.tag)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	serveLocalFile(w, r, f, p)
+}
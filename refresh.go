@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of refreshes kept in the RefreshHistory.
+	refreshHistorySize = 50
+	// Refreshes taking longer are logged as warnings.
+	slowRefresh = 10 * time.Second
+)
+
+// Upper bounds, in seconds, of the buckets of the refresh duration histogram.
+var refreshDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// A RefreshRecord describes one refresh.
+type RefreshRecord struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"-"`
+	Files    int           `json:"files"`    // Files served, drafts included.
+	Episodes int           `json:"episodes"` // Drafts included.
+	Added    int           `json:"added"`
+	Removed  int           `json:"removed"`
+	Modified int           `json:"modified"`
+	// Paths that could not be read, see ScanPolicy.
+	Unreadable int    `json:"unreadable,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (r RefreshRecord) MarshalJSON() ([]byte, error) {
+	type record RefreshRecord
+	return json.Marshal(struct {
+		record
+		DurationMs int64 `json:"duration_ms"`
+	}{record(r), r.Duration.Milliseconds()})
+}
+
+// A RefreshHistory keeps the latest refreshes, and totals over all of them,
+// to spot scans getting slower as the library grows. The zero value is ready
+// to use.
+type RefreshHistory struct {
+	mu      sync.Mutex      // Guards all below
+	records []RefreshRecord // Oldest first.
+	total   int64
+	errors  int64
+	sum     time.Duration
+	buckets []int64 // Refreshes per refreshDurationBuckets, not cumulative.
+}
+
+func (h *RefreshHistory) Add(r RefreshRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) == refreshHistorySize {
+		h.records = slices.Delete(h.records, 0, 1)
+	}
+	h.records = append(h.records, r)
+	h.total++
+	if r.Error != "" {
+		h.errors++
+	}
+	h.sum += r.Duration
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(refreshDurationBuckets))
+	}
+	for i, le := range refreshDurationBuckets {
+		if r.Duration.Seconds() <= le {
+			h.buckets[i]++
+			break
+		}
+	}
+	if r.Duration > slowRefresh {
+		slog.Warn("slow refresh", "duration", r.Duration, "files", r.Files, "tag", TagRefresh)
+	}
+}
+
+// Records returns the latest refreshes, newest first.
+func (h *RefreshHistory) Records() []RefreshRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := slices.Clone(h.records)
+	slices.Reverse(out)
+	return out
+}
+
+// WriteMetrics writes the refresh metrics in the Prometheus text format.
+func (h *RefreshHistory) WriteMetrics(w *metricsWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Counter("podserve_refreshes_total", "Refreshes of the feed.", h.total)
+	w.Counter("podserve_refresh_errors_total", "Refreshes of the feed that failed.", h.errors)
+	w.Help("podserve_refresh_duration_seconds", "histogram", "Duration of refreshes of the feed.")
+	var cum int64
+	for i, le := range refreshDurationBuckets {
+		if h.buckets != nil {
+			cum += h.buckets[i]
+		}
+		w.Sample("podserve_refresh_duration_seconds_bucket", cum, "le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	w.Sample("podserve_refresh_duration_seconds_bucket", h.total, "le", "+Inf")
+	w.Sample("podserve_refresh_duration_seconds_sum", h.sum.Seconds())
+	w.Sample("podserve_refresh_duration_seconds_count", h.total)
+	if len(h.records) == 0 {
+		return
+	}
+	last := h.records[len(h.records)-1]
+	w.Gauge("podserve_last_refresh_timestamp_seconds", "Start of the last refresh.", last.Start.Unix())
+	w.Gauge("podserve_last_refresh_duration_seconds", "Duration of the last refresh.", last.Duration.Seconds())
+	w.Gauge("podserve_last_refresh_files", "Files found by the last refresh, drafts included.", last.Files)
+	w.Gauge("podserve_last_refresh_changed_items", "Episodes added, removed or modified by the last refresh.", last.Added+last.Removed+last.Modified)
+}
+
+// An ItemChange is an episode added, removed, or modified by a refresh. Sizes
+// are those of the media file before and after, 0 when there is none.
+type ItemChange struct {
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	OldSize int64  `json:"old_size,omitempty"`
+	NewSize int64  `json:"new_size,omitempty"`
+}
+
+// A RefreshDiff is what changed in the published episodes between two
+// snapshots, each list sorted by path.
+type RefreshDiff struct {
+	Added    []ItemChange `json:"added"`
+	Removed  []ItemChange `json:"removed"`
+	Modified []ItemChange `json:"modified"`
+}
+
+func (d RefreshDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// diffItems compares published items by path. An item is modified if
+// anything about it changed, its file or its metadata.
+func diffItems(old, new []Item) RefreshDiff {
+	d := RefreshDiff{Added: []ItemChange{}, Removed: []ItemChange{}, Modified: []ItemChange{}}
+	before := make(map[string]Item, len(old))
+	for _, it := range old {
+		before[it.Path] = it
+	}
+	for _, it := range new {
+		prev, ok := before[it.Path]
+		delete(before, it.Path)
+		switch {
+		case !ok:
+			d.Added = append(d.Added, ItemChange{Path: it.Path, Title: it.Title, NewSize: it.Enclosure.Length})
+		case !reflect.DeepEqual(prev, it):
+			d.Modified = append(d.Modified, ItemChange{
+				Path:    it.Path,
+				Title:   it.Title,
+				OldSize: prev.Enclosure.Length,
+				NewSize: it.Enclosure.Length,
+			})
+		}
+	}
+	for _, it := range before {
+		d.Removed = append(d.Removed, ItemChange{Path: it.Path, Title: it.Title, OldSize: it.Enclosure.Length})
+	}
+	for _, changes := range [][]ItemChange{d.Added, d.Removed, d.Modified} {
+		slices.SortFunc(changes, func(a, b ItemChange) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+	}
+	return d
+}
+
+// Log logs every change, one line each.
+func (d RefreshDiff) Log() {
+	for _, c := range d.Added {
+		slog.Info("episode added", "path", c.Path, "title", c.Title, "size", c.NewSize, "tag", TagRefresh)
+	}
+	for _, c := range d.Removed {
+		slog.Info("episode removed", "path", c.Path, "title", c.Title, "size", c.OldSize, "tag", TagRefresh)
+	}
+	for _, c := range d.Modified {
+		slog.Info(
+			"episode modified",
+			"path", c.Path,
+			"title", c.Title,
+			"old_size", c.OldSize,
+			"new_size", c.NewSize,
+			"tag", TagRefresh,
+		)
+	}
+}
+
+// Pending scans the media directory and returns what a refresh would change
+// in the published episodes, without applying it. GUIDs and numbers of new
+// episodes are not kept, caches are not pruned and nothing is transcoded.
+func (s *Server) Pending() (RefreshDiff, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	snap, err := s.scan(true)
+	if err != nil {
+		return RefreshDiff{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return diffItems(s.Items, snap.Items), nil
+}
+
+// ServeRefreshPending reports what a refresh would change, e.g. to check which
+// drafts go live before flipping them.
+func (s *Server) ServeRefreshPending(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	diff, err := s.Pending()
+	if err != nil {
+		adminLogger(r, "refresh_pending").Error("could not scan media directory", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "scan failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// ServeRefreshHistory lists the latest refreshes, newest first.
+func (s *Server) ServeRefreshHistory(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"refreshes": s.History.Records()})
+}
+
+// removedUnreadable returns the first of the unreadable paths that a removed
+// episode is at or under, and false if the removed episodes were all readable
+// and so are really gone.
+func removedUnreadable(removed []ItemChange, unreadable []string) (string, bool) {
+	for _, u := range unreadable {
+		for _, c := range removed {
+			if c.Path == u || strings.HasPrefix(c.Path, u+"/") {
+				return u, true
+			}
+		}
+	}
+	return "", false
+}
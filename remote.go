@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of requests for media files passed on to their origin by proxyFile,
+// and of its responses passed back.
+var (
+	proxyRequestHeaders  = []string{"Range", "If-Range", "If-Modified-Since", "If-None-Match"}
+	proxyResponseHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+)
+
+// proxyFile serves a media file by passing the request on to its origin, with
+// do, and the response back. The origin answers range and conditional
+// requests. Failures are logged with the name of the file and the tag.
+func proxyFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	name, tag string,
+	do func(ctx context.Context, header http.Header) (*http.Response, error),
+) {
+	header := make(http.Header)
+	for _, k := range proxyRequestHeaders {
+		if v := r.Header.Values(k); len(v) > 0 {
+			header[k] = v
+		}
+	}
+	resp, err := do(r.Context(), header)
+	if err != nil {
+		slog.Error("could not get file from origin", "error", err, "file", name, "tag", tag)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		slog.Error("could not get file from origin", "status", resp.Status, "file", name, "tag", tag)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	for _, k := range proxyResponseHeaders {
+		if v := resp.Header.Values(k); len(v) > 0 {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// A remoteFile is a file of a remote media library.
+type remoteFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// A listingFS is the file system of the listing of a remote media library,
+// listed at most every ttl, all files at once. Remote sources embed it.
+type listingFS struct {
+	ttl time.Duration
+	// list lists all files of the library.
+	list func() ([]remoteFile, error)
+	// open opens the file at path p of the library for reading, e.g. a
+	// sidecar file.
+	open func(p string) (io.ReadCloser, error)
+
+	mu     sync.Mutex // Guards all below
+	listed time.Time
+	files  map[string]remoteFile
+	dirs   map[string][]fs.DirEntry // Path -> sorted entries, "." is the root.
+}
+
+// relist lists the library unless listed within ttl.
+func (l *listingFS) relist() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.listed) < l.ttl {
+		return nil
+	}
+	list, err := l.list()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]remoteFile, len(list))
+	dirs := map[string][]fs.DirEntry{".": nil}
+	for _, f := range list {
+		if !fs.ValidPath(f.Path) || f.Path == "." {
+			continue
+		}
+		files[f.Path] = f
+		for d := path.Dir(f.Path); d != "."; d = path.Dir(d) {
+			if _, ok := dirs[d]; ok {
+				break
+			}
+			dirs[d] = nil
+			parent := path.Dir(d)
+			dirs[parent] = append(dirs[parent], fs.FileInfoToDirEntry(remoteFileInfo{name: path.Base(d), dir: true}))
+		}
+		dir := path.Dir(f.Path)
+		dirs[dir] = append(dirs[dir], fs.FileInfoToDirEntry(remoteFileInfo{name: path.Base(f.Path), file: f}))
+	}
+	for _, entries := range dirs {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	l.files, l.dirs, l.listed = files, dirs, time.Now()
+	return nil
+}
+
+// lookup returns the file or the entries of the directory at path p.
+func (l *listingFS) lookup(op, p string) (remoteFile, []fs.DirEntry, bool, error) {
+	if !fs.ValidPath(p) {
+		return remoteFile{}, nil, false, &fs.PathError{Op: op, Path: p, Err: fs.ErrInvalid}
+	}
+	if err := l.relist(); err != nil {
+		return remoteFile{}, nil, false, &fs.PathError{Op: op, Path: p, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entries, ok := l.dirs[p]; ok {
+		return remoteFile{}, entries, true, nil
+	}
+	if f, ok := l.files[p]; ok {
+		return f, nil, false, nil
+	}
+	return remoteFile{}, nil, false, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+}
+
+// file returns the file at path p.
+func (l *listingFS) file(op, p string) (remoteFile, error) {
+	f, _, isDir, err := l.lookup(op, p)
+	if err == nil && isDir {
+		err = &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return f, err
+}
+
+func (l *listingFS) Open(name string) (fs.File, error) {
+	f, entries, isDir, err := l.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return &remoteDir{info: remoteFileInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+	}
+	return &remoteOpenFile{open: l.open, info: remoteFileInfo{name: path.Base(name), file: f}}, nil
+}
+
+func (l *listingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	_, entries, isDir, err := l.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return slices.Clone(entries), nil
+}
+
+func (l *listingFS) Stat(name string) (fs.FileInfo, error) {
+	f, _, isDir, err := l.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{name: path.Base(name), file: f, dir: isDir}, nil
+}
+
+type remoteFileInfo struct {
+	name string
+	file remoteFile
+	dir  bool
+}
+
+func (fi remoteFileInfo) Name() string       { return fi.name }
+func (fi remoteFileInfo) Size() int64        { return fi.file.Size }
+func (fi remoteFileInfo) ModTime() time.Time { return fi.file.ModTime }
+func (fi remoteFileInfo) IsDir() bool        { return fi.dir }
+func (fi remoteFileInfo) Sys() any           { return nil }
+
+func (fi remoteFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// A remoteOpenFile opens its file on first read.
+type remoteOpenFile struct {
+	open func(p string) (io.ReadCloser, error)
+	info remoteFileInfo
+	body io.ReadCloser
+}
+
+func (f *remoteOpenFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *remoteOpenFile) Read(b []byte) (int, error) {
+	if f.body == nil {
+		body, err := f.open(f.info.file.Path)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	return f.body.Read(b)
+}
+
+func (f *remoteOpenFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+type remoteDir struct {
+	info    remoteFileInfo
+	entries []fs.DirEntry
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *remoteDir) Read([]byte) (int, error)   { return 0, errors.New("is a directory") }
+func (d *remoteDir) Close() error               { return nil }
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Key of the ReplayGain in the MetaCache.
+const metaReplayGain = "replaygain"
+
+// ReplayGain reference loudness in LUFS. Episodes are adjusted by their track
+// gain to sound as loud as the reference.
+const replayGainReference = -18
+
+// ReplayGain describes the loudness of an episode, so that players can
+// normalize the volume.
+type ReplayGain struct {
+	// Integrated loudness in LUFS (EBU R128).
+	Loudness float64 `json:"loudness"`
+	// Adjustment in dB to reach the reference loudness.
+	TrackGain float64 `json:"track_gain"`
+	// Highest true peak, linear, 1 being full scale.
+	TrackPeak float64 `json:"track_peak"`
+}
+
+// applyGain sets the ReplayGain of it, if measured already, or else queues
+// measuring it.
+func (t *Transcoder) applyGain(m Metadata, it *Item, src string, info fs.FileInfo) {
+	var g ReplayGain
+	if t.Meta.Get(it.Path, info, metaReplayGain, &g) {
+		it.ReplayGain = &g
+		return
+	}
+	// Results go to the metadata cache, dst only identifies the job.
+	t.enqueue(m, transcodeJob{kind: jobGain, src: src, dst: metaReplayGain + ":" + it.Path, path: it.Path})
+}
+
+// measureGain measures the loudness of an episode with the first pass of
+// loudness normalization.
+func (t *Transcoder) measureGain(ctx context.Context, job transcodeJob) error {
+	info, err := os.Stat(job.src)
+	if err != nil {
+		return err
+	}
+	s, err := t.measureLoudness(ctx, job.src, Rendition{Loudness: replayGainReference})
+	if err != nil {
+		return err
+	}
+	loudness, err := strconv.ParseFloat(s.InputI, 64)
+	if err != nil {
+		return fmt.Errorf("measure loudness: %w", err)
+	}
+	tp, err := strconv.ParseFloat(s.InputTP, 64)
+	if err != nil {
+		return fmt.Errorf("measure loudness: %w", err)
+	}
+	round := func(f float64) float64 { return math.Round(f*100) / 100 }
+	g := ReplayGain{
+		Loudness:  round(loudness),
+		TrackGain: round(replayGainReference - loudness),
+		TrackPeak: math.Round(math.Pow(10, tp/20)*1e6) / 1e6,
+	}
+	if err := t.Meta.Put(job.path, info, metaReplayGain, g); err != nil {
+		return err
+	}
+	return t.Meta.Save()
+}
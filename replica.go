@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ApiReplicaPath lists the files of the media library for replicas to
+	// sync, and ApiReplicaFilesPath serves them, ranges included.
+	ApiReplicaPath      = "/api/replica"
+	ApiReplicaFilesPath = "/api/replica/files/"
+	// Directory in the media root of a replica holding partial downloads. It
+	// is skipped when scanning the library.
+	ReplicaPartDir = ".replica"
+	// Timeout of listing the files of the primary.
+	replicaListTimeout = time.Minute
+)
+
+// A replicaFile is a file of the media library of a primary.
+type replicaFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Sha256  string    `json:"sha256,omitempty"` // If hashed.
+}
+
+// A replicaListing is what a replica syncs from its primary.
+type replicaListing struct {
+	Files []replicaFile `json:"files"`
+	// GUIDs of the episodes, if the primary persists them.
+	Guids map[string]GuidRecord `json:"guids"`
+}
+
+// ServeReplica lists the files of the media library: the media files of the
+// episodes scanned, published or not, and every other file, such as sidecars
+// and images. Media files not scanned yet are left out until they have a GUID.
+func (s *Server) ServeReplica(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	scanned := make(map[string]string) // Source -> hash
+	s.mu.RLock()
+	for _, files := range []map[string]FileInfo{s.Files, s.DraftFiles} {
+		for _, f := range files {
+			if f.Source != "" {
+				scanned[f.Source] = f.Hash
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	listing := replicaListing{Files: []replicaFile{}}
+	fsys := s.Metadata.source
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == TrashDir || p == ReplicaPartDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		hash, ok := scanned[p]
+		if _, isMedia := mimeType[filepath.Ext(p)]; isMedia && !ok {
+			return nil
+		}
+		info, err := fsys.Stat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since listed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		listing.Files = append(listing.Files, replicaFile{Path: p, Size: info.Size(), ModTime: info.ModTime(), Sha256: hash})
+		return nil
+	})
+	if err != nil {
+		slog.Error("could not list files for replica", "error", err, "tag", TagReplica)
+		writeJSONError(w, http.StatusInternalServerError, "could not list files")
+		return
+	}
+	if gs := s.Metadata.guids; gs != nil {
+		listing.Guids = gs.Records()
+	}
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// ServeReplicaFile serves a file of the media library to a replica.
+func (s *Server) ServeReplicaFile(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, ApiReplicaFilesPath)
+	if !fs.ValidPath(p) || p == "." || p == TrashDir || strings.HasPrefix(p, TrashDir+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	info, err := s.Metadata.source.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not stat file", "error", err, "file", p, "tag", TagReplica)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f := FileInfo{
+		Path:     p,
+		MimeType: "application/octet-stream",
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Source:   p,
+	}
+	w.Header().Set("Content-Type", f.MimeType)
+	s.Metadata.source.ServeFile(w, r, f)
+}
+
+// A Replica keeps the media directory Dir an identical copy of the media
+// library of the podserve at Primary, syncing it every Interval. Changed files
+// are downloaded to ReplicaPartDir first, resuming partial downloads, checked
+// against their SHA-256 if the primary has hashed them and only then moved in
+// place. Files no longer on the primary are deleted, so Dir must not be used
+// for anything else. The GUIDs of the primary are synced to Guids, if set,
+// and its hashes to Meta, for the Hasher not to compute them again.
+type Replica struct {
+	Primary  string // externalUrl of the primary.
+	Key      string // API key of the replica role.
+	Dir      string
+	Interval time.Duration
+	Guids    *GuidStore
+	Meta     *MetaCache
+
+	// OnChange is called after a sync changed anything, to refresh the feed.
+	OnChange func()
+
+	client *http.Client
+
+	mu         sync.Mutex // Guards all below
+	syncs      int64
+	failures   int64
+	lastSync   time.Time // Of the last successful sync.
+	files      int
+	downloaded int64
+	bytes      int64
+	deleted    int64
+}
+
+func NewReplica(primary, key, dir string, interval time.Duration, guids *GuidStore, meta *MetaCache) (*Replica, error) {
+	u, err := url.Parse(primary)
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid primary url %q", primary)
+	}
+	if !strings.HasSuffix(primary, "/") {
+		primary += "/"
+	}
+	return &Replica{
+		Primary:  primary,
+		Key:      key,
+		Dir:      dir,
+		Interval: interval,
+		Guids:    guids,
+		Meta:     meta,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (rp *Replica) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		if err := rp.Sync(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("replica sync failed", "error", err, "primary", rp.Primary, "tag", TagReplica)
+		}
+		select {
+		case <-time.After(rp.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rp *Replica) request(ctx context.Context, p string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rp.Primary+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+rp.Key)
+	return rp.client.Do(req)
+}
+
+func (rp *Replica) list(ctx context.Context) (replicaListing, error) {
+	var listing replicaListing
+	ctx, cancel := context.WithTimeout(ctx, replicaListTimeout)
+	defer cancel()
+	resp, err := rp.request(ctx, ApiReplicaPath[1:], nil)
+	if err != nil {
+		return listing, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return listing, fmt.Errorf("GET %s: %s", ApiReplicaPath, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return listing, fmt.Errorf("GET %s: %w", ApiReplicaPath, err)
+	}
+	return listing, nil
+}
+
+// Sync brings Dir up to date with the primary.
+func (rp *Replica) Sync(ctx context.Context) error {
+	err := rp.sync(ctx)
+	rp.mu.Lock()
+	if err != nil {
+		rp.failures++
+	} else {
+		rp.syncs++
+		rp.lastSync = time.Now()
+	}
+	rp.mu.Unlock()
+	return err
+}
+
+func (rp *Replica) sync(ctx context.Context) error {
+	listing, err := rp.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(listing.Files) == 0 {
+		// More likely the media directory of the primary is not mounted than
+		// all of it deleted, keep serving the copy.
+		return errors.New("the primary lists no files, not deleting any")
+	}
+	// Without the same GUIDs, apps would see other episodes than on the
+	// primary.
+	changed := false
+	switch {
+	case rp.Guids == nil && listing.Guids != nil:
+		return errors.New("the primary persists GUIDs, set -guidFile")
+	case rp.Guids != nil && listing.Guids == nil:
+		return errors.New("the primary does not persist GUIDs, unset -guidFile")
+	case rp.Guids != nil:
+		if changed, err = rp.Guids.Replace(listing.Guids); err != nil {
+			return err
+		}
+	}
+
+	wanted := make(map[string]bool, len(listing.Files))
+	parts := make(map[string]bool)
+	var failed []string
+	for _, f := range listing.Files {
+		if !fs.ValidPath(f.Path) || f.Path == "." || strings.HasPrefix(f.Path, ReplicaPartDir+"/") {
+			continue
+		}
+		wanted[f.Path] = true
+		parts[partName(f)] = true
+		dst := filepath.Join(rp.Dir, filepath.FromSlash(f.Path))
+		if info, err := os.Stat(dst); err == nil && info.Size() == f.Size && info.ModTime().Equal(f.ModTime) {
+			// The primary may have hashed it since.
+			if rp.putHash(f, info) {
+				changed = true
+			}
+			continue
+		}
+		n, err := rp.download(ctx, f, dst)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			slog.Error("could not download file", "error", err, "file", f.Path, "tag", TagReplica)
+			failed = append(failed, f.Path)
+			continue
+		}
+		slog.Info("synced file", "file", f.Path, "size", f.Size, "tag", TagReplica)
+		if info, err := os.Stat(dst); err == nil {
+			rp.putHash(f, info)
+		}
+		changed = true
+		rp.mu.Lock()
+		rp.downloaded++
+		rp.bytes += n
+		rp.mu.Unlock()
+	}
+
+	deleted, err := rp.prune(wanted, parts)
+	if deleted > 0 {
+		changed = true
+		rp.mu.Lock()
+		rp.deleted += int64(deleted)
+		rp.mu.Unlock()
+	}
+	rp.mu.Lock()
+	rp.files = len(wanted)
+	rp.mu.Unlock()
+	if err := rp.Meta.Save(); err != nil {
+		slog.Warn("could not save metadata cache", "error", err, "tag", TagReplica)
+	}
+	if changed && rp.OnChange != nil {
+		rp.OnChange()
+	}
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not download %d of %d files, e.g. %s", len(failed), len(wanted), failed[0])
+	}
+	return nil
+}
+
+// putHash caches the hash of f computed by the primary, if it has, and
+// reports whether it was not cached already.
+func (rp *Replica) putHash(f replicaFile, info fs.FileInfo) bool {
+	var hash string
+	if rp.Meta == nil || f.Sha256 == "" || rp.Meta.Get(f.Path, info, metaSha256, &hash) && hash == f.Sha256 {
+		return false
+	}
+	if err := rp.Meta.Put(f.Path, info, metaSha256, f.Sha256); err != nil {
+		slog.Warn("could not cache hash", "error", err, "file", f.Path, "tag", TagReplica)
+		return false
+	}
+	return true
+}
+
+// partName is the name under ReplicaPartDir of the partial download of f. It
+// changes with the file, so a download of an older version is not resumed.
+func partName(f replicaFile) string {
+	sum := sha256.Sum256([]byte(f.Path))
+	return fmt.Sprintf("%x-%d-%x.part", sum[:8], f.Size, f.ModTime.UnixNano())
+}
+
+// download downloads f to dst, resuming a partial download, and returns the
+// number of bytes transferred.
+func (rp *Replica) download(ctx context.Context, f replicaFile, dst string) (int64, error) {
+	partDir := filepath.Join(rp.Dir, ReplicaPartDir)
+	if err := os.MkdirAll(partDir, 0o755); err != nil {
+		return 0, err
+	}
+	part := filepath.Join(partDir, partName(f))
+	fp, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	have, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if have < f.Size {
+		header := make(http.Header)
+		if have > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+			header.Set("If-Range", f.ModTime.UTC().Format(http.TimeFormat))
+		}
+		resp, err := rp.request(ctx, ApiReplicaFilesPath[1:]+escapePath(f.Path), header)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// Not resumable after all, start over.
+			if err := fp.Truncate(0); err != nil {
+				return 0, err
+			}
+			if _, err := fp.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("GET %s: %s", f.Path, resp.Status)
+		}
+		n, err = io.Copy(fp, resp.Body)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	size, err := fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return n, err
+	}
+	if size != f.Size {
+		os.Remove(part)
+		return n, fmt.Errorf("got %d bytes, expected %d", size, f.Size)
+	}
+	if f.Sha256 != "" {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return n, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, fp); err != nil {
+			return n, err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != f.Sha256 {
+			os.Remove(part)
+			return n, fmt.Errorf("checksum mismatch: expected %s, got %s", f.Sha256, sum)
+		}
+	}
+	if err := fp.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Chtimes(part, f.ModTime, f.ModTime); err != nil {
+		return n, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return n, err
+	}
+	return n, os.Rename(part, dst)
+}
+
+// prune deletes the files of Dir not on the primary, the partial downloads
+// of files no longer wanted and the directories left empty, and returns the
+// number of files deleted, partial downloads aside.
+func (rp *Replica) prune(wanted, parts map[string]bool) (int, error) {
+	deleted := 0
+	var dirs []string
+	err := filepath.WalkDir(rp.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rp.Dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == TrashDir {
+				return fs.SkipDir
+			}
+			if rel != "." {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if path.Dir(rel) == ReplicaPartDir {
+			if !parts[d.Name()] {
+				return os.Remove(p)
+			}
+			return nil
+		}
+		if wanted[rel] {
+			return nil
+		}
+		slog.Info("deleting file removed from primary", "file", rel, "tag", TagReplica)
+		deleted++
+		return os.Remove(p)
+	})
+	// Deepest first, so that parents are empty once their children are gone.
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		// Fails unless empty.
+		os.Remove(d)
+	}
+	return deleted, err
+}
+
+func (rp *Replica) WriteMetrics(w *metricsWriter) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	w.Counter("podserve_replica_syncs_total", "Successful syncs from the primary.", rp.syncs)
+	w.Counter("podserve_replica_sync_failures_total", "Failed syncs from the primary.", rp.failures)
+	w.Counter("podserve_replica_downloaded_files_total", "Files downloaded from the primary.", rp.downloaded)
+	w.Counter("podserve_replica_downloaded_bytes_total", "Bytes downloaded from the primary.", rp.bytes)
+	w.Counter("podserve_replica_deleted_files_total", "Files deleted as they were removed from the primary.", rp.deleted)
+	w.Gauge("podserve_replica_files", "Files of the primary at the last sync.", rp.files)
+	if !rp.lastSync.IsZero() {
+		w.Gauge("podserve_last_replica_sync_timestamp_seconds", "End of the last successful sync.", rp.lastSync.Unix())
+	}
+}
+
+// readOnly refuses requests to h that would change anything, on a replica.
+func readOnly(replica bool, h http.Handler) http.Handler {
+	if !replica {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isSafeMethod(r.Method) {
+			writeJSONError(w, http.StatusForbidden, "read-only replica, change the primary")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// replicaKey reads the API key of a replica from the environment.
+func replicaKey() (string, error) {
+	key := strings.TrimSpace(os.Getenv("PODSERVE_REPLICA_KEY"))
+	if key == "" {
+		return "", errors.New("-replicaOf requires the API key of the primary in PODSERVE_REPLICA_KEY")
+	}
+	return key, nil
+}
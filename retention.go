@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the retention policy is enforced.
+const retentionInterval = time.Hour
+
+// A RetentionPolicy limits the media kept, to keep e.g. a recording box from
+// filling its disk. The oldest published episodes are pruned first: they are
+// moved out of the library, which unpublishes them, and then deleted along
+// with their sidecars. Pinned episodes and drafts are never pruned.
+type RetentionPolicy struct {
+	MaxSize int64         // Total size of published episodes, 0 is unlimited.
+	MaxAge  time.Duration // 0 is unlimited.
+	DryRun  bool          // Only log what would be pruned.
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxSize > 0 || p.MaxAge > 0
+}
+
+// episodeSize is the size of an episode on disk, with its renditions.
+func episodeSize(it Item) int64 {
+	n := it.Enclosure.Length
+	for _, alt := range it.Alternates {
+		if alt.file == "" {
+			n += alt.Enclosure.Length
+		}
+	}
+	return n
+}
+
+// age returns when it was added to the library, which episodes are aged
+// by rather than by their publication date, which may be that of their tags:
+// a back catalogue added today is not pruned right away. That is when it
+// was first published as recorded in the GuidStore, as podserve import sets
+// the modification time of files to their publication date, or else the
+// modification time of its media file.
+func age(it Item) time.Time {
+	if !it.added.IsZero() {
+		return it.added
+	}
+	return it.fileTime
+}
+
+// Expired returns the items to prune, oldest first, see age.
+func (p RetentionPolicy) Expired(items []Item, now time.Time) []Item {
+	var candidates []Item
+	var total int64
+	for _, it := range items {
+		// Episodes of the manifest are not ours to delete.
+		if it.Draft || it.origin != "" {
+			continue
+		}
+		total += episodeSize(it)
+		if !it.Pinned {
+			candidates = append(candidates, it)
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b Item) int {
+		return age(a).Compare(age(b))
+	})
+	var out []Item
+	for _, it := range candidates {
+		tooOld := p.MaxAge > 0 && now.Sub(age(it)) > p.MaxAge
+		tooBig := p.MaxSize > 0 && total > p.MaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		out = append(out, it)
+		total -= episodeSize(it)
+	}
+	return out
+}
+
+// Prune enforces the retention policy on the published episodes.
+func (s *Server) Prune(p RetentionPolicy) {
+	s.mu.RLock()
+	expired := p.Expired(s.Items, time.Now())
+	s.mu.RUnlock()
+	if len(expired) == 0 {
+		return
+	}
+	if p.DryRun {
+		for _, it := range expired {
+			slog.Info("would prune episode", "path", it.Path, "size", episodeSize(it), "added", age(it), "tag", TagRetention)
+		}
+		return
+	}
+	var trashed []TrashEntry
+	for _, it := range expired {
+		e, err := s.Trash.Delete(it.Path, "retention")
+		if err != nil {
+			slog.Error("could not unpublish episode", "error", err, "path", it.Path, "tag", TagRetention)
+			continue
+		}
+		trashed = append(trashed, e)
+	}
+	if _, err := s.Refresh(); err != nil {
+		// Deleting the files would break the feed still being served.
+		slog.Error("could not refresh, keeping pruned episodes in the trash", "error", err, "tag", TagRetention)
+		return
+	}
+	for _, e := range trashed {
+		if _, err := s.Trash.Purge(e.ID); err != nil {
+			slog.Error("could not delete pruned episode", "error", err, "path", e.Path, "trash_id", e.ID, "tag", TagRetention)
+			continue
+		}
+		slog.Info("pruned episode", "path", e.Path, "files", e.Files, "tag", TagRetention)
+		s.Audit.Append(AuditEntry{
+			Time:      time.Now().UTC(),
+			Principal: "retention",
+			Action:    "prune",
+			Target:    e.Path,
+			Details:   map[string]any{"files": e.Files},
+		})
+	}
+}
+
+func enforceRetention(ctx context.Context, wg *sync.WaitGroup, s *Server, p RetentionPolicy) {
+	defer wg.Done()
+	for {
+		s.Prune(p)
+		select {
+		case <-time.After(retentionInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseSize parses a size in bytes with an optional binary unit suffix, e.g.
+// "500M" or "1.5G".
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	}
+	num, factor := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), 1.0
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, factor = n, u.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * factor), nil
+}
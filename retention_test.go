@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRetentionImportedCatalogue(t *testing.T) {
+	now := time.Now().UTC()
+	// As left by podserve import: files dated by their publication date,
+	// recorded in the GUID file when imported.
+	fsys := fstest.MapFS{
+		"old.mp3":    {Data: []byte("old"), ModTime: now.AddDate(-3, 0, 0)},
+		"recent.mp3": {Data: []byte("recent"), ModTime: now.AddDate(0, 0, -2)},
+	}
+	items := func() []Item {
+		var items []Item
+		for _, p := range []string{"old.mp3", "recent.mp3"} {
+			it := Item{Path: p, fileTime: fsys[p].ModTime}
+			it.Enclosure.Length = int64(len(fsys[p].Data))
+			items = append(items, it)
+		}
+		return items
+	}
+	tests := []struct {
+		name     string
+		imported time.Time // Zero without a GUID file.
+		policy   RetentionPolicy
+		want     []string
+	}{
+		{"imported today", now.Add(-time.Hour), RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, nil},
+		{"imported long ago", now.AddDate(0, -2, 0), RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, []string{"old.mp3", "recent.mp3"}},
+		{"without a GUID file", time.Time{}, RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, []string{"old.mp3"}},
+		{"size", now.Add(-time.Hour), RetentionPolicy{MaxSize: 1}, []string{"old.mp3", "recent.mp3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := items()
+			if !tt.imported.IsZero() {
+				gs, err := NewGuidStore(filepath.Join(t.TempDir(), "guids.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, it := range items {
+					gs.records[it.Path] = GuidRecord{Guid: "urn:uuid:" + it.Path, Created: tt.imported}
+				}
+				if err := gs.Assign(items, fsys); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for _, it := range tt.policy.Expired(items, now) {
+				got = append(got, it.Path)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expired = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
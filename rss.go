@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+)
+
+// Namespaces of the extensions of the RSS feed. See the references in the
+// package comment for a description of supported fields.
+const (
+	nsItunes  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	nsContent = "http://purl.org/rss/1.0/modules/content/"
+	nsPodcast = "https://podcastindex.org/namespace/1.0"
+	nsAtom    = "http://www.w3.org/2005/Atom"
+)
+
+// FeedPageParam selects a page of a paged feed, see Metadata.FeedPages.
+const FeedPageParam = "page"
+
+// The RSS feed. Elements of the extensions are named with the prefixes of
+// their namespaces, declared on the root element, as podcast apps expect.
+type rssDocument struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	NsItunes  string     `xml:"xmlns:itunes,attr"`
+	NsContent string     `xml:"xmlns:content,attr"`
+	NsPodcast string     `xml:"xmlns:podcast,attr"`
+	NsAtom    string     `xml:"xmlns:atom,attr,omitempty"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string          `xml:"title"`
+	Link        string          `xml:"link"`
+	AtomLinks   []atomLink      `xml:"atom:link"`
+	Desc        string          `xml:"description"`
+	Language    string          `xml:"language"`
+	Image       rssImage        `xml:"image"`
+	ItunesImage itunesImage     `xml:"itunes:image"`
+	Type        ShowType        `xml:"itunes:type"`
+	Explicit    bool            `xml:"itunes:explicit"`
+	Author      string          `xml:"itunes:author,omitempty"`
+	Category    *itunesCategory `xml:"itunes:category"`
+	Copyright   string          `xml:"copyright,omitempty"`
+	License     *rssLicense     `xml:"podcast:license"`
+	Funding     *rssFunding     `xml:"podcast:funding"`
+	Value       *rssValue       `xml:"podcast:value"`
+	Items       []rssEntry      `xml:"item"`
+}
+
+type rssImage struct {
+	Url    string `xml:"url"`
+	Title  string `xml:"title"`
+	Link   string `xml:"link"`
+	Width  int    `xml:"width,omitempty"`
+	Height int    `xml:"height,omitempty"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type itunesCategory struct {
+	Text string          `xml:"text,attr"`
+	Sub  *itunesCategory `xml:"itunes:category"`
+}
+
+type rssLicense struct {
+	Url  string `xml:"url,attr,omitempty"`
+	Name string `xml:",chardata"`
+}
+
+type rssFunding struct {
+	Url  string `xml:"url,attr"`
+	Text string `xml:",chardata"`
+}
+
+type rssValue struct {
+	Type       string              `xml:"type,attr"`
+	Method     string              `xml:"method,attr"`
+	Suggested  string              `xml:"suggested,attr,omitempty"`
+	Recipients []rssValueRecipient `xml:"podcast:valueRecipient"`
+}
+
+type rssValueRecipient struct {
+	Name        string `xml:"name,attr"`
+	Type        string `xml:"type,attr"`
+	Address     string `xml:"address,attr"`
+	Split       int    `xml:"split,attr"`
+	CustomKey   string `xml:"customKey,attr,omitempty"`
+	CustomValue string `xml:"customValue,attr,omitempty"`
+	Fee         bool   `xml:"fee,attr,omitempty"`
+}
+
+type rssEntry struct {
+	Title          string              `xml:"title"`
+	Link           string              `xml:"link"`
+	Desc           string              `xml:"description"`
+	Guid           *rssGuid            `xml:"guid"`
+	PubDate        string              `xml:"pubDate"`
+	Comments       string              `xml:"comments,omitempty"`
+	Enclosure      rssEnclosure        `xml:"enclosure"`
+	Image          *itunesImage        `xml:"itunes:image"`
+	Author         string              `xml:"itunes:author,omitempty"`
+	Season         int                 `xml:"itunes:season,omitempty"`
+	Episode        int                 `xml:"itunes:episode,omitempty"`
+	Duration       string              `xml:"itunes:duration,omitempty"`
+	Explicit       *bool               `xml:"itunes:explicit"`
+	License        *rssLicense         `xml:"podcast:license"`
+	Value          *rssValue           `xml:"podcast:value"`
+	Chapters       *rssChapters        `xml:"podcast:chapters"`
+	Transcripts    []rssTranscript     `xml:"podcast:transcript"`
+	Alternates     []rssAlternate      `xml:"podcast:alternateEnclosure"`
+	SocialInteract []rssSocialInteract `xml:"podcast:socialInteract"`
+}
+
+type rssChapters struct {
+	Url  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssTranscript struct {
+	Url  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Guid        string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	Url    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssAlternate struct {
+	Type      string        `xml:"type,attr"`
+	Length    int64         `xml:"length,attr,omitempty"`
+	Title     string        `xml:"title,attr,omitempty"`
+	Default   bool          `xml:"default,attr,omitempty"`
+	Source    rssSource     `xml:"podcast:source"`
+	Integrity *rssIntegrity `xml:"podcast:integrity"`
+}
+
+type rssSource struct {
+	Uri string `xml:"uri,attr"`
+}
+
+type rssIntegrity struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type rssSocialInteract struct {
+	Protocol   string `xml:"protocol,attr"`
+	Uri        string `xml:"uri,attr,omitempty"`
+	AccountId  string `xml:"accountId,attr,omitempty"`
+	AccountUrl string `xml:"accountUrl,attr,omitempty"`
+	Priority   int    `xml:"priority,attr,omitempty"`
+}
+
+// Feed returns the RSS feed of items.
+func (m Metadata) Feed(items []Item) ([]byte, error) {
+	return m.feed(items, nil)
+}
+
+// FeedPages returns the RSS feed of items split in pages of at most
+// m.maxItemsPerPage items, linked to each other as a paged feed of RFC 5005.
+// The first page is served at FeedPath and page n at FeedPath?page=n. The
+// newest items are on the first page: the items of serial shows, oldest
+// first, are split from the end.
+func (m Metadata) FeedPages(items []Item) ([][]byte, error) {
+	n := m.maxItemsPerPage
+	if n <= 0 || len(items) <= n {
+		feed, err := m.Feed(items)
+		return [][]byte{feed}, err
+	}
+	var chunks [][]Item
+	for rest := items; len(rest) > 0; {
+		k := min(n, len(rest))
+		if m.ShowType == ShowSerial {
+			chunks = append(chunks, rest[len(rest)-k:])
+			rest = rest[:len(rest)-k]
+		} else {
+			chunks = append(chunks, rest[:k])
+			rest = rest[k:]
+		}
+	}
+	pages := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		links := []atomLink{
+			{Rel: "self", Type: "application/rss+xml", Href: m.feedPageUrl(i + 1)},
+			{Rel: "first", Href: m.feedPageUrl(1)},
+			{Rel: "last", Href: m.feedPageUrl(len(chunks))},
+		}
+		if i > 0 {
+			links = append(links, atomLink{Rel: "previous", Href: m.feedPageUrl(i)})
+		}
+		if i+1 < len(chunks) {
+			links = append(links, atomLink{Rel: "next", Href: m.feedPageUrl(i + 2)})
+		}
+		var err error
+		if pages[i], err = m.feed(chunk, links); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+func (m Metadata) feedPageUrl(page int) string {
+	u := m.externalUrl + FeedPath[1:]
+	if page > 1 {
+		u += "?" + FeedPageParam + "=" + strconv.Itoa(page)
+	}
+	return u
+}
+
+func (m Metadata) feed(items []Item, links []atomLink) ([]byte, error) {
+	ch := rssChannel{
+		Title:     m.Title,
+		Link:      m.Link,
+		AtomLinks: links,
+		Desc:      m.Desc,
+		Language:  m.Language,
+		Image: rssImage{
+			Url:    m.CoverUrl,
+			Title:  m.Title,
+			Link:   m.Link,
+			Width:  m.CoverWidth,
+			Height: m.CoverHeight,
+		},
+		ItunesImage: itunesImage{Href: m.CoverUrl},
+		Type:        m.ShowType,
+		Explicit:    m.Explicit,
+		Author:      m.Author,
+		Copyright:   m.Copyright,
+		License:     newRssLicense(m.License),
+		Value:       newRssValue(m.Value),
+	}
+	if c := m.Category; c != nil {
+		ch.Category = &itunesCategory{Text: c.Name}
+		if c.Sub != "" {
+			ch.Category.Sub = &itunesCategory{Text: c.Sub}
+		}
+	}
+	if m.SupportUrl != "" {
+		ch.Funding = &rssFunding{Url: m.SupportUrl, Text: m.FundingText()}
+	}
+	for _, it := range items {
+		ch.Items = append(ch.Items, m.rssEntry(it))
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", " ")
+	doc := rssDocument{
+		Version:   "2.0",
+		NsItunes:  nsItunes,
+		NsContent: nsContent,
+		NsPodcast: nsPodcast,
+		Channel:   ch,
+	}
+	if len(links) > 0 {
+		doc.NsAtom = nsAtom
+	}
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (m Metadata) rssEntry(it Item) rssEntry {
+	ri := rssEntry{
+		Title:    it.Title,
+		Link:     it.Link,
+		Desc:     it.Desc,
+		PubDate:  it.ModTime.Format(TimeRFC2822),
+		Comments: it.CommentsUrl,
+		Enclosure: rssEnclosure{
+			Url:    it.Enclosure.Url,
+			Length: it.Enclosure.Length,
+			Type:   it.Enclosure.Type,
+		},
+		Author:   it.Author,
+		Season:   it.Season,
+		Episode:  it.Episode,
+		Explicit: it.Explicit,
+		License:  newRssLicense(it.License),
+		Value:    newRssValue(it.Value),
+	}
+	if it.Guid != "" {
+		ri.Guid = &rssGuid{Guid: it.Guid}
+	}
+	if it.Image != "" {
+		ri.Image = &itunesImage{Href: it.Image}
+	}
+	if it.Duration != 0 {
+		ri.Duration = formatDuration(it.Duration)
+	}
+	if it.ChaptersUrl != "" {
+		ri.Chapters = &rssChapters{Url: it.ChaptersUrl, Type: chaptersType}
+	}
+	for _, t := range it.Transcripts {
+		ri.Transcripts = append(ri.Transcripts, rssTranscript{Url: t.Url, Type: t.Type})
+	}
+	// With other renditions, the enclosure is listed as the default one.
+	if len(it.Alternates) > 0 || it.Hls != "" || it.Hash != "" {
+		def := rssAlternate{
+			Type:    it.Enclosure.Type,
+			Length:  it.Enclosure.Length,
+			Default: true,
+			Source:  rssSource{Uri: it.Enclosure.Url},
+		}
+		if it.Hash != "" {
+			def.Integrity = &rssIntegrity{Type: "sri", Value: sri(it.Hash)}
+		}
+		ri.Alternates = append(ri.Alternates, def)
+	}
+	if it.Hls != "" {
+		ri.Alternates = append(ri.Alternates, rssAlternate{
+			Type:   "application/x-mpegURL",
+			Title:  "HLS",
+			Source: rssSource{Uri: it.Hls},
+		})
+	}
+	for _, alt := range it.Alternates {
+		ri.Alternates = append(ri.Alternates, rssAlternate{
+			Type:   alt.Enclosure.Type,
+			Length: alt.Enclosure.Length,
+			Title:  alt.Title,
+			Source: rssSource{Uri: alt.Enclosure.Url},
+		})
+	}
+	for _, si := range it.SocialInteract {
+		ri.SocialInteract = append(ri.SocialInteract, rssSocialInteract{
+			Protocol:   si.Protocol,
+			Uri:        si.Uri,
+			AccountId:  si.AccountId,
+			AccountUrl: si.AccountUrl,
+			Priority:   si.Priority,
+		})
+	}
+	return ri
+}
+
+func newRssLicense(l *License) *rssLicense {
+	if l == nil {
+		return nil
+	}
+	return &rssLicense{Url: l.Url, Name: l.Name}
+}
+
+func newRssValue(v *ValueBlock) *rssValue {
+	if v == nil {
+		return nil
+	}
+	rv := &rssValue{Type: v.Type, Method: v.Method, Suggested: v.Suggested}
+	for _, r := range v.Recipients {
+		rv.Recipients = append(rv.Recipients, rssValueRecipient{
+			Name:        r.Name,
+			Type:        r.Type,
+			Address:     r.Address,
+			Split:       r.Split,
+			CustomKey:   r.CustomKey,
+			CustomValue: r.CustomValue,
+			Fee:         r.Fee,
+		})
+	}
+	return rv
+}
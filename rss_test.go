@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	m := Metadata{
+		Title:    "Show",
+		Link:     "https://podcast.example.com/",
+		Desc:     "A show.",
+		Language: "en",
+	}
+	items := []Item{
+		{
+			Title:   "Episode 1",
+			Guid:    "urn:uuid:3f1d5c0e-9b7a-4f0e-8a51-2d6f0c4b9e10",
+			ModTime: time.Date(2025, 3, 1, 9, 30, 0, 0, time.FixedZone("CET", 3600)),
+			Enclosure: Enclosure{
+				Url:    "https://podcast.example.com/episode%201.mp3",
+				Length: 1234,
+				Type:   "audio/mpeg",
+			},
+			Duration: 61,
+		},
+		{
+			Title:   "Episode 2",
+			ModTime: time.Date(2025, 3, 8, 18, 0, 0, 0, time.UTC),
+			Enclosure: Enclosure{
+				Url:    "https://podcast.example.com/episode%202.m4a",
+				Length: 5678,
+				Type:   "audio/mp4",
+			},
+		},
+	}
+	feed, err := m.Feed(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`<rss version="2.0"`,
+		`xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"`,
+		`xmlns:content="http://purl.org/rss/1.0/modules/content/"`,
+		`xmlns:podcast="https://podcastindex.org/namespace/1.0"`,
+		`<itunes:duration>0:01:01</itunes:duration>`,
+	} {
+		if !strings.Contains(string(feed), want) {
+			t.Errorf("feed has no %s:\n%s", want, feed)
+		}
+	}
+	if strings.Contains(string(feed), "xmlns:atom") {
+		t.Errorf("feed declares the Atom namespace without links:\n%s", feed)
+	}
+
+	var doc struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title string `xml:"title"`
+				Guid  *struct {
+					IsPermaLink string `xml:"isPermaLink,attr"`
+					Value       string `xml:",chardata"`
+				} `xml:"guid"`
+				PubDate   string `xml:"pubDate"`
+				Enclosure struct {
+					Url    string `xml:"url,attr"`
+					Length string `xml:"length,attr"`
+					Type   string `xml:"type,attr"`
+				} `xml:"enclosure"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(feed, &doc); err != nil {
+		t.Fatalf("parse feed: %v\n%s", err, feed)
+	}
+	if doc.Channel.Title != m.Title {
+		t.Errorf("channel title = %q, want %q", doc.Channel.Title, m.Title)
+	}
+	if len(doc.Channel.Items) != len(items) {
+		t.Fatalf("feed has %d items, want %d", len(doc.Channel.Items), len(items))
+	}
+	tests := []struct {
+		pubDate string
+		guid    string
+	}{
+		{"Sat, 01 Mar 2025 09:30:00 +0100", items[0].Guid},
+		{"Sat, 08 Mar 2025 18:00:00 +0000", ""},
+	}
+	for i, tt := range tests {
+		got, it := doc.Channel.Items[i], items[i]
+		if got.Title != it.Title {
+			t.Errorf("item %d: title = %q, want %q", i, got.Title, it.Title)
+		}
+		if got.PubDate != tt.pubDate {
+			t.Errorf("item %d: pubDate = %q, want %q", i, got.PubDate, tt.pubDate)
+		}
+		if d, err := time.Parse(time.RFC1123Z, got.PubDate); err != nil || !d.Equal(it.ModTime) {
+			t.Errorf("item %d: pubDate %q is not RFC 2822 for %v: %v", i, got.PubDate, it.ModTime, err)
+		}
+		switch {
+		case tt.guid == "" && got.Guid != nil:
+			t.Errorf("item %d: guid = %q, want none", i, got.Guid.Value)
+		case tt.guid != "" && got.Guid == nil:
+			t.Errorf("item %d: no guid, want %q", i, tt.guid)
+		case tt.guid != "" && (got.Guid.Value != tt.guid || got.Guid.IsPermaLink != "false"):
+			t.Errorf("item %d: guid = %q isPermaLink=%q, want %q isPermaLink=false", i, got.Guid.Value, got.Guid.IsPermaLink, tt.guid)
+		}
+		e := got.Enclosure
+		if e.Url != it.Enclosure.Url || e.Length != strconv.FormatInt(it.Enclosure.Length, 10) || e.Type != it.Enclosure.Type {
+			t.Errorf("item %d: enclosure = %+v, want %+v", i, e, it.Enclosure)
+		}
+	}
+}
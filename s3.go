@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a listing of the bucket is used before listing it again.
+	s3ListTTL = 30 * time.Second
+	// Timeout of listing requests. Downloads have none, media files are large.
+	s3ListTimeout = 30 * time.Second
+	// How long presigned URLs of redirects are valid.
+	s3PresignExpiry = 6 * time.Hour
+
+	// SHA-256 of an empty payload.
+	s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// An S3Source is a media library in a bucket of S3 or a compatible service
+// (MinIO, Backblaze B2, Cloudflare R2 etc.), so that the media does not have to
+// live on the serving host. It is a file system of the objects under a prefix
+// for scanning, relisted at most every s3ListTTL. Media files are served from
+// a MediaCache (see cachedRemote), or by redirecting to presigned URLs.
+//
+// Requests are path-style and signed with AWS Signature Version 4.
+type S3Source struct {
+	Endpoint *url.URL // E.g. https://s3.eu-west-1.amazonaws.com.
+	Region   string
+	Bucket   string
+	Prefix   string // Empty or ending in "/".
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // Optional.
+
+	// Serve media by redirecting to presigned URLs rather than from the
+	// cache.
+	Redirect bool
+	Cache    *MediaCache
+	Blocks   *BlockCache
+
+	listingFS
+	client *http.Client
+}
+
+// NewS3Source returns the source of the bucket and prefix of an s3://bucket/prefix
+// URL.
+func NewS3Source(rawUrl, endpoint, region string) (*S3Source, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid bucket URL %q, expected s3://bucket/prefix", rawUrl)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil || ep.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	s := &S3Source{
+		Endpoint:     ep,
+		Region:       region,
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.Prefix != "" {
+		s.Prefix += "/"
+	}
+	s.listingFS = listingFS{ttl: s3ListTTL, list: s.listBucket, open: s.openObject}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("set the credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// s3Escape escapes s as AWS expects in canonical requests: everything but
+// unreserved characters, and slashes unless escapeSlash is false.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// objectUrl returns the URL of an object, or of the bucket if key is empty.
+func (s *S3Source) objectUrl(key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signature returns the credential scope and the signature of a canonical
+// request.
+func (s *S3Source) signature(now time.Time, canonical string) (scope, sig string) {
+	date := now.Format("20060102")
+	scope = date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// get sends a signed GET request without a body.
+func (s *S3Source) get(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	signed := []string{"host"}
+	for k := range req.Header {
+		signed = append(signed, strings.ToLower(k))
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, k := range signed {
+		v := u.Host
+		if k != "host" {
+			v = strings.TrimSpace(req.Header.Get(k))
+		}
+		headers.WriteString(k + ":" + v + "\n")
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		s3EmptyHash,
+	}, "\n")
+	scope, sig := s.signature(now, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, strings.Join(signed, ";"), sig,
+	))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fs.ErrNotExist
+		}
+		return nil, fmt.Errorf("s3 %s: %s", u.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Presign returns a URL to get the object at path p without credentials, valid
+// for the given duration.
+func (s *S3Source) Presign(p string, expiry time.Duration) string {
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.AccessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {fmt.Sprint(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	u := s.objectUrl(s.Prefix+p, query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	_, sig := s.signature(now, canonical)
+	u.RawQuery += "&X-Amz-Signature=" + sig
+	return u.String()
+}
+
+// listBucket lists the objects under the prefix.
+func (s *S3Source) listBucket() ([]remoteFile, error) {
+	var files []remoteFile
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s3ListTimeout)
+		resp, err := s.get(ctx, s.objectUrl("", query), nil)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("list bucket %s: %w", s.Bucket, err)
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("list bucket %s: %w", s.Bucket, err)
+		}
+		for _, o := range page.Contents {
+			// Skips folder markers created by consoles.
+			if !strings.HasSuffix(o.Key, "/") {
+				files = append(files, remoteFile{
+					Path:    strings.TrimPrefix(o.Key, s.Prefix),
+					Size:    o.Size,
+					ModTime: o.LastModified,
+				})
+			}
+		}
+		if !page.IsTruncated {
+			return files, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Source) openObject(p string) (io.ReadCloser, error) {
+	resp, err := s.get(context.Background(), s.objectUrl(s.Prefix+p, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Source) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	if s.Redirect {
+		http.Redirect(w, r, s.Presign(f.Source, s3PresignExpiry), http.StatusFound)
+		return
+	}
+	cachedRemote{
+		cache:     s.Cache,
+		blocks:    s.Blocks,
+		tag:       TagS3,
+		stat:      s.file,
+		fill:      s.fill,
+		readRange: s.readRange,
+	}.ServeFile(w, r, f)
+}
+
+// fill downloads the object at path p to fp, for the cache.
+func (s *S3Source) fill(p string, fp *os.File) error {
+	body, err := s.openObject(p)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(fp, body)
+	return err
+}
+
+// readRange reads n bytes at offset off of the object at path p.
+func (s *S3Source) readRange(ctx context.Context, p string, off, n int64) ([]byte, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)}}
+	resp, err := s.get(ctx, s.objectUrl(s.Prefix+p, nil), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// The range was ignored.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, n))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Delay between attempts to stat a file.
+const scanRetryDelay = 500 * time.Millisecond
+
+var (
+	errStatTimeout = errors.New("stat timed out")
+	errScanRunning = errors.New("previous scan of the media directory still running")
+	errPartialScan = errors.New("partial scan")
+)
+
+// A ScanPolicy keeps a media directory on a flaky network file system (NFS,
+// SMB) from stalling refreshes. Files that cannot be read are skipped, and
+// the feed keeps being served from the last good scan rather than losing
+// them, see Server.Refresh.
+type ScanPolicy struct {
+	StatTimeout time.Duration // Per attempt, 0 waits forever.
+	Retries     int           // Attempts after the first one.
+	Timeout     time.Duration // Of the whole scan, 0 waits forever.
+}
+
+// stat stats name, giving up on attempts taking longer than StatTimeout, and
+// retrying failures other than the file not existing. An attempt that timed
+// out is left hanging in the background, there is no interrupting it.
+func (p ScanPolicy) stat(name string) (fs.FileInfo, error) {
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(scanRetryDelay)
+		}
+		var info fs.FileInfo
+		if info, err = p.statOnce(name); err == nil || errors.Is(err, fs.ErrNotExist) {
+			return info, err
+		}
+	}
+	return nil, err
+}
+
+func (p ScanPolicy) statOnce(name string) (fs.FileInfo, error) {
+	if p.StatTimeout <= 0 {
+		return os.Stat(name)
+	}
+	type result struct {
+		info fs.FileInfo
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		info, err := os.Stat(name)
+		ch <- result{info, err}
+	}()
+	timer := time.NewTimer(p.StatTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.info, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%s: %w", name, errStatTimeout)
+	}
+}
+
+// scan generates a snapshot of the media directory, giving up after the scan
+// timeout. A scan that gave up keeps running in the background, hung on the
+// file system, and scans fail until it returns rather than piling up. A dry
+// run has no side effects, see Metadata.dryRun.
+func (s *Server) scan(dryRun bool) (*Snapshot, error) {
+	if !s.scanning.CompareAndSwap(false, true) {
+		return nil, errScanRunning
+	}
+	type result struct {
+		snap *Snapshot
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer s.scanning.Store(false)
+		m := s.Metadata
+		m.dryRun = dryRun
+		snap, err := GenerateFeed(m)
+		ch <- result{snap, err}
+	}()
+	var timeout <-chan time.Time
+	if t := s.Metadata.scan.Timeout; t > 0 {
+		timer := time.NewTimer(t)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-ch:
+		return r.snap, r.err
+	case <-timeout:
+		return nil, fmt.Errorf("scan of the media directory timed out after %s", s.Metadata.scan.Timeout)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Shows with seasons can be laid out as a directory per season, with the
+// number of the episode in the file name:
+//
+//	Season 01/Episode 03 - Title.mp3
+//
+// The numbers are published as itunes:season and itunes:episode, and the
+// rest of the file name as the title, unless the tags have one.
+
+var (
+	seasonDir   = regexp.MustCompile(`(?i)^season\s*(\d+)$`)
+	episodeFile = regexp.MustCompile(`(?i)^episode\s*(\d+)(?:\s*[-–:.]\s*(.*))?$`)
+)
+
+// seasonEpisode returns the season and episode numbers of the file at the
+// relative path p with the name title, without its extension, and its title
+// without the number. The numbers are 0 if p does not follow the layout.
+func seasonEpisode(p, title string) (int, int, string) {
+	dir := path.Dir(p)
+	if path.Base(dir) == DraftsDir {
+		dir = path.Dir(dir)
+	}
+	var season, episode int
+	if m := seasonDir.FindStringSubmatch(path.Base(dir)); m != nil {
+		season, _ = strconv.Atoi(m[1])
+	}
+	if m := episodeFile.FindStringSubmatch(title); m != nil {
+		episode, _ = strconv.Atoi(m[1])
+		if t := strings.TrimSpace(m[2]); t != "" {
+			title = t
+		}
+	}
+	return season, episode, title
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	SessionCookie = "podserve_session"
+	CSRFHeader    = "X-CSRF-Token"
+	CSRFFormField = "csrf_token"
+)
+
+var ErrCSRF = errors.New("missing or invalid CSRF token")
+
+// A Session of a user logged in to the admin UI.
+type Session struct {
+	ID        string
+	CSRFToken string
+	Principal Principal
+	Expires   time.Time
+}
+
+// SessionStore keeps browser sessions in memory; they do not survive a
+// restart.
+type SessionStore struct {
+	TTL time.Duration
+	// Whether cookies are only sent over https.
+	Secure bool
+
+	mu       sync.Mutex // Guards sessions
+	sessions map[string]*Session
+}
+
+func NewSessionStore(ttl time.Duration, secure bool) *SessionStore {
+	return &SessionStore{
+		TTL:      ttl,
+		Secure:   secure,
+		sessions: make(map[string]*Session),
+	}
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Create starts a new session for p and sets its cookie on w.
+func (ss *SessionStore) Create(w http.ResponseWriter, p Principal) (*Session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		ID:        id,
+		CSRFToken: csrf,
+		Principal: p,
+		Expires:   time.Now().Add(ss.TTL),
+	}
+	ss.mu.Lock()
+	now := time.Now()
+	for id, s := range ss.sessions {
+		if now.After(s.Expires) {
+			delete(ss.sessions, id)
+		}
+	}
+	ss.sessions[sess.ID] = sess
+	ss.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.Expires,
+		Secure:   ss.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return sess, nil
+}
+
+// Get returns the unexpired session of the session cookie in r.
+func (ss *SessionStore) Get(r *http.Request) (*Session, bool) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sess, ok := ss.sessions[c.Value]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.Expires) {
+		delete(ss.sessions, c.Value)
+		return nil, false
+	}
+	return sess, true
+}
+
+// Destroy ends the session of r, if any, and clears its cookie.
+func (ss *SessionStore) Destroy(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		ss.mu.Lock()
+		delete(ss.sessions, c.Value)
+		ss.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   ss.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// crossOrigin reports whether r was initiated by a page of another origin
+// than externalUrl, as browsers tell in the Sec-Fetch-Site header or, older
+// ones, in the Origin header. It guards state-changing requests made without
+// a session, such as logging in, which a CSRF token cannot. Other clients
+// send neither header.
+func crossOrigin(r *http.Request, externalUrl string) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return !sameOrigin(origin, externalUrl)
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// CheckCSRF verifies that a state-changing request carries the CSRF token of
+// the session, either in a header (API calls) or a form field (HTML forms).
+func (sess *Session) CheckCSRF(r *http.Request) error {
+	if isSafeMethod(r.Method) {
+		return nil
+	}
+	token := r.Header.Get(CSRFHeader)
+	if token == "" {
+		token = r.PostFormValue(CSRFFormField)
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCrossOrigin(t *testing.T) {
+	const externalUrl = "https://podcast.example.com/show/"
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no headers", nil, false},
+		{"same origin", map[string]string{"Sec-Fetch-Site": "same-origin"}, false},
+		{"typed in", map[string]string{"Sec-Fetch-Site": "none"}, false},
+		{"same site", map[string]string{"Sec-Fetch-Site": "same-site"}, true},
+		{"cross site", map[string]string{"Sec-Fetch-Site": "cross-site"}, true},
+		{"Sec-Fetch-Site first", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://podcast.example.com"}, true},
+		{"origin", map[string]string{"Origin": "https://podcast.example.com"}, false},
+		{"other origin", map[string]string{"Origin": "https://evil.example.com"}, true},
+		{"other scheme", map[string]string{"Origin": "http://podcast.example.com"}, true},
+		{"opaque origin", map[string]string{"Origin": "null"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", AdminLoginPath, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := crossOrigin(r, externalUrl); got != tt.want {
+				t.Errorf("crossOrigin = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
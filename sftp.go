@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a listing of the library is used before listing it again.
+	sftpListTTL = 30 * time.Second
+	// Timeout of listing the library and of reading sidecar files. Downloads
+	// have none, a dead connection is noticed by ssh's keepalives.
+	sftpListTimeout = 2 * time.Minute
+	// Size of read requests, the largest all servers accept.
+	sftpChunk = 32 << 10
+	// Read requests in flight while downloading a file.
+	sftpReadAhead = 16
+)
+
+// Packet types of SFTP version 3, draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpOpenRead = 1 // SSH_FXF_READ
+
+	sftpAttrSize        = 0x1
+	sftpAttrUidGid      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrAcModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+
+	sftpStatusEOF        = 1
+	sftpStatusNoSuchFile = 2
+
+	sftpModeType    = 0o170000
+	sftpModeDir     = 0o040000
+	sftpModeRegular = 0o100000
+	sftpModeSymlink = 0o120000
+)
+
+// An SFTPSource is a media library in a directory of a remote host reachable
+// over SSH, e.g. a shell box or a NAS. It runs the ssh executable with key
+// authentication, so its configuration (~/.ssh/config, known_hosts, agent)
+// applies, and speaks SFTP over it. A few connections are kept open and shared
+// by listings and downloads. Media files are served from a MediaCache, see
+// cachedRemote.
+type SFTPSource struct {
+	Host    string // As passed to ssh, e.g. a Host of ~/.ssh/config.
+	User    string // Optional.
+	Port    string // Optional.
+	Root    string // Directory of the library, relative to the home directory unless absolute.
+	KeyFile string // Optional, ssh's defaults otherwise.
+	Ssh     string // The ssh executable.
+	Cache   *MediaCache
+	Blocks  *BlockCache
+
+	listingFS
+	slots chan struct{} // A slot per connection in use.
+	mu    sync.Mutex    // Guards idle
+	idle  []*sftpConn
+}
+
+// NewSFTPSource returns the source of an sftp://user@host:port/path URL. The
+// path is relative to the home directory, as in scp, sftp://host//srv/podcast
+// is absolute.
+func NewSFTPSource(rawUrl, keyFile, ssh string, conns int) (*SFTPSource, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid SFTP URL %q, expected sftp://user@host/path", rawUrl)
+	}
+	if conns < 1 {
+		return nil, errors.New("at least one connection is needed")
+	}
+	root := strings.TrimPrefix(u.Path, "/")
+	if root == "" {
+		root = "."
+	}
+	s := &SFTPSource{
+		Host:    u.Hostname(),
+		User:    u.User.Username(),
+		Port:    u.Port(),
+		Root:    strings.TrimSuffix(root, "/"),
+		KeyFile: keyFile,
+		Ssh:     ssh,
+		slots:   make(chan struct{}, conns),
+	}
+	s.listingFS = listingFS{ttl: sftpListTTL, list: s.listRoot, open: s.openFile}
+	return s, nil
+}
+
+// remotePath returns the path on the host of the file at path p of the
+// library.
+func (s *SFTPSource) remotePath(p string) string {
+	return path.Join(s.Root, p)
+}
+
+// conn returns a connection to the host, waiting for one to be free. Return
+// it with release.
+func (s *SFTPSource) conn(ctx context.Context) (*sftpConn, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mu.Lock()
+	for len(s.idle) > 0 {
+		c := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		if c.alive() {
+			s.mu.Unlock()
+			return c, nil
+		}
+	}
+	s.mu.Unlock()
+	c, err := s.dial()
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *SFTPSource) release(c *sftpConn) {
+	if c.alive() {
+		s.mu.Lock()
+		s.idle = append(s.idle, c)
+		s.mu.Unlock()
+	}
+	<-s.slots
+}
+
+func (s *SFTPSource) dial() (*sftpConn, error) {
+	args := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=30"}
+	if s.KeyFile != "" {
+		args = append(args, "-i", s.KeyFile)
+	}
+	if s.Port != "" {
+		args = append(args, "-p", s.Port)
+	}
+	if s.User != "" {
+		args = append(args, "-l", s.User)
+	}
+	args = append(args, s.Host, "-s", "sftp")
+	cmd := exec.Command(s.Ssh, args...)
+	c, err := newSftpConn(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", s.Host, err)
+	}
+	slog.Info("connected to SFTP server", "host", s.Host, "tag", TagSFTP)
+	return c, nil
+}
+
+// withConn calls f with a connection, giving up after timeout.
+func (s *SFTPSource) withConn(timeout time.Duration, f func(ctx context.Context, c *sftpConn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.release(c)
+	return f(ctx, c)
+}
+
+// listRoot lists the files of the library, recursively. Symbolic links are
+// followed.
+func (s *SFTPSource) listRoot() ([]remoteFile, error) {
+	var files []remoteFile
+	err := s.withConn(sftpListTimeout, func(ctx context.Context, c *sftpConn) error {
+		dirs := []string{"."}
+		for len(dirs) > 0 {
+			dir := dirs[0]
+			dirs = dirs[1:]
+			entries, err := c.readDir(ctx, s.remotePath(dir))
+			if err != nil {
+				return fmt.Errorf("list %s: %w", dir, err)
+			}
+			for _, e := range entries {
+				if e.name == "." || e.name == ".." {
+					continue
+				}
+				p := path.Join(dir, e.name)
+				attrs := e.attrs
+				if attrs.mode&sftpModeType == sftpModeSymlink {
+					if attrs, err = c.stat(ctx, s.remotePath(p)); err != nil {
+						slog.Warn("skipping unreadable symbolic link", "error", err, "path", p, "tag", TagSFTP)
+						continue
+					}
+				}
+				switch attrs.mode & sftpModeType {
+				case sftpModeDir:
+					dirs = append(dirs, p)
+				case sftpModeRegular:
+					files = append(files, remoteFile{Path: p, Size: attrs.size, ModTime: attrs.modTime})
+				}
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// openFile reads the file at path p of the library into memory, e.g. a sidecar
+// file.
+func (s *SFTPSource) openFile(p string) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	err := s.withConn(sftpListTimeout, func(ctx context.Context, c *sftpConn) error {
+		return c.download(ctx, s.remotePath(p), 0, -1, &bufferWriterAt{&buf})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// fill downloads the file at path p of the library to fp, for the cache.
+func (s *SFTPSource) fill(p string, fp *os.File) error {
+	// Not canceled with the request, see MediaCache.Get.
+	c, err := s.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer s.release(c)
+	return c.download(context.Background(), s.remotePath(p), 0, -1, fp)
+}
+
+// readRange reads n bytes at offset off of the file at path p of the library.
+func (s *SFTPSource) readRange(ctx context.Context, p string, off, n int64) ([]byte, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(c)
+	buf := make([]byte, n)
+	if err := c.download(ctx, s.remotePath(p), off, n, sliceWriterAt(buf)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *SFTPSource) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	cachedRemote{
+		cache:     s.Cache,
+		blocks:    s.Blocks,
+		tag:       TagSFTP,
+		stat:      s.file,
+		fill:      s.fill,
+		readRange: s.readRange,
+	}.ServeFile(w, r, f)
+}
+
+// A sliceWriterAt writes to a slice, as long as what is written.
+type sliceWriterAt []byte
+
+func (b sliceWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, errors.New("write out of range")
+	}
+	return copy(b[off:], p), nil
+}
+
+// A bufferWriterAt writes to a buffer, downloads write in order.
+type bufferWriterAt struct {
+	buf *bytes.Buffer
+}
+
+func (b *bufferWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off != int64(b.buf.Len()) {
+		return 0, errors.New("non-sequential write")
+	}
+	return b.buf.Write(p)
+}
+
+// An sftpConn is an SFTP session over an ssh process. Requests can be sent
+// concurrently, responses are matched to them by id.
+type sftpConn struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+
+	wmu     sync.Mutex // Guards w
+	mu      sync.Mutex // Guards all below
+	nextId  uint32
+	pending map[uint32]chan sftpPacket
+	done    chan struct{} // Closed once the session ended.
+	err     error         // Why it ended.
+}
+
+type sftpPacket struct {
+	typ  byte
+	data []byte // After the id.
+}
+
+func newSftpConn(cmd *exec.Cmd) (*sftpConn, error) {
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &sftpConn{
+		cmd:     cmd,
+		w:       w,
+		pending: make(map[uint32]chan sftpPacket),
+		done:    make(chan struct{}),
+	}
+	br := bufio.NewReaderSize(r, sftpChunk+1024)
+
+	// The version exchange, the only packets without an id.
+	var init sftpBuf
+	init.byte(sftpInit)
+	init.uint32(3)
+	typ, _, err := c.exchange(br, init)
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("unexpected packet type %d", typ)
+	}
+	if err != nil {
+		w.Close()
+		cmd.Wait()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	go c.read(br, &stderr)
+	return c, nil
+}
+
+func (c *sftpConn) exchange(br *bufio.Reader, b sftpBuf) (byte, []byte, error) {
+	if _, err := c.w.Write(b.packet()); err != nil {
+		return 0, nil, err
+	}
+	return readSftpPacket(br)
+}
+
+func readSftpPacket(br *bufio.Reader) (byte, []byte, error) {
+	var n uint32
+	if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n == 0 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// read dispatches responses until the session ends.
+func (c *sftpConn) read(br *bufio.Reader, stderr *bytes.Buffer) {
+	var err error
+	for {
+		var typ byte
+		var b []byte
+		if typ, b, err = readSftpPacket(br); err != nil {
+			break
+		}
+		if len(b) < 4 {
+			err = errors.New("short packet")
+			break
+		}
+		id := binary.BigEndian.Uint32(b)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{typ, b[4:]}
+		}
+	}
+	c.w.Close()
+	c.cmd.Wait()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	slog.Warn("SFTP session ended", "error", err, "tag", TagSFTP)
+	c.mu.Lock()
+	c.err = fmt.Errorf("SFTP session ended: %w", err)
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func (c *sftpConn) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// send sends a request of type typ with the given fields after its id, and
+// returns the channel its response is delivered to.
+func (c *sftpConn) send(typ byte, fields func(b *sftpBuf)) (chan sftpPacket, error) {
+	ch := make(chan sftpPacket, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextId++
+	id := c.nextId
+	c.pending[id] = ch
+	c.mu.Unlock()
+	var b sftpBuf
+	b.byte(typ)
+	b.uint32(id)
+	fields(&b)
+	c.wmu.Lock()
+	_, err := c.w.Write(b.packet())
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// wait returns the response delivered to ch. A response arriving after ctx is
+// done is dropped.
+func (c *sftpConn) wait(ctx context.Context, ch chan sftpPacket) (sftpPacket, error) {
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-c.done:
+		return sftpPacket{}, c.err
+	case <-ctx.Done():
+		return sftpPacket{}, ctx.Err()
+	}
+}
+
+func (c *sftpConn) call(ctx context.Context, typ byte, fields func(b *sftpBuf)) (sftpPacket, error) {
+	ch, err := c.send(typ, fields)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ctx, ch)
+}
+
+// statusError returns the error of a status response, nil if it is a success.
+func statusError(p sftpPacket) error {
+	if p.typ != sftpStatus {
+		return fmt.Errorf("unexpected packet type %d", p.typ)
+	}
+	d := sftpDecoder{b: p.data}
+	code := d.uint32()
+	msg := d.string()
+	switch {
+	case d.err != nil:
+		return d.err
+	case code == 0:
+		return nil
+	case code == sftpStatusEOF:
+		return io.EOF
+	case code == sftpStatusNoSuchFile:
+		return fs.ErrNotExist
+	}
+	return fmt.Errorf("SFTP error %d: %s", code, msg)
+}
+
+// openHandle returns the handle of a response to an open request.
+func openHandle(p sftpPacket, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if p.typ != sftpHandle {
+		return "", statusError(p)
+	}
+	d := sftpDecoder{b: p.data}
+	h := d.string()
+	return h, d.err
+}
+
+func (c *sftpConn) close(h string) {
+	// Not waited for, the response is dropped.
+	c.send(sftpClose, func(b *sftpBuf) { b.string(h) })
+}
+
+type sftpFileAttrs struct {
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+type sftpEntry struct {
+	name  string
+	attrs sftpFileAttrs
+}
+
+func (c *sftpConn) stat(ctx context.Context, p string) (sftpFileAttrs, error) {
+	resp, err := c.call(ctx, sftpStat, func(b *sftpBuf) { b.string(p) })
+	if err != nil {
+		return sftpFileAttrs{}, err
+	}
+	if resp.typ != sftpAttrs {
+		return sftpFileAttrs{}, statusError(resp)
+	}
+	d := sftpDecoder{b: resp.data}
+	attrs := d.attrs()
+	return attrs, d.err
+}
+
+func (c *sftpConn) readDir(ctx context.Context, p string) ([]sftpEntry, error) {
+	h, err := openHandle(c.call(ctx, sftpOpendir, func(b *sftpBuf) { b.string(p) }))
+	if err != nil {
+		return nil, err
+	}
+	defer c.close(h)
+	var entries []sftpEntry
+	for {
+		resp, err := c.call(ctx, sftpReaddir, func(b *sftpBuf) { b.string(h) })
+		if err != nil {
+			return nil, err
+		}
+		if resp.typ != sftpName {
+			if err := statusError(resp); err != io.EOF {
+				if err == nil {
+					err = errors.New("unexpected status")
+				}
+				return nil, err
+			}
+			return entries, nil
+		}
+		d := sftpDecoder{b: resp.data}
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			name := d.string()
+			d.string() // Long name, as of ls -l.
+			entries = append(entries, sftpEntry{name, d.attrs()})
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+}
+
+// download writes n bytes at offset off of the file at path p to w, at
+// offsets relative to off, in order, with several reads in flight. A negative
+// n reads up to the end of the file, as large as it is when starting.
+func (c *sftpConn) download(ctx context.Context, p string, off, n int64, w io.WriterAt) error {
+	if n < 0 {
+		attrs, err := c.stat(ctx, p)
+		if err != nil {
+			return err
+		}
+		n = attrs.size - off
+	}
+	end := off + n
+	h, err := openHandle(c.call(ctx, sftpOpen, func(b *sftpBuf) {
+		b.string(p)
+		b.uint32(sftpOpenRead)
+		b.uint32(0) // No attributes.
+	}))
+	if err != nil {
+		return err
+	}
+	defer c.close(h)
+
+	type read struct {
+		off int64
+		n   int
+		ch  chan sftpPacket
+	}
+	var inFlight []read
+	request := func(off int64, n int) (read, error) {
+		ch, err := c.send(sftpRead, func(b *sftpBuf) {
+			b.string(h)
+			b.uint64(uint64(off))
+			b.uint32(uint32(n))
+		})
+		return read{off, n, ch}, err
+	}
+	next := off
+	for next < end || len(inFlight) > 0 {
+		for len(inFlight) < sftpReadAhead && next < end {
+			r, err := request(next, int(min(sftpChunk, end-next)))
+			if err != nil {
+				return err
+			}
+			inFlight = append(inFlight, r)
+			next += int64(r.n)
+		}
+		r := inFlight[0]
+		inFlight = inFlight[1:]
+		resp, err := c.wait(ctx, r.ch)
+		if err != nil {
+			return err
+		}
+		if resp.typ != sftpData {
+			if err := statusError(resp); err != io.EOF {
+				return err
+			}
+			return fmt.Errorf("%s: %w", p, io.ErrUnexpectedEOF)
+		}
+		d := sftpDecoder{b: resp.data}
+		data := d.string()
+		if d.err != nil {
+			return d.err
+		}
+		if len(data) == 0 || len(data) > r.n {
+			return fmt.Errorf("%s: invalid read of %d bytes", p, len(data))
+		}
+		if _, err := w.WriteAt([]byte(data), r.off-off); err != nil {
+			return err
+		}
+		if len(data) < r.n {
+			// Servers may return less than requested, the rest is read
+			// next.
+			rest, err := request(r.off+int64(len(data)), r.n-len(data))
+			if err != nil {
+				return err
+			}
+			inFlight = slices.Insert(inFlight, 0, rest)
+		}
+	}
+	return nil
+}
+
+// An sftpBuf encodes a packet.
+type sftpBuf struct {
+	b []byte
+}
+
+func (b *sftpBuf) byte(v byte)     { b.b = append(b.b, v) }
+func (b *sftpBuf) uint32(v uint32) { b.b = binary.BigEndian.AppendUint32(b.b, v) }
+func (b *sftpBuf) uint64(v uint64) { b.b = binary.BigEndian.AppendUint64(b.b, v) }
+
+func (b *sftpBuf) string(s string) {
+	b.uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+
+// packet returns the packet, prefixed with its length.
+func (b *sftpBuf) packet() []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b.b))), b.b...)
+}
+
+// An sftpDecoder decodes the fields of a packet, keeping the first error.
+type sftpDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *sftpDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errors.New("short packet")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sftpDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) string() string {
+	n := d.uint32()
+	return string(d.next(int(n)))
+}
+
+func (d *sftpDecoder) attrs() sftpFileAttrs {
+	var a sftpFileAttrs
+	flags := d.uint32()
+	if flags&sftpAttrSize != 0 {
+		a.size = int64(d.uint64())
+	}
+	if flags&sftpAttrUidGid != 0 {
+		d.next(8)
+	}
+	if flags&sftpAttrPermissions != 0 {
+		a.mode = d.uint32()
+	}
+	if flags&sftpAttrAcModTime != 0 {
+		d.uint32() // Access time.
+		a.modTime = time.Unix(int64(d.uint32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return a
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Media is written in chunks of at most this size under a bandwidth cap.
+const throttleChunk = 32 << 10
+
+// A MediaLimiter caps the number of concurrent media downloads and their total
+// bandwidth. Rather than letting every download crawl when overloaded, it
+// answers new requests with 429 Too Many Requests and a Retry-After header,
+// for podcast apps to back off and retry.
+type MediaLimiter struct {
+	// Concurrent downloads beyond which to shed requests, 0 is unlimited.
+	MaxDownloads int
+	// Bytes per second sent for all downloads, 0 is unlimited. Requests are
+	// shed when a new download would get less than MinRate of it.
+	MaxRate int64
+	MinRate int64
+	// Suggested delay before retrying a shed request.
+	RetryAfter time.Duration
+
+	bandwidth *fairShaper
+	active    atomic.Int64
+	shedBusy  atomic.Int64 // Shed because of MaxDownloads.
+	shedSlow  atomic.Int64 // Shed because of MaxRate.
+}
+
+func NewMediaLimiter(maxDownloads int, maxRate, minRate int64, retryAfter time.Duration) *MediaLimiter {
+	l := &MediaLimiter{MaxDownloads: maxDownloads, MaxRate: maxRate, MinRate: minRate, RetryAfter: retryAfter}
+	if maxRate > 0 {
+		l.bandwidth = newFairShaper(maxRate)
+	}
+	return l
+}
+
+// overloaded reports whether to shed a new download with n already active,
+// and why.
+func (l *MediaLimiter) overloaded(n int64) (bool, *atomic.Int64) {
+	if l.MaxDownloads > 0 && n >= int64(l.MaxDownloads) {
+		return true, &l.shedBusy
+	}
+	if l.MaxRate > 0 && l.MinRate > 0 && l.MaxRate/(n+1) < l.MinRate {
+		return true, &l.shedSlow
+	}
+	return false, nil
+}
+
+// Wrap limits the media downloads served by h. HEAD requests are not limited.
+func (l *MediaLimiter) Wrap(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+		n := l.active.Add(1)
+		defer l.active.Add(-1)
+		if shed, reason := l.overloaded(n - 1); shed {
+			reason.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(l.RetryAfter.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if l.bandwidth != nil {
+			client := r.RemoteAddr
+			if addr, ok := remoteAddr(r); ok {
+				client = addr.String()
+			}
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), shaper: l.bandwidth, client: client}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (l *MediaLimiter) WriteMetrics(w *metricsWriter) {
+	w.Gauge("podserve_media_downloads_active", "Media downloads in progress.", l.active.Load())
+	w.Help("podserve_media_requests_shed_total", "counter", "Media requests answered with 429 Too Many Requests, by exceeded limit.")
+	w.Sample("podserve_media_requests_shed_total", l.shedBusy.Load(), "limit", "downloads")
+	w.Sample("podserve_media_requests_shed_total", l.shedSlow.Load(), "limit", "bandwidth")
+}
+
+// A throttledWriter writes no faster than its client's share of a fairShaper.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	shaper *fairShaper
+	client string
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), throttleChunk)
+		if err := w.shaper.wait(w.ctx, w.client, n); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A fairShaper sends at most rate bytes per second, shared fairly between
+// clients rather than in order of arrival: a client downloading over many
+// connections gets the same share as one downloading over one, and a client
+// using less than its share leaves the rest to the others. Within a client,
+// chunks are sent in order of request, alternating between its downloads.
+//
+// This is start-time fair queueing: a chunk is tagged with the virtual time it
+// may start at, its client's previous chunk's finish or the current virtual
+// time if later, and the chunk with the lowest tag is sent first.
+type fairShaper struct {
+	rate int64
+
+	mu      sync.Mutex // Guards all below
+	clients map[string]*shapedClient
+	vtime   float64       // Tag of the last chunk sent.
+	wake    chan struct{} // Signals the dispatcher of a new chunk.
+}
+
+type shapedClient struct {
+	finish  float64 // Virtual time the last queued chunk finishes at.
+	pending []*chunkGrant
+}
+
+type chunkGrant struct {
+	n    int
+	tag  float64
+	done chan struct{} // Closed once the chunk may be sent.
+}
+
+func newFairShaper(rate int64) *fairShaper {
+	s := &fairShaper{rate: rate, clients: make(map[string]*shapedClient), wake: make(chan struct{}, 1)}
+	go s.dispatch()
+	return s
+}
+
+// wait blocks until client may send n bytes.
+func (s *fairShaper) wait(ctx context.Context, client string, n int) error {
+	s.mu.Lock()
+	c, ok := s.clients[client]
+	if !ok {
+		c = &shapedClient{}
+		s.clients[client] = c
+	}
+	g := &chunkGrant{n: n, tag: max(s.vtime, c.finish), done: make(chan struct{})}
+	c.finish = g.tag + float64(n)
+	c.pending = append(c.pending, g)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-g.done:
+			// Granted meanwhile, the bandwidth is spent anyway.
+			return nil
+		default:
+		}
+		if i := slices.Index(c.pending, g); i >= 0 {
+			c.pending = slices.Delete(c.pending, i, i+1)
+		}
+		s.forget(client, c)
+		return ctx.Err()
+	}
+}
+
+// forget drops the state of a client without pending chunks once the others
+// have caught up with it, as it would start at the current virtual time
+// anyway.
+func (s *fairShaper) forget(client string, c *shapedClient) {
+	if len(c.pending) == 0 && c.finish <= s.vtime {
+		delete(s.clients, client)
+	}
+}
+
+// dispatch grants the chunk with the lowest tag, then waits for the time it
+// takes to send at the rate.
+func (s *fairShaper) dispatch() {
+	next := time.Now()
+	for {
+		s.mu.Lock()
+		var head *shapedClient
+		var headClient string
+		for client, c := range s.clients {
+			if len(c.pending) == 0 {
+				s.forget(client, c)
+			} else if head == nil || c.pending[0].tag < head.pending[0].tag {
+				head, headClient = c, client
+			}
+		}
+		if head == nil {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		g := head.pending[0]
+		head.pending = head.pending[1:]
+		s.vtime = g.tag
+		s.forget(headClient, head)
+		s.mu.Unlock()
+
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		time.Sleep(time.Until(next))
+		close(g.done)
+		next = next.Add(time.Duration(int64(g.n) * int64(time.Second) / s.rate))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions of sidecar files, in order of precedence.
+var sidecarExts = []string{".yaml", ".yml"}
+
+// A Sidecar holds per-episode settings, read from a YAML file next to the
+// media file with the same base name, e.g. episode.yaml for episode.mp3.
+type Sidecar struct {
+	// Notes are the show notes of the episode, used as its description.
+	// Paragraphs are separated by blank lines.
+	Notes string `yaml:"notes"`
+	// Slug replaces the title in the episode's page URL and, with -slugUrls,
+	// its media URL.
+	Slug string `yaml:"slug"`
+	// Pinned episodes are listed before all others.
+	Pinned bool `yaml:"pinned"`
+	// Order places the episode explicitly, lower values first. Episodes
+	// without an order are sorted by date after those with one.
+	Order *int `yaml:"order"`
+	// Drafts are left out of the public feed, see also DraftsDir.
+	Draft bool `yaml:"draft"`
+	// Explicit marks the episode as containing (or, if false, not containing)
+	// explicit content, regardless of the channel's setting.
+	Explicit *bool `yaml:"explicit"`
+	// Value replaces the channel's value-for-value recipients for the
+	// episode, e.g. to split with a guest.
+	Value *ValueBlock `yaml:"value"`
+	// SocialInteract points to places where the episode is discussed, such
+	// as a Mastodon post.
+	SocialInteract []SocialInteract `yaml:"socialInteract"`
+	// CommentsUrl points to a page for comments on the episode, such as a
+	// forum thread.
+	CommentsUrl string `yaml:"commentsUrl"`
+	// License of the episode, replacing the channel's, see License.
+	License    string `yaml:"license"`
+	LicenseUrl string `yaml:"licenseUrl"`
+
+	license *License
+}
+
+// A SocialInteract is emitted as <podcast:socialInteract>.
+//
+// See https://podcastindex.org/namespace/1.0#social-interact
+type SocialInteract struct {
+	Uri string `yaml:"uri"`
+	// Protocol of the post, defaults to "activitypub". Other values are e.g.
+	// "twitter", "lightning" or "disabled".
+	Protocol   string `yaml:"protocol"`
+	AccountId  string `yaml:"accountId"`
+	AccountUrl string `yaml:"accountUrl"`
+	Priority   int    `yaml:"priority"`
+}
+
+// readSidecar reads the sidecar of the media file at the path p of the media
+// library. Not having a sidecar is not an error.
+func readSidecar(fsys fs.FS, p string) (Sidecar, error) {
+	var sc Sidecar
+	base := strings.TrimSuffix(p, path.Ext(p))
+	for _, ext := range sidecarExts {
+		buf, err := fs.ReadFile(fsys, base+ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return sc, err
+		}
+		if err := yaml.Unmarshal(buf, &sc); err != nil {
+			return Sidecar{}, fmt.Errorf("parse sidecar %s: %w", base+ext, err)
+		}
+		if err := sc.normalize(); err != nil {
+			return Sidecar{}, fmt.Errorf("sidecar %s: %w", base+ext, err)
+		}
+		return sc, nil
+	}
+	return sc, nil
+}
+
+// normalize fills in defaults and validates the settings.
+func (sc *Sidecar) normalize() error {
+	for i := range sc.SocialInteract {
+		si := &sc.SocialInteract[i]
+		if si.Protocol == "" {
+			si.Protocol = "activitypub"
+		}
+		if si.Uri == "" && si.Protocol != "disabled" {
+			return errors.New("socialInteract without uri")
+		}
+	}
+	if sc.CommentsUrl != "" {
+		if u, err := url.Parse(sc.CommentsUrl); err != nil || !u.IsAbs() {
+			return errors.New("commentsUrl is not an absolute URL")
+		}
+	}
+	var err error
+	if sc.license, err = NewLicense(sc.License, sc.LicenseUrl); err != nil {
+		return err
+	}
+	if sc.Value != nil {
+		return sc.Value.normalize()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A MediaSource is where the media library lives: a directory on local disk,
+// or a remote library replacing it (see S3Source, WebDAVSource and
+// SFTPSource). It is a file system for scanning, with paths relative to the
+// library, and serves its media files itself, ranges included.
+type MediaSource interface {
+	fs.ReadDirFS
+	fs.StatFS
+	// ServeFile serves the file f, at f.Source in the library.
+	ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo)
+}
+
+// A LocalSource is a media directory on local disk, or a network file system
+// mounted locally. Stats follow the ScanPolicy.
+type LocalSource struct {
+	Root string
+	Scan ScanPolicy
+
+	dir fs.FS
+}
+
+func NewLocalSource(root string, scan ScanPolicy) *LocalSource {
+	return &LocalSource{Root: root, Scan: scan, dir: os.DirFS(root)}
+}
+
+// path returns the path on disk of the file at path p of the library.
+func (s *LocalSource) path(p string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(p))
+}
+
+func (s *LocalSource) Open(name string) (fs.File, error) {
+	return s.dir.Open(name)
+}
+
+func (s *LocalSource) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.dir, name)
+}
+
+func (s *LocalSource) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return s.Scan.stat(s.path(name))
+}
+
+func (s *LocalSource) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	serveLocalFile(w, r, f, s.path(f.Source))
+}
+
+// An fsSource is a media library in any file system, e.g. an fstest.MapFS.
+type fsSource struct {
+	fs.FS
+}
+
+// NewFSSource returns the source of the library in fsys.
+func NewFSSource(fsys fs.FS) MediaSource {
+	return fsSource{fsys}
+}
+
+func (s fsSource) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(s.FS, name) }
+func (s fsSource) Stat(name string) (fs.FileInfo, error)      { return fs.Stat(s.FS, name) }
+
+func (s fsSource) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	fp, err := s.Open(f.Source)
+	if err != nil {
+		slog.Error("could not open file", "error", err, "file", f.Source, "tag", TagHttp)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+	if rs, ok := fp.(io.ReadSeeker); ok {
+		serveContent(w, r, f, rs)
+		return
+	}
+	// Ranges are only served from seekable files.
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	if r.Method != http.MethodHead {
+		io.Copy(w, fp)
+	}
+}
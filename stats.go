@@ -0,0 +1,484 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ApiStatsTopPath lists the most downloaded episodes in a window.
+	ApiStatsTopPath = "/api/stats/top"
+	// ApiStatsRecentPath lists the latest downloads, or streams them as
+	// server-sent events.
+	ApiStatsRecentPath = "/api/stats/recent"
+	// ApiStatsEpisodesPath lists the downloads of every episode, and
+	// StatsPath shows them on a page.
+	ApiStatsEpisodesPath = "/api/stats/episodes"
+	StatsPath            = "/stats"
+
+	// Days of download counts kept.
+	statsRetentionDays = 400
+	// Number of downloads kept for ApiStatsRecentPath.
+	statsRecentSize = 100
+	// How often the counts are persisted.
+	statsSaveInterval = time.Minute
+	// Downloads of an episode by the same client within this long count
+	// once, as in the IAB podcast measurement guidelines.
+	statsDedupWindow = 24 * time.Hour
+	// Ranges from the start of a file shorter than this are players probing
+	// the file, such as Apple's requests for its first 2 bytes, and do not
+	// count.
+	statsMinRange = 1 << 10
+	// Clients remembered for statsDedupWindow at most. Beyond it, downloads
+	// by new clients count without being remembered, until old ones expire.
+	statsSeenMax = 100_000
+)
+
+// A Download is one download of an episode.
+type Download struct {
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Title     string    `json:"title,omitempty"` // Set when served.
+	UserAgent string    `json:"user_agent"`
+
+	client string // IP address of the client, for deduplication.
+}
+
+// Stats counts downloads of episodes per day, keyed by path relative to the
+// media directory, and keeps the latest downloads. Counts are persisted if
+// given a path. Only requests starting at the beginning of a file count, so
+// that players fetching a file in ranges count once, and a client fetching
+// an episode again within statsDedupWindow does not count again.
+type Stats struct {
+	path string // Optional.
+
+	mu     sync.Mutex                  // Guards all below
+	days   map[string]map[string]int64 // Path -> day (YYYY-MM-DD, UTC) -> downloads.
+	recent []Download                  // Oldest first.
+	subs   map[chan Download]bool
+	dirty  bool
+	// Last counted download of an episode by a client, keyed by path, IP
+	// address and user agent.
+	seen       map[string]time.Time
+	seenPruned time.Time // When expired clients were last dropped from seen.
+}
+
+func NewStats(path string) (*Stats, error) {
+	s := &Stats{
+		path: path,
+		days: make(map[string]map[string]int64),
+		subs: make(map[chan Download]bool),
+		seen: make(map[string]time.Time),
+	}
+	if path == "" {
+		return s, nil
+	}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &s.days); err != nil {
+		return nil, fmt.Errorf("parse stats file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// countsAsDownload reports whether a request for a media file counts as a
+// download: a GET of the whole file or of a range from its start, unless it
+// is shorter than statsMinRange.
+func countsAsDownload(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		return true
+	}
+	end, ok := strings.CutPrefix(rng, "bytes=0-")
+	if !ok {
+		return false
+	}
+	if end, _, _ = strings.Cut(end, ","); end == "" {
+		return true
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(end), 10, 64)
+	return err != nil || n+1 >= statsMinRange
+}
+
+// Record counts a download, unless the client downloaded the episode within
+// statsDedupWindow.
+func (s *Stats) Record(d Download) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d.client != "" {
+		key := d.Path + "\x00" + d.client + "\x00" + d.UserAgent
+		if last, ok := s.seen[key]; ok && d.Time.Sub(last) < statsDedupWindow {
+			return
+		}
+		if d.Time.Sub(s.seenPruned) >= time.Minute && (len(s.seen) >= statsSeenMax || d.Time.Sub(s.seenPruned) >= time.Hour) {
+			s.pruneSeen(d.Time)
+		}
+		if len(s.seen) < statsSeenMax {
+			s.seen[key] = d.Time
+		}
+	}
+	day := d.Time.UTC().Format(time.DateOnly)
+	if s.days[d.Path] == nil {
+		s.days[d.Path] = make(map[string]int64)
+	}
+	s.days[d.Path][day]++
+	s.dirty = true
+	if len(s.recent) == statsRecentSize {
+		s.recent = slices.Delete(s.recent, 0, 1)
+	}
+	s.recent = append(s.recent, d)
+	for ch := range s.subs {
+		select {
+		case ch <- d:
+		default:
+			// Slow subscriber, it misses this one.
+		}
+	}
+}
+
+// EpisodeDownloads is the number of downloads of an episode.
+type EpisodeDownloads struct {
+	Path      string `json:"path"`
+	Title     string `json:"title,omitempty"`
+	Downloads int64  `json:"downloads"`
+}
+
+// Top returns the at most n most downloaded episodes since the given time.
+func (s *Stats) Top(since time.Time, n int) []EpisodeDownloads {
+	first := since.UTC().Format(time.DateOnly)
+	s.mu.Lock()
+	top := []EpisodeDownloads{}
+	for p, days := range s.days {
+		var total int64
+		for day, count := range days {
+			if day >= first {
+				total += count
+			}
+		}
+		if total > 0 {
+			top = append(top, EpisodeDownloads{Path: p, Downloads: total})
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(top, func(a, b EpisodeDownloads) int {
+		if a.Downloads != b.Downloads {
+			return cmp.Compare(b.Downloads, a.Downloads)
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return top[:min(n, len(top))]
+}
+
+// EpisodeStats are the downloads of an episode, in all (as far back as
+// statsRetentionDays) and in the last 30 and 7 days.
+type EpisodeStats struct {
+	Path   string `json:"path"`
+	Title  string `json:"title,omitempty"`
+	Total  int64  `json:"total"`
+	Last30 int64  `json:"last_30_days"`
+	Last7  int64  `json:"last_7_days"`
+}
+
+// Episode returns the downloads of the episode at path p, as of now.
+func (s *Stats) Episode(p string, now time.Time) EpisodeStats {
+	since30 := now.UTC().AddDate(0, 0, -30).Format(time.DateOnly)
+	since7 := now.UTC().AddDate(0, 0, -7).Format(time.DateOnly)
+	es := EpisodeStats{Path: p}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for day, count := range s.days[p] {
+		es.Total += count
+		if day >= since30 {
+			es.Last30 += count
+		}
+		if day >= since7 {
+			es.Last7 += count
+		}
+	}
+	return es
+}
+
+// Recent returns the latest downloads, newest first.
+func (s *Stats) Recent() []Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := slices.Clone(s.recent)
+	slices.Reverse(out)
+	return out
+}
+
+func (s *Stats) subscribe() chan Download {
+	ch := make(chan Download, 16)
+	s.mu.Lock()
+	s.subs[ch] = true
+	s.mu.Unlock()
+	return ch
+}
+
+// pruneSeen drops the clients whose last download is older than
+// statsDedupWindow at now. The caller holds s.mu.
+func (s *Stats) pruneSeen(now time.Time) {
+	for key, t := range s.seen {
+		if now.Sub(t) >= statsDedupWindow {
+			delete(s.seen, key)
+		}
+	}
+	s.seenPruned = now
+}
+
+func (s *Stats) unsubscribe(ch chan Download) {
+	s.mu.Lock()
+	delete(s.subs, ch)
+	s.mu.Unlock()
+}
+
+// Save persists the counts if they have changed, dropping days older than
+// statsRetentionDays.
+func (s *Stats) Save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	oldest := time.Now().UTC().AddDate(0, 0, -statsRetentionDays).Format(time.DateOnly)
+	for p, days := range s.days {
+		for day := range days {
+			if day < oldest {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(s.days, p)
+		}
+	}
+	buf, err := json.Marshal(s.days)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, buf, 0o644); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run persists the counts periodically until ctx is done, and once more then.
+func (s *Stats) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := s.Save(); err != nil {
+				slog.Error("could not save stats", "error", err, "tag", TagStats)
+			}
+			return
+		}
+		if err := s.Save(); err != nil {
+			slog.Error("could not save stats", "error", err, "tag", TagStats)
+		}
+	}
+}
+
+// parseWindow parses a window of time such as "30d", or a duration such as
+// "12h".
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return d, nil
+}
+
+// titles returns the titles of the served items by path.
+func (s *Server) titles() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	titles := make(map[string]string, len(s.Items))
+	for _, it := range s.Items {
+		titles[it.Path] = it.Title
+	}
+	return titles
+}
+
+// topEpisodes returns the at most n most downloaded episodes since the given
+// time, with their titles.
+func (s *Server) topEpisodes(since time.Time, n int) []EpisodeDownloads {
+	top := s.Stats.Top(since, n)
+	titles := s.titles()
+	for i := range top {
+		top[i].Title = titles[top[i].Path]
+	}
+	return top
+}
+
+// episodeStats returns the downloads of the episodes of the feed, in feed
+// order.
+func (s *Server) episodeStats() []EpisodeStats {
+	s.mu.RLock()
+	items := s.Items
+	s.mu.RUnlock()
+	now := time.Now()
+	stats := make([]EpisodeStats, 0, len(items))
+	for _, it := range items {
+		es := s.Stats.Episode(it.Path, now)
+		es.Title = it.Title
+		stats = append(stats, es)
+	}
+	return stats
+}
+
+// ServeStatsEpisodes lists the downloads of every episode of the feed.
+func (s *Server) ServeStatsEpisodes(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"episodes": s.episodeStats()})
+}
+
+type statsPageData struct {
+	Title         string
+	StylesheetUrl string
+	Episodes      []EpisodeStats
+	Total         EpisodeStats // Sums of all episodes.
+}
+
+// ServeStatsPage shows the downloads of every episode of the feed.
+func (s *Server) ServeStatsPage(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data := statsPageData{
+		Title:         s.Metadata.Title,
+		StylesheetUrl: s.Metadata.StylesheetUrl,
+		Episodes:      s.episodeStats(),
+	}
+	for _, es := range data.Episodes {
+		data.Total.Total += es.Total
+		data.Total.Last30 += es.Last30
+		data.Total.Last7 += es.Last7
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.HtmlTemplate.ExecuteTemplate(w, "stats.html", data); err != nil {
+		slog.Error("template error", "error", err, "template", "stats.html", "tag", TagHttp)
+	}
+}
+
+// ServeStatsTop lists the most downloaded episodes in the window given by the
+// window parameter, 30 days by default, at most limit of them, 10 by
+// default.
+func (s *Server) ServeStatsTop(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	window := q.Get("window")
+	if window == "" {
+		window = "30d"
+	}
+	d, err := parseWindow(window)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := 10
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	top := s.topEpisodes(time.Now().Add(-d), limit)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window":   window,
+		"episodes": top,
+	})
+}
+
+// ServeStatsRecent lists the latest downloads, newest first, or streams
+// downloads as they happen as server-sent events if the client accepts
+// text/event-stream.
+func (s *Server) ServeStatsRecent(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		recent := s.Stats.Recent()
+		titles := s.titles()
+		for i := range recent {
+			recent[i].Title = titles[recent[i].Path]
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"downloads": recent})
+		return
+	}
+	rc := http.NewResponseController(w)
+	// The stream outlives any write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ch := s.Stats.subscribe()
+	defer s.Stats.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		select {
+		case d := <-ch:
+			d.Title = s.titles()[d.Path]
+			buf, err := json.Marshal(d)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: download\ndata: %s\n\n", buf); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
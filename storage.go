@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ApiStoragePath reports the disk usage of the library.
+const ApiStoragePath = "/api/storage"
+
+// StorageReport is the disk usage of the media directory.
+type StorageReport struct {
+	Items        int   `json:"items"`         // Published episodes.
+	Drafts       int   `json:"drafts"`        // Draft episodes.
+	LibraryBytes int64 `json:"library_bytes"` // Of all files served.
+
+	// Of the file system holding the media directory, 0 if unknown.
+	TotalBytes int64 `json:"total_bytes"`
+	FreeBytes  int64 `json:"free_bytes"`
+	// Free space is below the -minFreeSpace threshold.
+	Low bool `json:"low"`
+}
+
+// Storage reports the disk usage of the library.
+func (s *Server) Storage() StorageReport {
+	s.mu.RLock()
+	rep := StorageReport{Items: len(s.Items)}
+	// Episodes of the manifest are not on disk.
+	for _, f := range s.Files {
+		if f.Url == "" {
+			rep.LibraryBytes += f.Size
+		}
+	}
+	for _, f := range s.DraftFiles {
+		if f.Url == "" {
+			rep.LibraryBytes += f.Size
+		}
+	}
+	rep.Drafts = s.Drafts
+	s.mu.RUnlock()
+	total, free, err := diskSpace(s.Metadata.localRoot)
+	if err != nil {
+		slog.Warn("could not get free disk space", "error", err, "tag", TagStorage)
+		return rep
+	}
+	rep.TotalBytes, rep.FreeBytes = total, free
+	rep.Low = s.MinFreeSpace > 0 && free < s.MinFreeSpace
+	return rep
+}
+
+// logStorage logs the disk usage, warning if free space is low.
+func (s *Server) logStorage(rep StorageReport) {
+	args := []any{
+		"tag", TagStorage,
+		"items", rep.Items, "drafts", rep.Drafts,
+		"library", readableBytes(rep.LibraryBytes),
+		"free", readableBytes(rep.FreeBytes), "total", readableBytes(rep.TotalBytes),
+	}
+	if rep.Low {
+		slog.Warn("low disk space on media file system", append(args, "threshold", readableBytes(s.MinFreeSpace))...)
+		return
+	}
+	slog.Info("disk usage", args...)
+}
+
+func (s *Server) ServeStorage(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rep := s.Storage()
+	if rep.Low {
+		s.logStorage(rep)
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// monitorDisk checks the free space on the media file system every interval
+// until ctx is done, alerting when it drops below another of the thresholds
+// and when it is back above all of them.
+func monitorDisk(ctx context.Context, wg *sync.WaitGroup, s *Server, thresholds []int64, interval time.Duration, alerter *Alerter) {
+	defer wg.Done()
+	thresholds = slices.Clone(thresholds)
+	slices.Sort(thresholds)
+	slices.Reverse(thresholds)
+	crossed := 0 // Number of thresholds free space is below.
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		_, free, err := diskSpace(s.Metadata.localRoot)
+		if err != nil {
+			slog.Warn("could not get free disk space", "error", err, "tag", TagStorage)
+			continue
+		}
+		n := 0
+		for n < len(thresholds) && free < thresholds[n] {
+			n++
+		}
+		details := map[string]any{"free": readableBytes(free), "dir": s.Metadata.localRoot}
+		switch {
+		case n > crossed:
+			details["threshold"] = readableBytes(thresholds[n-1])
+			alerter.Send(ctx, Alert{
+				Title: s.Metadata.Title + ": low disk space",
+				Message: fmt.Sprintf(
+					"Only %s free on the media file system, below %s. Uploads and recordings fail when it is full.",
+					readableBytes(free), readableBytes(thresholds[n-1]),
+				),
+				Details: details,
+			})
+		case n == 0 && crossed > 0:
+			alerter.Send(ctx, Alert{
+				Title:    s.Metadata.Title + ": disk space recovered",
+				Message:  fmt.Sprintf("%s free on the media file system again.", readableBytes(free)),
+				Resolved: true,
+				Details:  details,
+			})
+		}
+		crossed = n
+	}
+}
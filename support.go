@@ -0,0 +1,143 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SupportPath serves the support page, see ServeSupport.
+const SupportPath = "/support"
+
+type SupportPageData struct {
+	Metadata Metadata
+	Theme    Theme
+	Locale   *Locale
+	Content  template.HTML
+	IndexUrl string
+}
+
+// ServeSupport serves the page telling listeners how to support the show,
+// written in Markdown in the file SupportPage. The file is read on every
+// request so that it can be edited without restarting.
+func (s *Server) ServeSupport(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	src, err := os.ReadFile(s.SupportPage)
+	if err != nil {
+		slog.Error("could not read support page", "error", err, "file", s.SupportPage, "tag", TagHttp)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	err = s.HtmlTemplate.ExecuteTemplate(w, "support.html", SupportPageData{
+		Metadata: s.Channel,
+		Theme:    s.Theme,
+		Locale:   s.locale(w, r),
+		Content:  renderMarkdown(string(src)),
+		IndexUrl: s.Metadata.externalUrl + FeedHtmlPath[1:],
+	})
+	if err != nil {
+		slog.Error("template error", "error", err)
+	}
+}
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdBullet  = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	mdNumber  = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdEm      = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+// renderMarkdown renders the subset of Markdown a support page needs:
+// headings, paragraphs, lists, links, emphasis and code. Raw HTML is escaped.
+func renderMarkdown(src string) template.HTML {
+	var b strings.Builder
+	var para []string
+	list := "" // Element of the open list, if any.
+	endPara := func() {
+		if len(para) > 0 {
+			b.WriteString(`<p class="mb-4">` + mdInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	endList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	startList := func(elem, style string) {
+		if list != elem {
+			endList()
+			b.WriteString("<" + elem + ` class="mb-4" style="list-style: ` + style + `; padding-left: 1.5rem">` + "\n")
+			list = elem
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			endPara()
+			endList()
+			level := string('0' + byte(len(m[1])))
+			b.WriteString("<h" + level + ` class="mb-4">` + mdInline(m[2]) + "</h" + level + ">\n")
+			continue
+		}
+		m := mdBullet.FindStringSubmatch(line)
+		elem, style := "ul", "disc"
+		if m == nil {
+			m = mdNumber.FindStringSubmatch(line)
+			elem, style = "ol", "decimal"
+		}
+		switch {
+		case m != nil:
+			endPara()
+			startList(elem, style)
+			b.WriteString("<li>" + mdInline(m[1]) + "</li>\n")
+		case line == "":
+			endPara()
+			endList()
+		default:
+			endList()
+			para = append(para, line)
+		}
+	}
+	endPara()
+	endList()
+	return template.HTML(b.String())
+}
+
+// mdInline renders the code spans, links and emphasis of a line of Markdown.
+func mdInline(s string) string {
+	var b strings.Builder
+	// Odd parts are within backticks.
+	for i, part := range strings.Split(s, "`") {
+		part = html.EscapeString(part)
+		if i%2 == 1 {
+			b.WriteString("<code>" + part + "</code>")
+			continue
+		}
+		part = mdLink.ReplaceAllStringFunc(part, func(link string) string {
+			m := mdLink.FindStringSubmatch(link)
+			u, err := url.Parse(html.UnescapeString(m[2]))
+			if err != nil || !(u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto") {
+				return m[1]
+			}
+			return `<a href="` + m[2] + `">` + m[1] + "</a>"
+		})
+		part = mdStrong.ReplaceAllString(part, "<strong>$1</strong>")
+		part = mdEm.ReplaceAllString(part, "<em>$1</em>")
+		b.WriteString(part)
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ThemeMode selects the color scheme of the HTML pages.
+type ThemeMode string
+
+const (
+	ThemeLight ThemeMode = "light"
+	ThemeDark  ThemeMode = "dark"
+	// Follow the viewer's system setting.
+	ThemeAuto ThemeMode = "auto"
+)
+
+func ParseThemeMode(s string) (ThemeMode, bool) {
+	switch t := ThemeMode(s); t {
+	case ThemeLight, ThemeDark, ThemeAuto:
+		return t, true
+	}
+	return "", false
+}
+
+// A Theme brands the public HTML pages without changing the templates.
+type Theme struct {
+	Mode ThemeMode
+	// CSS color of links, e.g. "#0a7" or "teal". The default is green.
+	Accent string
+	// Stylesheet loaded after the built-in one, to override anything else.
+	CssUrl string
+	// Header shown at the top of the pages, optionally with a logo.
+	Header  string
+	LogoUrl string
+}
+
+// Only plain colors are accepted, anything else would end up as arbitrary
+// CSS.
+var cssColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+|(rgb|hsl)a?\([0-9., %]+\))$`)
+
+func (t Theme) validate() error {
+	if t.Accent != "" && !cssColor.MatchString(t.Accent) {
+		return fmt.Errorf("invalid accent color %q", t.Accent)
+	}
+	return nil
+}
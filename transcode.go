@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// RenditionsPath serves renditions made by the Transcoder.
+const RenditionsPath = "/renditions/"
+
+// A Rendition is a version of every episode made with ffmpeg, published as
+// an Alternate.
+type Rendition struct {
+	Name    string // Title of the alternate, e.g. "low".
+	Codec   string // One of the keys of codecs.
+	Bitrate string // Audio bitrate as understood by ffmpeg, e.g. "48k".
+	// Target integrated loudness in LUFS for EBU R128 normalization, e.g.
+	// -16. Zero leaves the loudness as it is.
+	Loudness float64
+}
+
+type codec struct {
+	encoder string
+	format  string
+	ext     string
+}
+
+var codecs = map[string]codec{
+	"opus": {"libopus", "ogg", ".opus"},
+	"mp3":  {"libmp3lame", "mp3", ".mp3"},
+	"aac":  {"aac", "ipod", ".m4a"},
+}
+
+// ParseRenditions parses a comma separated list of renditions, each written
+// as name=codec:bitrate, e.g. "low=opus:48k".
+func ParseRenditions(s string) ([]Rendition, error) {
+	var out []Rendition
+	for _, spec := range splitList(s) {
+		name, rest, ok1 := strings.Cut(spec, "=")
+		c, bitrate, ok2 := strings.Cut(rest, ":")
+		if !ok1 || !ok2 || name == "" || bitrate == "" {
+			return nil, fmt.Errorf("invalid rendition %q, expected name=codec:bitrate", spec)
+		}
+		if _, ok := codecs[c]; !ok {
+			return nil, fmt.Errorf("rendition %q: unknown codec %q", name, c)
+		}
+		out = append(out, Rendition{Name: name, Codec: c, Bitrate: bitrate})
+	}
+	return out, nil
+}
+
+// convertTypes are the types of media files that podcast apps commonly
+// cannot play, converted with Transcoder.Convert. Those not published
+// otherwise are added to mimeType, see AddConvertTypes.
+var convertTypes = map[string]string{
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+	".wma":  "audio/x-ms-wma",
+	".mka":  "audio/x-matroska",
+	".mkv":  "video/x-matroska",
+}
+
+// AddConvertTypes publishes the files of convertTypes, unless given another
+// type with -mimeTypes.
+func AddConvertTypes() {
+	for ext, typ := range convertTypes {
+		if _, ok := mimeType[ext]; !ok {
+			mimeType[ext] = typ
+		}
+	}
+}
+
+// ParseConversion parses the format of Transcoder.Conversion, written as
+// codec:bitrate, e.g. "mp3:128k".
+func ParseConversion(s string) (Rendition, error) {
+	c, bitrate, ok := strings.Cut(s, ":")
+	if !ok || bitrate == "" {
+		return Rendition{}, fmt.Errorf("invalid format %q, expected codec:bitrate", s)
+	}
+	if _, ok := codecs[c]; !ok {
+		return Rendition{}, fmt.Errorf("unknown codec %q", c)
+	}
+	return Rendition{Name: "converted", Codec: c, Bitrate: bitrate}, nil
+}
+
+func (r Rendition) args() []string {
+	c := codecs[r.Codec]
+	return []string{"-vn", "-c:a", c.encoder, "-b:a", r.Bitrate, "-f", c.format}
+}
+
+// Loudness range and true peak targets of the normalization, as recommended
+// for podcasts.
+const (
+	loudnormLRA = 11
+	loudnormTP  = -1.5
+)
+
+func (r Rendition) loudnorm() string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%d", r.Loudness, loudnormTP, loudnormLRA)
+}
+
+// loudnormStats are the measurements printed by the first loudnorm pass.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudness runs the analysis pass of two-pass loudness normalization.
+func (t *Transcoder) measureLoudness(ctx context.Context, src string, r Rendition) (loudnormStats, error) {
+	var stats loudnormStats
+	cmd := exec.CommandContext(
+		ctx, t.ffmpeg, "-nostdin", "-hide_banner", "-i", src,
+		"-vn", "-af", r.loudnorm()+":print_format=json", "-f", "null", "-",
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stats, fmt.Errorf("measure loudness: %w", err)
+	}
+	// The JSON object comes last in the output.
+	out := stderr.String()
+	i := strings.LastIndex(out, "{")
+	if i < 0 {
+		return stats, errors.New("measure loudness: no measurements in ffmpeg output")
+	}
+	if err := json.Unmarshal([]byte(out[i:]), &stats); err != nil {
+		return stats, fmt.Errorf("measure loudness: %w", err)
+	}
+	return stats, nil
+}
+
+type jobKind string
+
+const (
+	jobRendition jobKind = "rendition"
+	jobPoster    jobKind = "poster"
+	jobHls       jobKind = "hls"
+	jobPeaks     jobKind = "peaks"
+	jobGain      jobKind = "replaygain"
+)
+
+type transcodeJob struct {
+	kind      jobKind
+	src, dst  string
+	rendition Rendition // Of jobRendition.
+	path      string    // Relative path of the source, for the MetaCache.
+}
+
+// A Transcoder makes renditions of episodes in the background and caches them
+// in a directory, named after a hash of the source file and the rendition's
+// settings. Episodes get the renditions that are done when the feed is
+// generated; OnDone is called after every finished rendition so the feed can
+// be regenerated.
+type Transcoder struct {
+	ffmpeg     string
+	dir        string
+	renditions []Rendition
+	// Format the files of convertTypes are converted to, see Convert.
+	// Optional.
+	Conversion *Rendition
+	// Make a poster image of video episodes, see applyPoster.
+	Posters bool
+	// Package video episodes for HLS streaming, see applyHls.
+	Hls bool
+	// Compute the waveform of audio episodes, see applyPeaks.
+	Waveforms bool
+	// Measure the loudness of episodes, see applyGain.
+	ReplayGain bool
+	// Caches measurements.
+	Meta   *MetaCache
+	OnDone func()
+
+	jobs chan transcodeJob
+
+	mu      sync.Mutex // Guards pending and failed
+	pending map[string]bool
+	failed  map[string]bool
+}
+
+func NewTranscoder(ffmpeg, dir string, renditions []Rendition) (*Transcoder, error) {
+	if _, err := exec.LookPath(ffmpeg); err != nil {
+		return nil, fmt.Errorf("transcoding requires ffmpeg: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Transcoder{
+		ffmpeg:     ffmpeg,
+		dir:        dir,
+		renditions: renditions,
+		jobs:       make(chan transcodeJob, 1024),
+		pending:    make(map[string]bool),
+		failed:     make(map[string]bool),
+	}, nil
+}
+
+// cacheName returns the name of the cached rendition of the file at src.
+func (t *Transcoder) cacheName(src string, info fs.FileInfo, r Rendition) string {
+	h := sha256.New()
+	args := r.args()
+	if r.Loudness != 0 {
+		args = append(args, r.loudnorm())
+	}
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%q", src, info.Size(), info.ModTime().UnixNano(), args)
+	return hex.EncodeToString(h.Sum(nil)[:12]) + codecs[r.Codec].ext
+}
+
+// Apply adds the finished renditions of items to their alternates and queues
+// the missing ones. Renditions of files that are gone are removed from the
+// cache, as are conversions not in keep, see Convert. Drafts, documents and
+// items already having an alternate with the rendition's name are left alone.
+func (t *Transcoder) Apply(m Metadata, items []Item, keep map[string]bool) {
+	for i := range items {
+		it := &items[i]
+		if it.Draft || it.IsDocument() {
+			continue
+		}
+		src := filepath.Join(m.localRoot, it.Path)
+		info, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+		if t.Posters && it.IsVideo() && it.Image == "" {
+			keep[t.applyPoster(m, it, src, info)] = true
+		}
+		if t.Hls && it.IsVideo() {
+			keep[t.applyHls(m, it, src, info)] = true
+		}
+		if t.Waveforms && !it.IsVideo() {
+			keep[t.applyPeaks(m, it, src, info)] = true
+		}
+		if t.ReplayGain && t.Meta != nil {
+			t.applyGain(m, it, src, info)
+		}
+	renditions:
+		for _, r := range t.renditions {
+			for _, alt := range it.Alternates {
+				if alt.Title == r.Name {
+					continue renditions
+				}
+			}
+			name := t.cacheName(src, info, r)
+			keep[name] = true
+			dst := filepath.Join(t.dir, name)
+			if info, err := os.Stat(dst); err == nil {
+				it.Alternates = append(it.Alternates, Alternate{
+					Title: r.Name,
+					Path:  RenditionsPath[1:] + name,
+					Enclosure: Enclosure{
+						Url:    m.externalUrl + RenditionsPath[1:] + name,
+						Length: info.Size(),
+						Type:   mimeType[codecs[r.Codec].ext],
+					},
+					file: dst,
+				})
+				continue
+			}
+			t.enqueue(m, transcodeJob{kind: jobRendition, src: src, dst: dst, rendition: r})
+		}
+	}
+	if !m.dryRun {
+		t.prune(keep)
+	}
+}
+
+// Convert replaces the enclosures of published items of convertTypes with
+// their conversion to t.Conversion, keeping the media file as an alternate,
+// and queues the missing conversions. Items are left out until converted,
+// so that apps do not download a file they cannot play. Drafts are left
+// alone. The names of the conversions, done or queued, are added to keep: one
+// finishing before Apply prunes the cache is not removed.
+func (t *Transcoder) Convert(m Metadata, items []Item, keep map[string]bool) []Item {
+	r := t.Conversion
+	if r == nil {
+		return items
+	}
+	var kept []Item
+	for _, it := range items {
+		if _, ok := convertTypes[strings.ToLower(path.Ext(it.Path))]; !ok || it.Draft {
+			kept = append(kept, it)
+			continue
+		}
+		src := filepath.Join(m.localRoot, it.Path)
+		info, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+		name := t.cacheName(src, info, *r)
+		keep[name] = true
+		dst := filepath.Join(t.dir, name)
+		cinfo, err := os.Stat(dst)
+		if err != nil {
+			t.enqueue(m, transcodeJob{kind: jobRendition, src: src, dst: dst, rendition: *r})
+			continue
+		}
+		it.Alternates = append(it.Alternates, Alternate{
+			Title:     "Original",
+			Path:      it.Path,
+			Enclosure: it.Enclosure,
+		})
+		it.Enclosure = Enclosure{
+			Url:    m.externalUrl + RenditionsPath[1:] + name,
+			Length: cinfo.Size(),
+			Type:   mimeType[codecs[r.Codec].ext],
+		}
+		it.converted = dst
+		kept = append(kept, it)
+	}
+	return kept
+}
+
+// enqueue queues job, unless queued already, failed before or m is a dry run.
+func (t *Transcoder) enqueue(m Metadata, job transcodeJob) {
+	if m.dryRun {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[job.dst] || t.failed[job.dst] {
+		return
+	}
+	select {
+	case t.jobs <- job:
+		t.pending[job.dst] = true
+	default:
+		// Queued on a later refresh.
+	}
+}
+
+// prune removes cached renditions that are not in keep.
+func (t *Transcoder) prune(keep map[string]bool) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		slog.Warn("could not read transcode directory", "error", err, "tag", TagTranscode)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range entries {
+		p := filepath.Join(t.dir, e.Name())
+		if keep[e.Name()] || t.pending[strings.TrimSuffix(p, ".part")] {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			slog.Warn("could not remove rendition", "error", err, "file", p, "tag", TagTranscode)
+		}
+	}
+}
+
+// Run transcodes queued jobs one at a time until ctx is done.
+func (t *Transcoder) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		var job transcodeJob
+		select {
+		case job = <-t.jobs:
+		case <-ctx.Done():
+			return
+		}
+		transcode := t.transcode
+		switch job.kind {
+		case jobPoster:
+			transcode = t.makePoster
+		case jobHls:
+			transcode = t.makeHls
+		case jobPeaks:
+			transcode = t.makePeaks
+		case jobGain:
+			transcode = t.measureGain
+		}
+		err := transcode(ctx, job)
+		t.mu.Lock()
+		delete(t.pending, job.dst)
+		if err != nil && ctx.Err() == nil {
+			// Not retried until restart, the source is most likely broken.
+			t.failed[job.dst] = true
+		}
+		t.mu.Unlock()
+		if err != nil {
+			slog.Error("transcoding failed", "error", err, "file", job.src, "kind", job.kind, "rendition", job.rendition.Name, "tag", TagTranscode)
+			continue
+		}
+		slog.Info("transcoded episode", "file", job.src, "kind", job.kind, "rendition", job.rendition.Name, "tag", TagTranscode)
+		if t.OnDone != nil {
+			t.OnDone()
+		}
+	}
+}
+
+func (t *Transcoder) transcode(ctx context.Context, job transcodeJob) error {
+	tmp := job.dst + ".part"
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y", "-i", job.src}
+	if r := job.rendition; r.Loudness != 0 {
+		// Measure first, so that the whole episode can be adjusted linearly
+		// rather than compressed on the fly.
+		s, err := t.measureLoudness(ctx, job.src, r)
+		if err != nil {
+			return err
+		}
+		filter := fmt.Sprintf(
+			"%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			r.loudnorm(), s.InputI, s.InputTP, s.InputLRA, s.InputThresh, s.TargetOffset,
+		)
+		// loudnorm resamples to 192 kHz.
+		args = append(args, "-af", filter, "-ar", "48000")
+	}
+	args = append(args, job.rendition.args()...)
+	args = append(args, tmp)
+	cmd := exec.CommandContext(ctx, t.ffmpeg, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	if _, err := os.Stat(tmp); errors.Is(err, fs.ErrNotExist) {
+		return errors.New("ffmpeg produced no output")
+	}
+	return os.Rename(tmp, job.dst)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Episodes have transcripts if subtitle files of the same name are next to
+// their media file, e.g. episode.vtt or episode.srt next to episode.mp3. They
+// are served like media files and linked as podcast:transcript.
+//
+// See https://github.com/Podcastindex-org/podcast-namespace/blob/main/transcripts/transcripts.md
+
+// transcriptTypes are the transcript files of episodes, by extension.
+var transcriptTypes = map[string]string{
+	".srt": "application/x-subrip",
+	".vtt": "text/vtt",
+}
+
+// A Transcript of an episode.
+type Transcript struct {
+	Url  string
+	Type string
+
+	// The transcript file, keyed by path in Files.
+	path string
+	file FileInfo
+}
+
+// Format returns the name of the format of the transcript, such as VTT.
+func (t Transcript) Format() string {
+	return strings.ToUpper(strings.TrimPrefix(path.Ext(t.path), "."))
+}
+
+// isTranscript reports whether files of type mime are transcripts.
+func isTranscript(mime string) bool {
+	for _, typ := range transcriptTypes {
+		if mime == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Directory in the media root holding deleted episodes. It is skipped when
+	// scanning the library.
+	TrashDir = ".trash"
+	// Manifest describing a trashed episode, stored in its trash directory.
+	trashManifest = "trash.json"
+
+	ApiEpisodesPath = "/api/episodes/"
+	ApiTrashPath    = "/api/trash/"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrFileExists = errors.New("file already exists")
+)
+
+// A TrashEntry is an episode, with its sidecar files, moved to the trash.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`  // Original path of the episode.
+	Files     []string  `json:"files"` // Original paths of all moved files.
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+}
+
+// Trash manages deleted episodes of a media directory. Each deleted episode
+// gets its own directory .trash/<id>/ in which files keep their relative
+// paths, so they can be restored to where they were.
+type Trash struct {
+	root      string
+	Retention time.Duration // Zero keeps trashed episodes forever.
+
+	mu sync.Mutex // Serializes changes to the library
+}
+
+func NewTrash(root string, retention time.Duration) *Trash {
+	return &Trash{root: root, Retention: retention}
+}
+
+func (t *Trash) dir(id string) string {
+	return filepath.Join(t.root, TrashDir, id)
+}
+
+// sidecarPaths returns the files next to the episode at p sharing its base
+// name, e.g. ep.yaml or ep.jpg for ep.mp3, and its renditions, e.g.
+// ep.low.opus. Other media files with the same base name are episodes in
+// their own right and are not included.
+func sidecarPaths(root, p string) ([]string, error) {
+	dir, name := path.Split(p)
+	base := strings.TrimSuffix(name, path.Ext(name))
+	entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || n == name {
+			continue
+		}
+		if _, isMedia := mimeType[path.Ext(n)]; isMedia {
+			if b, _, ok := alternateOf(n); ok && b == base {
+				out = append(out, path.Join(dir, n))
+			}
+			continue
+		}
+		if strings.TrimSuffix(n, path.Ext(n)) != base {
+			continue
+		}
+		out = append(out, path.Join(dir, n))
+	}
+	return out, nil
+}
+
+func newTrashID(t time.Time) (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(buf), nil
+}
+
+// Delete moves the episode at the relative path p, and its sidecars, to the
+// trash.
+func (t *Trash) Delete(p, by string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(t.root, filepath.FromSlash(p))); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return TrashEntry{}, ErrNotFound
+		}
+		return TrashEntry{}, err
+	}
+	sidecars, err := sidecarPaths(t.root, p)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	now := time.Now().UTC()
+	id, err := newTrashID(now)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	e := TrashEntry{
+		ID:        id,
+		Path:      p,
+		Files:     append([]string{p}, sidecars...),
+		DeletedAt: now,
+		DeletedBy: by,
+	}
+	dir := t.dir(id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return TrashEntry{}, err
+	}
+	if err := writeTrashManifest(dir, e); err != nil {
+		os.RemoveAll(dir)
+		return TrashEntry{}, err
+	}
+	for i, f := range e.Files {
+		if err := moveFile(filepath.Join(t.root, filepath.FromSlash(f)), filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+			// Put back what was already moved.
+			for _, f := range e.Files[:i] {
+				moveFile(filepath.Join(dir, filepath.FromSlash(f)), filepath.Join(t.root, filepath.FromSlash(f)))
+			}
+			os.RemoveAll(dir)
+			return TrashEntry{}, err
+		}
+	}
+	return e, nil
+}
+
+// Restore moves the files of a trashed episode back to their original place.
+// It fails if any of them would overwrite an existing file.
+func (t *Trash) Restore(id string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, err := t.entry(id)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	dir := t.dir(id)
+	for _, f := range e.Files {
+		if _, err := os.Stat(filepath.Join(t.root, filepath.FromSlash(f))); err == nil {
+			return TrashEntry{}, fmt.Errorf("restore %s: %w", f, ErrFileExists)
+		}
+	}
+	for _, f := range e.Files {
+		if err := moveFile(filepath.Join(dir, filepath.FromSlash(f)), filepath.Join(t.root, filepath.FromSlash(f))); err != nil {
+			return TrashEntry{}, err
+		}
+	}
+	return e, os.RemoveAll(dir)
+}
+
+// Purge permanently deletes a trashed episode.
+func (t *Trash) Purge(id string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, err := t.entry(id)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	return e, os.RemoveAll(t.dir(id))
+}
+
+// PurgeExpired permanently deletes episodes trashed longer ago than the
+// retention period.
+func (t *Trash) PurgeExpired() ([]TrashEntry, error) {
+	if t.Retention <= 0 {
+		return nil, nil
+	}
+	entries, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+	var purged []TrashEntry
+	cutoff := time.Now().Add(-t.Retention)
+	for _, e := range entries {
+		if e.DeletedAt.After(cutoff) {
+			continue
+		}
+		if _, err := t.Purge(e.ID); err != nil {
+			return purged, err
+		}
+		purged = append(purged, e)
+	}
+	return purged, nil
+}
+
+// List returns the trashed episodes, most recently deleted first.
+func (t *Trash) List() ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	dirs, err := os.ReadDir(filepath.Join(t.root, TrashDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		e, err := t.entry(d.Name())
+		if err != nil {
+			slog.Warn("skipping invalid trash entry", "error", err, "id", d.Name(), "tag", TagAdmin)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b TrashEntry) int {
+		return b.DeletedAt.Compare(a.DeletedAt)
+	})
+	return entries, nil
+}
+
+func (t *Trash) entry(id string) (TrashEntry, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return TrashEntry{}, ErrNotFound
+	}
+	buf, err := os.ReadFile(filepath.Join(t.dir(id), trashManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return TrashEntry{}, ErrNotFound
+	}
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	var e TrashEntry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return TrashEntry{}, err
+	}
+	return e, nil
+}
+
+func writeTrashManifest(dir string, e TrashEntry) error {
+	buf, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, trashManifest), buf, 0o644)
+}
+
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// purgeTrash periodically deletes expired episodes from the trash.
+func purgeTrash(ctx context.Context, wg *sync.WaitGroup, t *Trash) {
+	defer wg.Done()
+	for {
+		purged, err := t.PurgeExpired()
+		if err != nil {
+			slog.Error("could not purge trash", "error", err, "tag", TagAdmin)
+		}
+		for _, e := range purged {
+			slog.Info("purged expired episode from trash", "id", e.ID, "path", e.Path, "tag", TagAdmin)
+		}
+		select {
+		case <-time.After(time.Hour):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeEpisode handles requests to /api/episodes/<path>. Deleting an episode
+// moves it to the trash, patching it edits it, see EpisodeEdit.
+func (s *Server) ServeEpisode(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, ApiEpisodesPath)
+	switch r.Method {
+	case http.MethodDelete:
+		s.mu.RLock()
+		f, ok := s.Files[p]
+		s.mu.RUnlock()
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no such episode")
+			return
+		}
+		if f.Url != "" {
+			writeJSONError(w, http.StatusConflict, "episode of the manifest, remove it from there")
+			return
+		}
+		// The trash is a directory of the media directory.
+		if _, ok := s.Metadata.source.(*LocalSource); !ok {
+			writeJSONError(w, http.StatusConflict, "deleting episodes needs a local media directory")
+			return
+		}
+		principal, _ := PrincipalFrom(r.Context())
+		e, err := s.Trash.Delete(p, principal.Name)
+		if err != nil {
+			adminLogger(r, "delete").Error("could not delete episode", "error", err, "path", p)
+			writeJSONError(w, http.StatusInternalServerError, "could not delete episode")
+			return
+		}
+		adminLogger(r, "delete").Info("moved episode to trash", "path", p, "id", e.ID)
+		s.Audit.Record(r, "delete", p, map[string]any{"trash_id": e.ID, "files": e.Files})
+		s.refreshAfterChange(r)
+		writeJSON(w, http.StatusOK, e)
+	case http.MethodPatch:
+		s.editEpisode(w, r, p)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeTrash handles the trash API:
+//
+//	GET    /api/trash/              list trashed episodes
+//	POST   /api/trash/<id>/restore  restore an episode
+//	DELETE /api/trash/<id>          permanently delete an episode
+func (s *Server) ServeTrash(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, ApiTrashPath)
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		entries, err := s.Trash.List()
+		if err != nil {
+			slog.Error("could not list trash", "error", err, "tag", TagAdmin)
+			writeJSONError(w, http.StatusInternalServerError, "could not list trash")
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case id != "" && action == "restore" && r.Method == http.MethodPost:
+		e, err := s.Trash.Restore(id)
+		if err != nil {
+			s.writeTrashError(w, r, "restore", id, err)
+			return
+		}
+		adminLogger(r, "restore").Info("restored episode from trash", "path", e.Path, "id", id)
+		s.Audit.Record(r, "restore", e.Path, map[string]any{"trash_id": id})
+		s.refreshAfterChange(r)
+		writeJSON(w, http.StatusOK, e)
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		e, err := s.Trash.Purge(id)
+		if err != nil {
+			s.writeTrashError(w, r, "purge", id, err)
+			return
+		}
+		adminLogger(r, "purge").Info("purged episode from trash", "path", e.Path, "id", id)
+		s.Audit.Record(r, "purge", e.Path, map[string]any{"trash_id": id})
+		writeJSON(w, http.StatusOK, e)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) writeTrashError(w http.ResponseWriter, r *http.Request, action, id string, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeJSONError(w, http.StatusNotFound, "no such trash entry")
+	case errors.Is(err, ErrFileExists):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		adminLogger(r, action).Error("trash operation failed", "error", err, "id", id)
+		writeJSONError(w, http.StatusInternalServerError, action+" failed")
+	}
+}
+
+// refreshAfterChange publishes changes made to the library through the API
+// right away.
+func (s *Server) refreshAfterChange(r *http.Request) {
+	if _, err := s.Refresh(); err != nil {
+		adminLogger(r, "refresh").Error("could not refresh after change", "error", err)
+	}
+}
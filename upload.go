@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ApiUploadPath publishes an episode uploaded as multipart form data.
+const ApiUploadPath = "/api/episodes"
+
+// Suffix of files being staged. It is not a known media extension, so
+// partial uploads are never picked up when the library is scanned.
+const uploadPartSuffix = ".part"
+
+var ErrUploadTooLarge = errors.New("upload exceeds maximum size")
+
+// An Upload is a file staged next to its final destination in the library,
+// waiting to be published.
+type Upload struct {
+	tmpPath string
+	dst     string
+	Size    int64
+}
+
+// limitUploadBody caps the size of the request body to maxBytes. Zero or a
+// negative value means no limit.
+func limitUploadBody(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+}
+
+// StageUpload streams src into a temporary file in the directory of dst and
+// syncs it to disk. Staging in the same directory as the destination makes the
+// final rename atomic. Nothing is left behind on failure.
+func StageUpload(dst string, src io.Reader, maxBytes int64) (*Upload, error) {
+	if _, err := os.Stat(dst); err == nil {
+		return nil, ErrFileExists
+	}
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	fp, err := os.CreateTemp(dir, "."+filepath.Base(dst)+".*"+uploadPartSuffix)
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func(err error) (*Upload, error) {
+		fp.Close()
+		os.Remove(fp.Name())
+		return nil, err
+	}
+	if maxBytes > 0 {
+		// Read one byte past the limit to detect oversized uploads when the
+		// reader itself is not limited.
+		src = io.LimitReader(src, maxBytes+1)
+	}
+	n, err := io.Copy(fp, src)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			err = ErrUploadTooLarge
+		}
+		return cleanup(err)
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return cleanup(ErrUploadTooLarge)
+	}
+	if err := fp.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(fp.Name())
+		return nil, err
+	}
+	if err := os.Chmod(fp.Name(), 0o644); err != nil {
+		os.Remove(fp.Name())
+		return nil, err
+	}
+	return &Upload{tmpPath: fp.Name(), dst: dst, Size: n}, nil
+}
+
+// Publish moves the staged file into its final place in the library. It
+// refuses to overwrite an existing file.
+func (u *Upload) Publish() error {
+	// A hard link fails if the destination exists, unlike a rename which
+	// would silently replace it.
+	if err := os.Link(u.tmpPath, u.dst); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			u.Discard()
+			return ErrFileExists
+		}
+		// Hard links might not be supported by the file system, fall back to
+		// a rename.
+		if _, serr := os.Stat(u.dst); serr == nil {
+			u.Discard()
+			return ErrFileExists
+		}
+		if err := os.Rename(u.tmpPath, u.dst); err != nil {
+			u.Discard()
+			return fmt.Errorf("publish upload: %w", err)
+		}
+	} else {
+		os.Remove(u.tmpPath)
+	}
+	return syncDir(filepath.Dir(u.dst))
+}
+
+// Discard removes the staged file.
+func (u *Upload) Discard() {
+	os.Remove(u.tmpPath)
+}
+
+// syncDir flushes directory entries so a published file survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ServeUpload handles POST /api/episodes, a multipart form with the media
+// file in its "file" field, saved under its file name in the media
+// directory. The optional fields "notes", "slug", "draft" and "pinned" are
+// written to its sidecar, and "title" to its edits, see EditEpisode. The feed
+// is regenerated right away.
+func (s *Server) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.Metadata.source.(*LocalSource); !ok {
+		writeJSONError(w, http.StatusConflict, "uploads need a local media directory")
+		return
+	}
+	limitUploadBody(w, r, s.MaxUpload)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected multipart form data")
+		return
+	}
+	var (
+		upload *Upload
+		name   string
+		fields = make(map[string]string)
+	)
+	fail := func(status int, msg string) {
+		if upload != nil {
+			upload.Discard()
+		}
+		writeJSONError(w, status, msg)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, "invalid multipart form data")
+			return
+		}
+		if part.FormName() != "file" {
+			v, err := io.ReadAll(io.LimitReader(part, 1<<20))
+			if err != nil {
+				fail(http.StatusBadRequest, "invalid multipart form data")
+				return
+			}
+			fields[part.FormName()] = string(v)
+			continue
+		}
+		if upload != nil {
+			fail(http.StatusBadRequest, "only one file can be uploaded at a time")
+			return
+		}
+		name = path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+		if err := checkUploadType(name, part.Header.Get("Content-Type")); err != nil {
+			fail(http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+		dst := filepath.Join(s.Metadata.localRoot, name)
+		if upload, err = StageUpload(dst, part, s.MaxUpload); err != nil {
+			switch {
+			case errors.Is(err, ErrFileExists):
+				fail(http.StatusConflict, name+" already exists")
+			case errors.Is(err, ErrUploadTooLarge):
+				fail(http.StatusRequestEntityTooLarge, err.Error())
+			default:
+				adminLogger(r, "upload").Error("could not stage upload", "error", err, "path", name)
+				fail(http.StatusInternalServerError, "could not save upload")
+			}
+			return
+		}
+	}
+	if upload == nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	if fields["title"] != "" && s.Metadata.edits == nil {
+		fail(http.StatusBadRequest, "a title requires -editsFile")
+		return
+	}
+	sc, err := uploadSidecar(fields)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	// The sidecar goes first, so that a scan never sees the episode without
+	// it.
+	var sidecar string
+	if sc != nil {
+		sidecar = strings.TrimSuffix(upload.dst, filepath.Ext(upload.dst)) + sidecarExts[0]
+		if _, err := os.Stat(sidecar); err == nil {
+			fail(http.StatusConflict, filepath.Base(sidecar)+" already exists")
+			return
+		}
+		if err := writeFileAtomic(sidecar, sc, 0o644); err != nil {
+			adminLogger(r, "upload").Error("could not write sidecar", "error", err, "path", sidecar)
+			fail(http.StatusInternalServerError, "could not save upload")
+			return
+		}
+	}
+	if err := upload.Publish(); err != nil {
+		if sidecar != "" {
+			os.Remove(sidecar)
+		}
+		if errors.Is(err, ErrFileExists) {
+			writeJSONError(w, http.StatusConflict, name+" already exists")
+			return
+		}
+		adminLogger(r, "upload").Error("could not publish upload", "error", err, "path", name)
+		writeJSONError(w, http.StatusInternalServerError, "could not save upload")
+		return
+	}
+	if t := fields["title"]; t != "" {
+		if _, err := s.Metadata.edits.EditEpisode(name, EpisodeEdit{Title: &t}); err != nil {
+			adminLogger(r, "upload").Error("could not save title of upload", "error", err, "path", name)
+		}
+	}
+	adminLogger(r, "upload").Info("uploaded episode", "path", name, "size", upload.Size)
+	s.Audit.Record(r, "upload", name, map[string]any{"size": upload.Size})
+	s.refreshAfterChange(r)
+	resp := map[string]any{"path": name, "size": upload.Size}
+	s.mu.RLock()
+	for _, it := range s.Items {
+		if it.Path == name {
+			resp["link"] = it.Link
+			resp["url"] = it.Enclosure.Url
+		}
+	}
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// checkUploadType refuses files that are not published, by extension, and
+// files whose declared type is not that of their extension. Clients that do
+// not know the type send none or application/octet-stream, and others use
+// different names for the same type, so any audio or video type passes.
+func checkUploadType(name, declared string) error {
+	typ, ok := mimeType[filepath.Ext(name)]
+	if !ok || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%q is not a published file type", name)
+	}
+	if declared == "" {
+		return nil
+	}
+	d, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", declared)
+	}
+	if d == typ || d == "application/octet-stream" ||
+		strings.HasPrefix(d, "audio/") && strings.HasPrefix(typ, "audio/") ||
+		strings.HasPrefix(d, "video/") && strings.HasPrefix(typ, "video/") {
+		return nil
+	}
+	return fmt.Errorf("content type %s does not match %s", d, typ)
+}
+
+// uploadSidecar returns the sidecar of the form fields of an upload, nil if
+// there are none.
+func uploadSidecar(fields map[string]string) ([]byte, error) {
+	sc := make(map[string]any)
+	for _, k := range []string{"notes", "slug"} {
+		if v := strings.TrimSpace(fields[k]); v != "" {
+			sc[k] = v
+		}
+	}
+	for _, k := range []string{"draft", "pinned"} {
+		v, ok := fields[k]
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", k, v)
+		}
+		if b {
+			sc[k] = true
+		}
+	}
+	if len(sc) == 0 {
+		return nil, nil
+	}
+	return yaml.Marshal(sc)
+}
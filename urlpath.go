@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// escapePath escapes the segments of a slash-separated path for a URL,
+// leaving only unreserved characters (RFC 3986) as they are. Unlike
+// url.PathEscape, it keeps slashes, so that URLs mirror the directories of the
+// media library, and escapes sub-delimiters such as "+", "&" and "=", which
+// some podcast apps mangle, "+" into a space in particular.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte("0123456789ABCDEF"[c>>4])
+			b.WriteByte("0123456789ABCDEF"[c&15])
+		}
+	}
+	return b.String()
+}
+
+// legacyMediaUrl is the URL media files were published under before
+// escapePath, with slashes escaped as well. These URLs still resolve, and
+// may be what podcast apps know episodes by.
+func legacyMediaUrl(prefix, p string) string {
+	return prefix + url.PathEscape(p)
+}
+
+// lookupPath returns the key of m that the path p of a request refers to.
+// Besides p as decoded by net/http, it tries the forms some podcast apps turn
+// paths into: with spaces sent as "+", and escaped twice.
+func lookupPath[V any](m map[string]V, p string) (string, bool) {
+	if _, ok := m[p]; ok {
+		return p, true
+	}
+	candidates := []string{strings.ReplaceAll(p, "+", " ")}
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		candidates = append(candidates, unescaped)
+	}
+	for _, c := range candidates {
+		if _, ok := m[c]; ok {
+			return c, true
+		}
+	}
+	return p, false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEscapePathRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"plain", "show/episode-1.mp3"},
+		{"space", "show/episode 1.mp3"},
+		{"hash", "show/episode #1.mp3"},
+		{"percent", "show/100% done.mp3"},
+		{"escaped percent", "show/a%20b.mp3"},
+		{"plus", "show/c++ & go.mp3"},
+		{"question mark", "show/why?.mp3"},
+		{"query-like", "show/a?b=c&d=e.mp3"},
+		{"non-ASCII", "émissions/épisode ünïcödé 日本.mp3"},
+		{"NFC", "show/caf\u00e9.mp3"},
+		{"NFD", "show/cafe\u0301.mp3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			escaped := escapePath(tt.path)
+			if strings.ContainsAny(escaped, " #?+&=") {
+				t.Fatalf("escapePath(%q) = %q, has reserved characters", tt.path, escaped)
+			}
+			// As net/http decodes the path of a request.
+			u, err := url.Parse("http://localhost/" + escaped)
+			if err != nil {
+				t.Fatalf("url.Parse(%q): %v", escaped, err)
+			}
+			if u.RawQuery != "" || u.Fragment != "" {
+				t.Fatalf("escapePath(%q) = %q, parsed with query %q and fragment %q", tt.path, escaped, u.RawQuery, u.Fragment)
+			}
+			files := map[string]bool{tt.path: true}
+			if got, ok := lookupPath(files, u.Path[1:]); !ok || got != tt.path {
+				t.Errorf("lookupPath(%q) = %q, %v, want %q", u.Path[1:], got, ok, tt.path)
+			}
+			// Apps escaping the URL of the feed twice.
+			u, err = url.Parse("http://localhost/" + escapePath(escaped))
+			if err != nil {
+				t.Fatalf("url.Parse(%q): %v", escapePath(escaped), err)
+			}
+			if got, ok := lookupPath(files, u.Path[1:]); !ok || got != tt.path {
+				t.Errorf("lookupPath(%q) = %q, %v, want %q", u.Path[1:], got, ok, tt.path)
+			}
+		})
+	}
+}
+
+func TestLookupPathPlusAsSpace(t *testing.T) {
+	files := map[string]bool{"show/episode 1.mp3": true, "show/c++.mp3": true}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"show/episode+1.mp3", "show/episode 1.mp3", true},
+		{"show/c++.mp3", "show/c++.mp3", true},
+		{"show/episode%201.mp3", "show/episode 1.mp3", true},
+		{"show/episode-1.mp3", "show/episode-1.mp3", false},
+	}
+	for _, tt := range tests {
+		if got, ok := lookupPath(files, tt.path); got != tt.want || ok != tt.ok {
+			t.Errorf("lookupPath(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestEscapePathKeepsNormalization(t *testing.T) {
+	nfc, nfd := "caf\u00e9.mp3", "cafe\u0301.mp3"
+	if escapePath(nfc) == escapePath(nfd) {
+		t.Fatalf("escapePath(%q) = escapePath(%q) = %q", nfc, nfd, escapePath(nfc))
+	}
+	// Files differing only in normalization are told apart.
+	files := map[string]bool{nfc: true, nfd: true}
+	for _, p := range []string{nfc, nfd} {
+		decoded, err := url.PathUnescape(escapePath(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := lookupPath(files, decoded); !ok || got != p {
+			t.Errorf("lookupPath(%q) = %q, %v, want %q", decoded, got, ok, p)
+		}
+	}
+}
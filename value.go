@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A ValueBlock configures Podcasting 2.0 value-for-value payments
+// (<podcast:value>), letting supporting apps stream payments to the
+// recipients while listening.
+//
+// See https://podcastindex.org/namespace/1.0#value
+type ValueBlock struct {
+	Type       string           `yaml:"type"`   // Defaults to "lightning".
+	Method     string           `yaml:"method"` // Defaults to "keysend".
+	Suggested  string           `yaml:"suggested,omitempty"`
+	Recipients []ValueRecipient `yaml:"recipients"`
+}
+
+type ValueRecipient struct {
+	Name string `yaml:"name"`
+	// Type of address: "node" for a lightning node public key or "lnaddress"
+	// for a lightning address.
+	Type        string `yaml:"type"`
+	Address     string `yaml:"address"`
+	Split       int    `yaml:"split"`
+	CustomKey   string `yaml:"customKey,omitempty"`
+	CustomValue string `yaml:"customValue,omitempty"`
+	Fee         bool   `yaml:"fee,omitempty"`
+}
+
+// normalize fills in defaults and validates v.
+func (v *ValueBlock) normalize() error {
+	if v.Type == "" {
+		v.Type = "lightning"
+	}
+	if v.Method == "" {
+		v.Method = "keysend"
+	}
+	if len(v.Recipients) == 0 {
+		return errors.New("value block has no recipients")
+	}
+	for i, r := range v.Recipients {
+		if r.Address == "" {
+			return fmt.Errorf("value recipient %d (%q) has no address", i+1, r.Name)
+		}
+		if r.Split <= 0 {
+			return fmt.Errorf("value recipient %d (%q) must have a positive split", i+1, r.Name)
+		}
+		if r.Type == "" {
+			v.Recipients[i].Type = "node"
+		}
+	}
+	return nil
+}
+
+// ReadValueFile reads the channel-level value block from a YAML file.
+func ReadValueFile(path string) (*ValueBlock, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v ValueBlock
+	if err := yaml.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Errorf("parse value file %s: %w", path, err)
+	}
+	if err := v.normalize(); err != nil {
+		return nil, fmt.Errorf("value file %s: %w", path, err)
+	}
+	return &v, nil
+}
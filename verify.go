@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VerifyStatus is the outcome of checking a media file against its stored
+// checksum.
+type VerifyStatus string
+
+const (
+	VerifyOK VerifyStatus = "ok"
+	// The content changed while the size and modification time did not,
+	// e.g. bitrot.
+	VerifyCorrupted VerifyStatus = "corrupted"
+	// The size changed while the modification time did not.
+	VerifyTruncated  VerifyStatus = "truncated"
+	VerifyMissing    VerifyStatus = "missing"
+	VerifyUnreadable VerifyStatus = "unreadable"
+	// The file was modified since it was hashed, e.g. edited, and is not
+	// checked.
+	VerifyModified VerifyStatus = "modified"
+	// There is no checksum of the file.
+	VerifyUnhashed VerifyStatus = "unhashed"
+)
+
+// Problem reports whether the status means the file was damaged or lost.
+func (s VerifyStatus) Problem() bool {
+	switch s {
+	case VerifyCorrupted, VerifyTruncated, VerifyMissing, VerifyUnreadable:
+		return true
+	}
+	return false
+}
+
+type VerifyResult struct {
+	Path     string       `json:"path"`
+	Status   VerifyStatus `json:"status"`
+	Expected string       `json:"expected,omitempty"`
+	Actual   string       `json:"actual,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// A Verifier checks the media files of a media directory against the
+// checksums stored by the Hasher in the MetaCache, which also tell whether a
+// file was legitimately modified since, and against a sha256sum file, such as
+// a copy of /checksums.txt. With Ffmpeg, FLAC files are also checked against
+// the MD5 of their audio recorded in their STREAMINFO, which tags do not
+// change: files without checksums or modified since are then checked too.
+type Verifier struct {
+	Root      string
+	Meta      *MetaCache
+	Checksums map[string]string // Path -> SHA-256, optional.
+	Ffmpeg    string            // Executable decoding FLAC audio, optional.
+
+	limiter *rateLimiter // Nil if unlimited.
+	read    atomic.Int64
+}
+
+// NewVerifier returns a Verifier reading at most rate bytes per second, or
+// without limit if rate is 0.
+func NewVerifier(root string, meta *MetaCache, checksums map[string]string, rate int64) *Verifier {
+	v := &Verifier{Root: root, Meta: meta, Checksums: checksums}
+	if rate > 0 {
+		v.limiter = &rateLimiter{rate: rate}
+	}
+	return v
+}
+
+// ReadChecksums reads a file in the format of sha256sum.
+func ReadChecksums(p string) (map[string]string, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	sums := make(map[string]string)
+	sc := bufio.NewScanner(fp)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != 64 || len(name) < 2 {
+			return nil, fmt.Errorf("%s:%d: invalid checksum line", p, n)
+		}
+		// The second character marks binary ("*") or text (" ") mode.
+		sums[name[1:]] = strings.ToLower(hash)
+	}
+	return sums, sc.Err()
+}
+
+// Files returns the paths of the media files to check, those in the media
+// directory and those with a checksum, sorted.
+func (v *Verifier) Files() ([]string, error) {
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(v.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(v.Root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == TrashDir || rel == ReplicaPartDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if _, isMedia := mimeType[filepath.Ext(p)]; isMedia {
+			seen[rel] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range v.Meta.Paths() {
+		var hash string
+		if _, _, ok := v.Meta.Stored(p, metaSha256, &hash); ok {
+			seen[p] = true
+		}
+	}
+	for p := range v.Checksums {
+		seen[p] = true
+	}
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// Check checks the file at path p of the media directory.
+func (v *Verifier) Check(ctx context.Context, p string) VerifyResult {
+	res := v.checkSum(ctx, p)
+	switch res.Status {
+	case VerifyOK, VerifyModified, VerifyUnhashed:
+		if v.Ffmpeg != "" && strings.EqualFold(filepath.Ext(p), ".flac") {
+			v.checkAudio(ctx, &res)
+		}
+	}
+	return res
+}
+
+// flacPcmCodecs are the ffmpeg codecs writing samples as the MD5 of FLAC
+// audio is computed over, signed little endian, by bits per sample.
+var flacPcmCodecs = map[int]string{8: "pcm_s8", 16: "pcm_s16le", 24: "pcm_s24le", 32: "pcm_s32le"}
+
+// checkAudio decodes the FLAC file of res and compares the MD5 of its audio
+// with the one it records. Files recording none, or of a sample size ffmpeg
+// does not write as is, are left as they are. The decoding is not limited to
+// the rate of the Verifier.
+func (v *Verifier) checkAudio(ctx context.Context, res *VerifyResult) {
+	src := filepath.Join(v.Root, filepath.FromSlash(res.Path))
+	mi, err := parseFlac(src)
+	codec, ok := flacPcmCodecs[mi.audioBits]
+	if err != nil || mi.AudioMD5 == "" || !ok {
+		return
+	}
+	cmd := exec.CommandContext(
+		ctx, v.Ffmpeg, "-nostdin", "-hide_banner", "-loglevel", "error", "-i", src,
+		"-map", "0:a:0", "-c:a", codec, "-f", "md5", "-",
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		res.Status, res.Error = VerifyCorrupted, fmt.Sprintf("decode audio: %v: %s", err, strings.TrimSpace(stderr.String()))
+		return
+	}
+	actual, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "MD5=")
+	if !ok {
+		res.Status, res.Error = VerifyUnreadable, fmt.Sprintf("decode audio: unexpected ffmpeg output %q", out)
+		return
+	}
+	if actual != mi.AudioMD5 {
+		res.Status, res.Expected, res.Actual = VerifyCorrupted, mi.AudioMD5, actual
+		return
+	}
+	// The audio is intact, whatever its tags.
+	res.Status, res.Error = VerifyOK, ""
+}
+
+// checkSum checks the file at path p against its SHA-256.
+func (v *Verifier) checkSum(ctx context.Context, p string) VerifyResult {
+	res := VerifyResult{Path: p}
+	var expected string
+	size, modTime, fromMeta := v.Meta.Stored(p, metaSha256, &expected)
+	if !fromMeta {
+		expected = v.Checksums[p]
+	}
+	res.Expected = expected
+	src := filepath.Join(v.Root, filepath.FromSlash(p))
+	info, err := os.Stat(src)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		res.Status = VerifyMissing
+		return res
+	case err != nil:
+		res.Status, res.Error = VerifyUnreadable, err.Error()
+		return res
+	case expected == "":
+		res.Status = VerifyUnhashed
+		return res
+	case fromMeta && !info.ModTime().Equal(modTime):
+		res.Status = VerifyModified
+		return res
+	case fromMeta && info.Size() != size:
+		res.Status = VerifyTruncated
+		return res
+	}
+	if res.Actual, _, err = hashFile(ctx, src, v.limiter, &v.read); err != nil {
+		res.Status, res.Error = VerifyUnreadable, err.Error()
+		return res
+	}
+	res.Status = VerifyOK
+	if res.Actual != expected {
+		res.Status = VerifyCorrupted
+	}
+	return res
+}
+
+// runVerify implements the verify subcommand.
+func runVerify(args []string) error {
+	fset := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fset.String("dir", ".", "directory with media files")
+	metaCache := fset.String("metaCache", "", "-metaCache of the server, holding the checksums computed with -hashWorkers")
+	checksums := fset.String("checksums", "", "file of checksums in the format of sha256sum, e.g. a copy of /checksums.txt")
+	rate := fset.Float64("rate", 0, "maximum MiB per second read, 0 is unlimited")
+	alertWebhook := fset.String("alertWebhook", "", "URL receiving a report of failures as a JSON POST request")
+	alertNtfy := fset.String("alertNtfy", "", "URL of an ntfy topic receiving a report of failures")
+	ffmpeg := fset.String("ffmpeg", "", "ffmpeg executable checking the audio of FLAC files against the MD5 they record (not checked if empty)")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: podserve verify [flags]\n\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *metaCache == "" && *checksums == "" && *ffmpeg == "" {
+		fset.Usage()
+		return errors.New("verify: -metaCache, -checksums or -ffmpeg is required")
+	}
+
+	var meta *MetaCache
+	if *metaCache != "" {
+		if _, err := os.Stat(*metaCache); err != nil {
+			return err
+		}
+		var err error
+		if meta, err = NewMetaCache(*metaCache); err != nil {
+			return err
+		}
+	}
+	var sums map[string]string
+	if *checksums != "" {
+		var err error
+		if sums, err = ReadChecksums(*checksums); err != nil {
+			return err
+		}
+	}
+	v := NewVerifier(*dir, meta, sums, int64(*rate*(1<<20)))
+	v.Ffmpeg = *ffmpeg
+	paths, err := v.Files()
+	if err != nil {
+		return err
+	}
+	counts := make(map[VerifyStatus]int)
+	var problems []VerifyResult
+	for _, p := range paths {
+		res := v.Check(context.Background(), p)
+		counts[res.Status]++
+		switch {
+		case res.Status == VerifyCorrupted:
+			fmt.Printf("%-10s %s (expected %s, got %s)\n", res.Status, p, res.Expected, res.Actual)
+		case res.Error != "":
+			fmt.Printf("%-10s %s (%s)\n", res.Status, p, res.Error)
+		case res.Status != VerifyOK:
+			fmt.Printf("%-10s %s\n", res.Status, p)
+		}
+		if res.Status.Problem() {
+			problems = append(problems, res)
+		}
+	}
+	fmt.Printf(
+		"%d files: %d ok, %d corrupted, %d truncated, %d missing, %d unreadable, %d modified, %d unhashed\n",
+		len(paths), counts[VerifyOK], counts[VerifyCorrupted], counts[VerifyTruncated], counts[VerifyMissing],
+		counts[VerifyUnreadable], counts[VerifyModified], counts[VerifyUnhashed],
+	)
+	if len(problems) == 0 {
+		return nil
+	}
+	if *alertWebhook != "" || *alertNtfy != "" {
+		NewAlerter(*alertWebhook, *alertNtfy).Send(context.Background(), integrityAlert("Media files failed verification", problems, len(paths)))
+	}
+	return fmt.Errorf("verify: %d of %d files failed", len(problems), len(paths))
+}
+
+// integrityAlert reports the files that failed verification, the first ones
+// by name.
+func integrityAlert(title string, problems []VerifyResult, total int) Alert {
+	var names []string
+	for _, res := range problems[:min(len(problems), 20)] {
+		names = append(names, fmt.Sprintf("%s: %s", res.Status, res.Path))
+	}
+	return Alert{
+		Title:   title,
+		Message: fmt.Sprintf("%d of %d media files failed verification:\n%s", len(problems), total, strings.Join(names, "\n")),
+		Details: map[string]any{"failed": len(problems), "files": total},
+	}
+}
+
+// An IntegrityScanner verifies the media files every Interval in the
+// background, slowly so as not to compete with listeners, and alerts when files
+// fail verification and once they all pass again.
+type IntegrityScanner struct {
+	Verifier *Verifier
+	Interval time.Duration
+	Alerter  *Alerter
+	Title    string // Of the show, for alerts.
+
+	mu       sync.Mutex // Guards all below
+	scans    int64
+	lastScan time.Time
+	lastTook time.Duration
+	checked  int
+	failed   map[string]VerifyResult
+}
+
+func NewIntegrityScanner(v *Verifier, interval time.Duration, alerter *Alerter, title string) *IntegrityScanner {
+	return &IntegrityScanner{Verifier: v, Interval: interval, Alerter: alerter, Title: title}
+}
+
+func (s *IntegrityScanner) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-time.After(s.Interval):
+		case <-ctx.Done():
+			return
+		}
+		if err := s.scan(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("integrity scan failed", "error", err, "tag", TagVerify)
+		}
+	}
+}
+
+func (s *IntegrityScanner) scan(ctx context.Context) error {
+	start := time.Now()
+	paths, err := s.Verifier.Files()
+	if err != nil {
+		return err
+	}
+	slog.Info("starting integrity scan", "files", len(paths), "tag", TagVerify)
+	failed := make(map[string]VerifyResult)
+	for _, p := range paths {
+		res := s.Verifier.Check(ctx, p)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if res.Status.Problem() {
+			slog.Error("media file failed verification", "file", p, "status", res.Status, "expected", res.Expected, "actual", res.Actual, "error", res.Error, "tag", TagVerify)
+			failed[p] = res
+		}
+	}
+	took := time.Since(start)
+	slog.Info("integrity scan done", "files", len(paths), "failed", len(failed), "took", took.Round(time.Second), "tag", TagVerify)
+
+	s.mu.Lock()
+	var fresh []VerifyResult
+	for p, res := range failed {
+		if prev, ok := s.failed[p]; !ok || prev.Status != res.Status {
+			fresh = append(fresh, res)
+		}
+	}
+	recovered := len(failed) == 0 && len(s.failed) > 0
+	s.scans++
+	s.lastScan, s.lastTook, s.checked, s.failed = start, took, len(paths), failed
+	s.mu.Unlock()
+
+	switch {
+	case len(fresh) > 0:
+		slices.SortFunc(fresh, func(a, b VerifyResult) int { return strings.Compare(a.Path, b.Path) })
+		s.Alerter.Send(ctx, integrityAlert(s.Title+": media files failed verification", fresh, len(paths)))
+	case recovered:
+		s.Alerter.Send(ctx, Alert{
+			Title:    s.Title + ": media files verified",
+			Message:  fmt.Sprintf("All %d media files passed verification again.", len(paths)),
+			Resolved: true,
+			Details:  map[string]any{"files": len(paths)},
+		})
+	}
+	return nil
+}
+
+func (s *IntegrityScanner) WriteMetrics(w *metricsWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Counter("podserve_integrity_scans_total", "Completed integrity scans of the media files.", s.scans)
+	w.Counter("podserve_integrity_read_bytes_total", "Bytes read by integrity scans.", s.Verifier.read.Load())
+	if s.scans == 0 {
+		return
+	}
+	w.Gauge("podserve_last_integrity_scan_timestamp_seconds", "Start of the last integrity scan.", s.lastScan.Unix())
+	w.Gauge("podserve_last_integrity_scan_duration_seconds", "Duration of the last integrity scan.", s.lastTook.Seconds())
+	w.Gauge("podserve_last_integrity_scan_files", "Media files checked by the last integrity scan.", s.checked)
+	w.Help("podserve_integrity_failed_files", "gauge", "Media files that failed the last integrity scan, by status.")
+	counts := make(map[VerifyStatus]int)
+	for _, res := range s.failed {
+		counts[res.Status]++
+	}
+	for _, status := range []VerifyStatus{VerifyCorrupted, VerifyTruncated, VerifyMissing, VerifyUnreadable} {
+		w.Sample("podserve_integrity_failed_files", counts[status], "status", string(status))
+	}
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Changes watched for with inotify. Writes in progress are watched for too,
+// so that a file being copied in postpones the refresh until it is complete.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// watchDir watches the directory tree root for changes with inotify, sending
+// on the returned channel when anything changed. The channel is closed when
+// ctx is done, or if watching fails. Directories created later are watched as
+// well.
+func watchDir(ctx context.Context, root string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, so that reads wait in the runtime poller and Close
+	// interrupts them.
+	f := os.NewFile(uintptr(fd), "inotify")
+	w := &inotifyWatcher{fd: fd, root: root, dirs: make(map[int]string)}
+	if err := w.add(root); err != nil {
+		f.Close()
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("could not watch media directory", "error", err, "dir", root, "tag", TagRefresh)
+				}
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				off += syscall.SizeofInotifyEvent + int(ev.Len)
+				w.handle(ev, string(trimNul(name)))
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+type inotifyWatcher struct {
+	fd   int
+	root string
+	dirs map[int]string // Watch descriptor -> directory.
+}
+
+// add watches the directory dir and those below it, but for the trash and
+// partial replica downloads.
+func (w *inotifyWatcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p != w.root {
+				// Removed since.
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if rel, _ := filepath.Rel(w.root, p); rel == TrashDir || rel == ReplicaPartDir {
+			return fs.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch "+p, err)
+		}
+		w.dirs[wd] = p
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) handle(ev *syscall.InotifyEvent, name string) {
+	switch {
+	case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+		slog.Warn("missed changes of the media directory, rescanning", "dir", w.root, "tag", TagRefresh)
+	case ev.Mask&syscall.IN_IGNORED != 0:
+		// Removed, or no longer watched.
+		delete(w.dirs, int(ev.Wd))
+	case ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		dir, ok := w.dirs[int(ev.Wd)]
+		if !ok {
+			return
+		}
+		if err := w.add(filepath.Join(dir, name)); err != nil {
+			slog.Warn("could not watch new directory", "error", err, "tag", TagRefresh)
+		}
+	}
+}
+
+func trimNul(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
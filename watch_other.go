@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func watchDir(ctx context.Context, root string) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
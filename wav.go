@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// WAV files are RIFF files, a sequence of chunks of which fmt gives the byte
+// rate of the audio and data holds it, so the duration is the size of data
+// over the byte rate. Tags are in the INFO list, if any.
+//
+// See https://www.mmsp.ece.mcgill.ca/Documents/AudioFormats/WAVE/WAVE.html
+
+// wavInfoTags maps the INFO chunks of RIFF files to tags.
+var wavInfoTags = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"ICMT": "comment",
+	"ICRD": "date",
+}
+
+// parseWav reads the duration and tags of a WAV file.
+func parseWav(path string) (MediaInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer fp.Close()
+	r := bufio.NewReader(fp)
+
+	var h [12]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil || string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" {
+		return MediaInfo{}, errUnsupportedFormat
+	}
+	var (
+		mi       MediaInfo
+		byteRate uint32
+		dataSize int64 = -1
+	)
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return MediaInfo{}, fmt.Errorf("wav: %w", err)
+		}
+		id := string(ch[0:4])
+		n := int64(binary.LittleEndian.Uint32(ch[4:8]))
+		switch id {
+		case "fmt ", "LIST":
+			if n > 1<<20 {
+				return MediaInfo{}, fmt.Errorf("wav: %s chunk too large", id)
+			}
+			b, err := readBlock(r, n)
+			if err != nil {
+				return MediaInfo{}, fmt.Errorf("wav: %w", err)
+			}
+			if id == "fmt " {
+				if len(b) < 16 {
+					return MediaInfo{}, fmt.Errorf("wav: fmt chunk of %d bytes", len(b))
+				}
+				byteRate = binary.LittleEndian.Uint32(b[8:12])
+			} else if len(b) >= 4 && string(b[0:4]) == "INFO" {
+				mi.Tags = parseWavInfo(b[4:])
+			}
+			// The padding byte, if any, is read as the start of the next
+			// chunk otherwise.
+			if n&1 != 0 {
+				r.Discard(1)
+			}
+			continue
+		}
+		// Chunks are padded to an even size.
+		skipped, err := r.Discard(int(n + n&1))
+		if id == "data" {
+			dataSize = min(n, int64(skipped))
+		}
+		if err != nil {
+			// Files being written, or streamed with an unknown size, end
+			// early.
+			break
+		}
+	}
+	if byteRate > 0 && dataSize >= 0 {
+		mi.Duration = float64(dataSize) / float64(byteRate)
+	}
+	return mi, nil
+}
+
+// parseWavInfo reads the tags of the sub-chunks of an INFO list.
+func parseWavInfo(b []byte) map[string]string {
+	tags := make(map[string]string)
+	for len(b) >= 8 {
+		id := string(b[0:4])
+		n := int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if n > len(b) {
+			break
+		}
+		if tag, ok := wavInfoTags[id]; ok {
+			tags[tag] = strings.TrimRight(string(b[:n]), "\x00")
+		}
+		b = b[min(n+n&1, len(b)):]
+	}
+	return tags
+}
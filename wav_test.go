@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"testing"
+)
+
+// riffChunk returns a chunk holding body, padded to an even size.
+func riffChunk(id string, body ...[]byte) []byte {
+	b := concat(body...)
+	c := concat([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(b))), b)
+	if len(b)&1 != 0 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+// wavFile returns a WAV file of the given chunks.
+func wavFile(chunks ...[]byte) []byte {
+	b := concat(chunks...)
+	return concat([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(b))), []byte("WAVE"), b)
+}
+
+func TestParseWav(t *testing.T) {
+	// PCM, mono, 8 kHz, 8000 bytes per second, 1 byte per sample of 8 bits.
+	fmtChunk := riffChunk("fmt ", []byte{1, 0, 1, 0, 0x40, 0x1f, 0, 0, 0x40, 0x1f, 0, 0, 1, 0, 8, 0})
+	info := riffChunk("LIST", []byte("INFO"),
+		riffChunk("INAM", []byte("Episode 1\x00")),
+		riffChunk("IART", []byte("Someone")),
+		riffChunk("ISFT", []byte("Lavf")),
+	)
+	data := riffChunk("data", make([]byte, 16000))
+	tests := []struct {
+		name     string
+		data     []byte
+		duration float64
+		tags     map[string]string
+		err      error // Nil for any error if wantErr.
+		wantErr  bool
+	}{
+		{
+			name:     "tags",
+			data:     wavFile(fmtChunk, info, data),
+			duration: 2,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+		},
+		{name: "data first", data: wavFile(data, fmtChunk), duration: 2},
+		{
+			name:     "odd data",
+			data:     wavFile(fmtChunk, riffChunk("data", make([]byte, 4001)), info),
+			duration: 4001.0 / 8000,
+			tags:     map[string]string{"title": "Episode 1", "artist": "Someone"},
+		},
+		{
+			name:     "streamed",
+			data:     wavFile(fmtChunk, []byte("data\xff\xff\xff\xff"), make([]byte, 8000)),
+			duration: 1,
+		},
+		{name: "no data", data: wavFile(fmtChunk, info), tags: map[string]string{"title": "Episode 1", "artist": "Someone"}},
+		{name: "no fmt", data: wavFile(data)},
+		{
+			name: "oversized INFO entry",
+			data: wavFile(fmtChunk, riffChunk("LIST", []byte("INFO"), riffChunk("INAM", []byte("Episode 1")), []byte("IART\xff\xff\x00\x00Someone"))),
+			tags: map[string]string{"title": "Episode 1"},
+		},
+		{name: "not wav", data: []byte("RIFF\x00\x00\x00\x00AVI LIST"), err: errUnsupportedFormat, wantErr: true},
+		{name: "empty", data: nil, err: errUnsupportedFormat, wantErr: true},
+		{name: "short fmt", data: wavFile(riffChunk("fmt ", make([]byte, 8)), data), wantErr: true},
+		{name: "oversized LIST", data: wavFile(fmtChunk, []byte("LIST\x01\x00\x10\x00INFO"), data), wantErr: true},
+		{name: "truncated LIST", data: wavFile(fmtChunk, []byte("LIST\x00\x00\x0f\x00INFO")), wantErr: true},
+		{name: "truncated chunk header", data: wavFile(fmtChunk, []byte("LIS")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeMedia(t, "episode.wav", tt.data)
+			var mi MediaInfo
+			var err error
+			if n := allocated(func() { mi, err = parseWav(p) }); n > 1<<20 {
+				t.Errorf("parseWav allocated %d bytes", n)
+			}
+			if tt.wantErr {
+				if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseWav = %+v, %v, want error %v", mi, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseWav: %v", err)
+			}
+			if mi.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", mi.Duration, tt.duration)
+			}
+			if !maps.Equal(mi.Tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", mi.Tags, tt.tags)
+			}
+		})
+	}
+	parseTruncated(t, "episode.wav", wavFile(fmtChunk, info, riffChunk("data", make([]byte, 100))), parseWav)
+}
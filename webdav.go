@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a listing of a WebDAV folder is used before listing it again.
+	webdavListTTL = 30 * time.Second
+	// Timeout of every PROPFIND request.
+	webdavListTimeout = 30 * time.Second
+)
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// A WebDAVSource is a media library in a WebDAV folder, e.g. of Nextcloud. The
+// folder is listed with PROPFIND, a directory at a time as servers commonly
+// refuse listing whole trees, and media files are proxied from it, ranges
+// included.
+type WebDAVSource struct {
+	Root     *url.URL // Of the folder, ending in "/".
+	User     string
+	Password string
+
+	listingFS
+	client *http.Client
+}
+
+func NewWebDAVSource(rawUrl, user, password string) (*WebDAVSource, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", rawUrl)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath = ""
+	}
+	s := &WebDAVSource{Root: u, User: user, Password: password, client: &http.Client{}}
+	s.listingFS = listingFS{ttl: webdavListTTL, list: s.listFolder, open: s.openFile}
+	return s, nil
+}
+
+// fileUrl returns the URL of the file at path p of the folder.
+func (s *WebDAVSource) fileUrl(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return s.Root.String() + strings.Join(segments, "/")
+}
+
+func (s *WebDAVSource) do(ctx context.Context, method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.User != "" {
+		req.SetBasicAuth(s.User, s.Password)
+	}
+	return s.client.Do(req)
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// listFolder lists the files of the folder, recursively.
+func (s *WebDAVSource) listFolder() ([]remoteFile, error) {
+	var files []remoteFile
+	dirs := []string{"."}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		u := s.Root.String()
+		if dir != "." {
+			u = s.fileUrl(dir) + "/"
+		}
+		ms, err := s.propfind(u)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", dir, err)
+		}
+		for _, r := range ms.Responses {
+			href, err := url.Parse(r.Href)
+			if err != nil {
+				continue
+			}
+			rel, ok := strings.CutPrefix(href.Path, s.Root.Path)
+			rel = strings.TrimSuffix(rel, "/")
+			if !ok || rel == "" || rel == dir {
+				// The directory itself.
+				continue
+			}
+			for _, ps := range r.Propstat {
+				if !strings.Contains(ps.Status, " 200 ") {
+					continue
+				}
+				if ps.Prop.ResourceType.Collection != nil {
+					dirs = append(dirs, rel)
+					break
+				}
+				modTime, _ := http.ParseTime(ps.Prop.LastModified)
+				files = append(files, remoteFile{Path: rel, Size: ps.Prop.ContentLength, ModTime: modTime})
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+func (s *WebDAVSource) propfind(u string) (*webdavMultistatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webdavListTimeout)
+	defer cancel()
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := s.do(ctx, "PROPFIND", u, header, strings.NewReader(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: %s", u, resp.Status)
+	}
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %w", u, err)
+	}
+	return &ms, nil
+}
+
+func (s *WebDAVSource) openFile(p string) (io.ReadCloser, error) {
+	resp, err := s.do(context.Background(), http.MethodGet, s.fileUrl(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fs.ErrNotExist
+		}
+		return nil, fmt.Errorf("GET %s: %s", p, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// ServeFile proxies the request for f to the WebDAV server, which answers
+// range and conditional requests.
+func (s *WebDAVSource) ServeFile(w http.ResponseWriter, r *http.Request, f FileInfo) {
+	proxyFile(w, r, f.Source, TagWebDAV, func(ctx context.Context, header http.Header) (*http.Response, error) {
+		return s.do(ctx, r.Method, s.fileUrl(f.Source), header, nil)
+	})
+}